@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// leadership is whether this updater holds the leader lease,
+// the reconcilers of other swarms only run while it does
+type leadership struct {
+	lock    sync.RWMutex
+	leading bool
+}
+
+func (leading *leadership) set(value bool) {
+	leading.lock.Lock()
+	defer leading.lock.Unlock()
+	leading.leading = value
+}
+
+func (leading *leadership) get() bool {
+	leading.lock.RLock()
+	defer leading.lock.RUnlock()
+	return leading.leading
+}
+
+// runClusters starts a reconciler for every swarm in the clusters
+// of the config file. They share the beekeeper cache, credentials
+// and update budget of theDeployer, so another swarm costs
+// no more beekeeper lookups than its own services
+func runClusters(context *cli.Context, theDeployer *deployer.Deployer, leading *leadership) error {
+	clusters, err := loadClusters(context.String("config"))
+	if err != nil {
+		return err
+	}
+	lockPath := context.String("lock-file")
+	for name, cluster := range clusters {
+		var dockerClient deployer.DockerClient = getDockerClient(cluster.DockerURI, cluster.DockerContext)
+		if context.Bool("watch-events") {
+			dockerClient = withServiceEvents(dockerClient, cluster.DockerURI, cluster.DockerContext)
+		}
+		info("Updating cluster", name)
+		go runCluster(theDeployer.ForCluster(name, dockerClient), leading, lockPath)
+	}
+	return nil
+}
+
+// runCluster runs the cycles of the swarm of clusterDeployer, an error
+// is logged and retried next cycle instead of restarting the updater,
+// since the other swarms are still fine
+func runCluster(clusterDeployer *deployer.Deployer, leading *leadership, lockPath string) {
+	for {
+		if leading.get() {
+			err := runLocked(clusterDeployer, lockPath+"."+clusterDeployer.Cluster())
+			if err != nil {
+				warn("Run error", clusterDeployer.Cluster(), "["+clusterDeployer.RequestID()+"]:", err.Error())
+			}
+		}
+		time.Sleep(clusterDeployer.PollInterval(pollInterval))
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// clusterStateHandler serves the live state of the tracked services
+// at /cluster, read-only so it can be exposed with its own token
+func clusterStateHandler(theDeployer *deployer.Deployer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		response.Header().Set("Content-Type", "application/json")
+		state, err := theDeployer.ClusterState()
+		if err != nil {
+			response.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(response).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(response).Encode(state)
+	})
+	return mux
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+func healthcheck(context *cli.Context) error {
+	var health control.Health
+	status, err := control.Get(context.GlobalString("control-socket"), "/health", &health)
+	if err != nil {
+		fmt.Println("unhealthy:", err.Error())
+		os.Exit(exitError)
+	}
+	if status != http.StatusOK {
+		fmt.Println("unhealthy:", health.Reason)
+		os.Exit(exitError)
+	}
+	fmt.Println("healthy")
+	return nil
+}
+
+func explain(context *cli.Context) error {
+	serviceName := context.Args().First()
+	if serviceName == "" {
+		return cli.NewExitError("Missing service name", exitError)
+	}
+	theDeployer, err := newCommandDeployer(context)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	explanation, err := theDeployer.Explain(serviceName)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(explanation)
+	}
+
+	fmt.Printf("service %s (%s)\n", explanation.Service, explanation.ServiceID)
+	fmt.Printf("image %s\n", explanation.Image)
+	fmt.Printf("update status %q\n", explanation.UpdateStatus)
+	fmt.Println("beekeeper labels:")
+	keys := make([]string, 0, len(explanation.Labels))
+	for key := range explanation.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s=%s\n", key, explanation.Labels[key])
+	}
+	fmt.Printf("selectors %v\n", explanation.Selectors)
+	for _, step := range explanation.Steps {
+		fmt.Printf("  %s\n", step)
+	}
+	fmt.Println("")
+	if explanation.Reason == deployer.ReasonDeployed {
+		fmt.Printf("conclusion: would deploy %s\n", explanation.LatestImage)
+	} else {
+		fmt.Printf("conclusion: %s\n", explanation.Reason)
+	}
+	if explanation.Error != "" {
+		fmt.Printf("error: %s\n", explanation.Error)
+	}
+	return nil
+}
+
+func forceUpdate(context *cli.Context) error {
+	serviceName := context.Args().First()
+	if serviceName == "" {
+		return cli.NewExitError("Missing service name", exitError)
+	}
+	theDeployer, err := newCommandDeployer(context)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+
+	unlock, err := lockFile(context.GlobalString("lock-file"), context.Duration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	defer unlock()
+
+	image, err := theDeployer.ForceUpdate(serviceName, context.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	fmt.Printf("updating %s to %s\n", serviceName, image)
+	return nil
+}
+
+// newCommandDeployer builds a deployer for a subcommand that talks
+// to docker directly, with the global flags and credentials
+func newCommandDeployer(context *cli.Context) (*deployer.Deployer, error) {
+	dockerURI, options := getOpts(context.Parent())
+	dockerClient := getDockerClient(dockerURI, context.GlobalString("docker-context"))
+	theDeployer := deployer.New(dockerClient, options)
+	if err := loadCredentials(context.Parent(), theDeployer); err != nil {
+		return nil, err
+	}
+	if err := loadNotifications(context.Parent(), theDeployer); err != nil {
+		return nil, err
+	}
+	if context.GlobalString("vault-addr") != "" {
+		if _, err := loadVaultCredentials(context.Parent(), theDeployer); err != nil {
+			return nil, err
+		}
+	}
+	return theDeployer, nil
+}
+
+func labelsGC(context *cli.Context) error {
+	return changeLabels(context, func(theDeployer *deployer.Deployer, dryRun bool) ([]deployer.LabelChange, error) {
+		return theDeployer.GarbageCollectLabels(dryRun)
+	})
+}
+
+func labelsMigrate(context *cli.Context) error {
+	from, to := context.String("from"), context.String("to")
+	if from == "" || to == "" {
+		return cli.NewExitError("Missing --from or --to", exitError)
+	}
+	return changeLabels(context, func(theDeployer *deployer.Deployer, dryRun bool) ([]deployer.LabelChange, error) {
+		return theDeployer.MigrateLabels(from, to, dryRun)
+	})
+}
+
+func changeLabels(context *cli.Context, change func(*deployer.Deployer, bool) ([]deployer.LabelChange, error)) error {
+	theDeployer, err := newCommandDeployer(context.Parent())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	dryRun := context.Bool("dry-run")
+	if !dryRun {
+		unlock, err := lockFile(context.GlobalString("lock-file"), 5*time.Minute)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+		defer unlock()
+	}
+
+	changes, err := change(theDeployer, dryRun)
+	if jsonOutput(context) {
+		if changes == nil {
+			changes = []deployer.LabelChange{}
+		}
+		printJSON(changes)
+	} else {
+		for _, change := range changes {
+			for _, label := range change.Removed {
+				fmt.Printf("%s: remove %s\n", change.Service, label)
+			}
+			for from, to := range change.Renamed {
+				fmt.Printf("%s: rename %s to %s\n", change.Service, from, to)
+			}
+			for _, label := range change.Conflicts {
+				fmt.Printf("%s: keep %s, the new label already exists\n", change.Service, label)
+			}
+		}
+		if dryRun {
+			fmt.Printf("%d services would change\n", len(changes))
+		} else {
+			fmt.Printf("%d services changed\n", len(changes))
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	return nil
+}
+
+func getServiceStates(context *cli.Context) ([]deployer.ServiceState, error) {
+	var states []deployer.ServiceState
+	status, err := control.Get(context.GlobalString("control-socket"), "/services", &states)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("daemon responded with %v", status)
+	}
+	return states, nil
+}
+
+func list(context *cli.Context) error {
+	if context.Bool("pending") {
+		return listPending(context)
+	}
+	states, err := getServiceStates(context)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(states)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tIMAGE\tLATEST\tREASON\tUPDATED\tCHECKED")
+	for _, state := range states {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", state.Name, state.Image, state.LatestImage, state.Reason, lastUpdated(state), state.CheckedAt.Format(time.RFC3339))
+	}
+	return writer.Flush()
+}
+
+// lastUpdated shows when the updater last deployed to the service,
+// calling out a malformed lastUpdatedAt label
+func lastUpdated(state deployer.ServiceState) string {
+	if state.LastUpdatedAtError != "" {
+		return "invalid: " + state.LastUpdatedAtError
+	}
+	if state.LastUpdatedAt == nil {
+		return "never"
+	}
+	return state.LastUpdatedAt.Format(time.RFC3339)
+}
+
+func listPending(context *cli.Context) error {
+	var pending []deployer.PendingUpdate
+	status, err := control.Get(context.GlobalString("control-socket"), "/pending", &pending)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if status != http.StatusOK {
+		return cli.NewExitError(fmt.Sprintf("daemon responded with %v", status), exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(pending)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tIMAGE\tLATEST\tREASON\tSINCE\tELIGIBLE")
+	for _, update := range pending {
+		eligible := "unknown"
+		if update.EligibleAt != nil {
+			eligible = update.EligibleAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", update.Service, update.Image, update.LatestImage, update.Reason, update.Since.Format(time.RFC3339), eligible)
+	}
+	return writer.Flush()
+}
+
+func status(context *cli.Context) error {
+	var health control.Health
+	_, err := control.Get(context.GlobalString("control-socket"), "/health", &health)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	states, err := getServiceStates(context)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+
+	if name := context.Args().First(); name != "" {
+		for _, state := range states {
+			if state.Name == name || state.ID == name {
+				if jsonOutput(context) {
+					return printJSON(state)
+				}
+				printServiceState(state)
+				return nil
+			}
+		}
+		return cli.NewExitError(fmt.Sprintf("service %s is not tracked", name), exitError)
+	}
+
+	var rollouts []deployer.RolloutProgress
+	if _, err := control.Get(context.GlobalString("control-socket"), "/rollouts", &rollouts); err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	var pauseState deployer.PauseState
+	if _, err := control.Get(context.GlobalString("control-socket"), "/paused", &pauseState); err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	reasons := make(map[string]int)
+	for _, state := range states {
+		reasons[string(state.Reason)]++
+	}
+	if jsonOutput(context) {
+		return printJSON(map[string]interface{}{
+			"health":          health,
+			"trackedServices": len(states),
+			"reasons":         reasons,
+			"rollouts":        rollouts,
+			"pause":           pauseState,
+		})
+	}
+
+	fmt.Printf("healthy:         %v %s\n", health.Healthy, health.Reason)
+	fmt.Printf("started at:      %s\n", health.StartedAt.Format(time.RFC3339))
+	fmt.Printf("last cycle at:   %s\n", health.LastCycleAt.Format(time.RFC3339))
+	fmt.Printf("last success at: %s\n", health.LastSuccessAt.Format(time.RFC3339))
+	if health.LastError != "" {
+		fmt.Printf("last error:      %s\n", health.LastError)
+	}
+	printPauseState(pauseState)
+
+	names := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		names = append(names, reason)
+	}
+	sort.Strings(names)
+	fmt.Printf("tracked services: %v\n", len(states))
+	for _, reason := range names {
+		fmt.Printf("  %-20s %v\n", reason, reasons[reason])
+	}
+
+	fmt.Printf("rollouts in progress: %v\n", len(rollouts))
+	for _, rollout := range rollouts {
+		fmt.Printf("  %-20s %d/%d tasks updated, %d failed, %s\n", rollout.Service, rollout.Updated, rollout.Desired, rollout.Failed, rollout.Image)
+	}
+	return nil
+}
+
+func history(context *cli.Context) error {
+	path := context.GlobalString("audit-log")
+	if path == "" {
+		return cli.NewExitError("Missing --audit-log or AUDIT_LOG", exitError)
+	}
+	records, err := deployer.ReadAuditLog(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+
+	name := context.Args().First()
+	if name != "" {
+		var filtered []deployer.AuditRecord
+		for _, record := range records {
+			if record.Service == name || record.ServiceID == name {
+				filtered = append(filtered, record)
+			}
+		}
+		records = filtered
+	}
+	if jsonOutput(context) {
+		if records == nil {
+			records = []deployer.AuditRecord{}
+		}
+		return printJSON(records)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tSERVICE\tEVENT\tIMAGE\tNODES\tMESSAGE")
+	for _, record := range records {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Timestamp.Format(time.RFC3339), record.Service, record.Event, record.Image, placementNodes(record.Placement), record.Message)
+	}
+	return writer.Flush()
+}
+
+// placementNodes summarizes where tasks landed as node:count
+func placementNodes(placement []deployer.TaskPlacement) string {
+	counts := make(map[string]int)
+	var nodes []string
+	for _, task := range placement {
+		node := task.Node
+		if node == "" {
+			node = task.NodeID
+		}
+		if counts[node] == 0 {
+			nodes = append(nodes, node)
+		}
+		counts[node]++
+	}
+	sort.Strings(nodes)
+	summary := make([]string, len(nodes))
+	for i, node := range nodes {
+		summary[i] = fmt.Sprintf("%s:%d", node, counts[node])
+	}
+	return strings.Join(summary, ",")
+}
+
+func printServiceState(state deployer.ServiceState) {
+	fmt.Printf("name:    %s\n", state.Name)
+	fmt.Printf("id:      %s\n", state.ID)
+	fmt.Printf("image:   %s\n", state.Image)
+	fmt.Printf("latest:  %s\n", state.LatestImage)
+	fmt.Printf("reason:  %s\n", state.Reason)
+	if state.Error != "" {
+		fmt.Printf("error:   %s\n", state.Error)
+	}
+	fmt.Printf("checked: %s\n", state.CheckedAt.Format(time.RFC3339))
+}
+
+// outputFlag selects text or json output of an informational command
+var outputFlag = cli.StringFlag{
+	Name:  "output, o",
+	Usage: "Output format, text or json",
+	Value: "text",
+}
+
+func jsonOutput(context *cli.Context) bool {
+	return context.String("output") == "json"
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
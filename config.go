@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"github.com/octoblu/beekeeper-updater-swarm/secrets"
+)
+
+// fileConfig is the json file given by --config, for
+// settings that do not fit in flags
+type fileConfig struct {
+	// BeekeeperInstances route services with the
+	// octoblu.beekeeper.instance label to other beekeepers
+	BeekeeperInstances map[string]deployer.BeekeeperInstance `json:"beekeeperInstances"`
+
+	// Services are managed as if they had the
+	// octoblu.beekeeper.update label, like --services
+	Services []string `json:"services"`
+
+	// DeployWindows are the only times services are updated,
+	// Blackouts are times they never are, e.g. a sales week
+	DeployWindows []deployer.Window `json:"deployWindows"`
+	Blackouts     []deployer.Window `json:"blackouts"`
+
+	// ReleaseTrains are deployed together at their departures
+	// by the services with their octoblu.beekeeper.releaseTrain label
+	ReleaseTrains []deployer.Train `json:"releaseTrains"`
+
+	// RegistryMirrors are added to --registry-mirror
+	RegistryMirrors []string `json:"registryMirrors"`
+
+	// PagerDutyRoutingKeys route the alerts of services by
+	// their owner, the keys may be aws-sm://, ssm:// or file:// references
+	PagerDutyRoutingKeys map[string]string `json:"pagerDutyRoutingKeys"`
+
+	// Clusters are other swarms updated alongside the
+	// one of --docker-uri, keyed by their cluster name
+	Clusters map[string]clusterConfig `json:"clusters"`
+}
+
+// clusterConfig is the docker endpoint of another swarm
+type clusterConfig struct {
+	DockerURI     string `json:"dockerUri"`
+	DockerContext string `json:"dockerContext"`
+}
+
+// loadConfig reads and validates the config file, instance
+// credentials may be aws-sm://, ssm:// or file:// references
+func loadConfig(path string) (*fileConfig, error) {
+	config := &fileConfig{}
+	if path == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+
+	for _, window := range append(config.DeployWindows, config.Blackouts...) {
+		if err := window.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := deployer.ValidateTrains(config.ReleaseTrains); err != nil {
+		return nil, err
+	}
+
+	if err := validateClusters(config.Clusters); err != nil {
+		return nil, err
+	}
+
+	for owner, routingKey := range config.PagerDutyRoutingKeys {
+		if config.PagerDutyRoutingKeys[owner], err = secrets.Resolve(routingKey); err != nil {
+			return nil, fmt.Errorf("PagerDuty routing key of %s: %v", owner, err)
+		}
+	}
+
+	for name, instance := range config.BeekeeperInstances {
+		if instance.URI == "" {
+			return nil, fmt.Errorf("Beekeeper instance %s has no uri", name)
+		}
+		if instance.Username, err = secrets.Resolve(instance.Username); err != nil {
+			return nil, fmt.Errorf("Beekeeper instance %s username: %v", name, err)
+		}
+		if instance.Password, err = secrets.Resolve(instance.Password); err != nil {
+			return nil, fmt.Errorf("Beekeeper instance %s password: %v", name, err)
+		}
+		config.BeekeeperInstances[name] = instance
+	}
+	return config, nil
+}
+
+// pagerDutyRoutingKeys returns the routing keys as owner=routing key
+func (config *fileConfig) pagerDutyRoutingKeys() []string {
+	var routingKeys []string
+	for owner, routingKey := range config.PagerDutyRoutingKeys {
+		routingKeys = append(routingKeys, owner+"="+routingKey)
+	}
+	return routingKeys
+}
+
+// loadClusters reads only the clusters of the config file,
+// without resolving the instance credentials again
+func loadClusters(path string) (map[string]clusterConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &fileConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %v", path, err)
+	}
+	return config.Clusters, validateClusters(config.Clusters)
+}
+
+func validateClusters(clusters map[string]clusterConfig) error {
+	for name, cluster := range clusters {
+		if cluster.DockerURI == "" && cluster.DockerContext == "" {
+			return fmt.Errorf("Cluster %s has no dockerUri or dockerContext", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Get requests path from the daemon listening on socketPath,
+// decoding the json response into value
+func Get(socketPath, path string, value interface{}) (int, error) {
+	response, err := newClient(socketPath).Get("http://control" + path)
+	if err != nil {
+		return 0, err
+	}
+	return decodeResponse(response, value)
+}
+
+// Post sends body as json to path on the daemon listening
+// on socketPath, decoding the json response into value
+func Post(socketPath, path string, body, value interface{}) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	response, err := newClient(socketPath).Post("http://control"+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return decodeResponse(response, value)
+}
+
+func newClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+}
+
+func decodeResponse(response *http.Response, value interface{}) (int, error) {
+	defer response.Body.Close()
+
+	if value == nil {
+		return response.StatusCode, nil
+	}
+	return response.StatusCode, json.NewDecoder(response.Body).Decode(value)
+}
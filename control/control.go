@@ -0,0 +1,189 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	De "github.com/tj/go-debug"
+)
+
+var debug = De.Debug("beekeeper-updater-swarm:control")
+
+// Server answers queries from the cli about the
+// running daemon over a unix socket
+type Server struct {
+	socketPath   string
+	maxAge       time.Duration
+	startupDelay time.Duration
+	mux          *http.ServeMux
+
+	lock          sync.Mutex
+	startedAt     time.Time
+	lastCycleAt   time.Time
+	lastSuccessAt time.Time
+	lastError     string
+}
+
+// Health is the response of /health
+type Health struct {
+	Healthy       bool      `json:"healthy"`
+	Reason        string    `json:"reason,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	LastCycleAt   time.Time `json:"lastCycleAt"`
+	LastSuccessAt time.Time `json:"lastSuccessAt"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+// NewServer constructs a control server, the daemon is unhealthy
+// when it has not completed a cycle successfully within maxAge, or
+// within maxAge of the startupDelay before its first cycle
+func NewServer(socketPath string, maxAge, startupDelay time.Duration) *Server {
+	server := &Server{
+		socketPath:   socketPath,
+		maxAge:       maxAge,
+		startupDelay: startupDelay,
+		mux:          http.NewServeMux(),
+		startedAt:    time.Now(),
+	}
+	server.mux.HandleFunc("/health", server.handleHealth)
+	return server
+}
+
+// HandleJSON serves the value returned by provider at path
+func (server *Server) HandleJSON(path string, provider func() interface{}) {
+	server.mux.HandleFunc(path, func(response http.ResponseWriter, request *http.Request) {
+		writeJSON(response, http.StatusOK, provider())
+	})
+}
+
+// Action handles a json request body, the value
+// it returns is the response
+type Action func(decode func(value interface{}) error) (interface{}, error)
+
+// HandleAction serves action at path, it only accepts POST.
+// An error is answered with 400 and {"error": message}
+func (server *Server) HandleAction(path string, action Action) {
+	server.mux.HandleFunc(path, func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writeJSON(response, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		value, err := action(func(value interface{}) error {
+			return json.NewDecoder(request.Body).Decode(value)
+		})
+		if err != nil {
+			writeJSON(response, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(response, http.StatusOK, value)
+	})
+}
+
+// Stream sends events to a client until done is closed,
+// send fails once the client has gone away
+type Stream func(done <-chan struct{}, send func(event string, value interface{}) error)
+
+// HandleStream serves stream at path as server-sent events
+func (server *Server) HandleStream(path string, stream Stream) {
+	server.mux.HandleFunc(path, func(response http.ResponseWriter, request *http.Request) {
+		flusher, ok := response.(http.Flusher)
+		if !ok {
+			http.Error(response, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		response.Header().Set("Content-Type", "text/event-stream")
+		response.Header().Set("Cache-Control", "no-cache")
+		response.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		stream(request.Context().Done(), func(event string, value interface{}) error {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+	})
+}
+
+// Listen removes any stale socket and starts serving in the background
+func (server *Server) Listen() error {
+	os.Remove(server.socketPath)
+	listener, err := net.Listen("unix", server.socketPath)
+	if err != nil {
+		return err
+	}
+	debug("listening on %s", server.socketPath)
+	go func() {
+		err := http.Serve(listener, server.mux)
+		debug("control server stopped: %v", err)
+	}()
+	return nil
+}
+
+// Handler returns the handler of the control api, e.g. to
+// serve it on an Endpoint besides the unix socket
+func (server *Server) Handler() http.Handler {
+	return server.mux
+}
+
+// RecordCycle records the outcome of a deployer cycle
+func (server *Server) RecordCycle(err error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.lastCycleAt = time.Now()
+	if err != nil {
+		server.lastError = err.Error()
+		return
+	}
+	server.lastError = ""
+	server.lastSuccessAt = server.lastCycleAt
+}
+
+// Health reports whether the loop is alive and succeeding
+func (server *Server) Health() Health {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	health := Health{
+		Healthy:       true,
+		StartedAt:     server.startedAt,
+		LastCycleAt:   server.lastCycleAt,
+		LastSuccessAt: server.lastSuccessAt,
+		LastError:     server.lastError,
+	}
+	since := server.lastSuccessAt
+	if since.IsZero() {
+		since = server.startedAt.Add(server.startupDelay)
+	}
+	if time.Since(since) > server.maxAge {
+		health.Healthy = false
+		health.Reason = "no successful cycle since " + since.Format(time.RFC3339)
+	}
+	return health
+}
+
+func (server *Server) handleHealth(response http.ResponseWriter, request *http.Request) {
+	health := server.Health()
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(response, status, health)
+}
+
+func writeJSON(response http.ResponseWriter, status int, value interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(value)
+}
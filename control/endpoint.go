@@ -0,0 +1,99 @@
+package control
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Endpoint is a tcp address an http feature is served on with its
+// own auth, so e.g. metrics can stay cluster-internal while another
+// feature is exposed through the ingress
+type Endpoint struct {
+	Address string
+
+	// Token is required as a bearer token, when set
+	Token string
+
+	// TLSCert and TLSKey serve https, ClientCA additionally
+	// requires client certificates it signed (mTLS)
+	TLSCert  string
+	TLSKey   string
+	ClientCA string
+}
+
+// Serve binds the endpoint and serves handler behind its auth in
+// the background. Nothing is served without an address
+func (endpoint Endpoint) Serve(name string, handler http.Handler) error {
+	if endpoint.Address == "" {
+		return nil
+	}
+	if (endpoint.TLSCert == "") != (endpoint.TLSKey == "") {
+		return fmt.Errorf("%s endpoint needs both a tls cert and key", name)
+	}
+	if endpoint.ClientCA != "" && endpoint.TLSCert == "" {
+		return fmt.Errorf("%s endpoint needs a tls cert to verify client certificates", name)
+	}
+
+	listener, err := net.Listen("tcp", endpoint.Address)
+	if err != nil {
+		return err
+	}
+	if endpoint.TLSCert != "" {
+		config, err := endpoint.tlsConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	if endpoint.Token != "" {
+		handler = requireToken(endpoint.Token, handler)
+	}
+	debug("serving %s on %s", name, endpoint.Address)
+	go func() {
+		err := http.Serve(listener, handler)
+		debug("%s server stopped: %v", name, err)
+	}()
+	return nil
+}
+
+func (endpoint Endpoint) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(endpoint.TLSCert, endpoint.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if endpoint.ClientCA == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(endpoint.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates in %s", endpoint.ClientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// requireToken answers 401 unless the request has the bearer token
+func requireToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			response.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(response, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		handler.ServeHTTP(response, request)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/engine-api/types"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"github.com/octoblu/beekeeper-updater-swarm/secrets"
+)
+
+// loadCredentials resolves the credential flags, any of them
+// may be an aws-sm://, ssm:// or file:// reference, into theDeployer
+func loadCredentials(context *cli.Context, theDeployer *deployer.Deployer) error {
+	username, err := resolveFlag(context, "beekeeper-username")
+	if err != nil {
+		return err
+	}
+	password, err := resolveFlag(context, "beekeeper-password")
+	if err != nil {
+		return err
+	}
+	if username != "" || password != "" {
+		theDeployer.SetBeekeeperCredentials(username, password)
+	}
+
+	registryUsername, err := resolveFlag(context, "registry-username")
+	if err != nil {
+		return err
+	}
+	registryPassword, err := resolveFlag(context, "registry-password")
+	if err != nil {
+		return err
+	}
+	if registryUsername == "" {
+		return nil
+	}
+	return theDeployer.SetRegistryAuth(types.AuthConfig{
+		Username:      registryUsername,
+		Password:      registryPassword,
+		ServerAddress: context.String("registry-server"),
+	})
+}
+
+// loadNotifications resolves the alert webhook and PagerDuty routing
+// keys of the flags and config file, any of them may be a reference,
+// e.g. file:///run/secrets/alert_webhook, into theDeployer
+func loadNotifications(context *cli.Context, theDeployer *deployer.Deployer) error {
+	alertWebhook, err := resolveFlag(context, "alert-webhook")
+	if err != nil {
+		return err
+	}
+	var routingKeys []string
+	for _, routingKey := range context.StringSlice("pagerduty-routing-key") {
+		parts := strings.SplitN(routingKey, "=", 2)
+		if len(parts) == 2 {
+			if parts[1], err = secrets.Resolve(parts[1]); err != nil {
+				return fmt.Errorf("--pagerduty-routing-key of %s: %v", parts[0], err)
+			}
+		}
+		routingKeys = append(routingKeys, strings.Join(parts, "="))
+	}
+	config, err := loadConfig(context.String("config"))
+	if err != nil {
+		return err
+	}
+	theDeployer.SetNotifications(alertWebhook, append(routingKeys, config.pagerDutyRoutingKeys()...))
+	return nil
+}
+
+func resolveFlag(context *cli.Context, name string) (string, error) {
+	value, err := secrets.Resolve(context.String(name))
+	if err != nil {
+		return "", fmt.Errorf("--%s: %v", name, err)
+	}
+	return value, nil
+}
+
+// reloadCredentialsOnHangup rereads the credential flags, alert
+// endpoints and vault secrets whenever the process receives SIGHUP
+func reloadCredentialsOnHangup(context *cli.Context, theDeployer *deployer.Deployer) {
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	for range sigHup {
+		info("SIGHUP received, reloading credentials")
+		if err := loadNotifications(context, theDeployer); err != nil {
+			warn("Could not reload alert endpoints:", err.Error())
+		}
+		if err := loadCredentials(context, theDeployer); err != nil {
+			warn("Could not reload credentials:", err.Error())
+			continue
+		}
+		if context.String("vault-addr") == "" {
+			continue
+		}
+		if _, err := loadVaultCredentials(context, theDeployer); err != nil {
+			warn("Could not reload vault credentials:", err.Error())
+		}
+	}
+}
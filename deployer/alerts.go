@@ -0,0 +1,119 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// Alert is posted as json to the alert webhook
+type Alert struct {
+	Kind        string    `json:"kind"`
+	ServiceID   string    `json:"serviceId"`
+	Service     string    `json:"service"`
+	Image       string    `json:"image,omitempty"`
+	Message     string    `json:"message"`
+	Owner       string    `json:"owner,omitempty"`
+	Logs        []string  `json:"logs,omitempty"`
+	RequestID   string    `json:"requestId"`
+	Cluster     string    `json:"cluster,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+var alertClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifications are where alerts are sent, shared by the
+// deployers of every swarm and replaced when they are reloaded
+type notifications struct {
+	alertWebhook  string
+	pagerDutyKeys map[string]string
+	lock          sync.RWMutex
+}
+
+func newNotifications(options *Options) *notifications {
+	return &notifications{
+		alertWebhook:  options.AlertWebhook,
+		pagerDutyKeys: parsePagerDutyKeys(options.PagerDutyRoutingKeys),
+	}
+}
+
+// SetNotifications replaces the alert webhook and PagerDuty routing
+// keys, e.g. after a leaked webhook was rotated. Alerts being sent
+// still go to the previous ones
+func (deployer *Deployer) SetNotifications(alertWebhook string, pagerDutyRoutingKeys []string) {
+	pagerDutyKeys := parsePagerDutyKeys(pagerDutyRoutingKeys)
+	deployer.notifications.lock.Lock()
+	defer deployer.notifications.lock.Unlock()
+	deployer.notifications.alertWebhook = alertWebhook
+	deployer.notifications.pagerDutyKeys = pagerDutyKeys
+}
+
+func (deployer *Deployer) alertWebhook() string {
+	deployer.notifications.lock.RLock()
+	defer deployer.notifications.lock.RUnlock()
+	return deployer.notifications.alertWebhook
+}
+
+// sendAlert posts alert to the webhook and triggers the PagerDuty
+// service of its owner in the background, a failed alert is
+// counted but never blocks the cycle. Alerts without a request id
+// get the one of the cycle. Dry runs send no alerts
+func (deployer *Deployer) sendAlert(alert Alert) {
+	if deployer.dryRun {
+		deployer.debug("dry run, not sending the %s alert of %s", alert.Kind, alert.ServiceID)
+		return
+	}
+	countLabeledMetric("alerts", alert.Kind)
+	if alert.RequestID == "" {
+		alert.RequestID = deployer.requestID
+	}
+	alert.Cluster = deployer.cluster
+	alert.Environment = deployer.environment
+	alert.Timestamp = deployer.clock.Now()
+	if webhook := deployer.alertWebhook(); webhook != "" {
+		go func() {
+			if err := postAlert(webhook, alert); err != nil {
+				countMetric("alert_errors")
+				debug("could not send %s alert: %v", alert.Kind, redactError(err))
+			}
+		}()
+	}
+	if routingKey := deployer.pagerDutyKey(alert.Owner); routingKey != "" {
+		go func() {
+			if err := deployer.triggerPagerDuty(routingKey, alert); err != nil {
+				countMetric("alert_errors")
+				debug("could not send %s alert to pagerduty: %v", alert.Kind, redactError(err))
+			}
+		}()
+	}
+}
+
+// serviceOwner returns the team that owns service, from its owner label
+func (deployer *Deployer) serviceOwner(service swarm.Service) string {
+	return service.Spec.Labels[deployer.ownerLabel]
+}
+
+func postAlert(webhook string, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	res, err := alertClient.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Invalid alert webhook response status code %v", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package deployer
+
+import "github.com/docker/engine-api/types/swarm"
+
+// The labels a deploy stamps on the service from the beekeeper
+// deployment, so docker service inspect tells what code runs
+const (
+	deploymentIDLabel = "octoblu.beekeeper.deploymentId"
+	commitSHALabel    = "octoblu.beekeeper.commitSHA"
+	buildURLLabel     = "octoblu.beekeeper.buildURL"
+)
+
+// annotateDeploy returns the service with the deployment labels set
+// from metadata. Labels metadata has no value for are removed, they
+// described the image being replaced. Nothing is written to docker,
+// the labels go out with the deploy
+func annotateDeploy(service swarm.Service, metadata *RequestMetadata) swarm.Service {
+	values := map[string]string{}
+	if metadata != nil {
+		values[deploymentIDLabel] = metadata.ID
+		if metadata.Provenance != nil {
+			values[commitSHALabel] = metadata.Provenance.CommitSHA
+			values[buildURLLabel] = metadata.Provenance.BuildURL
+		}
+	}
+
+	labels := make(map[string]string, len(service.Spec.Labels)+len(values))
+	for key, value := range service.Spec.Labels {
+		labels[key] = value
+	}
+	for _, label := range []string{deploymentIDLabel, commitSHALabel, buildURLLabel} {
+		if values[label] == "" {
+			delete(labels, label)
+		} else {
+			labels[label] = values[label]
+		}
+	}
+	service.Spec.Labels = labels
+	return service
+}
@@ -0,0 +1,158 @@
+package deployer
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// AuditRecord is a line of the audit log, written when
+// a deploy starts and when its rollout ends
+type AuditRecord struct {
+	Timestamp     time.Time       `json:"timestamp"`
+	RequestID     string          `json:"requestId"`
+	ServiceID     string          `json:"serviceId"`
+	Service       string          `json:"service"`
+	Event         string          `json:"event"`
+	Image         string          `json:"image"`
+	PreviousImage string          `json:"previousImage,omitempty"`
+	Message       string          `json:"message,omitempty"`
+	Placement     []TaskPlacement `json:"placement,omitempty"`
+	Failures      []TaskFailure   `json:"failures,omitempty"`
+}
+
+// TaskPlacement is where a task of a rollout landed
+type TaskPlacement struct {
+	TaskID      string `json:"taskId"`
+	NodeID      string `json:"nodeId"`
+	Node        string `json:"node"`
+	ContainerID string `json:"containerId,omitempty"`
+	State       string `json:"state"`
+}
+
+// audit appends record to the audit log, if there is
+// one, and exports it to kafka, if enabled. Dry runs are not audited
+func (deployer *Deployer) audit(record AuditRecord) {
+	if deployer.dryRun {
+		return
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = deployer.clock.Now()
+	}
+	deployer.export(ExportEvent{
+		Type:          "audit",
+		Event:         record.Event,
+		Timestamp:     record.Timestamp,
+		RequestID:     record.RequestID,
+		ServiceID:     record.ServiceID,
+		Service:       record.Service,
+		Image:         record.Image,
+		PreviousImage: record.PreviousImage,
+		Message:       record.Message,
+	})
+	if deployer.auditLog == "" {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		debug("could not encode audit record: %v", err)
+		return
+	}
+
+	deployer.auditLock.Lock()
+	defer deployer.auditLock.Unlock()
+	file, err := os.OpenFile(deployer.auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		countMetric("audit_errors")
+		debug("could not open audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		countMetric("audit_errors")
+		debug("could not write audit log: %v", err)
+	}
+}
+
+// ReadAuditLog reads every record of the audit log at path, oldest first
+func ReadAuditLog(path string) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// getTaskPlacement lists the running tasks of the service
+// with the nodes they were scheduled on
+func (deployer *Deployer) getTaskPlacement(serviceID string) ([]TaskPlacement, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+
+	filter := filters.NewArgs()
+	filter.Add("service", serviceID)
+	filter.Add("desired-state", "running")
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "TaskList", err)
+	}
+	nodes, err := deployer.dockerClient.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "NodeList", err)
+	}
+	hostnames := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	placement := make([]TaskPlacement, 0, len(tasks))
+	for _, task := range tasks {
+		placement = append(placement, TaskPlacement{
+			TaskID:      task.ID,
+			NodeID:      task.NodeID,
+			Node:        hostnames[task.NodeID],
+			ContainerID: task.Status.ContainerStatus.ContainerID,
+			State:       string(task.Status.State),
+		})
+	}
+	return placement, nil
+}
+
+// auditRollout records the end of a rollout with where its
+// tasks landed, and why those that failed did
+func (deployer *Deployer) auditRollout(requestID string, service swarm.Service, event, message string, failures []TaskFailure) {
+	if deployer.auditLog == "" {
+		return
+	}
+	placement, err := deployer.getTaskPlacement(service.ID)
+	if err != nil {
+		debug("[%s] could not get task placement of %s: %v", requestID, service.ID, err)
+	}
+	deployer.audit(AuditRecord{
+		RequestID: requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     event,
+		Image:     service.Spec.TaskTemplate.ContainerSpec.Image,
+		Message:   message,
+		Placement: placement,
+		Failures:  failures,
+	})
+}
@@ -0,0 +1,75 @@
+package deployer
+
+import (
+	"strconv"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// batchOrderLabel orders the rollout of the services sharing a
+// beekeeper project, e.g. an app and its workers. A service waits
+// until every one with a lower order runs the new image and finished
+// rolling it out, services with the same order roll out together.
+// A service without the label has order 0
+const batchOrderLabel = "octoblu.beekeeper.batchOrder"
+
+// groupByImage groups the services of a cycle by beekeeper project,
+// only projects with a batchOrder label on a service are kept
+func (deployer *Deployer) groupByImage(services []swarm.Service) map[deploymentKey][]swarm.Service {
+	groups := make(map[deploymentKey][]swarm.Service)
+	ordered := make(map[deploymentKey]bool)
+	for _, service := range services {
+		if deployer.getUpdateMode(service) != updateModeDeploy {
+			continue
+		}
+		key := deployer.getDeploymentKey(service)
+		if key == (deploymentKey{}) {
+			continue
+		}
+		groups[key] = append(groups[key], service)
+		if _, ok := service.Spec.Labels[batchOrderLabel]; ok {
+			ordered[key] = true
+		}
+	}
+	for key := range groups {
+		if !ordered[key] {
+			delete(groups, key)
+		}
+	}
+	return groups
+}
+
+// getBatchOrder returns the batchOrder label of the service, 0 when
+// it is missing or invalid
+func (deployer *Deployer) getBatchOrder(service swarm.Service) int {
+	label, ok := service.Spec.Labels[batchOrderLabel]
+	if !ok {
+		return 0
+	}
+	order, err := strconv.Atoi(label)
+	if err != nil {
+		deployer.debug("invalid batchOrder label %q on %s, using 0", label, service.ID)
+		return 0
+	}
+	return order
+}
+
+// batchBlocker returns the name of a service of the batch of service
+// with a lower order that does not run dockerURL yet, or is still
+// rolling it out, or an empty string when service may go ahead
+func (deployer *Deployer) batchBlocker(service swarm.Service, dockerURL string) string {
+	batch, ok := deployer.batches[deployer.getDeploymentKey(service)]
+	if !ok {
+		return ""
+	}
+	order := deployer.getBatchOrder(service)
+	for _, other := range batch {
+		if other.ID == service.ID || deployer.getBatchOrder(other) >= order {
+			continue
+		}
+		if !doesDockerURLMatchCurrent(dockerURL, other) || isUpdateInProcess(other) || !didLastUpdatePass(other) {
+			return other.Spec.Name
+		}
+	}
+	return ""
+}
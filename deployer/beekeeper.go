@@ -0,0 +1,428 @@
+package deployer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const beekeeperTimeout = 30 * time.Second
+
+// newHTTPClient constructs the client shared by every beekeeper request,
+// keeping connections alive between lookups and cycles
+func newHTTPClient(options *Options) *http.Client {
+	maxConns := options.BeekeeperMaxConns
+	if maxConns <= 0 {
+		maxConns = 10
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxConns,
+		MaxIdleConnsPerHost:   maxConns,
+		MaxConnsPerHost:       maxConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     options.BeekeeperHTTP2,
+	}
+	if options.BeekeeperClientCert != "" || options.BeekeeperCACert != "" {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if options.BeekeeperClientCert != "" {
+		transport.TLSClientConfig.GetClientCertificate = clientCertificateLoader(options.BeekeeperClientCert, options.BeekeeperClientKey)
+	}
+	if options.BeekeeperCACert != "" {
+		roots, err := LoadCertPool(options.BeekeeperCACert)
+		if err != nil {
+			debug("%v, verifying beekeeper with the system certificate authorities", err)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	if !options.BeekeeperHTTP2 {
+		// a non-nil, empty map disables the automatic http2 upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   beekeeperTimeout,
+	}
+}
+
+// clientCertificateLoader reads the key pair on every handshake,
+// so a rotated certificate is picked up without a restart
+func clientCertificateLoader(certFile, keyFile string) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load beekeeper client certificate: %v", err)
+		}
+		return &cert, nil
+	}
+}
+
+// LoadCertPool reads the pem certificate authorities in caFile
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read beekeeper ca certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates in beekeeper ca certificate %v", caFile)
+	}
+	return roots, nil
+}
+
+// BeekeeperInstance is a beekeeper services can be routed
+// to with the octoblu.beekeeper.instance label
+type BeekeeperInstance struct {
+	URI      string `json:"uri"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Tags     string `json:"tags,omitempty"`
+}
+
+// beekeeperEndpoint is where a service's deployments are looked up
+type beekeeperEndpoint struct {
+	name     string
+	uri      string
+	username string
+	password string
+	tags     string
+	useToken bool
+}
+
+// getBeekeeper picks the beekeeper a service's deployments are
+// looked up on. Its octoblu.beekeeper.uri label overrides the uri
+// of the instance, keeping the instance's tags. The instance's
+// credentials are only sent to its own host and the hosts of
+// --beekeeper-uri-host, and never downgraded from https to http
+func (deployer *Deployer) getBeekeeper(service swarm.Service) (beekeeperEndpoint, error) {
+	beekeeper, err := deployer.getBeekeeperInstance(service)
+	if err != nil {
+		return beekeeperEndpoint{}, err
+	}
+	uri := service.Spec.Labels["octoblu.beekeeper.uri"]
+	if uri == "" {
+		return beekeeper, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return beekeeperEndpoint{}, fmt.Errorf("Invalid octoblu.beekeeper.uri label %v", RedactURI(uri))
+	}
+	instance, err := url.Parse(beekeeper.uri)
+	if err != nil {
+		return beekeeperEndpoint{}, err
+	}
+	if instance.Scheme == "https" && u.Scheme != "https" {
+		return beekeeperEndpoint{}, fmt.Errorf("The octoblu.beekeeper.uri label %v is not https like beekeeper %v", RedactURI(uri), beekeeper.name)
+	}
+	if !strings.EqualFold(u.Host, instance.Host) && !deployer.beekeeperURIHosts[strings.ToLower(u.Host)] {
+		beekeeper.username = ""
+		beekeeper.password = ""
+		beekeeper.useToken = false
+	}
+	beekeeper.name += " " + RedactURI(uri)
+	beekeeper.uri = strings.TrimRight(uri, "/")
+	return beekeeper, nil
+}
+
+// defaultBeekeeper is the beekeeper given by the flags
+func (deployer *Deployer) defaultBeekeeper() beekeeperEndpoint {
+	username, password := deployer.beekeeperCredentials()
+	return beekeeperEndpoint{
+		name:     "default",
+		uri:      deployer.beekeeperURI,
+		username: username,
+		password: password,
+		tags:     deployer.tags,
+		useToken: deployer.tokenSource != nil,
+	}
+}
+
+// getBeekeeperInstance picks the beekeeper instance named by the
+// service's octoblu.beekeeper.instance label, or the default one
+func (deployer *Deployer) getBeekeeperInstance(service swarm.Service) (beekeeperEndpoint, error) {
+	name := service.Spec.Labels["octoblu.beekeeper.instance"]
+	if name == "" {
+		return deployer.defaultBeekeeper(), nil
+	}
+	instance, ok := deployer.beekeeperInstances[name]
+	if !ok {
+		return beekeeperEndpoint{}, fmt.Errorf("Unknown beekeeper instance %v", name)
+	}
+	tags := instance.Tags
+	if tags == "" {
+		tags = deployer.tags
+	}
+	return beekeeperEndpoint{
+		name:     name,
+		uri:      instance.URI,
+		username: instance.Username,
+		password: instance.Password,
+		tags:     tags,
+	}, nil
+}
+
+// defaultDeploymentPath is beekeeper's latest deployment endpoint
+const defaultDeploymentPath = "/deployments/{{.Owner}}/{{.Repo}}/latest"
+
+// deploymentPathData is what a deployment path template can use
+type deploymentPathData struct {
+	Owner string
+	Repo  string
+}
+
+// ParseDeploymentPath parses a deployment path template, e.g.
+// "/api/v2/projects/{{.Owner}}/{{.Repo}}/releases/current"
+func ParseDeploymentPath(path string) (*template.Template, error) {
+	return template.New("deployment-path").Option("missingkey=error").Parse(path)
+}
+
+func (deployer *Deployer) getBeekeeperURL(beekeeper beekeeperEndpoint, owner, repo string) (string, error) {
+	var path bytes.Buffer
+	if err := deployer.deploymentPath.Execute(&path, deploymentPathData{Owner: owner, Repo: repo}); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(beekeeper.uri + path.String())
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if beekeeper.tags != "" {
+		q.Set("tags", beekeeper.tags)
+	}
+	u.RawQuery = q.Encode()
+	return fmt.Sprint(u), nil
+}
+
+// userAgent tells beekeeper which version of the updater polls it
+// from which swarm, e.g. "beekeeper-updater-swarm/1.2.3 (west)"
+func userAgent(options *Options) string {
+	suffix := options.UserAgentSuffix
+	if suffix == "" {
+		suffix = options.Cluster
+	}
+	if options.UserAgent == "" || suffix == "" {
+		return options.UserAgent
+	}
+	return fmt.Sprintf("%s (%s)", options.UserAgent, suffix)
+}
+
+// newBeekeeperRequest builds a request with the headers and
+// credentials every beekeeper call needs, requestID is passed as
+// requests are also made in the background of the cycles
+func (deployer *Deployer) newBeekeeperRequest(requestID string, beekeeper beekeeperEndpoint, method, uri string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	// setting Accept-Encoding ourselves disables the transport's
+	// implicit gzip handling, decodeBody takes care of it instead
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	if deployer.userAgent != "" {
+		req.Header.Set("User-Agent", deployer.userAgent)
+	}
+	if deployer.cluster != "" {
+		req.Header.Set("X-Beekeeper-Cluster", deployer.cluster)
+	}
+	if deployer.environment != "" {
+		req.Header.Set("X-Beekeeper-Environment", deployer.environment)
+	}
+	if err := deployer.authorizeBeekeeperRequest(beekeeper, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// authorizeBeekeeperRequest sets the bearer token, or the basic
+// auth credentials, of the beekeeper on req
+func (deployer *Deployer) authorizeBeekeeperRequest(beekeeper beekeeperEndpoint, req *http.Request) error {
+	if beekeeper.useToken {
+		token, err := deployer.tokenSource.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if beekeeper.username != "" {
+		req.SetBasicAuth(beekeeper.username, beekeeper.password)
+	}
+	return nil
+}
+
+// decodeBody wraps the response body in a decompressor
+// matching its Content-Encoding
+func decodeBody(res *http.Response) (io.ReadCloser, error) {
+	switch strings.ToLower(res.Header.Get("Content-Encoding")) {
+	case "gzip":
+		return gzip.NewReader(res.Body)
+	case "deflate":
+		return zlib.NewReader(res.Body)
+	case "", "identity":
+		return ioutil.NopCloser(res.Body), nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Encoding %v", res.Header.Get("Content-Encoding"))
+}
+
+func (deployer *Deployer) getLatestDeployment(beekeeper beekeeperEndpoint, owner, repo string) (*RequestMetadata, error) {
+	metadata := &RequestMetadata{}
+
+	u, err := deployer.getBeekeeperURL(beekeeper, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	deployer.debug("get latest docker url %s", RedactURI(u))
+
+	req, err := deployer.newBeekeeperRequest(deployer.requestID, beekeeper, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var res *http.Response
+	if err = deployer.faults.beekeeperError(); err == nil {
+		res, err = deployer.httpClient.Do(req)
+	}
+	deployer.observeClusterLatency("beekeeper_request", time.Since(start))
+	deployer.latencyBudget.observe(deployer.clock.Now(), time.Since(start), err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests)
+
+	if err != nil {
+		deployer.countClusterMetric("beekeeper_errors", classifyBeekeeperError(err))
+		deployer.debug("got error from beekeeper-service %v", redactError(err))
+		return nil, classify(ErrBeekeeperUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	deployer.debug("get latest: got status code %v", res.StatusCode)
+	countLabeledMetric("beekeeper_responses", strconv.Itoa(res.StatusCode))
+	if res.StatusCode >= 400 {
+		deployer.countClusterMetric("beekeeper_errors", fmt.Sprintf("%dxx", res.StatusCode/100))
+	}
+	if res.StatusCode == http.StatusUnauthorized && beekeeper.useToken {
+		deployer.tokenSource.Invalidate()
+	}
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, errProjectNotFound
+	}
+	if res.StatusCode != 200 {
+		// drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, &beekeeperStatusError{res.StatusCode}
+	}
+
+	reader, err := decodeBody(res)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deployer.debug("get latest: got body %s", body)
+	if len(body) == 0 {
+		return metadata, nil
+	}
+
+	err = json.Unmarshal(body, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// beekeeperStatusError is an unexpected beekeeper response
+type beekeeperStatusError struct {
+	StatusCode int
+}
+
+func (err *beekeeperStatusError) Error() string {
+	return fmt.Sprintf("Invalid response status code %v", err.StatusCode)
+}
+
+// Is makes server errors and too many requests ErrBeekeeperUnavailable
+func (err *beekeeperStatusError) Is(target error) bool {
+	return target == ErrBeekeeperUnavailable && (err.StatusCode >= 500 || err.StatusCode == http.StatusTooManyRequests)
+}
+
+// classifyBeekeeperError buckets a transport error into
+// timeout, dns, tls, connection or injected for the beekeeper_errors metric
+func classifyBeekeeperError(err error) string {
+	if err == errInjectedFault {
+		return "injected"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+	var recordErr tls.RecordHeaderError
+	var certErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return "tls"
+	}
+	return "connection"
+}
+
+// RedactURI replaces the password in a uri with "xxxxx",
+// so it can be safely logged
+func RedactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return uri
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u.String()
+}
+
+// redactError strips credentials out of the url
+// embedded in *url.Error, which net/http returns
+func redactError(err error) error {
+	if classified, ok := err.(*classifiedError); ok {
+		return classify(classified.class, redactError(classified.err))
+	}
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	return &url.Error{Op: urlErr.Op, URL: RedactURI(urlErr.URL), Err: urlErr.Err}
+}
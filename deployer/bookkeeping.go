@@ -0,0 +1,142 @@
+package deployer
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// deployRecord is the bookkeeping of the last deploy to a service,
+// kept in its labels or, with NoBookkeepingLabels, in the state file
+type deployRecord struct {
+	LastDockerURL     string `json:"lastDockerURL"`
+	LastUpdatedAt     string `json:"lastUpdatedAt"`
+	PreviousDockerURL string `json:"previousDockerURL,omitempty"`
+}
+
+// deployRecords are the deploy records of the state file, keyed
+// by cluster and service id, shared by the swarms of a deployer
+type deployRecords struct {
+	byService map[string]deployRecord
+	lock      sync.Mutex
+}
+
+func newDeployRecords(options *Options) *deployRecords {
+	if !options.NoBookkeepingLabels {
+		return nil
+	}
+	return &deployRecords{byService: make(map[string]deployRecord)}
+}
+
+// deployRecordKey keeps the records of the swarms apart
+func (deployer *Deployer) deployRecordKey(serviceID string) string {
+	return deployer.clusterLabel() + "/" + serviceID
+}
+
+// lastDeploy returns the bookkeeping of the last deploy to the service
+func (deployer *Deployer) lastDeploy(service swarm.Service) deployRecord {
+	if deployer.deployRecords == nil {
+		labels := service.Spec.Labels
+		return deployRecord{
+			LastDockerURL:     labels["octoblu.beekeeper.lastDockerURL"],
+			LastUpdatedAt:     labels["octoblu.beekeeper.lastUpdatedAt"],
+			PreviousDockerURL: labels[previousDockerURLLabel],
+		}
+	}
+	deployer.deployRecords.lock.Lock()
+	defer deployer.deployRecords.lock.Unlock()
+	return deployer.deployRecords.byService[deployer.deployRecordKey(service.ID)]
+}
+
+// labelDeploy sets the bookkeeping labels of a deploy on the spec,
+// unless it is kept in the state file, see saveDeploy
+func (deployer *Deployer) labelDeploy(spec *swarm.ServiceSpec, record deployRecord) {
+	if deployer.deployRecords != nil {
+		return
+	}
+	if spec.Labels == nil {
+		spec.Labels = make(map[string]string)
+	}
+	spec.Labels["octoblu.beekeeper.lastDockerURL"] = record.LastDockerURL
+	spec.Labels["octoblu.beekeeper.lastUpdatedAt"] = record.LastUpdatedAt
+	spec.Labels[previousDockerURLLabel] = record.PreviousDockerURL
+}
+
+// saveDeploy writes the bookkeeping of a deploy that went out
+// to the state file, when it is not kept in labels
+func (deployer *Deployer) saveDeploy(serviceID string, record deployRecord) {
+	if deployer.deployRecords == nil {
+		return
+	}
+	deployer.deployRecords.lock.Lock()
+	deployer.deployRecords.byService[deployer.deployRecordKey(serviceID)] = record
+	deployer.deployRecords.lock.Unlock()
+	deployer.saveDeployRecords()
+}
+
+// restoreDeployRecords loads the deploy records of the state file
+func (deployer *Deployer) restoreDeployRecords() {
+	if deployer.deployRecords == nil || deployer.stateStore == nil {
+		return
+	}
+	state, err := deployer.stateStore.load()
+	if err != nil {
+		debug("could not load the deploy records from the state file: %v", err)
+		return
+	}
+	deployer.deployRecords.lock.Lock()
+	defer deployer.deployRecords.lock.Unlock()
+	for key, record := range state.Deploys {
+		deployer.deployRecords.byService[key] = record
+	}
+}
+
+// forgetDeployRecords drops the records of the services of
+// the swarm of the deployer that were not seen in the last cycle
+func (deployer *Deployer) forgetDeployRecords(seen map[string]bool) {
+	if deployer.deployRecords == nil {
+		return
+	}
+	prefix := deployer.deployRecordKey("")
+	forgot := false
+	deployer.deployRecords.lock.Lock()
+	for key := range deployer.deployRecords.byService {
+		if strings.HasPrefix(key, prefix) && !seen[strings.TrimPrefix(key, prefix)] {
+			delete(deployer.deployRecords.byService, key)
+			forgot = true
+		}
+	}
+	deployer.deployRecords.lock.Unlock()
+	if forgot {
+		deployer.saveDeployRecords()
+	}
+}
+
+func (deployer *Deployer) saveDeployRecords() {
+	if deployer.stateStore == nil {
+		return
+	}
+	deployer.deployRecords.lock.Lock()
+	records := make(map[string]deployRecord, len(deployer.deployRecords.byService))
+	for key, record := range deployer.deployRecords.byService {
+		records[key] = record
+	}
+	deployer.deployRecords.lock.Unlock()
+	err := deployer.stateStore.update(func(state *persistedState) {
+		state.Deploys = records
+	})
+	if err != nil {
+		countMetric("state_file_errors")
+		debug("could not save the deploy records to the state file: %v", err)
+	}
+}
+
+func newDeployRecord(dockerURL, previousImage string, now time.Time) deployRecord {
+	return deployRecord{
+		LastDockerURL:     dockerURL,
+		LastUpdatedAt:     now.Format(time.RFC3339),
+		PreviousDockerURL: previousImage,
+	}
+}
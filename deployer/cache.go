@@ -0,0 +1,251 @@
+package deployer
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+const eventsRetryInterval = 10 * time.Second
+
+// serviceCache holds the labeled services, kept current by
+// docker service events between periodic full resyncs
+type serviceCache struct {
+	lock       sync.Mutex
+	services   map[string]swarm.Service
+	syncedAt   time.Time
+	valid      bool
+	watchOnce  sync.Once
+	resyncTime time.Duration
+	clock      Clock
+}
+
+func newServiceCache(resyncTime time.Duration, clock Clock) *serviceCache {
+	if resyncTime <= 0 {
+		resyncTime = 10 * time.Minute
+	}
+	return &serviceCache{
+		services:   make(map[string]swarm.Service),
+		resyncTime: resyncTime,
+		clock:      clock,
+	}
+}
+
+// list returns the cached services, ok is false
+// when a full resync is due
+func (cache *serviceCache) list() ([]swarm.Service, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if !cache.valid || cache.clock.Now().Sub(cache.syncedAt) > cache.resyncTime {
+		return nil, false
+	}
+	services := make([]swarm.Service, 0, len(cache.services))
+	for _, service := range cache.services {
+		services = append(services, service)
+	}
+	return services, true
+}
+
+// replace caches the services of a full list and returns them. A
+// service an event refreshed after the list was taken keeps its
+// newer version
+func (cache *serviceCache) replace(services []swarm.Service) []swarm.Service {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	replaced := make(map[string]swarm.Service, len(services))
+	current := make([]swarm.Service, 0, len(services))
+	for _, service := range services {
+		if cached, ok := cache.services[service.ID]; ok && cached.Version.Index > service.Version.Index {
+			service = cached
+		}
+		replaced[service.ID] = service
+		current = append(current, service)
+	}
+	cache.services = replaced
+	cache.syncedAt = cache.clock.Now()
+	cache.valid = true
+	return current
+}
+
+func (cache *serviceCache) set(service swarm.Service) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.services[service.ID] = service
+}
+
+func (cache *serviceCache) remove(serviceID string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.services, serviceID)
+}
+
+// invalidate forces a full resync, events may
+// have been missed while the stream was down
+func (cache *serviceCache) invalidate() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.valid = false
+}
+
+// listServices returns the labeled services, from the cache
+// when watching events, otherwise straight from docker
+func (deployer *Deployer) listServices() ([]swarm.Service, error) {
+	if deployer.cache != nil {
+		deployer.cache.watchOnce.Do(func() {
+			go deployer.watchEvents()
+		})
+		if services, ok := deployer.cache.list(); ok {
+			deployer.debug("using %v cached services", len(services))
+			return deployer.applyPolicies(services), nil
+		}
+	}
+
+	filters := filters.NewArgs()
+	filters.Add("label", "octoblu.beekeeper.update")
+	for _, selector := range deployer.selectors {
+		filters.Add("label", selector)
+	}
+	options := types.ServiceListOptions{
+		Filter: filters,
+	}
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	services, err := deployer.dockerClient.ServiceList(ctx, options)
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "ServiceList", err)
+	}
+	countMetric("service_list_calls")
+	if len(deployer.listedServices) > 0 {
+		listed, err := deployer.listListedServices(ctx)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, listed...)
+	}
+	if deployer.cache != nil {
+		services = deployer.cache.replace(services)
+	}
+	return deployer.applyPolicies(services), nil
+}
+
+// listListedServices returns the services given by --services
+// that lack the update label, they cannot be found by label.
+// A listed service that does not exist is only logged
+func (deployer *Deployer) listListedServices(ctx context.Context) ([]swarm.Service, error) {
+	all, err := deployer.dockerClient.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "ServiceList", err)
+	}
+	countMetric("service_list_calls")
+
+	found := make(map[string]bool)
+	var services []swarm.Service
+	for _, service := range all {
+		if !deployer.isListed(service) {
+			continue
+		}
+		found[service.Spec.Name] = true
+		found[service.ID] = true
+		if _, ok := service.Spec.Labels["octoblu.beekeeper.update"]; ok {
+			continue
+		}
+		if deployer.matchesSelectors(service) {
+			services = append(services, service)
+		}
+	}
+	for name := range deployer.listedServices {
+		if !found[name] {
+			deployer.debug("listed service %s does not exist", name)
+		}
+	}
+	return services, nil
+}
+
+// watchEvents keeps the cache current, reconnecting
+// to the event stream whenever it drops
+func (deployer *Deployer) watchEvents() {
+	for {
+		err := deployer.streamEvents()
+		deployer.cache.invalidate()
+		debug("service event stream ended, reconnecting: %v", err)
+		countMetric("event_stream_reconnects")
+		time.Sleep(eventsRetryInterval)
+	}
+}
+
+func (deployer *Deployer) streamEvents() error {
+	filters := filters.NewArgs()
+	filters.Add("type", "service")
+	options := types.EventsOptions{
+		Filters: filters,
+	}
+	body, err := deployer.dockerClient.Events(context.Background(), options)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var event eventMessage
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		deployer.handleEvent(event)
+	}
+}
+
+// eventMessage is the subset of events.Message we need,
+// service events are not described by engine-api yet
+type eventMessage struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+func (deployer *Deployer) handleEvent(event eventMessage) {
+	if event.Type != "service" {
+		return
+	}
+	serviceID := event.Actor.ID
+	debug("service event %s %s", event.Action, serviceID)
+	countLabeledMetric("service_events", event.Action)
+
+	if event.Action == "remove" {
+		deployer.cache.remove(serviceID)
+		return
+	}
+	deployer.refreshCachedService(serviceID)
+}
+
+// refreshCachedService re-inspects a service so the cache
+// holds its current spec and version
+func (deployer *Deployer) refreshCachedService(serviceID string) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		debug("refreshing cached service failed %v", deployer.dockerError(ctx, "ServiceInspect", err))
+		deployer.cache.invalidate()
+		return
+	}
+	if !deployer.matchesSelectors(service) {
+		deployer.cache.remove(serviceID)
+		return
+	}
+	deployer.cache.set(service)
+}
@@ -0,0 +1,318 @@
+package deployer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCalendarRefresh is how often the freeze calendar is fetched
+	defaultCalendarRefresh = 15 * time.Minute
+	// calendarHorizon is how far ahead recurring freezes are expanded,
+	// past the week windowOpens looks at
+	calendarHorizon = 8 * 24 * time.Hour
+)
+
+// freezeCalendar is an iCal calendar whose events are deploy freezes,
+// e.g. the secret ical url of a google calendar or a caldav calendar.
+// It is fetched again every refresh, the last freezes fetched are
+// kept while it cannot be. Until it was fetched once every deploy
+// is held, a freeze that cannot be read is not ignored
+type freezeCalendar struct {
+	url       string
+	refresh   time.Duration
+	client    *http.Client
+	freezes   []Window
+	fetchedAt time.Time
+	loaded    bool
+	lock      sync.Mutex
+}
+
+func newFreezeCalendar(options *Options) *freezeCalendar {
+	if options.FreezeCalendarURL == "" {
+		return nil
+	}
+	refresh := options.FreezeCalendarRefresh
+	if refresh <= 0 {
+		refresh = defaultCalendarRefresh
+	}
+	return &freezeCalendar{
+		url:     options.FreezeCalendarURL,
+		refresh: refresh,
+		client:  &http.Client{Timeout: beekeeperTimeout},
+	}
+}
+
+// refreshFreezes fetches the freeze calendar when it is due
+func (deployer *Deployer) refreshFreezes(now time.Time) {
+	calendar := deployer.freezeCalendar
+	if calendar == nil {
+		return
+	}
+	calendar.lock.Lock()
+	due := now.Sub(calendar.fetchedAt) >= calendar.refresh
+	calendar.lock.Unlock()
+	if !due {
+		return
+	}
+
+	freezes, err := calendar.fetch(now)
+	calendar.lock.Lock()
+	defer calendar.lock.Unlock()
+	calendar.fetchedAt = now
+	if err != nil {
+		countMetric("freeze_calendar_errors")
+		deployer.debug("could not fetch the freeze calendar %s: %v", RedactURI(calendar.url), redactError(err))
+		return
+	}
+	deployer.debug("freeze calendar has %d freezes in the next days", len(freezes))
+	calendar.freezes = freezes
+	calendar.loaded = true
+}
+
+// current returns the freezes of the calendar,
+// loaded is false until it was fetched once
+func (calendar *freezeCalendar) current() (freezes []Window, loaded bool) {
+	calendar.lock.Lock()
+	defer calendar.lock.Unlock()
+	return calendar.freezes, calendar.loaded
+}
+
+func (calendar *freezeCalendar) fetch(now time.Time) ([]Window, error) {
+	req, err := http.NewRequest("GET", calendar.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+	res, err := calendar.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid freeze calendar response status code %v", res.StatusCode)
+	}
+	return ParseFreezes(res.Body, now.Add(-calendarHorizon), now.Add(calendarHorizon))
+}
+
+// calendarDays are the days of a BYDAY rule
+var calendarDays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// calendarEvent is a VEVENT of an iCal calendar
+type calendarEvent struct {
+	summary   string
+	start     time.Time
+	end       time.Time
+	allDay    bool
+	rule      map[string]string
+	cancelled bool
+}
+
+// ParseFreezes reads the events of an iCal calendar overlapping from
+// to until as fixed windows. Recurring events are expanded for daily
+// and weekly rules, with INTERVAL, COUNT, UNTIL and weekly BYDAY,
+// other rules only freeze their first occurrence
+func ParseFreezes(reader io.Reader, from, until time.Time) ([]Window, error) {
+	lines, err := unfoldLines(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var freezes []Window
+	var event *calendarEvent
+	location := time.UTC
+	for _, line := range lines {
+		name, params, value := parseProperty(line)
+		switch {
+		case name == "X-WR-TIMEZONE":
+			if loaded, err := time.LoadLocation(value); err == nil {
+				location = loaded
+			}
+		case name == "BEGIN" && value == "VEVENT":
+			event = &calendarEvent{}
+		case event == nil:
+		case name == "END" && value == "VEVENT":
+			if err := event.validate(); err != nil {
+				return nil, err
+			}
+			if !event.cancelled {
+				freezes = append(freezes, event.occurrences(from, until)...)
+			}
+			event = nil
+		case name == "SUMMARY":
+			event.summary = unescapeText(value)
+		case name == "STATUS":
+			event.cancelled = value == "CANCELLED"
+		case name == "DTSTART":
+			event.start, event.allDay, err = parseCalendarTime(value, params, location)
+		case name == "DTEND":
+			event.end, _, err = parseCalendarTime(value, params, location)
+		case name == "RRULE":
+			event.rule = parseRule(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid freeze calendar %s: %v", name, err)
+		}
+	}
+	return freezes, nil
+}
+
+func (event *calendarEvent) validate() error {
+	if event.start.IsZero() {
+		return fmt.Errorf("Freeze calendar event %q has no DTSTART", event.summary)
+	}
+	if event.end.IsZero() && event.allDay {
+		event.end = event.start.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+// occurrences returns the windows of the event overlapping from to until
+func (event *calendarEvent) occurrences(from, until time.Time) []Window {
+	duration := event.end.Sub(event.start)
+	if duration <= 0 {
+		return nil
+	}
+	var windows []Window
+	add := func(start time.Time) {
+		end := start.Add(duration)
+		if end.After(from) && start.Before(until) {
+			windows = append(windows, Window{Name: event.summary, Start: start, End: end})
+		}
+	}
+
+	frequency := event.rule["FREQ"]
+	if frequency != "DAILY" && frequency != "WEEKLY" {
+		add(event.start)
+		return windows
+	}
+	interval, err := strconv.Atoi(event.rule["INTERVAL"])
+	if err != nil || interval < 1 {
+		interval = 1
+	}
+	count, _ := strconv.Atoi(event.rule["COUNT"])
+	ruleUntil, _, _ := parseCalendarTime(event.rule["UNTIL"], nil, event.start.Location())
+
+	days := []int{0}
+	step := interval
+	if frequency == "WEEKLY" {
+		step = 7 * interval
+		if byDay := event.rule["BYDAY"]; byDay != "" {
+			days = nil
+			for _, day := range strings.Split(byDay, ",") {
+				if weekday, ok := calendarDays[day]; ok {
+					days = append(days, (int(weekday)-int(event.start.Weekday())+7)%7)
+				}
+			}
+			sort.Ints(days)
+		}
+	}
+
+	seen := 0
+	for period := 0; ; period++ {
+		base := event.start.AddDate(0, 0, period*step)
+		if base.After(until) || (!ruleUntil.IsZero() && base.After(ruleUntil)) {
+			return windows
+		}
+		for _, offset := range days {
+			start := base.AddDate(0, 0, offset)
+			if !ruleUntil.IsZero() && start.After(ruleUntil) {
+				return windows
+			}
+			if count > 0 && seen >= count {
+				return windows
+			}
+			seen++
+			add(start)
+		}
+	}
+}
+
+// unfoldLines joins the continuation lines of an iCal
+// calendar, which start with a space or a tab
+func unfoldLines(reader io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty splits NAME;PARAM=VALUE:VALUE
+func parseProperty(line string) (string, map[string]string, string) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), nil, ""
+	}
+	parts := strings.Split(line[:colon], ";")
+	params := make(map[string]string, len(parts)-1)
+	for _, param := range parts[1:] {
+		pair := strings.SplitN(param, "=", 2)
+		if len(pair) == 2 {
+			params[strings.ToUpper(pair[0])] = strings.Trim(pair[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:]
+}
+
+// parseCalendarTime parses a DATE-TIME in UTC, in its TZID or
+// floating in location, or a DATE, all day in location
+func parseCalendarTime(value string, params map[string]string, location *time.Location) (time.Time, bool, error) {
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		loaded, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		location = loaded
+	}
+	if strings.HasSuffix(value, "Z") {
+		parsed, err := time.Parse("20060102T150405Z", value)
+		return parsed, false, err
+	}
+	if len(value) == len("20060102") {
+		parsed, err := time.ParseInLocation("20060102", value, location)
+		return parsed, true, err
+	}
+	parsed, err := time.ParseInLocation("20060102T150405", value, location)
+	return parsed, false, err
+}
+
+func parseRule(value string) map[string]string {
+	rule := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 2 {
+			rule[strings.ToUpper(pair[0])] = strings.ToUpper(pair[1])
+		}
+	}
+	return rule
+}
+
+func unescapeText(value string) string {
+	return strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(value)
+}
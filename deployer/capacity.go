@@ -0,0 +1,114 @@
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// updateOrderLabel is "start-first" on services whose update config
+// starts the new tasks before stopping the old ones. The docker api
+// the deployer speaks does not expose the update order, so such
+// services declare it for the capacity check
+const updateOrderLabel = "octoblu.beekeeper.updateOrder"
+
+// capacityError is returned by checkCapacity when the cluster
+// has no room for the tasks the rollout starts at once
+type capacityError struct {
+	needed, fits uint64
+}
+
+func (err *capacityError) Error() string {
+	return fmt.Sprintf("The rollout starts %d tasks at once but the free capacity of the cluster only fits %d", err.needed, err.fits)
+}
+
+// checkCapacity returns a capacityError when the rollout of a
+// replicated service would leave tasks unschedulable. Start-first
+// rollouts, and those with a parallelism of at least the capacity
+// parallelism, need room for parallelism more tasks by their resource
+// reservations on the active nodes. Placement constraints are not
+// taken into account, services without reservations are not checked
+func (deployer *Deployer) checkCapacity(service swarm.Service) error {
+	if service.Spec.Mode.Replicated == nil {
+		return nil
+	}
+	reservation := taskReservation(service.Spec.TaskTemplate)
+	if reservation.NanoCPUs <= 0 && reservation.MemoryBytes <= 0 {
+		return nil
+	}
+	parallelism := getUpdateParallelism(service)
+	startFirst := service.Spec.Labels[updateOrderLabel] == "start-first"
+	large := deployer.capacityParallelism > 0 && parallelism >= uint64(deployer.capacityParallelism)
+	if !startFirst && !large {
+		return nil
+	}
+
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	nodes, err := deployer.dockerClient.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return deployer.dockerError(ctx, "NodeList", err)
+	}
+	filter := filters.NewArgs()
+	filter.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return deployer.dockerError(ctx, "TaskList", err)
+	}
+
+	used := make(map[string]swarm.Resources)
+	for _, task := range tasks {
+		taken := taskReservation(task.Spec)
+		nodeUsed := used[task.NodeID]
+		nodeUsed.NanoCPUs += taken.NanoCPUs
+		nodeUsed.MemoryBytes += taken.MemoryBytes
+		used[task.NodeID] = nodeUsed
+	}
+
+	var fits uint64
+	for _, node := range nodes {
+		if node.Spec.Availability != swarm.NodeAvailabilityActive || node.Status.State == swarm.NodeStateDown {
+			continue
+		}
+		capacity := node.Description.Resources
+		free := swarm.Resources{
+			NanoCPUs:    capacity.NanoCPUs - used[node.ID].NanoCPUs,
+			MemoryBytes: capacity.MemoryBytes - used[node.ID].MemoryBytes,
+		}
+		fits += tasksFitting(free, reservation)
+		if fits >= parallelism {
+			return nil
+		}
+	}
+	deployer.debug("%s needs room for %d tasks, the cluster fits %d", service.ID, parallelism, fits)
+	return &capacityError{needed: parallelism, fits: fits}
+}
+
+// taskReservation returns the resources a task reserves, none
+// when it has no reservations
+func taskReservation(spec swarm.TaskSpec) swarm.Resources {
+	if spec.Resources == nil || spec.Resources.Reservations == nil {
+		return swarm.Resources{}
+	}
+	return *spec.Resources.Reservations
+}
+
+// tasksFitting returns how many tasks of the reservation fit in free
+func tasksFitting(free, reservation swarm.Resources) uint64 {
+	fits := int64(-1)
+	if reservation.NanoCPUs > 0 {
+		fits = free.NanoCPUs / reservation.NanoCPUs
+	}
+	if reservation.MemoryBytes > 0 {
+		byMemory := free.MemoryBytes / reservation.MemoryBytes
+		if fits < 0 || byMemory < fits {
+			fits = byMemory
+		}
+	}
+	if fits < 0 {
+		return 0
+	}
+	return uint64(fits)
+}
@@ -0,0 +1,82 @@
+package deployer
+
+import (
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/mount"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// cleanupImage removes image from every node once a rollout
+// replaced it. The manager cannot reach the daemons of the other
+// nodes, so a global service running the docker cli against each
+// node's socket does it, and is removed once its tasks are done.
+// An image still used by a container is left alone by docker
+func (deployer *Deployer) cleanupImage(requestID, image string) {
+	if deployer.cleanupRunnerImage == "" || image == "" {
+		return
+	}
+
+	spec := swarm.ServiceSpec{
+		Mode: swarm.ServiceMode{Global: &swarm.GlobalService{}},
+	}
+	spec.Name = "beekeeper-image-cleanup-" + newRequestID()
+	spec.Labels = map[string]string{"octoblu.beekeeper.cleanup": image}
+	spec.TaskTemplate.ContainerSpec = swarm.ContainerSpec{
+		Image: deployer.cleanupRunnerImage,
+		Args:  []string{"docker", "image", "rm", image},
+		Mounts: []mount.Mount{{
+			Type:   mount.TypeBind,
+			Source: "/var/run/docker.sock",
+			Target: "/var/run/docker.sock",
+		}},
+	}
+	spec.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionNone}
+
+	ctx, cancel := deployer.dockerContext()
+	response, err := deployer.dockerClient.ServiceCreate(ctx, spec, types.ServiceCreateOptions{})
+	err = deployer.dockerError(ctx, "ServiceCreate", err)
+	cancel()
+	if err != nil {
+		debug("[%s] could not start the cleanup of %s: %v", requestID, image, err)
+		countMetric("image_cleanup_errors")
+		return
+	}
+	debug("[%s] removing %s from the nodes with %s", requestID, image, spec.Name)
+	countMetric("image_cleanups")
+
+	deadline := deployer.clock.Now().Add(deployer.deployTimeout)
+	for deployer.clock.Now().Before(deadline) {
+		deployer.clock.Sleep(rolloutPollInterval)
+		if deployer.cleanupDone(response.ID) {
+			break
+		}
+	}
+
+	ctx, cancel = deployer.dockerContext()
+	defer cancel()
+	if err := deployer.dockerClient.ServiceRemove(ctx, response.ID); err != nil {
+		debug("[%s] could not remove cleanup service %s: %v", requestID, spec.Name, deployer.dockerError(ctx, "ServiceRemove", err))
+	}
+}
+
+// cleanupDone returns true when every task of
+// the cleanup service has stopped, one way or another
+func (deployer *Deployer) cleanupDone(serviceID string) bool {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	filter := filters.NewArgs()
+	filter.Add("service", serviceID)
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil || len(tasks) == 0 {
+		return false
+	}
+	for _, task := range tasks {
+		switch task.Status.State {
+		case swarm.TaskStateComplete, swarm.TaskStateFailed, swarm.TaskStateRejected, swarm.TaskStateShutdown:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package deployer
+
+import "time"
+
+// Clock tells the deployer the time and makes it wait, so tests
+// and simulated runs can move time instead of waiting for it
+type Clock interface {
+	Now() time.Time
+	Sleep(duration time.Duration)
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(duration time.Duration) {
+	time.Sleep(duration)
+}
+
+// since returns the time elapsed on the clock of the deployer
+func (deployer *Deployer) since(at time.Time) time.Duration {
+	return deployer.clock.Now().Sub(at)
+}
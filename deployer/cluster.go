@@ -0,0 +1,86 @@
+package deployer
+
+import "sort"
+
+// ForCluster returns a deployer of another swarm with the options
+// of this one. It shares the beekeeper client, credentials, latest
+// deployment cache, update and latency budgets, freeze calendar, alert
+// endpoints and api pause of this deployer, so
+// adding a swarm does not multiply the lookups or updates. Its cycles
+// run independently, each swarm keeps its own service states
+func (deployer *Deployer) ForCluster(cluster string, dockerClient DockerClient) *Deployer {
+	options := deployer.options
+	options.Cluster = cluster
+	options.KafkaRESTURL = ""
+	options.UserAgentSuffix = ""
+	sibling := newDeployer(dockerClient, &options)
+	sibling.parent = deployer.root()
+	sibling.httpClient = deployer.httpClient
+	sibling.tokenSource = deployer.tokenSource
+	sibling.deployments = deployer.deployments
+	sibling.updateBudget = deployer.updateBudget
+	sibling.latencyBudget = deployer.latencyBudget
+	sibling.freezeCalendar = deployer.freezeCalendar
+	sibling.policies = deployer.policies
+	sibling.notifications = deployer.notifications
+	sibling.flapDetector = deployer.flapDetector
+	sibling.shard = deployer.shard
+	sibling.knownDeployments = deployer.knownDeployments
+	sibling.scanReports = deployer.scanReports
+	sibling.stateStore = deployer.stateStore
+	sibling.deployRecords = deployer.deployRecords
+	sibling.kafka = deployer.kafka
+	sibling.countersSince = deployer.countersSince
+
+	root := deployer.root()
+	root.siblingsLock.Lock()
+	defer root.siblingsLock.Unlock()
+	root.siblings = append(root.siblings, sibling)
+	return sibling
+}
+
+// ClusterStatus is the last decision for every
+// tracked service of one swarm
+type ClusterStatus struct {
+	Cluster  string         `json:"cluster"`
+	Services []ServiceState `json:"services"`
+}
+
+// Clusters returns the status of this swarm followed
+// by the ones added with ForCluster, sorted by name
+func (deployer *Deployer) Clusters() []ClusterStatus {
+	root := deployer.root()
+	root.siblingsLock.Lock()
+	siblings := append([]*Deployer{}, root.siblings...)
+	root.siblingsLock.Unlock()
+
+	sort.Slice(siblings, func(i, j int) bool {
+		return siblings[i].clusterLabel() < siblings[j].clusterLabel()
+	})
+	clusters := []ClusterStatus{{Cluster: root.clusterLabel(), Services: root.Services()}}
+	for _, sibling := range siblings {
+		clusters = append(clusters, ClusterStatus{Cluster: sibling.clusterLabel(), Services: sibling.Services()})
+	}
+	return clusters
+}
+
+// Cluster returns the name of the swarm of the deployer
+func (deployer *Deployer) Cluster() string {
+	return deployer.cluster
+}
+
+// root is the deployer the shared state is kept on
+func (deployer *Deployer) root() *Deployer {
+	if deployer.parent != nil {
+		return deployer.parent
+	}
+	return deployer
+}
+
+// clusterLabel names the swarm of the deployer in per-cluster metrics
+func (deployer *Deployer) clusterLabel() string {
+	if deployer.cluster == "" {
+		return "default"
+	}
+	return deployer.cluster
+}
@@ -0,0 +1,90 @@
+package deployer
+
+import (
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// ClusterState is the live state of the tracked services of a swarm,
+// what beekeeper or a dashboard pulls instead of waiting for callbacks
+type ClusterState struct {
+	Cluster        string          `json:"cluster,omitempty"`
+	Environment    string          `json:"environment,omitempty"`
+	Timestamp      time.Time       `json:"timestamp"`
+	ReasonsVersion int             `json:"reasonsVersion"`
+	Services       []ServiceStatus `json:"services"`
+}
+
+// ServiceStatus is the live state of a tracked service with the last
+// decision about it. Replicas is the desired count, nil for a global
+// service, Rollout the progress of the rollout the updater watches
+type ServiceStatus struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Owner         string           `json:"owner,omitempty"`
+	Repo          string           `json:"repo,omitempty"`
+	Image         string           `json:"image"`
+	LatestImage   string           `json:"latestImage,omitempty"`
+	Replicas      *uint64          `json:"replicas,omitempty"`
+	UpdateState   string           `json:"updateState,omitempty"`
+	UpdateMessage string           `json:"updateMessage,omitempty"`
+	Rollout       *RolloutProgress `json:"rollout,omitempty"`
+	Reason        Reason           `json:"reason,omitempty"`
+	Outcome       Outcome          `json:"outcome,omitempty"`
+	CheckedAt     *time.Time       `json:"checkedAt,omitempty"`
+}
+
+// ClusterState lists the tracked services, through the service cache
+// when events are watched, with their last decision and rollout
+func (deployer *Deployer) ClusterState() (ClusterState, error) {
+	services, err := deployer.listServices()
+	if err != nil {
+		return ClusterState{}, err
+	}
+	state := ClusterState{
+		Cluster:        deployer.cluster,
+		Environment:    deployer.environment,
+		Timestamp:      deployer.clock.Now(),
+		ReasonsVersion: ReasonsVersion,
+		Services:       make([]ServiceStatus, 0, len(services)),
+	}
+	for _, service := range services {
+		state.Services = append(state.Services, deployer.serviceStatus(service))
+	}
+	return state, nil
+}
+
+func (deployer *Deployer) serviceStatus(service swarm.Service) ServiceStatus {
+	status := ServiceStatus{
+		ID:            service.ID,
+		Name:          service.Spec.Name,
+		Image:         getCurrentDockerURL(service),
+		UpdateState:   string(service.UpdateStatus.State),
+		UpdateMessage: service.UpdateStatus.Message,
+	}
+	status.Owner, status.Repo = deployer.getBeekeeperProject(service)
+	if replicated := service.Spec.Mode.Replicated; replicated != nil && replicated.Replicas != nil {
+		replicas := *replicated.Replicas
+		status.Replicas = &replicas
+	}
+
+	deployer.statesLock.Lock()
+	decision, ok := deployer.states[service.ID]
+	deployer.statesLock.Unlock()
+	if ok {
+		status.LatestImage = decision.LatestImage
+		status.Reason = decision.Reason
+		status.Outcome = decision.Reason.Outcome()
+		checkedAt := decision.CheckedAt
+		status.CheckedAt = &checkedAt
+	}
+
+	deployer.rolloutsLock.Lock()
+	progress, ok := deployer.progress[service.ID]
+	deployer.rolloutsLock.Unlock()
+	if ok {
+		status.Rollout = &progress
+	}
+	return status
+}
@@ -0,0 +1,106 @@
+package deployer
+
+import (
+	"expvar"
+	"time"
+)
+
+// persistedCounterNames are the counters kept in the state file,
+// so dashboards do not drop to zero when the updater is redeployed
+var persistedCounterNames = []string{
+	"deploys",
+	"rollouts_converged",
+	"rollouts_failed",
+	"rollouts_timed_out",
+}
+
+// persistedLabeledCounterNames are the labeled counters kept
+var persistedLabeledCounterNames = []string{
+	"service_deploys",
+	"service_failures",
+}
+
+// persistedCounters are the counters in the state file. Since is
+// when they last started from zero, for rate calculations
+type persistedCounters struct {
+	Since   time.Time                   `json:"since"`
+	Plain   map[string]int64            `json:"plain"`
+	Labeled map[string]map[string]int64 `json:"labeled"`
+}
+
+var processStart = time.Now()
+
+func init() {
+	metrics.Set("process_start_time_seconds", expvarInt(processStart.Unix()))
+}
+
+func expvarInt(value int64) *expvar.Int {
+	variable := new(expvar.Int)
+	variable.Set(value)
+	return variable
+}
+
+// restoreCounters adds the counters of the state file to the
+// metrics of this process and publishes when they started from
+// zero as counters_reset_time_seconds. Without a state file that
+// is the start of the process
+func (deployer *Deployer) restoreCounters() {
+	since := processStart
+	defer func() {
+		metrics.Set("counters_reset_time_seconds", expvarInt(since.Unix()))
+	}()
+	if deployer.stateStore == nil {
+		return
+	}
+	state, err := deployer.stateStore.load()
+	if err != nil {
+		debug("could not load the counters from the state file: %v", err)
+		return
+	}
+	if state.Counters == nil {
+		return
+	}
+	since = state.Counters.Since
+	deployer.countersSince = since
+	for name, value := range state.Counters.Plain {
+		metrics.Add(name, value)
+	}
+	for name, labels := range state.Counters.Labeled {
+		for label, value := range labels {
+			labeledMetric(name).Add(label, value)
+		}
+	}
+}
+
+// saveCounters writes the current counters to the state file
+func (deployer *Deployer) saveCounters() {
+	if deployer.stateStore == nil {
+		return
+	}
+	counters := &persistedCounters{
+		Since:   deployer.countersSince,
+		Plain:   make(map[string]int64),
+		Labeled: make(map[string]map[string]int64),
+	}
+	for _, name := range persistedCounterNames {
+		if value, ok := metrics.Get(name).(*expvar.Int); ok {
+			counters.Plain[name] = value.Value()
+		}
+	}
+	for _, name := range persistedLabeledCounterNames {
+		labels := make(map[string]int64)
+		labeledMetric(name).Do(func(label expvar.KeyValue) {
+			if value, ok := label.Value.(*expvar.Int); ok {
+				labels[label.Key] = value.Value()
+			}
+		})
+		counters.Labeled[name] = labels
+	}
+	err := deployer.stateStore.update(func(state *persistedState) {
+		state.Counters = counters
+	})
+	if err != nil {
+		countMetric("state_file_errors")
+		debug("could not save the counters to the state file: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package deployer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/docker/engine-api/types"
+)
+
+// SetBeekeeperCredentials replaces the basic auth credentials
+// sent to beekeeper, e.g. after they were rotated in vault
+func (deployer *Deployer) SetBeekeeperCredentials(username, password string) {
+	root := deployer.root()
+	root.credentialsLock.Lock()
+	defer root.credentialsLock.Unlock()
+	root.beekeeperUsername = username
+	root.beekeeperPassword = password
+}
+
+// SetRegistryAuth sets the registry credentials sent along
+// with every service update, so the nodes can pull private images
+func (deployer *Deployer) SetRegistryAuth(auth types.AuthConfig) error {
+	encoded, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	root := deployer.root()
+	root.credentialsLock.Lock()
+	defer root.credentialsLock.Unlock()
+	root.registryAuth = base64.URLEncoding.EncodeToString(encoded)
+	return nil
+}
+
+func (deployer *Deployer) beekeeperCredentials() (string, string) {
+	root := deployer.root()
+	root.credentialsLock.RLock()
+	defer root.credentialsLock.RUnlock()
+	return root.beekeeperUsername, root.beekeeperPassword
+}
+
+func (deployer *Deployer) encodedRegistryAuth() string {
+	root := deployer.root()
+	root.credentialsLock.RLock()
+	defer root.credentialsLock.RUnlock()
+	return root.registryAuth
+}
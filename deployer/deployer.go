@@ -1,21 +1,22 @@
 package deployer
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"net/url"
+	"runtime"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	"golang.org/x/net/context"
-
-	"github.com/docker/engine-api/client"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/engine-api/types"
-	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/engine-api/types/swarm"
 	De "github.com/tj/go-debug"
+	"golang.org/x/time/rate"
 )
 
 var debug = De.Debug("beekeeper-updater-swarm:deployer")
@@ -23,208 +24,1170 @@ var debug = De.Debug("beekeeper-updater-swarm:deployer")
 // Deployer watches a redis queue
 // and deploys services using Etcd
 type Deployer struct {
-	dockerClient client.APIClient
-	beekeeperURI string
-	tags         string
+	options             Options
+	clock               Clock
+	parent              *Deployer
+	siblings            []*Deployer
+	dockerClient        DockerClient
+	faults              *faultInjector
+	beekeeperURI        string
+	beekeeperUsername   string
+	beekeeperPassword   string
+	beekeeperEventsURL  string
+	registryAuth        string
+	tags                string
+	beekeeperInstances  map[string]BeekeeperInstance
+	beekeeperURIHosts   map[string]bool
+	deploymentPath      *template.Template
+	userAgent           string
+	cluster             string
+	environment         string
+	requestID           string
+	dockerTimeout       time.Duration
+	deployTimeout       time.Duration
+	httpClient          *http.Client
+	tokenSource         *tokenSource
+	updateLabelValues   []string
+	listedServices      map[string]bool
+	selectors           []string
+	allowedRegistries   []string
+	requireProvenance   bool
+	verifyImageRevision bool
+	revisions           map[string]string
+	notifications       *notifications
+	rollbackHoldDown    time.Duration
+	kafka               *kafkaProducer
+	stuckAfter          time.Duration
+	retireGrace         time.Duration
+	minUpdateInterval   time.Duration
+	unparsableUpdated   string
+	stuckAction         string
+	updating            map[string]time.Time
+	stuckAlerted        map[string]bool
+	updatingLock        sync.Mutex
+	stateStore          *stateStore
+	deployRecords       *deployRecords
+	knownDeployments    *knownDeployments
+	deployLastKnownGood bool
+	scanURL             *template.Template
+	scanSeverityDefault string
+	scanReports         *scanReports
+	countersSince       time.Time
+	waveNodeLabel       string
+	waveSize            int
+	minHealthy          float64
+	capacityParallelism int
+	ownerLabel          string
+	pagerDutyURL        string
+	statusPath          string
+	bumpScaledToZero    bool
+	auditLog            string
+	failureLogLines     int
+	logReader           LogReader
+	cleanupRunnerImage  string
+	imageMappings       []imageMapping
+	registryMirrors     []imageMapping
+	cache               *serviceCache
+	deployments         *deploymentCache
+	updateBudget        *rate.Limiter
+	latencyBudget       *latencyBudget
+	deployWindows       []Window
+	blackouts           []Window
+	ignoreWindows       bool
+	trains              map[string]Train
+	freezeCalendar      *freezeCalendar
+	policies            *policyConfig
+	flapDetector        *flapDetector
+	shard               *shard
+	rollouts            map[string]bool
+	waveRollouts        map[string]string
+	progress            map[string]RolloutProgress
+	subscribers         map[chan RolloutProgress]bool
+	states              map[string]ServiceState
+	pending             map[string]PendingUpdate
+	eligibleAt          time.Time
+	trace               io.Writer
+	dryRun              bool
+	snapshot            BeekeeperSnapshot
+	batches             map[deploymentKey][]swarm.Service
+	observing           bool
+	differential        bool
+	untracked           map[deploymentKey]*untrackedProject
+	untrackedBackoff    time.Duration
+	pause               PauseState
+	swarmPause          PauseState
+	statesLock          sync.Mutex
+	credentialsLock     sync.RWMutex
+	rolloutsLock        sync.Mutex
+	auditLock           sync.Mutex
+	pauseLock           sync.Mutex
+	untrackedLock       sync.Mutex
+	pendingLock         sync.Mutex
+	revisionsLock       sync.Mutex
+	siblingsLock        sync.Mutex
+}
+
+// Options configures a Deployer
+type Options struct {
+	// BeekeeperURI is the base uri of the beekeeper service,
+	// it may include basic auth credentials
+	BeekeeperURI string
+
+	// BeekeeperUsername and BeekeeperPassword are sent as basic auth,
+	// taking precedence over credentials embedded in BeekeeperURI
+	BeekeeperUsername string
+	BeekeeperPassword string
+
+	// BeekeeperEventsURL is a ws:// or wss:// url beekeeper publishes
+	// a DeploymentEvent on for every build, see SubscribeDeployments
+	BeekeeperEventsURL string
+
+	// Tags are used to filter beekeeper deployments
+	Tags string
+
+	// BeekeeperInstances are the beekeepers other than the default
+	// one, keyed by the octoblu.beekeeper.instance label value
+	// that routes a service to them
+	BeekeeperInstances map[string]BeekeeperInstance
+
+	// BeekeeperURIHosts are the hosts, as host or host:port, an
+	// octoblu.beekeeper.uri label may send the credentials of the
+	// beekeeper instance to. Other hosts get no credentials
+	BeekeeperURIHosts []string
+
+	// DeploymentPath is appended to the beekeeper uri to look up the
+	// latest deployment of a project, see ParseDeploymentPath.
+	// Defaults to /deployments/{{.Owner}}/{{.Repo}}/latest
+	DeploymentPath *template.Template
+
+	// BeekeeperMaxConns limits the pooled connections to beekeeper,
+	// defaults to 10
+	BeekeeperMaxConns int
+
+	// OAuthTokenURL enables the oauth2 client credentials grant,
+	// the bearer token replaces basic auth on beekeeper requests
+	OAuthTokenURL     string
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthScopes       []string
+
+	// BeekeeperClientCert and BeekeeperClientKey are pem files
+	// presented to beekeeper for mutual tls, they are reread
+	// on every new connection
+	BeekeeperClientCert string
+	BeekeeperClientKey  string
+
+	// BeekeeperCACert is a pem file of the certificate authorities
+	// the certificate of beekeeper is verified with, instead of the
+	// ones of the system, e.g. the internal ca of mutual tls
+	BeekeeperCACert string
+
+	// BeekeeperHTTP2 enables http2 when beekeeper supports it
+	BeekeeperHTTP2 bool
+
+	// UserAgent is sent with every beekeeper request, followed by
+	// UserAgentSuffix or else the name of the cluster
+	UserAgent       string
+	UserAgentSuffix string
+
+	// Cluster and Environment tell this deployer apart from the
+	// ones of other swarms, they are published with the metrics and
+	// sent with alerts, hooks, heartbeats and beekeeper requests
+	Cluster     string
+	Environment string
+
+	// Faults are injected into the calls to beekeeper and docker,
+	// to test alerting and recovery in staging. Nil injects none
+	Faults *Faults
+
+	// DockerRateLimit is how many docker api calls per second the
+	// updater makes to a swarm, with bursts of DockerRateBurst,
+	// default 1. Zero does not limit them
+	DockerRateLimit float64
+	DockerRateBurst int
+
+	// DockerTimeout bounds each docker api call,
+	// defaults to 30 seconds
+	DockerTimeout time.Duration
+
+	// DeployTimeout is how long a rollout may take to converge,
+	// services can override it with octoblu.beekeeper.deployTimeout.
+	// Defaults to 5 minutes
+	DeployTimeout time.Duration
+
+	// UpdateLabelValues are the octoblu.beekeeper.update label values
+	// that opt a service into deploys, defaults to "true".
+	// "report" and "pinned" are always understood as modes
+	UpdateLabelValues []string
+
+	// Services are service names or ids treated as if they carried
+	// octoblu.beekeeper.update with the first UpdateLabelValues value,
+	// for swarms where labels cannot be added to existing services.
+	// A label on the service still takes precedence
+	Services []string
+
+	// Selectors further restrict the managed services, a service must
+	// match all of them. Each is either "label" or "label=value"
+	Selectors []string
+
+	// AllowedRegistries are the only registries images may be
+	// deployed from, "docker.io" for docker hub. Empty allows any
+	AllowedRegistries []string
+
+	// RequireProvenance refuses deployments without a commit sha
+	// and pipeline id. VerifyImageRevision also requires the
+	// org.opencontainers.image.revision label of the image, read
+	// from its registry, to be that commit
+	RequireProvenance   bool
+	VerifyImageRevision bool
+
+	// ScanURL is the trivy json report of an image, see ParseScanURL.
+	// Images with vulnerabilities of ScanSeverity, CRITICAL by
+	// default, or higher are not deployed, nor images without a
+	// report. The octoblu.beekeeper.scanSeverity label of a service
+	// overrides the severity, "off" skips the gate. Nil disables it
+	ScanURL      *template.Template
+	ScanSeverity string
+
+	// BumpScaledToZero sets the latest image on services scaled to
+	// zero without rolling it out, so they start on it when scaled
+	// up. Otherwise they are skipped
+	BumpScaledToZero bool
+
+	// StatusPath is the path on the beekeeper of a service a
+	// RolloutStatus is posted to when a rollout ends. Empty disables
+	StatusPath string
+
+	// AlertWebhook receives an Alert as json when something
+	// needs a human, e.g. an image from a registry not allowed.
+	// It and PagerDutyRoutingKeys may be replaced while running
+	// with SetNotifications
+	AlertWebhook string
+
+	// BeekeeperLatencyBudget and BeekeeperErrorBudget are the p95
+	// latency and error rate, from 0 to 1, the beekeeper lookups of
+	// BeekeeperBudgetWindow may reach before PollInterval lengthens
+	// and a beekeeper-over-budget alert is sent. Zero disables each,
+	// the window defaults to 10 minutes
+	BeekeeperLatencyBudget time.Duration
+	BeekeeperErrorBudget   float64
+	BeekeeperBudgetWindow  time.Duration
+
+	// FlapWindow holds the updates of a project whose latest
+	// deployment changed FlapChanges times, 3 by default, within
+	// it, back and forth between images, e.g. two ci pipelines
+	// deploying over each other, until it stops. Zero disables it
+	FlapWindow  time.Duration
+	FlapChanges int
+
+	// RollbackHoldDown is how long an image that was rolled back,
+	// by hand or by the updater, is not deployed to the service
+	// again even if beekeeper still has it. Zero disables it
+	RollbackHoldDown time.Duration
+
+	// KafkaRESTURL is the rest proxy of a kafka cluster deploys,
+	// rollout outcomes and skips are published to as ExportEvents
+	KafkaRESTURL string
+
+	// KafkaTopic is the topic events are published to
+	KafkaTopic string
+
+	// StuckAfter is how long a service may be updating before its
+	// update counts as stuck, e.g. because its tasks cannot be
+	// scheduled, and is alerted on. Zero disables it
+	StuckAfter time.Duration
+
+	// DeployLastKnownGood deploys the last answer of beekeeper kept
+	// in the state file while beekeeper is unavailable, so services
+	// reverted by hand meanwhile converge back to it
+	DeployLastKnownGood bool
+
+	// MinUpdateInterval is how long after a deploy a service is not
+	// updated again, newer deployments wait for it. Zero disables it
+	MinUpdateInterval time.Duration
+
+	// UnparsableUpdatedAt is UnparsableIgnore, the default,
+	// or UnparsableHold
+	UnparsableUpdatedAt string
+
+	// RetireGrace is how long after beekeeper retired a project its
+	// services are taken down, their owners are alerted meanwhile
+	RetireGrace time.Duration
+
+	// StuckAction is what is done about a stuck update besides the
+	// alert, StuckActionRollback or nothing
+	StuckAction string
+
+	// StateFile is where the updater remembers state across
+	// restarts, e.g. the cumulative deploy and failure counters and
+	// the last answer of beekeeper for each project, which tells
+	// the drift of services while beekeeper is unavailable
+	StateFile string
+
+	// NoBookkeepingLabels keeps the lastDockerURL, lastUpdatedAt and
+	// previousDockerURL of a deploy in the state file instead of
+	// service labels, for swarms where the spec must not churn.
+	// It requires StateFile
+	NoBookkeepingLabels bool
+
+	// ObserveFirstCycle only records what the first cycle would
+	// deploy, so an updater restarted with a manager does not
+	// update services while the swarm is still settling
+	ObserveFirstCycle bool
+
+	// WaveNodeLabel is the node label grouping nodes into racks.
+	// When set global services are rolled out in waves of nodes,
+	// the nodes of later waves are paused until the earlier ones
+	// run the new image, so a rack never loses all its nodes at once
+	WaveNodeLabel string
+
+	// WaveSize is the number of nodes in a wave,
+	// by default one node of every rack
+	WaveSize int
+
+	// MinHealthy is the fraction of the replicas of a service that
+	// must be running before it is updated, e.g. 0.5. A degraded
+	// service is held back and alerted on. The minHealthy label
+	// overrides it per service, zero disables the check
+	MinHealthy float64
+
+	// CapacityParallelism is the update parallelism from which a
+	// rollout is deferred when the free capacity of the cluster does
+	// not fit the tasks it starts at once, like start-first rollouts
+	// always are. Zero only checks start-first rollouts
+	CapacityParallelism int
+
+	// OwnerLabel is the service label naming the team that owns
+	// it, sent with alerts and used to route them to PagerDuty.
+	// Defaults to octoblu.beekeeper.team, octoblu.beekeeper.owner
+	// is the beekeeper owner of the service's project
+	OwnerLabel string
+
+	// PagerDutyRoutingKeys route alerts to the PagerDuty Events
+	// API, each is "owner=routing key". The key of owner "*"
+	// receives the alerts of services without a routed owner
+	PagerDutyRoutingKeys []string
+
+	// PagerDutyURL overrides the PagerDuty Events API url
+	PagerDutyURL string
+
+	// AuditLog is a file every deploy and rollout outcome
+	// is appended to as a json line, see ReadAuditLog
+	AuditLog string
+
+	// FailureLogLines is how many of the last lines the failed tasks
+	// of a rollout logged are read with LogReader and attached to
+	// the failures in the audit log, the rollout status and the
+	// alert. Zero does not read them
+	FailureLogLines int
+	LogReader       LogReader
+
+	// ImageMappings rewrite image names before they are split into
+	// the beekeeper owner/repo, each is "prefix=replacement", e.g.
+	// "registry.example.com:5000/mirror/=octoblu/"
+	ImageMappings []string
+
+	// RegistryMirrors rewrite the docker urls from beekeeper before
+	// they are deployed, so nodes pull from a mirror. Each is
+	// "source=mirror", e.g. "docker.io/*=mirror.internal:5000/*"
+	RegistryMirrors []string
+
+	// WatchEvents keeps an in-memory cache of the services
+	// up to date from docker events instead of listing them each cycle
+	WatchEvents bool
+
+	// DeployWindows are the only times services are updated,
+	// none means any time. Blackouts are times they never are.
+	// IgnoreWindows overrides both, e.g. for an urgent fix
+	DeployWindows []Window
+	Blackouts     []Window
+	IgnoreWindows bool
+
+	// Trains are the release trains services join with the
+	// octoblu.beekeeper.releaseTrain label, they must be valid
+	Trains []Train
+
+	// PolicyConfig is the name of the swarm config, read with
+	// PolicyReader, that holds the Policies of tracked services. It is
+	// read again every PolicyRefresh, a minute by default
+	PolicyConfig  string
+	PolicyReader  ConfigReader
+	PolicyRefresh time.Duration
+
+	// FreezeCalendarURL is an iCal calendar, e.g. the secret address
+	// of a google calendar, whose events are blackouts. It is fetched
+	// every FreezeCalendarRefresh, 15 minutes by default
+	FreezeCalendarURL     string
+	FreezeCalendarRefresh time.Duration
+
+	// CleanupRunnerImage enables removing the replaced image from
+	// every node after a rollout converges, it is the image of the
+	// global service that runs docker image rm on each node
+	CleanupRunnerImage string
+
+	// UpdatesPerHour caps the service updates started in any hour,
+	// refilling gradually. Zero means no limit
+	UpdatesPerHour int
+
+	// BeekeeperCacheTTL is how long the latest deployment of a
+	// project is reused before beekeeper is asked again, a published
+	// deployment event drops it early. Zero disables the cache
+	BeekeeperCacheTTL time.Duration
+
+	// Differential reuses the last decision for services whose spec
+	// did not change, as long as the beekeeper answer it was based on
+	// is still in the deployment cache, see BeekeeperCacheTTL
+	Differential bool
+
+	// UntrackedBackoff is how long lookups of a project beekeeper
+	// does not know are skipped, doubling up to 6 hours while it
+	// stays unknown. Defaults to 10 minutes
+	UntrackedBackoff time.Duration
+
+	// ResyncInterval is how often the cache is replaced
+	// by a full service list, defaults to 10 minutes
+	ResyncInterval time.Duration
+
+	// Clock is the time windows, backoffs, hold-downs, rollout
+	// polling and the stamps on services follow, the wall clock
+	// by default. Docker and beekeeper timeouts and rate limits
+	// always follow the wall clock
+	Clock Clock
 }
 
 // RequestMetadata is the metadata of the request
 type RequestMetadata struct {
+	// ID is the id of the deployment in beekeeper
+	ID string `json:"id,omitempty"`
+
 	DockerURL string `json:"docker_url"`
+
+	// DeployAfter holds the deployment back until then
+	DeployAfter *time.Time `json:"deploy_after,omitempty"`
+
+	// Migration runs before the service is updated
+	Migration *Migration `json:"migration,omitempty"`
+
+	// Provenance is the ci build of the image
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// Pinned is set when a release manager pinned this version in
+	// beekeeper, which answers with it until it is unpinned, even
+	// if newer deployments are made. It may be an older version
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Ports are published with the update, so a
+	// port the version adds is reachable right away
+	Ports []PublishedPort `json:"ports,omitempty"`
+
+	// Retired is set instead of a docker url once the
+	// project is decommissioned, see Retirement
+	Retired *Retirement `json:"retired,omitempty"`
 }
 
 // New constructs a new deployer instance
-func New(dockerClient client.APIClient, beekeeperURI, tags string) *Deployer {
+func New(dockerClient DockerClient, options *Options) *Deployer {
+	setIdentity(options.Cluster, options.Environment)
+	deployer := newDeployer(dockerClient, options)
+	deployer.restoreCounters()
+	deployer.restoreDeployRecords()
+	deployer.restoreKnownDeployments()
+	return deployer
+}
+
+func newDeployer(dockerClient DockerClient, options *Options) *Deployer {
+	dockerTimeout := options.DockerTimeout
+	if dockerTimeout <= 0 {
+		dockerTimeout = 30 * time.Second
+	}
+	deployTimeout := options.DeployTimeout
+	if deployTimeout <= 0 {
+		deployTimeout = 5 * time.Minute
+	}
+	updateLabelValues := options.UpdateLabelValues
+	if len(updateLabelValues) == 0 {
+		updateLabelValues = []string{"true"}
+	}
+	listedServices := make(map[string]bool, len(options.Services))
+	for _, name := range options.Services {
+		listedServices[name] = true
+	}
+	clock := options.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	var cache *serviceCache
+	if options.WatchEvents {
+		cache = newServiceCache(options.ResyncInterval, clock)
+	}
+	deploymentPath := options.DeploymentPath
+	if deploymentPath == nil {
+		deploymentPath = template.Must(ParseDeploymentPath(defaultDeploymentPath))
+	}
+	beekeeperURIHosts := make(map[string]bool)
+	for _, host := range options.BeekeeperURIHosts {
+		beekeeperURIHosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	untrackedBackoff := options.UntrackedBackoff
+	if untrackedBackoff <= 0 {
+		untrackedBackoff = 10 * time.Minute
+	}
+	var updateBudget *rate.Limiter
+	if options.UpdatesPerHour > 0 {
+		updateBudget = rate.NewLimiter(rate.Every(time.Hour/time.Duration(options.UpdatesPerHour)), options.UpdatesPerHour)
+	}
+	ownerLabel := options.OwnerLabel
+	if ownerLabel == "" {
+		ownerLabel = defaultOwnerLabel
+	}
+	pagerDutyURL := options.PagerDutyURL
+	if pagerDutyURL == "" {
+		pagerDutyURL = pagerDutyEventsURL
+	}
+	httpClient := newHTTPClient(options)
+	scanSeverity := strings.ToUpper(options.ScanSeverity)
+	if scanSeverity == "" {
+		scanSeverity = "CRITICAL"
+	}
+	faults := newFaultInjector(options)
 	return &Deployer{
-		dockerClient: dockerClient,
-		beekeeperURI: beekeeperURI,
-		tags:         tags,
+		options:             *options,
+		clock:               clock,
+		dockerClient:        rateLimitDocker(injectDockerFaults(dockerClient, faults), options),
+		faults:              faults,
+		beekeeperURI:        options.BeekeeperURI,
+		beekeeperUsername:   options.BeekeeperUsername,
+		beekeeperPassword:   options.BeekeeperPassword,
+		beekeeperEventsURL:  options.BeekeeperEventsURL,
+		tags:                options.Tags,
+		beekeeperInstances:  options.BeekeeperInstances,
+		beekeeperURIHosts:   beekeeperURIHosts,
+		deploymentPath:      deploymentPath,
+		userAgent:           userAgent(options),
+		cluster:             options.Cluster,
+		environment:         options.Environment,
+		dockerTimeout:       dockerTimeout,
+		deployTimeout:       deployTimeout,
+		httpClient:          httpClient,
+		tokenSource:         newTokenSource(options, httpClient),
+		updateLabelValues:   updateLabelValues,
+		listedServices:      listedServices,
+		selectors:           options.Selectors,
+		allowedRegistries:   options.AllowedRegistries,
+		requireProvenance:   options.RequireProvenance,
+		verifyImageRevision: options.VerifyImageRevision,
+		revisions:           make(map[string]string),
+		notifications:       newNotifications(options),
+		rollbackHoldDown:    options.RollbackHoldDown,
+		kafka:               newKafkaProducer(options.KafkaRESTURL, options.KafkaTopic),
+		stuckAfter:          options.StuckAfter,
+		retireGrace:         options.RetireGrace,
+		minUpdateInterval:   options.MinUpdateInterval,
+		unparsableUpdated:   options.UnparsableUpdatedAt,
+		stuckAction:         options.StuckAction,
+		updating:            make(map[string]time.Time),
+		stuckAlerted:        make(map[string]bool),
+		stateStore:          newStateStore(options.StateFile),
+		deployRecords:       newDeployRecords(options),
+		knownDeployments:    newKnownDeployments(options),
+		deployLastKnownGood: options.DeployLastKnownGood,
+		scanURL:             options.ScanURL,
+		scanSeverityDefault: scanSeverity,
+		scanReports:         &scanReports{byImage: make(map[string]cachedScanReport)},
+		countersSince:       processStart,
+		observing:           options.ObserveFirstCycle,
+		waveNodeLabel:       options.WaveNodeLabel,
+		waveSize:            options.WaveSize,
+		minHealthy:          options.MinHealthy,
+		capacityParallelism: options.CapacityParallelism,
+		ownerLabel:          ownerLabel,
+		pagerDutyURL:        pagerDutyURL,
+		statusPath:          options.StatusPath,
+		bumpScaledToZero:    options.BumpScaledToZero,
+		auditLog:            options.AuditLog,
+		failureLogLines:     options.FailureLogLines,
+		logReader:           options.LogReader,
+		cleanupRunnerImage:  options.CleanupRunnerImage,
+		imageMappings:       parseImageMappings(options.ImageMappings),
+		registryMirrors:     parseRegistryMirrors(options.RegistryMirrors),
+		cache:               cache,
+		deployments:         newDeploymentCache(options.BeekeeperCacheTTL, clock),
+		updateBudget:        updateBudget,
+		latencyBudget:       newLatencyBudget(options),
+		differential:        options.Differential,
+		untracked:           make(map[deploymentKey]*untrackedProject),
+		untrackedBackoff:    untrackedBackoff,
+		deployWindows:       options.DeployWindows,
+		blackouts:           options.Blackouts,
+		ignoreWindows:       options.IgnoreWindows,
+		trains:              trainsByName(options.Trains),
+		freezeCalendar:      newFreezeCalendar(options),
+		policies:            newPolicyConfig(options),
+		flapDetector:        newFlapDetector(options),
+		shard:               &shard{},
+		rollouts:            make(map[string]bool),
+		waveRollouts:        make(map[string]string),
+		progress:            make(map[string]RolloutProgress),
+		subscribers:         make(map[chan RolloutProgress]bool),
+		states:              make(map[string]ServiceState),
+		pending:             make(map[string]PendingUpdate),
 	}
 }
 
 // Run watches the redis queue and starts taking action
 func (deployer *Deployer) Run() error {
-	filters := filters.NewArgs()
-	filters.Add("label", "octoblu.beekeeper.update")
-	options := types.ServiceListOptions{
-		Filter: filters,
+	deployer.requestID = newRequestID()
+	deployer.checkSwarmPause()
+	countLabeledMetric("cluster_cycles", deployer.clusterLabel())
+	if err := deployer.refreshPolicies(deployer.clock.Now()); err != nil {
+		countLabeledMetric("cluster_errors", deployer.clusterLabel())
+		return err
 	}
-	ctx := context.Background()
-	services, err := deployer.dockerClient.ServiceList(ctx, options)
+	services, err := deployer.listServices()
 	if err != nil {
+		countLabeledMetric("cluster_errors", deployer.clusterLabel())
 		return err
 	}
+	deployer.batches = deployer.groupByImage(services)
+	deployer.refreshFreezes(deployer.clock.Now())
+	seen := make(map[string]bool, len(services))
 	for _, service := range services {
-		shouldUpdate, err := deployer.shouldUpdateService(service)
-		if err != nil {
-			debug("error updating service %s - %v", service, err)
-			continue
-		}
-		debug("found service %s", getCurrentDockerURL(service))
-		if shouldUpdate {
-			err = deployer.updateService(service)
-			if err != nil {
-				debug("error updating service %s - %v", service, err)
-				continue
-			}
-		}
+		seen[service.ID] = true
+		deployer.processService(service)
 	}
+	deployer.forgetStates(seen)
+	deployer.forgetDeployRecords(seen)
+	deployer.observing = false
+	deployer.saveCounters()
+	deployer.checkLatencyBudget()
 	return nil
 }
 
-func (deployer *Deployer) shouldUpdateService(service swarm.Service) (bool, error) {
-	if service.Spec.Labels["octoblu.beekeeper.update"] != "true" {
-		debug("beekeeper update label != true")
-		return false, nil
+// processService runs a single service through the update
+// pipeline, a panic is recovered so the other services still update
+func (deployer *Deployer) processService(service swarm.Service) {
+	state := ServiceState{
+		ID:        service.ID,
+		Name:      service.Spec.Name,
+		Image:     getCurrentDockerURL(service),
+		CheckedAt: deployer.clock.Now(),
+
+		version:     service.Version.Index,
+		updateState: service.UpdateStatus.State,
+		policy:      deployer.policyVersion(),
 	}
-	if getCurrentDockerURL(service) == "" {
-		debug("Could not get currentDockerURL for service", service.ID)
-		return false, nil
+	if previous, ok := deployer.reuseState(state); ok {
+		deployer.debug("service %s is unchanged, %s", service.ID, previous.Reason)
+		countMetric("services_unchanged")
+		deployer.storeState(previous)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			deployer.debug("recovered panic processing service %s - %v\n%s", service.ID, r, debugStack())
+			countLabeledMetric("recovered_panics", service.ID)
+			state.Reason = ReasonPanic
+			state.Error = fmt.Sprintf("%v", r)
+		}
+		deployer.postDecision(service, state)
+		deployer.recordState(state)
+	}()
+
+	deployer.debug("found service %s", state.Image)
+	if lastUpdatedAt, err := deployer.lastUpdatedAt(service); err != nil {
+		state.LastUpdatedAtError = err.Error()
+	} else if !lastUpdatedAt.IsZero() {
+		state.LastUpdatedAt = &lastUpdatedAt
 	}
 	if isUpdateInProcess(service) {
-		debug("Update already in progress, skipping update", service.ID)
-		return false, nil
+		since := deployer.updatingSince(service)
+		state.UpdatingSince = &since
+	} else {
+		deployer.forgetUpdating(service.ID)
+	}
+	state.Reason = deployer.shouldUpdateService(service)
+	if state.Reason != "" {
+		return
 	}
-	return true, nil
-}
 
-func (deployer *Deployer) updateService(service swarm.Service) error {
-	currentDockerURL := getCurrentDockerURL(service)
-	owner, repo, _ := deployer.parseDockerURL(currentDockerURL)
-	if owner == "" || repo == "" {
-		return fmt.Errorf("Could not parse docker URL %v %v", currentDockerURL, service.ID)
+	var err error
+	deployer.eligibleAt = time.Time{}
+	state.LatestImage, state.Reason, err = deployer.updateService(service)
+	if !deployer.eligibleAt.IsZero() {
+		eligibleAt := deployer.eligibleAt
+		state.EligibleAt = &eligibleAt
 	}
-	dockerURL, err := deployer.getLatestDeployment(owner, repo)
 	if err != nil {
-		return fmt.Errorf("Error getting latest docker URL for %v/%v: %v", owner, repo, err.Error())
+		deployer.debug("error updating service %s - %v", service.ID, err)
+		state.Error = err.Error()
+		state.ErrorClass = ErrorClass(err)
+		countLabeledMetric("error_classes", state.ErrorClass)
 	}
-	if dockerURL == "" {
-		debug("No latest docker url from the beekeeper service")
-		return nil
+	if lookupReasons[state.Reason] {
+		state.deployment = deployer.getDeploymentKey(service)
 	}
-	if doesDockerURLMatchCurrent(dockerURL, service) {
-		debug("docker url is the same")
-		return nil
+}
+
+func debugStack() string {
+	stack := make([]byte, 4096)
+	return string(stack[:runtime.Stack(stack, false)])
+}
+
+// RequestID is the id of the current cycle, it is sent to beekeeper
+// as X-Request-Id and prefixed to every log line of the cycle
+func (deployer *Deployer) RequestID() string {
+	return deployer.requestID
+}
+
+func (deployer *Deployer) debug(format string, args ...interface{}) {
+	debug("[%s] "+format, append([]interface{}{deployer.requestID}, args...)...)
+	if deployer.trace != nil {
+		fmt.Fprintf(deployer.trace, format+"\n", args...)
 	}
-	if !didLastUpdatePass(service) {
-		debug("Last update failed", service.ID)
-		if doesDockerURLMatchLast(dockerURL, service) {
-			debug("Update already has been done", service.ID)
-			return nil
-		}
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
 	}
-	return deployer.deploy(service, dockerURL)
+	return hex.EncodeToString(id)
 }
 
-func (deployer *Deployer) deploy(service swarm.Service, dockerURL string) error {
-	var err error
-	dockerClient := deployer.dockerClient
+// updateMode is what the octoblu.beekeeper.update label asks for
+type updateMode int
 
-	ctx := context.Background()
-	updateOpts := types.ServiceUpdateOptions{}
+const (
+	// updateModeOff leaves the service alone
+	updateModeOff updateMode = iota
+	// updateModeDeploy deploys new versions
+	updateModeDeploy
+	// updateModeReport logs new versions without deploying them
+	updateModeReport
+	// updateModePinned holds the service on its current version
+	updateModePinned
+)
 
-	service.Spec.TaskTemplate.ContainerSpec.Image = dockerURL
-	currentDate := time.Now().Format(time.RFC3339)
-	if service.Spec.Labels == nil {
-		service.Spec.Labels = make(map[string]string)
+// updateLabel returns the octoblu.beekeeper.update value of the
+// service, services given by --services have it implicitly
+func (deployer *Deployer) updateLabel(service swarm.Service) (string, bool) {
+	if value, ok := service.Spec.Labels["octoblu.beekeeper.update"]; ok {
+		return value, true
 	}
-	service.Spec.Labels["octoblu.beekeeper.lastDockerURL"] = dockerURL
-	service.Spec.Labels["octoblu.beekeeper.lastUpdatedAt"] = currentDate
-	debug("About to deploy %s at %s", dockerURL, currentDate)
-	service.Spec.UpdateConfig.Parallelism = getUpdateParallelism(service)
-	service.Spec.UpdateConfig.FailureAction = "pause"
-	err = dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, updateOpts)
-	if err != nil {
-		return err
+	if deployer.isListed(service) {
+		return deployer.updateLabelValues[0], true
 	}
+	return "", false
+}
 
-	return nil
+func (deployer *Deployer) isListed(service swarm.Service) bool {
+	return deployer.listedServices[service.Spec.Name] || deployer.listedServices[service.ID]
 }
 
-func (deployer *Deployer) getBeekeeperURL(owner, repo string) (string, error) {
-	repoUrl := fmt.Sprintf("%s/deployments/%s/%s/latest", deployer.beekeeperURI, owner, repo)
-	u, err := url.Parse(repoUrl)
-	if err != nil {
-		return "", err
+func (deployer *Deployer) getUpdateMode(service swarm.Service) updateMode {
+	value, _ := deployer.updateLabel(service)
+	switch value {
+	case "":
+		return updateModeOff
+	case "report":
+		return updateModeReport
+	case "pinned":
+		return updateModePinned
 	}
-	q := u.Query()
-	if deployer.tags != "" {
-		q.Set("tags", deployer.tags)
+	for _, accepted := range deployer.updateLabelValues {
+		if value == accepted {
+			return updateModeDeploy
+		}
 	}
-	u.RawQuery = q.Encode()
-	return fmt.Sprint(u), nil
+	return updateModeOff
 }
 
-func (deployer *Deployer) getLatestDeployment(owner, repo string) (string, error) {
-	var metadata RequestMetadata
-
-	u, err := deployer.getBeekeeperURL(owner, repo)
-	if err != nil {
-		return "", err
+// matchesSelectors returns true if the service carries the
+// update label, or is listed, and every selector, the same way docker filters them
+func (deployer *Deployer) matchesSelectors(service swarm.Service) bool {
+	if _, ok := deployer.updateLabel(service); !ok {
+		return false
 	}
+	for _, selector := range deployer.selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		value, ok := service.Spec.Labels[parts[0]]
+		if !ok {
+			return false
+		}
+		if len(parts) == 2 && value != parts[1] {
+			return false
+		}
+	}
+	return true
+}
 
-	debug("get latest docker url %s", u)
-
-	res, err := http.Get(u)
+// shouldUpdateService returns why the service should be skipped
+// without asking beekeeper, or an empty reason
+func (deployer *Deployer) shouldUpdateService(service swarm.Service) Reason {
+	if !deployer.matchesSelectors(service) {
+		deployer.debug("service %s does not match the selectors", service.ID)
+		return ReasonSelectorMismatch
+	}
+	switch deployer.getUpdateMode(service) {
+	case updateModeOff:
+		value, _ := deployer.updateLabel(service)
+		deployer.debug("beekeeper update label %q is not an accepted value", value)
+		return ReasonNotOptedIn
+	case updateModePinned:
+		deployer.debug("service %s is pinned", service.ID)
+		return ReasonPinned
+	}
+	if !deployer.inShard(service) {
+		deployer.debug("service %s belongs to another shard", service.ID)
+		return ReasonOtherShard
+	}
+	if getCurrentDockerURL(service) == "" {
+		deployer.debug("Could not get currentDockerURL for service %s", service.ID)
+		return ReasonNoImage
+	}
+	if isUpdateInProcess(service) {
+		if deployer.checkStuck(service) {
+			return ReasonUpdateStuck
+		}
+		deployer.debug("Update already in progress, skipping update %s", service.ID)
+		return ReasonUpdateInProgress
+	}
+	if isScaledToZero(service) && !deployer.bumpScaledToZero {
+		deployer.debug("service %s is scaled to zero", service.ID)
+		return ReasonScaledToZero
+	}
+	return ""
+}
 
+// updateService looks up the latest image and deploys it,
+// returning the image and the reason for the outcome
+func (deployer *Deployer) updateService(service swarm.Service) (string, Reason, error) {
+	currentDockerURL := getCurrentDockerURL(service)
+	owner, repo := deployer.getBeekeeperProject(service)
+	if owner == "" || repo == "" {
+		return "", ReasonUnparsableImage, classify(ErrUnparsableImage, fmt.Errorf("Could not parse docker URL %v %v", currentDockerURL, service.ID))
+	}
+	beekeeper, err := deployer.getBeekeeper(service)
 	if err != nil {
-		debug("got error from beekeeper-service %v", err)
-		return "", err
+		return "", ReasonInvalidBeekeeper, err
 	}
-
-	debug("get latest: got status code %v", res.StatusCode)
-	if res.StatusCode != 200 {
-		return "", fmt.Errorf("Invalid response status code %v", res.StatusCode)
+	deployer.debug("beekeeper project %s/%s on %s", owner, repo, beekeeper.name)
+	key := newDeploymentKey(beekeeper, owner, repo)
+	if retryAt, ok := deployer.untrackedUntil(key); ok {
+		deployer.debug("beekeeper does not know %s/%s, next lookup at %s", owner, repo, retryAt.Format(time.RFC3339))
+		return "", ReasonNoDeployment, nil
+	}
+	metadata, err := deployer.getCachedDeployment(beekeeper, owner, repo)
+	if err == errProjectNotFound {
+		deployer.forgetDeployment(key)
+		retryAt := deployer.markUntracked(key, service)
+		deployer.debug("beekeeper does not know %s/%s, next lookup at %s", owner, repo, retryAt.Format(time.RFC3339))
+		return "", ReasonNoDeployment, nil
 	}
-
-	body, err := ioutil.ReadAll(res.Body)
-
 	if err != nil {
-		return "", err
+		err = fmt.Errorf("Error getting latest docker URL for %v/%v: %w", owner, repo, redactError(err))
+		known, ok := deployer.lastKnownGood(key, err)
+		if !ok {
+			return deployer.knownLatestImage(service, key, owner, repo, err), ReasonBeekeeperError, err
+		}
+		deployer.debug("beekeeper is unavailable, converging %s on the last known good %s", service.ID, known.DockerURL)
+		countMetric("last_known_good_lookups")
+		metadata = known
 	}
-
-	if len(body) == 0 {
-		return "", nil
+	deployer.markTracked(key)
+	deployer.rememberDeployment(key, metadata)
+	if metadata.Retired != nil {
+		reason, err := deployer.retireService(service, owner, repo, metadata.Retired)
+		return "", reason, err
 	}
-
-	err = json.Unmarshal(body, &metadata)
+	flappingUntil := deployer.checkFlapping(service, key, metadata.DockerURL)
+	dockerURL, err := deployer.expandDockerURL(metadata.DockerURL, service, owner, repo)
 	if err != nil {
-		return "", err
+		return "", ReasonInvalidDeployment, err
 	}
-
-	return metadata.DockerURL, nil
+	// the registry beekeeper named is the one allowed or not, not its mirror
+	if err := deployer.validateDeployment(owner, repo, dockerURL); err != nil {
+		if _, ok := err.(*registryError); ok {
+			deployer.sendAlert(Alert{
+				Kind:      "registry-not-allowed",
+				ServiceID: service.ID,
+				Service:   service.Spec.Name,
+				Image:     dockerURL,
+				Message:   err.Error(),
+				Owner:     deployer.serviceOwner(service),
+			})
+			return dockerURL, ReasonRegistryNotAllowed, err
+		}
+		return "", ReasonInvalidDeployment, err
+	}
+	dockerURL = deployer.mirrorDockerURL(dockerURL)
+	deployer.debug("currentDockerURL = %s, dockerURL = %s", currentDockerURL, dockerURL)
+	if doesDockerURLMatchCurrent(dockerURL, service) {
+		deployer.debug("docker url is the same")
+		if metadata.Pinned {
+			return dockerURL, ReasonPinnedInBeekeeper, nil
+		}
+		return dockerURL, ReasonUpToDate, nil
+	}
+	if metadata.Pinned {
+		deployer.debug("%s is pinned in beekeeper", dockerURL)
+	}
+	if !flappingUntil.IsZero() {
+		deployer.debug("the latest deployment of %s/%s is flapping, holding %s until %s", owner, repo, service.ID, flappingUntil.Format(time.RFC3339))
+		deployer.holdUntil(flappingUntil)
+		return dockerURL, ReasonFlapping, nil
+	}
+	if !didLastUpdatePass(service) {
+		deployer.debug("Last update failed %s", service.ID)
+		lastDockerURL := deployer.lastDeploy(service).LastDockerURL
+		deployer.debug("lastDockerURL = %s, dockerURL = %s", lastDockerURL, dockerURL)
+		if lastDockerURL != "" && lastDockerURL == dockerURL {
+			deployer.debug("Update already has been done %s", service.ID)
+			return dockerURL, ReasonLastUpdateFailed, nil
+		}
+	}
+	if service.Spec.Labels[migrationFailedImageLabel] == dockerURL {
+		deployer.debug("migration for %s failed before", dockerURL)
+		return dockerURL, ReasonLastUpdateFailed, nil
+	}
+	if service.Spec.Labels[stuckImageLabel] == dockerURL {
+		deployer.debug("update to %s was stuck before", dockerURL)
+		return dockerURL, ReasonLastUpdateFailed, nil
+	}
+	service = deployer.noteRollback(service)
+	if until, ok := heldDownUntil(service, dockerURL, deployer.clock.Now()); ok {
+		deployer.debug("%s was rolled back, holding it down until %s", dockerURL, until.Format(time.RFC3339))
+		if deployer.previousReason(service.ID) != ReasonHeldDown {
+			deployer.sendAlert(Alert{
+				Kind:      "held-down",
+				ServiceID: service.ID,
+				Service:   service.Spec.Name,
+				Image:     dockerURL,
+				Message:   fmt.Sprintf("%s was rolled back and is not deployed again until %s, a newer build is required", dockerURL, until.Format(time.RFC3339)),
+				Owner:     deployer.serviceOwner(service),
+			})
+		}
+		return dockerURL, ReasonHeldDown, nil
+	}
+	if err := deployer.verifyProvenance(dockerURL, metadata.Provenance); err != nil {
+		if _, ok := err.(*provenanceError); !ok {
+			return dockerURL, ReasonRegistryError, err
+		}
+		countMetric("provenance_rejections")
+		deployer.sendAlert(Alert{
+			Kind:      "provenance-rejected",
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Image:     dockerURL,
+			Message:   err.Error(),
+			Owner:     deployer.serviceOwner(service),
+		})
+		return dockerURL, ReasonProvenanceRejected, err
+	}
+	if reason, err := deployer.checkVulnerabilities(service, dockerURL, owner, repo); reason != "" {
+		return dockerURL, reason, err
+	}
+	if reason, err := deployer.checkUpdateInterval(service); reason != "" {
+		return dockerURL, reason, err
+	}
+	if metadata.DeployAfter != nil && deployer.clock.Now().Before(*metadata.DeployAfter) {
+		deployer.debug("holding %s until %s", dockerURL, metadata.DeployAfter.Format(time.RFC3339))
+		deployer.holdUntil(*metadata.DeployAfter)
+		return dockerURL, ReasonDeferred, nil
+	}
+	if deployer.getUpdateMode(service) == updateModeReport {
+		deployer.debug("report only, would deploy %s to %s", dockerURL, service.ID)
+		return dockerURL, ReasonReportOnly, nil
+	}
+	if deployer.isPaused() {
+		deployer.debug("updates are paused, not deploying %s to %s", dockerURL, service.ID)
+		return dockerURL, ReasonPaused, nil
+	}
+	if closed := deployer.windowClosed(deployer.clock.Now()); closed != "" {
+		deployer.debug("%s, not deploying %s to %s", closed, dockerURL, service.ID)
+		deployer.holdUntil(deployer.windowOpens(deployer.clock.Now()))
+		return dockerURL, ReasonOutsideWindow, nil
+	}
+	if reason := deployer.waitForTrain(service, dockerURL); reason != "" {
+		return dockerURL, reason, nil
+	}
+	if deployer.observing {
+		deployer.debug("observing the first cycle, not deploying %s to %s", dockerURL, service.ID)
+		return dockerURL, ReasonObserving, nil
+	}
+	if blocker := deployer.batchBlocker(service, dockerURL); blocker != "" {
+		deployer.debug("%s rolls out %s before %s", blocker, dockerURL, service.ID)
+		return dockerURL, ReasonBatchWaiting, nil
+	}
+	if deployer.dryRun {
+		deployer.debug("dry run, not deploying %s to %s", dockerURL, service.ID)
+		return dockerURL, ReasonDeployed, nil
+	}
+	service = annotateDeploy(service, metadata)
+	if service, err = publishPorts(service, metadata); err != nil {
+		return dockerURL, ReasonInvalidPorts, err
+	}
+	if isScaledToZero(service) {
+		deployer.debug("service %s is scaled to zero, only setting its image to %s", service.ID, dockerURL)
+		if err := deployer.bumpImage(service, dockerURL); err != nil {
+			return dockerURL, ReasonDeployError, err
+		}
+		return dockerURL, ReasonScaledToZero, nil
+	}
+	if err := deployer.checkHealthy(service); err != nil {
+		if _, ok := err.(*degradedError); !ok {
+			return dockerURL, ReasonDeployError, err
+		}
+		deployer.debug("service %s is degraded, not deploying %s: %v", service.ID, dockerURL, err)
+		countMetric("degraded_deferrals")
+		if deployer.previousReason(service.ID) != ReasonDegraded {
+			deployer.sendAlert(Alert{
+				Kind:      "degraded",
+				ServiceID: service.ID,
+				Service:   service.Spec.Name,
+				Image:     dockerURL,
+				Message:   err.Error(),
+				Owner:     deployer.serviceOwner(service),
+			})
+		}
+		return dockerURL, ReasonDegraded, nil
+	}
+	if err := deployer.checkCapacity(service); err != nil {
+		if _, ok := err.(*capacityError); !ok {
+			return dockerURL, ReasonDeployError, err
+		}
+		deployer.debug("not deploying %s to %s: %v", dockerURL, service.ID, err)
+		countMetric("capacity_deferrals")
+		if deployer.previousReason(service.ID) != ReasonNoCapacity {
+			deployer.sendAlert(Alert{
+				Kind:      "insufficient-capacity",
+				ServiceID: service.ID,
+				Service:   service.Spec.Name,
+				Image:     dockerURL,
+				Message:   err.Error(),
+				Owner:     deployer.serviceOwner(service),
+			})
+		}
+		return dockerURL, ReasonNoCapacity, nil
+	}
+	schedule, err := getWeightSchedule(service)
+	if err != nil {
+		return dockerURL, ReasonInvalidWeights, err
+	}
+	if schedule != nil {
+		reason, err := deployer.deployWeighted(service, dockerURL, metadata.Migration, schedule)
+		return dockerURL, reason, err
+	}
+	reservation, ok := deployer.reserveUpdate()
+	if !ok {
+		deployer.debug("update budget exhausted, not deploying %s to %s", dockerURL, service.ID)
+		return dockerURL, ReasonBudgetExhausted, nil
+	}
+	if reason, err := deployer.beforeDeploy(service, dockerURL, metadata.Migration); err != nil {
+		if reservation != nil {
+			reservation.Cancel()
+		}
+		return dockerURL, reason, err
+	}
+	if err := deployer.deploy(service, dockerURL); err != nil {
+		if reservation != nil {
+			reservation.Cancel()
+		}
+		return dockerURL, ReasonDeployError, err
+	}
+	return dockerURL, ReasonDeployed, nil
 }
 
-func getRealDockerURL(dockerURL string) string {
-	return strings.Split(dockerURL, "@")[0]
+// reserveUpdate takes an update from the hourly budget, ok is
+// false when it is spent. The reservation is nil without a budget
+func (deployer *Deployer) reserveUpdate() (*rate.Reservation, bool) {
+	if deployer.updateBudget == nil {
+		return nil, true
+	}
+	reservation := deployer.updateBudget.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		deployer.holdUntil(deployer.clock.Now().Add(delay))
+		reservation.Cancel()
+		return nil, false
+	}
+	return reservation, true
 }
 
-func (deployer *Deployer) parseDockerURL(dockerURL string) (string, string, string) {
-	var owner, repo, tag string
-	realDockerURL := getRealDockerURL(dockerURL)
-	dockerURLParts := strings.Split(realDockerURL, ":")
+func (deployer *Deployer) deploy(service swarm.Service, dockerURL string) error {
+	var err error
 
-	if len(dockerURLParts) != 2 {
-		return "", "", ""
+	updateOpts := types.ServiceUpdateOptions{
+		EncodedRegistryAuth: deployer.encodedRegistryAuth(),
 	}
 
-	if dockerURLParts[1] != "" {
-		tag = dockerURLParts[1]
+	previousImage := getCurrentDockerURL(service)
+	listedImage := service.Spec.TaskTemplate.ContainerSpec.Image
+	service.Spec.TaskTemplate.ContainerSpec.Image = dockerURL
+	record := newDeployRecord(dockerURL, previousImage, deployer.clock.Now())
+	deployer.labelDeploy(&service.Spec, record)
+	deployer.debug("About to deploy %s at %s", dockerURL, record.LastUpdatedAt)
+	if service.Spec.UpdateConfig == nil {
+		service.Spec.UpdateConfig = &swarm.UpdateConfig{}
 	}
+	service.Spec.UpdateConfig.Parallelism = getUpdateParallelism(service)
+	service.Spec.UpdateConfig.FailureAction = "pause"
+	var waves [][]swarm.Node
+	if deployer.waveNodeLabel != "" && service.Spec.Mode.Global != nil {
+		if waves, err = deployer.planWaves(); err != nil {
+			return err
+		}
+		if len(waves) > 1 {
+			deployer.debug("rolling %s out in %d waves", service.ID, len(waves))
+			service.Spec.UpdateConfig.Parallelism = uint64(len(waves[0]))
+			if err := deployer.cordonWaves(service.Spec.Name, waves); err != nil {
+				return err
+			}
+			// before the update, the rollout it supersedes must see it
+			deployer.startWaves(service.ID, dockerURL)
+		}
+	}
+	err = deployer.writeService(service, listedImage, updateOpts)
+	if err != nil {
+		if len(waves) > 1 {
+			deployer.stopWaves(service.ID, dockerURL)
+			deployer.uncordonNodes(flattenWaves(waves[1:]))
+		}
+		return err
+	}
+	deployer.saveDeploy(service.ID, record)
+	deployer.audit(AuditRecord{
+		RequestID:     deployer.requestID,
+		ServiceID:     service.ID,
+		Service:       service.Spec.Name,
+		Event:         "deployed",
+		Image:         dockerURL,
+		PreviousImage: previousImage,
+	})
 
-	projectParts := strings.Split(dockerURLParts[0], "/")
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	if len(waves) > 1 {
+		go deployer.rollWaves(deployer.requestID, service, dockerURL, previousImage, waves, deployer.getDeployTimeout(service))
+		return nil
+	}
+	go deployer.monitorRollout(deployer.requestID, service.ID, dockerURL, previousImage, deployer.getDeployTimeout(service))
+	return nil
+}
 
-	if len(projectParts) == 2 {
-		owner = projectParts[0]
-		repo = projectParts[1]
-	} else if len(projectParts) == 3 {
-		owner = projectParts[1]
-		repo = projectParts[2]
-	} else {
-		return "", "", ""
+// getRealDockerURL drops the digest swarm pins a tagged image to,
+// a reference by digest only keeps it
+func getRealDockerURL(dockerURL string) string {
+	parts := strings.SplitN(dockerURL, "@", 2)
+	if len(parts) == 2 && !hasTag(parts[0]) {
+		return dockerURL
 	}
+	return parts[0]
+}
 
-	return owner, repo, tag
+// hasTag returns true if the image name ends in a tag
+func hasTag(name string) bool {
+	return strings.Contains(name[strings.LastIndex(name, "/")+1:], ":")
 }
 
 func getUpdateParallelism(service swarm.Service) uint64 {
@@ -242,21 +1205,6 @@ func getCurrentDockerURL(service swarm.Service) string {
 	return getRealDockerURL(service.Spec.TaskTemplate.ContainerSpec.Image)
 }
 
-func getLastUpdatedAt(service swarm.Service) (time.Time, error) {
-	if service.Spec.Labels == nil {
-		return time.Now(), nil
-	}
-	lastUpdatedAt := service.Spec.Labels["octoblu.beekeeper.lastUpdatedAt"]
-	return time.Parse(time.RFC3339, lastUpdatedAt)
-}
-
-func getLastDockerURL(service swarm.Service) string {
-	if service.Spec.Labels == nil {
-		return ""
-	}
-	return service.Spec.Labels["octoblu.beekeeper.lastDockerURL"]
-}
-
 func isUpdateInProcess(service swarm.Service) bool {
 	return service.UpdateStatus.State == swarm.UpdateStateUpdating
 }
@@ -268,20 +1216,30 @@ func didLastUpdatePass(service swarm.Service) bool {
 	return false
 }
 
+// doesDockerURLMatchCurrent returns true if the service runs
+// dockerURL. A reference by digest matches the image swarm pinned
+// to that digest, whatever its tag, a tagged one matches the tag
 func doesDockerURLMatchCurrent(dockerURL string, service swarm.Service) bool {
-	currentDockerURL := getCurrentDockerURL(service)
-	debug("currentDockerURL = %s, dockerURL = %s", currentDockerURL, dockerURL)
-	if currentDockerURL == "" {
+	current := service.Spec.TaskTemplate.ContainerSpec.Image
+	if current == "" {
 		return false
 	}
-	return dockerURL == currentDockerURL
-}
-
-func doesDockerURLMatchLast(dockerURL string, service swarm.Service) bool {
-	lastDockerURL := getLastDockerURL(service)
-	debug("lastDockerURL = %s, dockerURL = %s", lastDockerURL, dockerURL)
-	if lastDockerURL == "" {
+	wanted, err := reference.ParseNamed(dockerURL)
+	if err != nil {
+		return dockerURL == getRealDockerURL(current)
+	}
+	running, err := reference.ParseNamed(current)
+	if err != nil || wanted.Name() != running.Name() {
 		return false
 	}
-	return dockerURL == lastDockerURL
+	wantedTagged, wantsTag := wanted.(reference.Tagged)
+	runningTagged, runsTag := running.(reference.Tagged)
+	if wantsTag && (!runsTag || wantedTagged.Tag() != runningTagged.Tag()) {
+		return false
+	}
+	if wantedDigested, ok := wanted.(reference.Digested); ok {
+		runningDigested, ok := running.(reference.Digested)
+		return ok && wantedDigested.Digest() == runningDigested.Digest()
+	}
+	return wantsTag || !runsTag
 }
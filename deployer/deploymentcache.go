@@ -0,0 +1,113 @@
+package deployer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// deploymentCache remembers the latest deployment of each
+// project across cycles, so beekeeper is asked at most once per ttl
+type deploymentCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	clock   Clock
+	entries map[deploymentKey]cachedDeployment
+}
+
+// deploymentKey is a lookup, tags filter the builds so they are part of it
+type deploymentKey struct {
+	beekeeper string
+	owner     string
+	repo      string
+	tags      string
+}
+
+type cachedDeployment struct {
+	metadata  *RequestMetadata
+	fetchedAt time.Time
+}
+
+func newDeploymentCache(ttl time.Duration, clock Clock) *deploymentCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &deploymentCache{
+		ttl:     ttl,
+		clock:   clock,
+		entries: make(map[deploymentKey]cachedDeployment),
+	}
+}
+
+func (cache *deploymentCache) get(key deploymentKey) (*RequestMetadata, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok || cache.clock.Now().Sub(entry.fetchedAt) > cache.ttl {
+		return nil, false
+	}
+	return entry.metadata, true
+}
+
+func (cache *deploymentCache) set(key deploymentKey, metadata *RequestMetadata) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.entries[key] = cachedDeployment{metadata: metadata, fetchedAt: cache.clock.Now()}
+	for key, entry := range cache.entries {
+		if cache.clock.Now().Sub(entry.fetchedAt) > cache.ttl {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// forget drops the project from every beekeeper and tags,
+// a build was published for it
+func (cache *deploymentCache) forget(owner, repo string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for key := range cache.entries {
+		if key.owner == owner && key.repo == repo {
+			delete(cache.entries, key)
+		}
+	}
+}
+
+// getDeploymentKey returns the deployment cache key of the service,
+// or the zero key when it has no beekeeper project
+func (deployer *Deployer) getDeploymentKey(service swarm.Service) deploymentKey {
+	owner, repo := deployer.getBeekeeperProject(service)
+	beekeeper, err := deployer.getBeekeeper(service)
+	if err != nil || owner == "" || repo == "" {
+		return deploymentKey{}
+	}
+	return newDeploymentKey(beekeeper, owner, repo)
+}
+
+func newDeploymentKey(beekeeper beekeeperEndpoint, owner, repo string) deploymentKey {
+	return deploymentKey{beekeeper: beekeeper.uri, owner: owner, repo: repo, tags: beekeeper.tags}
+}
+
+// getCachedDeployment is getLatestDeployment through the
+// deployment cache, errors are never cached
+func (deployer *Deployer) getCachedDeployment(beekeeper beekeeperEndpoint, owner, repo string) (*RequestMetadata, error) {
+	if deployer.snapshot != nil {
+		return deployer.snapshotDeployment(owner, repo)
+	}
+	if deployer.deployments == nil {
+		return deployer.getLatestDeployment(beekeeper, owner, repo)
+	}
+	key := newDeploymentKey(beekeeper, owner, repo)
+	if metadata, ok := deployer.deployments.get(key); ok {
+		deployer.debug("using cached deployment of %s/%s", owner, repo)
+		countMetric("beekeeper_cache_hits")
+		return metadata, nil
+	}
+	countMetric("beekeeper_cache_misses")
+	metadata, err := deployer.getLatestDeployment(beekeeper, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	deployer.deployments.set(key, metadata)
+	return metadata, nil
+}
@@ -0,0 +1,62 @@
+package deployer
+
+// stableReasons are decisions that only change when the service
+// spec does, or when beekeeper answers differently
+var stableReasons = map[Reason]bool{
+	ReasonSelectorMismatch:   true,
+	ReasonNotOptedIn:         true,
+	ReasonPinned:             true,
+	ReasonNoImage:            true,
+	ReasonScaledToZero:       true,
+	ReasonUnparsableImage:    true,
+	ReasonInvalidBeekeeper:   true,
+	ReasonUpToDate:           true,
+	ReasonPinnedInBeekeeper:  true,
+	ReasonReportOnly:         true,
+	ReasonLastUpdateFailed:   true,
+	ReasonRegistryNotAllowed: true,
+	ReasonInvalidDeployment:  true,
+	ReasonProvenanceRejected: true,
+}
+
+// lookupReasons are the stable reasons that depend on beekeeper
+var lookupReasons = map[Reason]bool{
+	ReasonUpToDate:           true,
+	ReasonPinnedInBeekeeper:  true,
+	ReasonReportOnly:         true,
+	ReasonLastUpdateFailed:   true,
+	ReasonRegistryNotAllowed: true,
+	ReasonInvalidDeployment:  true,
+	ReasonProvenanceRejected: true,
+}
+
+// reuseState returns the last decision for the service when
+// neither its spec nor the cached beekeeper answer changed since,
+// so the cycle does not evaluate it again
+func (deployer *Deployer) reuseState(state ServiceState) (ServiceState, bool) {
+	if !deployer.differential {
+		return state, false
+	}
+	deployer.statesLock.Lock()
+	previous, ok := deployer.states[state.ID]
+	deployer.statesLock.Unlock()
+	if !ok || previous.version != state.version || previous.updateState != state.updateState || previous.policy != state.policy || !stableReasons[previous.Reason] {
+		return state, false
+	}
+	if lookupReasons[previous.Reason] && !deployer.deploymentUnchanged(previous) {
+		return state, false
+	}
+	previous.CheckedAt = deployer.clock.Now()
+	return previous, true
+}
+
+// deploymentUnchanged returns true if the deployment cache still
+// holds the answer the previous decision was based on
+func (deployer *Deployer) deploymentUnchanged(previous ServiceState) bool {
+	if deployer.deployments == nil || previous.deployment == (deploymentKey{}) {
+		return false
+	}
+	metadata, ok := deployer.deployments.get(previous.deployment)
+	pinned := previous.Reason == ReasonPinnedInBeekeeper
+	return ok && metadata.DockerURL == previous.LatestImage && metadata.Pinned == pinned
+}
@@ -0,0 +1,69 @@
+package deployer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+// DockerClient is the part of client.APIClient the deployer
+// uses, deployertest.FakeDocker implements it in memory
+type DockerClient interface {
+	Events(ctx context.Context, options types.EventsOptions) (io.ReadCloser, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error
+	ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceRemove(ctx context.Context, serviceID string) error
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error
+	SwarmInspect(ctx context.Context) (swarm.Swarm, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+}
+
+// TimeoutError is returned when a docker api call
+// does not finish within the docker timeout
+type TimeoutError struct {
+	Operation string
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("docker %s timed out", err.Operation)
+}
+
+// IsTimeout returns true if err is a docker api timeout,
+// the operation will simply be retried next cycle
+func IsTimeout(err error) bool {
+	var timeout *TimeoutError
+	return errors.As(err, &timeout)
+}
+
+// isNotFound returns true if err says the service does not
+// exist, engine-api and deployertest errors have NotFound
+func isNotFound(err error) bool {
+	notFound, ok := err.(interface {
+		NotFound() bool
+	})
+	return ok && notFound.NotFound()
+}
+
+// dockerContext returns a context bounded by the docker timeout,
+// the cancel func must always be called
+func (deployer *Deployer) dockerContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), deployer.dockerTimeout)
+}
+
+// dockerError records and converts deadline errors
+// into a *TimeoutError, other errors are returned as is
+func (deployer *Deployer) dockerError(ctx context.Context, operation string, err error) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	countLabeledMetric("docker_timeouts", operation)
+	deployer.debug("docker %s timed out after %v", operation, deployer.dockerTimeout)
+	return &TimeoutError{Operation: operation}
+}
@@ -0,0 +1,66 @@
+package deployer
+
+import "errors"
+
+// The classes of the errors of the deployer, errors.Is tells them
+// apart, e.g. to retry a conflict but not an unparsable image
+var (
+	// ErrBeekeeperUnavailable means beekeeper could not be reached
+	// or answered with a server error or too many requests
+	ErrBeekeeperUnavailable = errors.New("beekeeper unavailable")
+
+	// ErrUnparsableImage means no beekeeper project could be
+	// derived from the image of a service
+	ErrUnparsableImage = errors.New("unparsable image")
+
+	// ErrUpdateConflict means the service changed while the
+	// updater wrote it, more than it could merge
+	ErrUpdateConflict = errors.New("update conflict")
+
+	// ErrRegistryAuth means the registry refused the
+	// registry credentials, or required some
+	ErrRegistryAuth = errors.New("registry auth failed")
+)
+
+// classifiedError is an error of one of the classes,
+// it reads like the error it wraps
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func classify(class, err error) error {
+	return &classifiedError{class, err}
+}
+
+func (err *classifiedError) Error() string {
+	return err.err.Error()
+}
+
+func (err *classifiedError) Unwrap() error {
+	return err.err
+}
+
+func (err *classifiedError) Is(target error) bool {
+	return target == err.class
+}
+
+// ErrorClass names the class of err for metrics and callbacks,
+// "other" when it has none and empty without an error
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrBeekeeperUnavailable):
+		return "beekeeper-unavailable"
+	case errors.Is(err, ErrUnparsableImage):
+		return "unparsable-image"
+	case errors.Is(err, ErrUpdateConflict):
+		return "update-conflict"
+	case errors.Is(err, ErrRegistryAuth):
+		return "registry-auth"
+	case IsTimeout(err):
+		return "docker-timeout"
+	}
+	return "other"
+}
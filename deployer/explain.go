@@ -0,0 +1,81 @@
+package deployer
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// Explanation is the outcome of running the decision
+// pipeline for one service, with every step it took
+type Explanation struct {
+	ServiceID    string            `json:"serviceId"`
+	Service      string            `json:"service"`
+	Image        string            `json:"image"`
+	UpdateStatus string            `json:"updateStatus"`
+	Labels       map[string]string `json:"labels"`
+	Selectors    []string          `json:"selectors"`
+	Steps        []string          `json:"steps"`
+	Reason       Reason            `json:"reason"`
+	LatestImage  string            `json:"latestImage,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// Explain runs the full decision pipeline for one service
+// without deploying anything, docker is read-only meanwhile
+func (deployer *Deployer) Explain(serviceName string) (*Explanation, error) {
+	var trace bytes.Buffer
+	dockerClient := deployer.dockerClient
+	deployer.dockerClient = ReadOnly(dockerClient)
+	defer func() {
+		deployer.dockerClient = dockerClient
+	}()
+	deployer.requestID = newRequestID()
+	deployer.checkSwarmPause()
+	if err := deployer.refreshPolicies(deployer.clock.Now()); err != nil {
+		return nil, err
+	}
+	deployer.trace = &trace
+	deployer.dryRun = true
+	defer func() {
+		deployer.trace = nil
+		deployer.dryRun = false
+	}()
+
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceName)
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "ServiceInspect", err)
+	}
+	service = deployer.applyPolicies([]swarm.Service{service})[0]
+
+	explanation := &Explanation{
+		ServiceID:    service.ID,
+		Service:      service.Spec.Name,
+		Image:        service.Spec.TaskTemplate.ContainerSpec.Image,
+		UpdateStatus: strings.TrimSpace(string(service.UpdateStatus.State) + " " + service.UpdateStatus.Message),
+		Labels:       make(map[string]string),
+		Selectors:    deployer.selectors,
+	}
+	for key, value := range service.Spec.Labels {
+		if strings.HasPrefix(key, "octoblu.beekeeper.") {
+			explanation.Labels[key] = value
+		}
+	}
+
+	explanation.Reason = deployer.shouldUpdateService(service)
+	if explanation.Reason == "" {
+		explanation.LatestImage, explanation.Reason, err = deployer.updateService(service)
+		if err != nil {
+			explanation.Error = err.Error()
+		}
+	}
+	for _, step := range strings.Split(trace.String(), "\n") {
+		if step = strings.TrimSpace(step); step != "" {
+			explanation.Steps = append(explanation.Steps, step)
+		}
+	}
+	return explanation, nil
+}
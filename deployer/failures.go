@@ -0,0 +1,213 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// maxTaskFailures bounds the failures kept of one rollout
+const maxTaskFailures = 10
+
+// TaskFailure is why a task of a rollout did not run
+type TaskFailure struct {
+	TaskID   string `json:"taskId"`
+	NodeID   string `json:"nodeId,omitempty"`
+	Node     string `json:"node,omitempty"`
+	State    string `json:"state"`
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode,omitempty"`
+
+	// Logs are the last lines the task logged, see FailureLogLines
+	Logs []string `json:"logs,omitempty"`
+}
+
+// RolloutStatus is posted to the beekeeper of a service when its
+// rollout converged, failed or timed out, and with the "decision"
+// state when the decision about its latest image changed
+type RolloutStatus struct {
+	Owner          string        `json:"owner"`
+	Repo           string        `json:"repo"`
+	ServiceID      string        `json:"serviceId"`
+	Service        string        `json:"service"`
+	Image          string        `json:"image"`
+	LatestImage    string        `json:"latestImage,omitempty"`
+	State          string        `json:"state"`
+	Reason         Reason        `json:"reason,omitempty"`
+	Outcome        Outcome       `json:"outcome,omitempty"`
+	ReasonsVersion int           `json:"reasonsVersion"`
+	Message        string        `json:"message,omitempty"`
+	Failures       []TaskFailure `json:"failures,omitempty"`
+	RequestID      string        `json:"requestId"`
+	Cluster        string        `json:"cluster,omitempty"`
+	Environment    string        `json:"environment,omitempty"`
+	Timestamp      time.Time     `json:"timestamp"`
+}
+
+// getTaskFailures returns the failed and rejected tasks of the
+// service on dockerURL, the most recent first
+func (deployer *Deployer) getTaskFailures(serviceID, dockerURL string) ([]TaskFailure, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+
+	filter := filters.NewArgs()
+	filter.Add("service", serviceID)
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "TaskList", err)
+	}
+	var failed []swarm.Task
+	for _, task := range tasks {
+		if task.Spec.ContainerSpec.Image != dockerURL {
+			continue
+		}
+		if task.Status.State == swarm.TaskStateFailed || task.Status.State == swarm.TaskStateRejected {
+			failed = append(failed, task)
+		}
+	}
+	if len(failed) == 0 {
+		return nil, nil
+	}
+	sort.Sort(byTimestamp(failed))
+	if len(failed) > maxTaskFailures {
+		failed = failed[:maxTaskFailures]
+	}
+
+	nodes, err := deployer.dockerClient.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		debug("could not list nodes for the failures of %s: %v", serviceID, deployer.dockerError(ctx, "NodeList", err))
+	}
+	hostnames := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		hostnames[node.ID] = node.Description.Hostname
+	}
+
+	failures := make([]TaskFailure, len(failed))
+	for i, task := range failed {
+		message := task.Status.Err
+		if message == "" {
+			message = task.Status.Message
+		}
+		failures[i] = TaskFailure{
+			TaskID:   task.ID,
+			NodeID:   task.NodeID,
+			Node:     hostnames[task.NodeID],
+			State:    string(task.Status.State),
+			Message:  message,
+			ExitCode: task.Status.ContainerStatus.ExitCode,
+		}
+	}
+	return failures, nil
+}
+
+// summarizeFailures lists the distinct failure messages
+// with how many tasks failed with each, e.g. for an alert
+func summarizeFailures(failures []TaskFailure) string {
+	counts := make(map[string]int)
+	var messages []string
+	for _, failure := range failures {
+		message := failure.Message
+		if failure.ExitCode != 0 {
+			message = fmt.Sprintf("%s (exit code %d)", message, failure.ExitCode)
+		}
+		if counts[message] == 0 {
+			messages = append(messages, message)
+		}
+		counts[message]++
+	}
+	for i, message := range messages {
+		if counts[message] > 1 {
+			messages[i] = fmt.Sprintf("%dx %s", counts[message], message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// postRolloutStatus posts the outcome of a rollout to the status
+// path on the beekeeper of the service, when a path is configured
+func (deployer *Deployer) postRolloutStatus(service swarm.Service, status RolloutStatus) {
+	if deployer.statusPath == "" {
+		return
+	}
+	status.Owner, status.Repo = deployer.getBeekeeperProject(service)
+	status.ServiceID = service.ID
+	status.Service = service.Spec.Name
+	status.Image = service.Spec.TaskTemplate.ContainerSpec.Image
+	status.Cluster = deployer.cluster
+	status.Environment = deployer.environment
+	status.ReasonsVersion = ReasonsVersion
+	status.Timestamp = deployer.clock.Now()
+	if err := deployer.sendRolloutStatus(service, status); err != nil {
+		countLabeledMetric("rollout_statuses", "error")
+		debug("[%s] could not post the rollout status of %s: %v", status.RequestID, service.ID, redactError(err))
+		return
+	}
+	countLabeledMetric("rollout_statuses", "ok")
+}
+
+// postDecision posts the decision about the latest image of the
+// service when it differs from the last one. Deploys are reported
+// when their rollout ends instead
+func (deployer *Deployer) postDecision(service swarm.Service, state ServiceState) {
+	if deployer.statusPath == "" || state.LatestImage == "" || state.Reason == ReasonDeployed {
+		return
+	}
+	deployer.statesLock.Lock()
+	previous, ok := deployer.states[state.ID]
+	deployer.statesLock.Unlock()
+	if ok && previous.Reason == state.Reason && previous.LatestImage == state.LatestImage {
+		return
+	}
+	go deployer.postRolloutStatus(service, RolloutStatus{
+		LatestImage: state.LatestImage,
+		State:       "decision",
+		Reason:      state.Reason,
+		Outcome:     state.Reason.Outcome(),
+		Message:     state.Error,
+		RequestID:   deployer.requestID,
+	})
+}
+
+func (deployer *Deployer) sendRolloutStatus(service swarm.Service, status RolloutStatus) error {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	beekeeper, err := deployer.getBeekeeper(service)
+	if err != nil {
+		return err
+	}
+	req, err := deployer.newBeekeeperRequest(status.RequestID, beekeeper, "POST", beekeeper.uri+deployer.statusPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := deployer.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Invalid rollout status response status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+type byTimestamp []swarm.Task
+
+func (tasks byTimestamp) Len() int      { return len(tasks) }
+func (tasks byTimestamp) Swap(i, j int) { tasks[i], tasks[j] = tasks[j], tasks[i] }
+func (tasks byTimestamp) Less(i, j int) bool {
+	return tasks[i].Status.Timestamp.After(tasks[j].Status.Timestamp)
+}
@@ -0,0 +1,152 @@
+package deployer
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+// errInjectedFault is what a beekeeper call failed by Faults returns
+var errInjectedFault = errors.New("injected fault")
+
+// Faults are failures injected into the calls of the updater, to test
+// alerting and recovery in staging without breaking its dependencies
+type Faults struct {
+	// BeekeeperErrors is the share of beekeeper lookups that fail
+	BeekeeperErrors float64
+
+	// DockerUpdateDelay delays every docker service update, past
+	// the docker timeout it fails the update like docker would
+	DockerUpdateDelay time.Duration
+
+	// PausedRollouts is the share of inspections of an updating
+	// service that report its rollout paused
+	PausedRollouts float64
+}
+
+// ParseFaults parses comma separated faults, e.g.
+// "beekeeper-errors=0.1,docker-update-delay=5s,paused-rollouts=0.5"
+func ParseFaults(value string) (*Faults, error) {
+	faults := &Faults{}
+	for _, fault := range strings.Split(value, ",") {
+		fault = strings.TrimSpace(fault)
+		if fault == "" {
+			continue
+		}
+		parts := strings.SplitN(fault, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("fault %q is not name=value", fault)
+		}
+		var err error
+		switch parts[0] {
+		case "beekeeper-errors":
+			faults.BeekeeperErrors, err = parseShare(parts[1])
+		case "docker-update-delay":
+			faults.DockerUpdateDelay, err = time.ParseDuration(parts[1])
+		case "paused-rollouts":
+			faults.PausedRollouts, err = parseShare(parts[1])
+		default:
+			return nil, fmt.Errorf("unknown fault %q", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fault %s: %v", parts[0], err)
+		}
+	}
+	return faults, nil
+}
+
+func parseShare(value string) (float64, error) {
+	share, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if share < 0 || share > 1 {
+		return 0, fmt.Errorf("%v is not between 0 and 1", share)
+	}
+	return share, nil
+}
+
+// faultInjector decides which calls fail, it is nil without faults
+type faultInjector struct {
+	faults Faults
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+func newFaultInjector(options *Options) *faultInjector {
+	if options.Faults == nil {
+		return nil
+	}
+	return &faultInjector{
+		faults: *options.Faults,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// inject returns true for share of the calls, counting them by fault
+func (injector *faultInjector) inject(fault string, share float64) bool {
+	if injector == nil || share <= 0 {
+		return false
+	}
+	injector.lock.Lock()
+	injected := injector.random.Float64() < share
+	injector.lock.Unlock()
+	if injected {
+		countLabeledMetric("injected_faults", fault)
+	}
+	return injected
+}
+
+// beekeeperError returns an error for the beekeeper lookups to fail
+func (injector *faultInjector) beekeeperError() error {
+	if injector != nil && injector.inject("beekeeper-errors", injector.faults.BeekeeperErrors) {
+		return errInjectedFault
+	}
+	return nil
+}
+
+// faultyDocker injects the docker faults into the calls of the deployer
+type faultyDocker struct {
+	DockerClient
+	injector *faultInjector
+}
+
+// injectDockerFaults wraps dockerClient in the faults of the
+// injector, without faults it is returned as is
+func injectDockerFaults(dockerClient DockerClient, injector *faultInjector) DockerClient {
+	if injector == nil || (injector.faults.DockerUpdateDelay <= 0 && injector.faults.PausedRollouts <= 0) {
+		return dockerClient
+	}
+	return &faultyDocker{dockerClient, injector}
+}
+
+func (docker *faultyDocker) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	service, raw, err := docker.DockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	if err == nil && service.UpdateStatus.State == swarm.UpdateStateUpdating && docker.injector.inject("paused-rollouts", docker.injector.faults.PausedRollouts) {
+		service.UpdateStatus.State = swarm.UpdateStatePaused
+		service.UpdateStatus.Message = "update paused by an injected fault"
+	}
+	return service, raw, err
+}
+
+func (docker *faultyDocker) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error {
+	if delay := docker.injector.faults.DockerUpdateDelay; delay > 0 {
+		countLabeledMetric("injected_faults", "docker-update-delay")
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return docker.DockerClient.ServiceUpdate(ctx, serviceID, version, service, options)
+}
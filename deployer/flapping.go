@@ -0,0 +1,123 @@
+package deployer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// defaultFlapChanges is how many times the answer for a project
+// may change within the flap window before it counts as flapping
+const defaultFlapChanges = 3
+
+// flapDetector remembers when the latest deployment of each
+// project changed. A project whose answer changed FlapChanges
+// times within FlapWindow, back to an image it answered before,
+// is flapping, e.g. two ci pipelines deploying over each other
+type flapDetector struct {
+	window  time.Duration
+	changes int
+	answers map[deploymentKey]*flapHistory
+	lock    sync.Mutex
+}
+
+type flapHistory struct {
+	dockerURL string
+	changes   []flapChange
+	alerted   bool
+}
+
+type flapChange struct {
+	at        time.Time
+	dockerURL string
+}
+
+func newFlapDetector(options *Options) *flapDetector {
+	if options.FlapWindow <= 0 {
+		return nil
+	}
+	changes := options.FlapChanges
+	if changes <= 0 {
+		changes = defaultFlapChanges
+	}
+	return &flapDetector{
+		window:  options.FlapWindow,
+		changes: changes,
+		answers: make(map[deploymentKey]*flapHistory),
+	}
+}
+
+// observe records the answer beekeeper gave for key, it
+// returns until when the project is held as flapping and
+// whether it just started to flap
+func (detector *flapDetector) observe(key deploymentKey, dockerURL string, now time.Time) (until time.Time, started bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	history, ok := detector.answers[key]
+	if !ok {
+		detector.answers[key] = &flapHistory{dockerURL: dockerURL}
+		return time.Time{}, false
+	}
+	if history.dockerURL != dockerURL {
+		history.changes = append(history.changes, flapChange{now, dockerURL})
+		history.dockerURL = dockerURL
+	}
+
+	cutoff := now.Add(-detector.window)
+	kept := history.changes[:0]
+	for _, change := range history.changes {
+		if change.at.After(cutoff) {
+			kept = append(kept, change)
+		}
+	}
+	history.changes = kept
+	if len(kept) < detector.changes || !revisits(kept) {
+		history.alerted = false
+		return time.Time{}, false
+	}
+	// it stops flapping once enough changes aged out of the window
+	until = kept[len(kept)-detector.changes].at.Add(detector.window)
+	started = !history.alerted
+	history.alerted = true
+	return until, started
+}
+
+// revisits returns true if the answer changed back
+// to an image it was changed to before
+func revisits(changes []flapChange) bool {
+	seen := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		if seen[change.dockerURL] {
+			return true
+		}
+		seen[change.dockerURL] = true
+	}
+	return false
+}
+
+// checkFlapping returns until when the service is held because the
+// answer for its project flaps, zero when it does not. The first
+// time a project flaps it is alerted on
+func (deployer *Deployer) checkFlapping(service swarm.Service, key deploymentKey, dockerURL string) time.Time {
+	if deployer.flapDetector == nil {
+		return time.Time{}
+	}
+	until, started := deployer.flapDetector.observe(key, dockerURL, deployer.clock.Now())
+	if until.IsZero() {
+		return until
+	}
+	countLabeledMetric("flapping_projects", key.owner+"/"+key.repo)
+	if started {
+		deployer.sendAlert(Alert{
+			Kind:      "deployment-flapping",
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Image:     dockerURL,
+			Message:   fmt.Sprintf("The latest deployment of %v/%v changed %d times within %v, holding updates until %v", key.owner, key.repo, deployer.flapDetector.changes, deployer.flapDetector.window, until.Format(time.RFC3339)),
+			Owner:     deployer.serviceOwner(service),
+		})
+	}
+	return until
+}
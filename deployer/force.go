@@ -0,0 +1,67 @@
+package deployer
+
+import "fmt"
+
+// ForceUpdate deploys image to the service regardless of its labels
+// or the last rollout, looking up the latest deployment in
+// beekeeper when image is empty, even one held back by deploy_after.
+// Only a looked up deployment runs its migration. It returns the
+// deployed image
+func (deployer *Deployer) ForceUpdate(serviceName, image string) (string, error) {
+	deployer.requestID = newRequestID()
+
+	ctx, cancel := deployer.dockerContext()
+	service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceName)
+	err = deployer.dockerError(ctx, "ServiceInspect", err)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+
+	owner, repo := deployer.getBeekeeperProject(service)
+	var metadata *RequestMetadata
+	if image == "" {
+		if owner == "" || repo == "" {
+			return "", classify(ErrUnparsableImage, fmt.Errorf("Could not parse docker URL %v %v", getCurrentDockerURL(service), service.ID))
+		}
+		beekeeper, err := deployer.getBeekeeper(service)
+		if err != nil {
+			return "", err
+		}
+		metadata, err = deployer.getLatestDeployment(beekeeper, owner, repo)
+		if err != nil {
+			return "", fmt.Errorf("Error getting latest docker URL for %v/%v: %v", owner, repo, redactError(err).Error())
+		}
+		image, err = deployer.expandDockerURL(metadata.DockerURL, service, owner, repo)
+		if err != nil {
+			return "", err
+		}
+		image = deployer.mirrorDockerURL(image)
+	}
+	if err := deployer.validateDeployment(owner, repo, image); err != nil {
+		return "", err
+	}
+
+	deployer.debug("force updating %s to %s", service.ID, image)
+	countMetric("force_updates")
+	var migration *Migration
+	if metadata != nil {
+		migration = metadata.Migration
+	}
+	if _, err := deployer.beforeDeploy(service, image, migration); err != nil {
+		return "", err
+	}
+	service = annotateDeploy(service, metadata)
+	if err := deployer.deploy(service, image); err != nil {
+		return "", err
+	}
+	deployer.recordState(ServiceState{
+		ID:          service.ID,
+		Name:        service.Spec.Name,
+		Image:       getCurrentDockerURL(service),
+		LatestImage: image,
+		Reason:      ReasonDeployed,
+		CheckedAt:   deployer.clock.Now(),
+	})
+	return image, nil
+}
@@ -0,0 +1,72 @@
+package deployer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// getMinHealthy returns the fraction of the replicas of the service
+// that must run before it is updated, from its minHealthy label or
+// the deployer. Zero disables the check
+func (deployer *Deployer) getMinHealthy(service swarm.Service) float64 {
+	label := service.Spec.Labels["octoblu.beekeeper.minHealthy"]
+	if label == "" {
+		return deployer.minHealthy
+	}
+	fraction, err := strconv.ParseFloat(label, 64)
+	if err != nil || fraction < 0 || fraction > 1 {
+		deployer.debug("invalid minHealthy label %q on %s, using %v", label, service.ID, deployer.minHealthy)
+		return deployer.minHealthy
+	}
+	return fraction
+}
+
+// checkHealthy returns an error when fewer than the minimum healthy
+// fraction of the replicas of the service are running, updating
+// a degraded service would only take more of it down
+func (deployer *Deployer) checkHealthy(service swarm.Service) error {
+	minHealthy := deployer.getMinHealthy(service)
+	if minHealthy <= 0 {
+		return nil
+	}
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	filter := filters.NewArgs()
+	filter.Add("service", service.ID)
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return deployer.dockerError(ctx, "TaskList", err)
+	}
+
+	desired, running := 0, 0
+	for _, task := range tasks {
+		if task.DesiredState != swarm.TaskStateRunning {
+			continue
+		}
+		desired++
+		if task.Status.State == swarm.TaskStateRunning {
+			running++
+		}
+	}
+	if replicated := service.Spec.Mode.Replicated; replicated != nil && replicated.Replicas != nil {
+		desired = int(*replicated.Replicas)
+	}
+	if desired == 0 || float64(running) >= minHealthy*float64(desired) {
+		return nil
+	}
+	return &degradedError{running: running, desired: desired, minHealthy: minHealthy}
+}
+
+// degradedError is returned by checkHealthy for a degraded service
+type degradedError struct {
+	running, desired int
+	minHealthy       float64
+}
+
+func (err *degradedError) Error() string {
+	return fmt.Sprintf("Only %d of %d replicas are running, below the minimum of %v healthy", err.running, err.desired, err.minHealthy)
+}
@@ -0,0 +1,55 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Heartbeat tells beekeeper an updater is alive
+// and how its last cycle went
+type Heartbeat struct {
+	Cluster         string    `json:"cluster"`
+	Environment     string    `json:"environment,omitempty"`
+	Version         string    `json:"version"`
+	TrackedServices int       `json:"trackedServices"`
+	LastCycleAt     time.Time `json:"lastCycleAt"`
+	LastCycleError  string    `json:"lastCycleError,omitempty"`
+	Healthy         bool      `json:"healthy"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// SendHeartbeat posts heartbeat to path on the default beekeeper,
+// with the cluster and environment of the deployer
+func (deployer *Deployer) SendHeartbeat(path string, heartbeat Heartbeat) error {
+	heartbeat.Cluster = deployer.cluster
+	heartbeat.Environment = deployer.environment
+	body, err := json.Marshal(heartbeat)
+	if err != nil {
+		return err
+	}
+	beekeeper := deployer.defaultBeekeeper()
+	req, err := deployer.newBeekeeperRequest("", beekeeper, "POST", beekeeper.uri+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := deployer.httpClient.Do(req)
+	if err != nil {
+		countLabeledMetric("heartbeats", "error")
+		return redactError(err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 300 {
+		countLabeledMetric("heartbeats", "error")
+		return fmt.Errorf("Invalid heartbeat response status code %v", res.StatusCode)
+	}
+	countLabeledMetric("heartbeats", "ok")
+	return nil
+}
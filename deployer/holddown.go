@@ -0,0 +1,96 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const (
+	// previousDockerURLLabel is the image a deploy replaced,
+	// going back to it is a rollback of the deployed image
+	previousDockerURLLabel = "octoblu.beekeeper.previousDockerURL"
+
+	// badDockerURLLabel is an image that was rolled back, it is not
+	// deployed again until badUntilLabel
+	badDockerURLLabel = "octoblu.beekeeper.badDockerURL"
+	badUntilLabel     = "octoblu.beekeeper.badUntil"
+)
+
+// noteRollback marks the deployed image of the service bad for the
+// hold-down when the service runs the image the deploy replaced
+// again, e.g. after docker service update --rollback. The labels
+// keep it across restarts of the updater
+func (deployer *Deployer) noteRollback(service swarm.Service) swarm.Service {
+	if deployer.rollbackHoldDown <= 0 {
+		return service
+	}
+	last := deployer.lastDeploy(service)
+	deployed, previous := last.LastDockerURL, last.PreviousDockerURL
+	if deployed == "" || previous == "" || previous == deployed || getCurrentDockerURL(service) != previous {
+		return service
+	}
+	if service.Spec.Labels[badDockerURLLabel] == deployed {
+		return service
+	}
+	updated, err := deployer.markBad(service, deployed)
+	if err != nil {
+		deployer.debug("could not mark %s bad on %s: %v", deployed, service.ID, err)
+		return service
+	}
+	deployer.audit(AuditRecord{
+		RequestID:     deployer.requestID,
+		ServiceID:     service.ID,
+		Service:       service.Spec.Name,
+		Event:         "rolled-back",
+		Image:         previous,
+		PreviousImage: deployed,
+		Message:       fmt.Sprintf("Holding %s down until %s", deployed, updated.Spec.Labels[badUntilLabel]),
+	})
+	return updated
+}
+
+// markBad labels dockerURL as bad on the service for the hold-down
+func (deployer *Deployer) markBad(service swarm.Service, dockerURL string) (swarm.Service, error) {
+	labels := make(map[string]string, len(service.Spec.Labels)+2)
+	for key, value := range service.Spec.Labels {
+		labels[key] = value
+	}
+	labels[badDockerURLLabel] = dockerURL
+	labels[badUntilLabel] = deployer.clock.Now().Add(deployer.rollbackHoldDown).Format(time.RFC3339)
+	service.Spec.Labels = labels
+	if deployer.dryRun {
+		deployer.debug("dry run, not labeling %s bad on %s", dockerURL, service.ID)
+		return service, nil
+	}
+
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.writeService(service, service.Spec.TaskTemplate.ContainerSpec.Image, options); err != nil {
+		return service, err
+	}
+	countLabeledMetric("rollbacks_held_down", service.Spec.Name)
+
+	// the version changed, a deploy this cycle needs the new one
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	updated, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, service.ID)
+	if err != nil {
+		return service, deployer.dockerError(ctx, "ServiceInspect", err)
+	}
+	return updated, nil
+}
+
+// heldDownUntil returns when dockerURL may be deployed to the
+// service again, if it was rolled back within the hold-down
+func heldDownUntil(service swarm.Service, dockerURL string, now time.Time) (time.Time, bool) {
+	if service.Spec.Labels[badDockerURLLabel] != dockerURL {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, service.Spec.Labels[badUntilLabel])
+	if err != nil || now.After(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
@@ -0,0 +1,188 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const (
+	preDeployLabel  = "octoblu.beekeeper.preDeploy"
+	postDeployLabel = "octoblu.beekeeper.postDeploy"
+
+	// jobHookPrefix marks a hook run as a one-shot job
+	// of the new image instead of an http call
+	jobHookPrefix = "job:"
+)
+
+// HookEvent is posted as json to an http deploy hook
+type HookEvent struct {
+	Phase         string `json:"phase"`
+	ServiceID     string `json:"serviceId"`
+	Service       string `json:"service"`
+	Image         string `json:"image"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	RequestID     string `json:"requestId"`
+	Cluster       string `json:"cluster,omitempty"`
+	Environment   string `json:"environment,omitempty"`
+}
+
+// runHook runs the hook of the service in label, if it has one.
+// An http(s) url is posted a HookEvent and must answer 2xx,
+// "job:<command>" runs the command with sh in a one-shot service
+// of the new image, e.g. to migrate a database, and must exit 0.
+// Either must finish within the deploy timeout of the service
+func (deployer *Deployer) runHook(requestID, label string, service swarm.Service, dockerURL, previousImage string) error {
+	hook := service.Spec.Labels[label]
+	if hook == "" {
+		return nil
+	}
+	phase := strings.TrimPrefix(label, "octoblu.beekeeper.")
+	timeout := deployer.getDeployTimeout(service)
+	debug("[%s] running %s hook of %s", requestID, phase, service.ID)
+
+	var err error
+	switch {
+	case strings.HasPrefix(hook, jobHookPrefix):
+		err = deployer.runJob(requestID, strings.ToLower(phase), service, dockerURL, strings.TrimPrefix(hook, jobHookPrefix), timeout)
+	case strings.HasPrefix(hook, "http://"), strings.HasPrefix(hook, "https://"):
+		err = postHook(hook, timeout, HookEvent{
+			Phase:         phase,
+			ServiceID:     service.ID,
+			Service:       service.Spec.Name,
+			Image:         dockerURL,
+			PreviousImage: previousImage,
+			RequestID:     requestID,
+			Cluster:       deployer.cluster,
+			Environment:   deployer.environment,
+		})
+	default:
+		err = fmt.Errorf("Invalid %v label, expected an http(s) url or %v<command>", label, jobHookPrefix)
+	}
+	if err == nil {
+		countLabeledMetric("hooks", phase)
+		return nil
+	}
+
+	err = fmt.Errorf("%v hook of %v failed: %v", phase, service.Spec.Name, redactError(err).Error())
+	countLabeledMetric("hook_errors", phase)
+	deployer.audit(AuditRecord{
+		RequestID:     requestID,
+		ServiceID:     service.ID,
+		Service:       service.Spec.Name,
+		Event:         "hook-failed",
+		Image:         dockerURL,
+		PreviousImage: previousImage,
+		Message:       err.Error(),
+	})
+	deployer.sendAlert(Alert{
+		Kind:      "hook-failed",
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     dockerURL,
+		Message:   err.Error(),
+		Owner:     deployer.serviceOwner(service),
+	})
+	return err
+}
+
+func postHook(url string, timeout time.Duration, event HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Invalid hook response status code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// runJob runs command in a single task of image with the env, mounts
+// and networks of the service, but none of its ports or aliases,
+// and removes the job service once the task stopped
+func (deployer *Deployer) runJob(requestID, kind string, service swarm.Service, image, command string, timeout time.Duration) error {
+	replicas := uint64(1)
+	spec := service.Spec
+	spec.Name = fmt.Sprintf("%s-%s-%s", service.Spec.Name, kind, newRequestID())
+	spec.Labels = map[string]string{"octoblu.beekeeper.jobOf": service.ID}
+	spec.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	spec.UpdateConfig = nil
+	spec.EndpointSpec = nil
+	spec.Networks = make([]swarm.NetworkAttachmentConfig, len(service.Spec.Networks))
+	for i, network := range service.Spec.Networks {
+		spec.Networks[i] = swarm.NetworkAttachmentConfig{Target: network.Target}
+	}
+	spec.TaskTemplate.ContainerSpec.Image = image
+	spec.TaskTemplate.ContainerSpec.Command = []string{"sh", "-c", command}
+	spec.TaskTemplate.ContainerSpec.Args = nil
+	spec.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionNone}
+
+	ctx, cancel := deployer.dockerContext()
+	options := types.ServiceCreateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	response, err := deployer.dockerClient.ServiceCreate(ctx, spec, options)
+	err = deployer.dockerError(ctx, "ServiceCreate", err)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := deployer.dockerContext()
+		defer cancel()
+		if err := deployer.dockerClient.ServiceRemove(ctx, response.ID); err != nil {
+			debug("[%s] could not remove job service %s: %v", requestID, spec.Name, deployer.dockerError(ctx, "ServiceRemove", err))
+		}
+	}()
+	debug("[%s] running %s in %s", requestID, command, spec.Name)
+
+	deadline := deployer.clock.Now().Add(timeout)
+	for deployer.clock.Now().Before(deadline) {
+		deployer.clock.Sleep(rolloutPollInterval)
+		done, err := deployer.jobDone(response.ID)
+		if done {
+			return err
+		}
+	}
+	return fmt.Errorf("Job %v did not finish within %v", spec.Name, timeout)
+}
+
+// jobDone returns true once the task of the job stopped,
+// with an error unless it completed
+func (deployer *Deployer) jobDone(serviceID string) (bool, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	filter := filters.NewArgs()
+	filter.Add("service", serviceID)
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return false, nil
+	}
+	for _, task := range tasks {
+		switch task.Status.State {
+		case swarm.TaskStateComplete:
+			return true, nil
+		case swarm.TaskStateFailed, swarm.TaskStateRejected, swarm.TaskStateShutdown:
+			message := task.Status.Err
+			if message == "" {
+				message = task.Status.Message
+			}
+			return true, fmt.Errorf("Job task %v %v: %v", task.ID, task.Status.State, message)
+		}
+	}
+	return false, nil
+}
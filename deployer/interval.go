@@ -0,0 +1,55 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const (
+	// UnparsableIgnore treats a service with an unparsable
+	// lastUpdatedAt as never updated, e.g. a hand-edited label
+	UnparsableIgnore = "ignore"
+
+	// UnparsableHold does not update a service with an unparsable
+	// lastUpdatedAt until the label is fixed or removed
+	UnparsableHold = "hold"
+)
+
+// lastUpdatedAt returns when the updater last deployed to the
+// service, the zero time when it never did
+func (deployer *Deployer) lastUpdatedAt(service swarm.Service) (time.Time, error) {
+	value := deployer.lastDeploy(service).LastUpdatedAt
+	if value == "" {
+		return time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unparsable lastUpdatedAt %q", value)
+	}
+	return at, nil
+}
+
+// checkUpdateInterval returns the reason to hold back a deploy to a
+// service updated less than the min update interval ago, or whose
+// lastUpdatedAt is unparsable with UnparsableHold, empty otherwise
+func (deployer *Deployer) checkUpdateInterval(service swarm.Service) (Reason, error) {
+	lastUpdatedAt, err := deployer.lastUpdatedAt(service)
+	if err != nil {
+		if deployer.unparsableUpdated == UnparsableHold {
+			return ReasonInvalidUpdatedAt, err
+		}
+		deployer.debug("%v on %s, treating it as never updated", err, service.ID)
+	}
+	if deployer.minUpdateInterval <= 0 || lastUpdatedAt.IsZero() {
+		return "", nil
+	}
+	next := lastUpdatedAt.Add(deployer.minUpdateInterval)
+	if !deployer.clock.Now().Before(next) {
+		return "", nil
+	}
+	deployer.debug("%s was updated at %s, not updating it again until %s", service.ID, lastUpdatedAt.Format(time.RFC3339), next.Format(time.RFC3339))
+	deployer.holdUntil(next)
+	return ReasonTooSoon, nil
+}
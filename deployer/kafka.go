@@ -0,0 +1,148 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	kafkaBatchSize     = 100
+	kafkaFlushInterval = time.Second
+	kafkaQueueSize     = 10000
+)
+
+// ExportEvent is published to kafka for every deploy, rollout
+// outcome and failure in the audit log, and every skip
+// decision that differs from the last one of the service
+type ExportEvent struct {
+	Type          string    `json:"type"`
+	Event         string    `json:"event"`
+	Timestamp     time.Time `json:"timestamp"`
+	RequestID     string    `json:"requestId"`
+	ServiceID     string    `json:"serviceId"`
+	Service       string    `json:"service"`
+	Image         string    `json:"image,omitempty"`
+	LatestImage   string    `json:"latestImage,omitempty"`
+	PreviousImage string    `json:"previousImage,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	Cluster       string    `json:"cluster,omitempty"`
+	Environment   string    `json:"environment,omitempty"`
+}
+
+// kafkaProducer publishes events to a topic through the rest proxy
+// of the kafka cluster in batches, in the background. Events are
+// dropped, and counted, while the proxy cannot keep up
+type kafkaProducer struct {
+	url    string
+	client *http.Client
+	events chan ExportEvent
+}
+
+type kafkaRecord struct {
+	Key   string      `json:"key"`
+	Value ExportEvent `json:"value"`
+}
+
+func newKafkaProducer(restURL, topic string) *kafkaProducer {
+	if restURL == "" {
+		return nil
+	}
+	producer := &kafkaProducer{
+		url:    strings.TrimSuffix(restURL, "/") + "/topics/" + topic,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan ExportEvent, kafkaQueueSize),
+	}
+	go producer.run()
+	return producer
+}
+
+// export queues event for kafka, if it is enabled
+func (deployer *Deployer) export(event ExportEvent) {
+	if deployer.kafka == nil {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = deployer.clock.Now()
+	}
+	event.Cluster = deployer.cluster
+	event.Environment = deployer.environment
+	select {
+	case deployer.kafka.events <- event:
+	default:
+		countMetric("kafka_dropped")
+	}
+}
+
+// exportDecision exports a skip decision when it differs
+// from the last decision for the service
+func (deployer *Deployer) exportDecision(state ServiceState) {
+	if deployer.kafka == nil || state.Reason == ReasonDeployed {
+		return
+	}
+	deployer.statesLock.Lock()
+	previous, ok := deployer.states[state.ID]
+	deployer.statesLock.Unlock()
+	if ok && previous.Reason == state.Reason && previous.LatestImage == state.LatestImage {
+		return
+	}
+	deployer.export(ExportEvent{
+		Type:        "skip",
+		Event:       string(state.Reason),
+		RequestID:   deployer.requestID,
+		ServiceID:   state.ID,
+		Service:     state.Name,
+		Image:       state.Image,
+		LatestImage: state.LatestImage,
+		Message:     state.Error,
+	})
+}
+
+func (producer *kafkaProducer) run() {
+	var batch []kafkaRecord
+	ticker := time.NewTicker(kafkaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-producer.events:
+			batch = append(batch, kafkaRecord{Key: event.Service, Value: event})
+			if len(batch) < kafkaBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := producer.send(batch); err != nil {
+			countLabeledMetric("kafka_errors", "send")
+			countMetric("kafka_dropped")
+			debug("could not publish %d events to kafka: %v", len(batch), redactError(err))
+		} else {
+			metrics.Add("kafka_published", int64(len(batch)))
+		}
+		batch = nil
+	}
+}
+
+func (producer *kafkaProducer) send(batch []kafkaRecord) error {
+	body, err := json.Marshal(map[string]interface{}{"records": batch})
+	if err != nil {
+		return err
+	}
+	res, err := producer.client.Post(producer.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Invalid kafka rest proxy response status code %v", res.StatusCode)
+	}
+	return nil
+}
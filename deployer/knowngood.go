@@ -0,0 +1,152 @@
+package deployer
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// knownDeployments are the last answers beekeeper gave for each
+// project, kept in the state file, so an updater restarted while
+// beekeeper is unavailable still knows what its services should run
+type knownDeployments struct {
+	byProject map[string]knownDeployment
+	lock      sync.Mutex
+}
+
+// knownDeployment is a beekeeper answer and since when it was given
+type knownDeployment struct {
+	Metadata RequestMetadata `json:"metadata"`
+	Since    time.Time       `json:"since"`
+}
+
+func newKnownDeployments(options *Options) *knownDeployments {
+	if options.StateFile == "" {
+		return nil
+	}
+	return &knownDeployments{byProject: make(map[string]knownDeployment)}
+}
+
+// knownDeploymentKey keeps the projects of the beekeepers and tags apart
+func knownDeploymentKey(key deploymentKey) string {
+	return key.beekeeper + " " + key.owner + "/" + key.repo + " " + key.tags
+}
+
+// restoreKnownDeployments loads the known deployments of the state file
+func (deployer *Deployer) restoreKnownDeployments() {
+	if deployer.knownDeployments == nil || deployer.stateStore == nil {
+		return
+	}
+	state, err := deployer.stateStore.load()
+	if err != nil {
+		debug("could not load the known deployments from the state file: %v", err)
+		return
+	}
+	deployer.knownDeployments.lock.Lock()
+	defer deployer.knownDeployments.lock.Unlock()
+	for key, known := range state.Deployments {
+		deployer.knownDeployments.byProject[key] = known
+	}
+}
+
+// rememberDeployment keeps the answer of beekeeper for the project,
+// the state file is only written when the answer changed
+func (deployer *Deployer) rememberDeployment(key deploymentKey, metadata *RequestMetadata) {
+	if deployer.knownDeployments == nil || deployer.snapshot != nil {
+		return
+	}
+	deployer.knownDeployments.lock.Lock()
+	previous, ok := deployer.knownDeployments.byProject[knownDeploymentKey(key)]
+	if ok && reflect.DeepEqual(previous.Metadata, *metadata) {
+		deployer.knownDeployments.lock.Unlock()
+		return
+	}
+	deployer.knownDeployments.byProject[knownDeploymentKey(key)] = knownDeployment{
+		Metadata: *metadata,
+		Since:    deployer.clock.Now(),
+	}
+	deployer.knownDeployments.lock.Unlock()
+	deployer.saveKnownDeployments()
+}
+
+// forgetDeployment drops the project, beekeeper does not know it anymore
+func (deployer *Deployer) forgetDeployment(key deploymentKey) {
+	if deployer.knownDeployments == nil {
+		return
+	}
+	deployer.knownDeployments.lock.Lock()
+	_, ok := deployer.knownDeployments.byProject[knownDeploymentKey(key)]
+	delete(deployer.knownDeployments.byProject, knownDeploymentKey(key))
+	deployer.knownDeployments.lock.Unlock()
+	if ok {
+		deployer.saveKnownDeployments()
+	}
+}
+
+// knownDeployment returns the last answer of beekeeper for the project
+func (deployer *Deployer) knownDeployment(key deploymentKey) (knownDeployment, bool) {
+	if deployer.knownDeployments == nil {
+		return knownDeployment{}, false
+	}
+	deployer.knownDeployments.lock.Lock()
+	defer deployer.knownDeployments.lock.Unlock()
+	known, ok := deployer.knownDeployments.byProject[knownDeploymentKey(key)]
+	return known, ok
+}
+
+func (deployer *Deployer) saveKnownDeployments() {
+	if deployer.stateStore == nil {
+		return
+	}
+	deployer.knownDeployments.lock.Lock()
+	deployments := make(map[string]knownDeployment, len(deployer.knownDeployments.byProject))
+	for key, known := range deployer.knownDeployments.byProject {
+		deployments[key] = known
+	}
+	deployer.knownDeployments.lock.Unlock()
+	err := deployer.stateStore.update(func(state *persistedState) {
+		state.Deployments = deployments
+	})
+	if err != nil {
+		countMetric("state_file_errors")
+		debug("could not save the known deployments to the state file: %v", err)
+	}
+}
+
+// lastKnownGood returns the last answer of beekeeper for the project
+// while beekeeper is unavailable, with DeployLastKnownGood, so a
+// service reverted by hand or recreated with an old tag meanwhile
+// is converged back to it
+func (deployer *Deployer) lastKnownGood(key deploymentKey, err error) (*RequestMetadata, bool) {
+	if !deployer.deployLastKnownGood || !errors.Is(err, ErrBeekeeperUnavailable) {
+		return nil, false
+	}
+	known, ok := deployer.knownDeployment(key)
+	if !ok || known.Metadata.Retired != nil {
+		return nil, false
+	}
+	return &known.Metadata, true
+}
+
+// knownLatestImage returns the image of the last answer of beekeeper
+// for the project of the service while beekeeper is unavailable, so
+// the drift of the service is still reported, empty otherwise
+func (deployer *Deployer) knownLatestImage(service swarm.Service, key deploymentKey, owner, repo string, err error) string {
+	if !errors.Is(err, ErrBeekeeperUnavailable) {
+		return ""
+	}
+	known, ok := deployer.knownDeployment(key)
+	if !ok || known.Metadata.Retired != nil {
+		return ""
+	}
+	dockerURL, err := deployer.expandDockerURL(known.Metadata.DockerURL, service, owner, repo)
+	if err != nil {
+		return ""
+	}
+	deployer.debug("beekeeper is unavailable, it answered %s for %s/%s since %s", known.Metadata.DockerURL, owner, repo, known.Since.Format(time.RFC3339))
+	countMetric("known_deployment_lookups")
+	return deployer.mirrorDockerURL(dockerURL)
+}
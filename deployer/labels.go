@@ -0,0 +1,137 @@
+package deployer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// bookkeepingLabels are written by the deployer on every deploy
+var bookkeepingLabels = []string{
+	"octoblu.beekeeper.lastDockerURL",
+	"octoblu.beekeeper.lastUpdatedAt",
+	weightFailedImageLabel,
+	migrationFailedImageLabel,
+	resumedAtLabel,
+	stuckImageLabel,
+	previousDockerURLLabel,
+	badDockerURLLabel,
+	badUntilLabel,
+	deploymentIDLabel,
+	commitSHALabel,
+	buildURLLabel,
+}
+
+// LabelChange is what a labels command changed,
+// or would change, on one service
+type LabelChange struct {
+	ServiceID string            `json:"serviceId"`
+	Service   string            `json:"service"`
+	Removed   []string          `json:"removed,omitempty"`
+	Renamed   map[string]string `json:"renamed,omitempty"`
+	Conflicts []string          `json:"conflicts,omitempty"`
+}
+
+// GarbageCollectLabels removes the bookkeeping labels from services
+// that no longer have the octoblu.beekeeper.update label
+// and are not given by --services
+func (deployer *Deployer) GarbageCollectLabels(dryRun bool) ([]LabelChange, error) {
+	services, err := deployer.listAllServices()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []LabelChange
+	for _, service := range services {
+		if _, tracked := deployer.updateLabel(service); tracked {
+			continue
+		}
+		change := LabelChange{ServiceID: service.ID, Service: service.Spec.Name}
+		for _, label := range bookkeepingLabels {
+			if _, ok := service.Spec.Labels[label]; ok {
+				change.Removed = append(change.Removed, label)
+				delete(service.Spec.Labels, label)
+			}
+		}
+		if len(change.Removed) == 0 {
+			continue
+		}
+		if !dryRun {
+			if err := deployer.updateLabels(service); err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// MigrateLabels renames every label starting with from to start with
+// to instead, a label already present under the new name is kept
+// and the old one left in place as a conflict
+func (deployer *Deployer) MigrateLabels(from, to string, dryRun bool) ([]LabelChange, error) {
+	services, err := deployer.listAllServices()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []LabelChange
+	for _, service := range services {
+		change := LabelChange{ServiceID: service.ID, Service: service.Spec.Name, Renamed: make(map[string]string)}
+		keys := make([]string, 0, len(service.Spec.Labels))
+		for key := range service.Spec.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, from) {
+				continue
+			}
+			renamed := to + strings.TrimPrefix(key, from)
+			if _, exists := service.Spec.Labels[renamed]; exists {
+				change.Conflicts = append(change.Conflicts, key)
+				continue
+			}
+			service.Spec.Labels[renamed] = service.Spec.Labels[key]
+			delete(service.Spec.Labels, key)
+			change.Renamed[key] = renamed
+		}
+		if len(change.Renamed) == 0 && len(change.Conflicts) == 0 {
+			continue
+		}
+		if len(change.Renamed) > 0 && !dryRun {
+			if err := deployer.updateLabels(service); err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func (deployer *Deployer) listAllServices() ([]swarm.Service, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	services, err := deployer.dockerClient.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "ServiceList", err)
+	}
+	return services, nil
+}
+
+// updateLabels writes the service spec back, only service labels
+// changed so no task is restarted
+func (deployer *Deployer) updateLabels(service swarm.Service) error {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	err := deployer.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return deployer.dockerError(ctx, "ServiceUpdate", err)
+	}
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	return nil
+}
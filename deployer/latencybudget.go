@@ -0,0 +1,149 @@
+package deployer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBudgetWindow is how far back the lookups are judged
+	defaultBudgetWindow = 10 * time.Minute
+	// minBudgetSamples keeps a few slow lookups of a quiet
+	// window from slowing the polling down
+	minBudgetSamples = 20
+	// maxPollBackoff bounds how many times longer
+	// the poll interval gets while over budget
+	maxPollBackoff = 8
+)
+
+// latencyBudget judges the beekeeper lookups of a window against
+// a p95 latency and an error rate. Each cycle over budget doubles
+// the poll interval, each cycle within it halves it back
+type latencyBudget struct {
+	p95       time.Duration
+	errorRate float64
+	window    time.Duration
+	samples   []lookupSample
+	backoff   int
+	lock      sync.Mutex
+}
+
+type lookupSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+func newLatencyBudget(options *Options) *latencyBudget {
+	if options.BeekeeperLatencyBudget <= 0 && options.BeekeeperErrorBudget <= 0 {
+		return nil
+	}
+	window := options.BeekeeperBudgetWindow
+	if window <= 0 {
+		window = defaultBudgetWindow
+	}
+	return &latencyBudget{
+		p95:       options.BeekeeperLatencyBudget,
+		errorRate: options.BeekeeperErrorBudget,
+		window:    window,
+		backoff:   1,
+	}
+}
+
+// observe records a lookup made at, failed for a
+// transport error, a 5xx or 429 response
+func (budget *latencyBudget) observe(at time.Time, latency time.Duration, failed bool) {
+	if budget == nil {
+		return
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	budget.samples = append(budget.samples, lookupSample{at, latency, failed})
+}
+
+// judge drops the lookups older than the window and returns the p95
+// latency and error rate of the others, over is false for too few
+func (budget *latencyBudget) judge(now time.Time) (p95 time.Duration, errorRate float64, over bool) {
+	cutoff := now.Add(-budget.window)
+	kept := budget.samples[:0]
+	for _, sample := range budget.samples {
+		if sample.at.After(cutoff) {
+			kept = append(kept, sample)
+		}
+	}
+	budget.samples = kept
+	if len(kept) < minBudgetSamples {
+		return 0, 0, false
+	}
+
+	latencies := make([]time.Duration, len(kept))
+	failed := 0
+	for i, sample := range kept {
+		latencies[i] = sample.latency
+		if sample.failed {
+			failed++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p95 = latencies[(len(latencies)*95-1)/100]
+	errorRate = float64(failed) / float64(len(kept))
+	over = (budget.p95 > 0 && p95 > budget.p95) || (budget.errorRate > 0 && errorRate > budget.errorRate)
+	return p95, errorRate, over
+}
+
+// checkLatencyBudget lengthens or shortens the poll interval after a
+// cycle and alerts when the lookups went over budget. Only the cycles
+// of the root deployer judge, the swarms share its budget
+func (deployer *Deployer) checkLatencyBudget() {
+	budget := deployer.latencyBudget
+	if budget == nil || deployer.parent != nil {
+		return
+	}
+	budget.lock.Lock()
+	p95, errorRate, over := budget.judge(deployer.clock.Now())
+	previous := budget.backoff
+	if over && budget.backoff < maxPollBackoff {
+		budget.backoff *= 2
+	} else if !over && budget.backoff > 1 {
+		budget.backoff /= 2
+	}
+	backoff := budget.backoff
+	budget.lock.Unlock()
+
+	metrics.Set("beekeeper_poll_backoff", expvarInt(int64(backoff)))
+	if backoff == previous {
+		return
+	}
+	if backoff < previous {
+		deployer.debug("beekeeper lookups within budget, polling %dx less often", backoff)
+		return
+	}
+	message := fmt.Sprintf("beekeeper lookups over budget, p95 %v and %.0f%% errors over the last %v, polling %dx less often", p95, errorRate*100, budget.window, backoff)
+	deployer.debug("%s", message)
+	if previous == 1 {
+		deployer.sendAlert(Alert{Kind: "beekeeper-over-budget", Message: message})
+	}
+}
+
+// MaxPollInterval returns the longest PollInterval returns for
+// base, while the beekeeper lookups stay over the latency budget
+func (deployer *Deployer) MaxPollInterval(base time.Duration) time.Duration {
+	if deployer.latencyBudget == nil {
+		return base
+	}
+	return base * maxPollBackoff
+}
+
+// PollInterval returns how long to wait between cycles, base
+// unless the beekeeper lookups went over the latency budget
+func (deployer *Deployer) PollInterval(base time.Duration) time.Duration {
+	budget := deployer.latencyBudget
+	if budget == nil {
+		return base
+	}
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return base * time.Duration(budget.backoff)
+}
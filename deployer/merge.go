@@ -0,0 +1,114 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// maxWriteAttempts bounds the retries of a write that raced
+// another update of the service
+const maxWriteAttempts = 3
+
+// imageChangedError means the image of a service was changed by
+// someone else between the cycle listing it and deploying to it
+type imageChangedError struct {
+	service string
+	image   string
+}
+
+func (err *imageChangedError) Error() string {
+	return fmt.Sprintf("The image of %s was changed to %s since it was listed, not deploying over it", err.service, err.image)
+}
+
+// Is makes it an ErrUpdateConflict
+func (err *imageChangedError) Is(target error) bool {
+	return target == ErrUpdateConflict
+}
+
+// writeService writes the changes the updater made to service, as
+// listed with listedImage, onto the spec docker has now: the image,
+// when it changed, with the update config of the deploy, and the
+// bookkeeping labels. Everything else an operator changed since the
+// service was listed, e.g. resources or env, is kept. A write that
+// races another update is merged again, a deploy over an image
+// changed since is refused
+func (deployer *Deployer) writeService(service swarm.Service, listedImage string, options types.ServiceUpdateOptions) error {
+	var err error
+	for attempt := 1; attempt <= maxWriteAttempts; attempt++ {
+		if err = deployer.writeMerged(service, listedImage, options); !isOutOfSequence(err) {
+			return err
+		}
+		deployer.debug("%s changed while writing it, merging again", service.ID)
+	}
+	return classify(ErrUpdateConflict, err)
+}
+
+func (deployer *Deployer) writeMerged(service swarm.Service, listedImage string, options types.ServiceUpdateOptions) error {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	current, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, service.ID)
+	if err != nil {
+		return deployer.dockerError(ctx, "ServiceInspect", err)
+	}
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	currentImage := current.Spec.TaskTemplate.ContainerSpec.Image
+	if image != listedImage && currentImage != listedImage && currentImage != image {
+		return &imageChangedError{service.Spec.Name, currentImage}
+	}
+	if current.Version.Index != service.Version.Index {
+		countMetric("spec_merges")
+	}
+	merged := mergeSpec(service.Spec, current.Spec, image != listedImage)
+	err = deployer.dockerClient.ServiceUpdate(ctx, service.ID, current.Version, merged, options)
+	return deployer.dockerError(ctx, "ServiceUpdate", err)
+}
+
+// mergeSpec returns theirs with the bookkeeping labels of ours and,
+// for a deploy, the image and update config of ours
+func mergeSpec(ours, theirs swarm.ServiceSpec, deploy bool) swarm.ServiceSpec {
+	merged := theirs
+	labels := make(map[string]string, len(theirs.Labels))
+	for key, value := range theirs.Labels {
+		labels[key] = value
+	}
+	for _, label := range bookkeepingLabels {
+		if value, ok := ours.Labels[label]; ok {
+			labels[label] = value
+		} else {
+			delete(labels, label)
+		}
+	}
+	merged.Labels = labels
+	if !deploy {
+		return merged
+	}
+
+	merged.TaskTemplate.ContainerSpec.Image = ours.TaskTemplate.ContainerSpec.Image
+	if ours.UpdateConfig != nil {
+		updateConfig := swarm.UpdateConfig{}
+		if theirs.UpdateConfig != nil {
+			updateConfig = *theirs.UpdateConfig
+		}
+		updateConfig.Parallelism = ours.UpdateConfig.Parallelism
+		updateConfig.FailureAction = ours.UpdateConfig.FailureAction
+		merged.UpdateConfig = &updateConfig
+	}
+	if ours.EndpointSpec != nil {
+		endpointSpec := swarm.EndpointSpec{Mode: ours.EndpointSpec.Mode}
+		if theirs.EndpointSpec != nil {
+			endpointSpec = *theirs.EndpointSpec
+		}
+		endpointSpec.Ports = mergePorts(endpointSpec.Ports, ours.EndpointSpec.Ports)
+		merged.EndpointSpec = &endpointSpec
+	}
+	return merged
+}
+
+// isOutOfSequence returns true if docker refused an update
+// because the service changed since the version given
+func isOutOfSequence(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "update out of sequence")
+}
@@ -0,0 +1,103 @@
+package deployer
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// metrics are published by expvar under "beekeeper",
+// see /debug/vars on the metrics address
+var metrics = expvar.NewMap("beekeeper")
+
+var metricsLock sync.Mutex
+
+// setIdentity publishes the cluster and environment next to the
+// counters, so the metrics of several swarms can be told apart
+func setIdentity(cluster, environment string) {
+	identity := func(value string) *expvar.String {
+		variable := new(expvar.String)
+		variable.Set(value)
+		return variable
+	}
+	metrics.Set("cluster", identity(cluster))
+	metrics.Set("environment", identity(environment))
+}
+
+// countMetric increments a plain counter
+func countMetric(name string) {
+	metrics.Add(name, 1)
+}
+
+// countLabeledMetric increments the label counter
+// nested under name, creating it on first use
+func countLabeledMetric(name, label string) {
+	labeledMetric(name).Add(label, 1)
+}
+
+func labeledMetric(name string) *expvar.Map {
+	return nestedMetric(metrics, name)
+}
+
+// clusterMetrics are the metrics of one swarm, nested under
+// "clusters" so the cycles of each can be told apart
+func clusterMetrics(cluster string) *expvar.Map {
+	return nestedMetric(labeledMetric("clusters"), cluster)
+}
+
+func nestedMetric(parent *expvar.Map, name string) *expvar.Map {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	nested, ok := parent.Get(name).(*expvar.Map)
+	if !ok {
+		nested = new(expvar.Map).Init()
+		parent.Set(name, nested)
+	}
+	return nested
+}
+
+// countClusterMetric increments the label counter nested under
+// name, both overall and in the metrics of the swarm
+func (deployer *Deployer) countClusterMetric(name, label string) {
+	countLabeledMetric(name, label)
+	nestedMetric(clusterMetrics(deployer.clusterLabel()), name).Add(label, 1)
+}
+
+// observeClusterLatency records a duration both overall
+// and in the metrics of the swarm
+func (deployer *Deployer) observeClusterLatency(name string, duration time.Duration) {
+	observeLatency(name, duration)
+	observeLatencyIn(clusterMetrics(deployer.clusterLabel()), name, duration)
+}
+
+// latencyBuckets are the upper bounds of the cumulative
+// buckets observeLatency counts into
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// observeLatency records a duration as a sum, a count
+// and cumulative buckets nested under name_bucket
+func observeLatency(name string, duration time.Duration) {
+	observeLatencyIn(metrics, name, duration)
+}
+
+func observeLatencyIn(parent *expvar.Map, name string, duration time.Duration) {
+	parent.AddFloat(name+"_seconds_sum", duration.Seconds())
+	parent.Add(name+"_count", 1)
+	buckets := nestedMetric(parent, name+"_bucket")
+	for _, bucket := range latencyBuckets {
+		if duration <= bucket {
+			buckets.Add("le_"+bucket.String(), 1)
+		}
+	}
+	buckets.Add("le_inf", 1)
+}
@@ -0,0 +1,92 @@
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// migrationFailedImageLabel holds the image whose migration
+// failed, so it is not migrated or deployed again
+const migrationFailedImageLabel = "octoblu.beekeeper.migrationFailedImage"
+
+// Migration is declared by a deployment to run before
+// the service is updated
+type Migration struct {
+	// Image defaults to the image of the deployment
+	Image   string `json:"image,omitempty"`
+	Command string `json:"command"`
+}
+
+// beforeDeploy runs the pre-deploy hook and then the migration
+// of the deployment, if any, the service is updated only if both
+// succeed
+func (deployer *Deployer) beforeDeploy(service swarm.Service, dockerURL string, migration *Migration) (Reason, error) {
+	previousImage := getCurrentDockerURL(service)
+	if err := deployer.runHook(deployer.requestID, preDeployLabel, service, dockerURL, previousImage); err != nil {
+		return ReasonHookFailed, err
+	}
+	if err := deployer.migrate(service, dockerURL, migration); err != nil {
+		return ReasonMigrationFailed, err
+	}
+	return "", nil
+}
+
+// migrate runs the migration as a job of the service, a failed
+// migration aborts the deploy of dockerURL for good
+func (deployer *Deployer) migrate(service swarm.Service, dockerURL string, migration *Migration) error {
+	if migration == nil {
+		return nil
+	}
+	if migration.Command == "" {
+		return fmt.Errorf("Migration of %v has no command", dockerURL)
+	}
+	image := migration.Image
+	if image == "" {
+		image = dockerURL
+	}
+
+	deployer.debug("migrating %s with %s before deploying %s", service.ID, image, dockerURL)
+	err := deployer.runJob(deployer.requestID, "migration", service, image, migration.Command, deployer.getDeployTimeout(service))
+	if err == nil {
+		countMetric("migrations")
+		deployer.audit(AuditRecord{
+			RequestID: deployer.requestID,
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Event:     "migrated",
+			Image:     image,
+			Message:   migration.Command,
+		})
+		return nil
+	}
+
+	err = fmt.Errorf("Migration of %v failed: %v", service.Spec.Name, err.Error())
+	countMetric("migration_errors")
+	deployer.audit(AuditRecord{
+		RequestID: deployer.requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "migration-failed",
+		Image:     image,
+		Message:   err.Error(),
+	})
+	deployer.sendAlert(Alert{
+		Kind:      "migration-failed",
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     dockerURL,
+		Message:   err.Error(),
+		Owner:     deployer.serviceOwner(service),
+	})
+
+	service.Spec.Labels[migrationFailedImageLabel] = dockerURL
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if updateErr := deployer.writeService(service, service.Spec.TaskTemplate.ContainerSpec.Image, options); updateErr != nil {
+		deployer.debug("could not mark the migration of %s as failed: %v", service.ID, updateErr)
+	} else if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	return err
+}
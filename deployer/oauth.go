@@ -0,0 +1,121 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryMargin is how long before its expiry
+// a token is considered stale and refreshed
+const tokenExpiryMargin = 30 * time.Second
+
+// tokenSource fetches and caches an oauth2 bearer token
+// with the client credentials grant
+type tokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	httpClient   *http.Client
+	token        string
+	expiresAt    time.Time
+	lock         sync.Mutex
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newTokenSource(options *Options, httpClient *http.Client) *tokenSource {
+	if options.OAuthTokenURL == "" {
+		return nil
+	}
+	return &tokenSource{
+		tokenURL:     options.OAuthTokenURL,
+		clientID:     options.OAuthClientID,
+		clientSecret: options.OAuthClientSecret,
+		scopes:       options.OAuthScopes,
+		httpClient:   httpClient,
+	}
+}
+
+// Token returns the cached token, fetching a new one
+// when there is none or it is about to expire
+func (source *tokenSource) Token() (string, error) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	if source.token != "" && (source.expiresAt.IsZero() || time.Now().Add(tokenExpiryMargin).Before(source.expiresAt)) {
+		return source.token, nil
+	}
+
+	token, expiresAt, err := source.fetch()
+	if err != nil {
+		countLabeledMetric("oauth_token_fetches", "error")
+		return "", err
+	}
+	countLabeledMetric("oauth_token_fetches", "ok")
+	source.token = token
+	source.expiresAt = expiresAt
+	return token, nil
+}
+
+// Invalidate drops the cached token, beekeeper rejecting
+// it means it was revoked before it expired
+func (source *tokenSource) Invalidate() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.token = ""
+}
+
+func (source *tokenSource) fetch() (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(source.scopes) > 0 {
+		form.Set("scope", strings.Join(source.scopes, " "))
+	}
+	req, err := http.NewRequest("POST", source.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(source.clientID), url.QueryEscape(source.clientSecret))
+
+	res, err := source.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, redactError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return "", time.Time{}, fmt.Errorf("Invalid token response status code %v", res.StatusCode)
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", time.Time{}, fmt.Errorf("Could not decode token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("Token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", time.Time{}, fmt.Errorf("Unsupported token type %v", token.TokenType)
+	}
+
+	var expiresAt time.Time
+	if token.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return token.AccessToken, expiresAt, nil
+}
@@ -0,0 +1,95 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	defaultOwnerLabel  = "octoblu.beekeeper.team"
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// pagerDutyFallback is the owner whose routing key
+	// receives the alerts of services no other key routes
+	pagerDutyFallback = "*"
+)
+
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Component     string `json:"component"`
+	Group         string `json:"group,omitempty"`
+	Class         string `json:"class"`
+	CustomDetails Alert  `json:"custom_details"`
+}
+
+func parsePagerDutyKeys(routingKeys []string) map[string]string {
+	parsed := make(map[string]string, len(routingKeys))
+	for _, routingKey := range routingKeys {
+		parts := strings.SplitN(routingKey, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			debug("ignoring invalid pagerduty routing key for %q", parts[0])
+			continue
+		}
+		parsed[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return parsed
+}
+
+// pagerDutyKey returns the routing key of owner, or the fallback
+func (deployer *Deployer) pagerDutyKey(owner string) string {
+	deployer.notifications.lock.RLock()
+	defer deployer.notifications.lock.RUnlock()
+	if routingKey, ok := deployer.notifications.pagerDutyKeys[owner]; ok && owner != "" {
+		return routingKey
+	}
+	return deployer.notifications.pagerDutyKeys[pagerDutyFallback]
+}
+
+// triggerPagerDuty triggers an incident for alert, repeated
+// alerts of a service and kind are grouped into one incident
+func (deployer *Deployer) triggerPagerDuty(routingKey string, alert Alert) error {
+	source := alert.Cluster
+	if source == "" {
+		source = "beekeeper-updater-swarm"
+	}
+	body, err := json.Marshal(pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		DedupKey:    fmt.Sprintf("%s/%s/%s", alert.Cluster, alert.Service, alert.Kind),
+		Payload: pagerDutyPayload{
+			Summary:       fmt.Sprintf("%s of %s: %s", alert.Kind, alert.Service, alert.Message),
+			Source:        source,
+			Severity:      "error",
+			Component:     alert.Service,
+			Group:         alert.Owner,
+			Class:         alert.Kind,
+			CustomDetails: alert,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	res, err := alertClient.Post(deployer.pagerDutyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Invalid pagerduty response status code %v", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package deployer
+
+import "time"
+
+// PauseState is whether updates are paused cluster-wide. While
+// paused services are still checked and reported, nothing is deployed
+type PauseState struct {
+	Paused bool `json:"paused"`
+	// Source is what paused the updates, "api", "signal" or "swarm"
+	Source string    `json:"source,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// swarmPauseLabel on the swarm spec pauses every updater of the
+// swarm, e.g. set through the swarm update api during an incident
+const swarmPauseLabel = "octoblu.beekeeper.paused"
+
+// Pause stops updates until Unpause is called, the deployers
+// of other swarms from ForCluster are paused with it
+func (deployer *Deployer) Pause(source, reason string) PauseState {
+	root := deployer.root()
+	root.pauseLock.Lock()
+	if !root.pause.Paused {
+		root.pause = PauseState{Paused: true, Source: source, Reason: reason, Since: deployer.clock.Now()}
+		countLabeledMetric("pauses", source)
+	}
+	root.pauseLock.Unlock()
+	return deployer.PauseState()
+}
+
+// Unpause lifts a pause from the api or a signal, a pause
+// from the swarm label lasts until the label is removed
+func (deployer *Deployer) Unpause() PauseState {
+	root := deployer.root()
+	root.pauseLock.Lock()
+	root.pause = PauseState{}
+	root.pauseLock.Unlock()
+	return deployer.PauseState()
+}
+
+// PauseState returns the current pause, the swarm
+// label is only seen at the start of each cycle
+func (deployer *Deployer) PauseState() PauseState {
+	root := deployer.root()
+	root.pauseLock.Lock()
+	pause := root.pause
+	root.pauseLock.Unlock()
+	if pause.Paused {
+		return pause
+	}
+	deployer.pauseLock.Lock()
+	defer deployer.pauseLock.Unlock()
+	return deployer.swarmPause
+}
+
+func (deployer *Deployer) isPaused() bool {
+	return deployer.PauseState().Paused
+}
+
+// checkSwarmPause reads the pause label of the swarm, when
+// the swarm cannot be inspected the last state is kept
+func (deployer *Deployer) checkSwarmPause() {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	swarmInfo, err := deployer.dockerClient.SwarmInspect(ctx)
+	if err != nil {
+		deployer.debug("could not inspect the swarm for the pause label: %v", deployer.dockerError(ctx, "SwarmInspect", err))
+		return
+	}
+
+	reason, paused := swarmInfo.Spec.Labels[swarmPauseLabel]
+	deployer.pauseLock.Lock()
+	defer deployer.pauseLock.Unlock()
+	if !paused {
+		deployer.swarmPause = PauseState{}
+		return
+	}
+	if !deployer.swarmPause.Paused {
+		deployer.debug("updates paused by the %s swarm label", swarmPauseLabel)
+		deployer.swarmPause = PauseState{Paused: true, Source: "swarm", Reason: reason, Since: deployer.clock.Now()}
+		countLabeledMetric("pauses", "swarm")
+	}
+}
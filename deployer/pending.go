@@ -0,0 +1,98 @@
+package deployer
+
+import (
+	"sort"
+	"time"
+)
+
+// pendingReasons are the decisions that hold back a deploy
+// which will happen by itself later
+var pendingReasons = map[Reason]bool{
+	ReasonDeferred:        true,
+	ReasonOutsideWindow:   true,
+	ReasonWaitingForTrain: true,
+	ReasonBudgetExhausted: true,
+	ReasonPaused:          true,
+	ReasonWeighted:        true,
+	ReasonDegraded:        true,
+	ReasonNoCapacity:      true,
+	ReasonObserving:       true,
+	ReasonBatchWaiting:    true,
+	ReasonFlapping:        true,
+	ReasonTooSoon:         true,
+}
+
+// PendingUpdate is a deploy waiting for its turn. EligibleAt is
+// the earliest time it may go ahead, nil when that is not known,
+// e.g. until updates are unpaused
+type PendingUpdate struct {
+	ServiceID   string     `json:"serviceId"`
+	Service     string     `json:"service"`
+	Image       string     `json:"image"`
+	LatestImage string     `json:"latestImage"`
+	Reason      Reason     `json:"reason"`
+	Since       time.Time  `json:"since"`
+	EligibleAt  *time.Time `json:"eligibleAt,omitempty"`
+}
+
+// holdUntil records when the deploy held back in this
+// cycle may go ahead, see updatePending
+func (deployer *Deployer) holdUntil(eligibleAt time.Time) {
+	deployer.eligibleAt = eligibleAt
+}
+
+// updatePending queues the service while state holds back
+// a deploy and takes it off the queue once it does not
+func (deployer *Deployer) updatePending(state ServiceState) {
+	deployer.pendingLock.Lock()
+	defer deployer.pendingLock.Unlock()
+	if !pendingReasons[state.Reason] || state.LatestImage == "" {
+		delete(deployer.pending, state.ID)
+		return
+	}
+
+	pending := PendingUpdate{
+		ServiceID:   state.ID,
+		Service:     state.Name,
+		Image:       state.Image,
+		LatestImage: state.LatestImage,
+		Reason:      state.Reason,
+		Since:       state.CheckedAt,
+		EligibleAt:  state.EligibleAt,
+	}
+	if previous, ok := deployer.pending[state.ID]; ok && previous.LatestImage == state.LatestImage {
+		pending.Since = previous.Since
+	}
+	deployer.pending[state.ID] = pending
+}
+
+// Pending returns the queued deploys, the soonest eligible first
+func (deployer *Deployer) Pending() []PendingUpdate {
+	deployer.pendingLock.Lock()
+	defer deployer.pendingLock.Unlock()
+
+	pending := make([]PendingUpdate, 0, len(deployer.pending))
+	for _, update := range deployer.pending {
+		pending = append(pending, update)
+	}
+	sort.Sort(byEligibility(pending))
+	return pending
+}
+
+// byEligibility sorts unknown eligibility last, then by name
+type byEligibility []PendingUpdate
+
+func (pending byEligibility) Len() int      { return len(pending) }
+func (pending byEligibility) Swap(i, j int) { pending[i], pending[j] = pending[j], pending[i] }
+func (pending byEligibility) Less(i, j int) bool {
+	a, b := pending[i].EligibleAt, pending[j].EligibleAt
+	switch {
+	case a != nil && b != nil && !a.Equal(*b):
+		return a.Before(*b)
+	case a != nil && b == nil:
+		return true
+	case a == nil && b != nil:
+		return false
+	}
+	return pending[i].Service < pending[j].Service
+}
@@ -0,0 +1,211 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+// defaultPolicyRefresh is how often the policy config is read
+const defaultPolicyRefresh = time.Minute
+
+// policyLabelPrefix is the prefix of the labels a policy may set
+const policyLabelPrefix = "octoblu.beekeeper."
+
+// SwarmConfig is a swarm config object. Configs cannot be changed,
+// a new version of one is created under the same name once the old
+// one is removed, or under the name with a -suffix
+type SwarmConfig struct {
+	ID      string
+	Name    string
+	Version uint64
+	Data    []byte
+}
+
+// ConfigReader reads swarm configs, which the docker
+// api the DockerClient speaks predates
+type ConfigReader interface {
+	// ReadConfig returns the config named name, or the newest of
+	// those named name-<version>, e.g. beekeeper-policies-3
+	ReadConfig(ctx context.Context, name string) (SwarmConfig, error)
+}
+
+// Policies are the settings of tracked services kept in a swarm
+// config, versioned in the cluster instead of spread over labels
+type Policies struct {
+	// Services are the octoblu.beekeeper labels of services by
+	// name, they override the labels of the service, e.g.
+	// {"app": {"octoblu.beekeeper.releaseTrain": "web"}}
+	Services map[string]map[string]string `json:"services"`
+
+	// ReleaseTrains are added to those of the --config file,
+	// replacing the ones of the same name
+	ReleaseTrains []Train `json:"releaseTrains"`
+}
+
+// ParsePolicies reads and validates the json of a policy config
+func ParsePolicies(data []byte) (*Policies, error) {
+	policies := &Policies{}
+	if err := json.Unmarshal(data, policies); err != nil {
+		return nil, err
+	}
+	for name, labels := range policies.Services {
+		for label := range labels {
+			if !strings.HasPrefix(label, policyLabelPrefix) {
+				return nil, fmt.Errorf("Policy of %s sets %s, only %s labels may be set", name, label, policyLabelPrefix)
+			}
+			for _, bookkeeping := range bookkeepingLabels {
+				if label == bookkeeping {
+					return nil, fmt.Errorf("Policy of %s sets %s, which the updater keeps", name, label)
+				}
+			}
+		}
+	}
+	if err := ValidateTrains(policies.ReleaseTrains); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// policyConfig is the swarm config the policies are read from.
+// It is read again every refresh and a new version replaces the
+// policies, the last valid ones are kept while it cannot be read.
+// Until it was read once every cycle fails, services are not
+// updated without the policies meant for them
+type policyConfig struct {
+	reader    ConfigReader
+	name      string
+	refresh   time.Duration
+	policies  *Policies
+	version   string
+	trains    map[string]Train
+	fetchedAt time.Time
+	lock      sync.Mutex
+}
+
+func newPolicyConfig(options *Options) *policyConfig {
+	if options.PolicyConfig == "" || options.PolicyReader == nil {
+		return nil
+	}
+	refresh := options.PolicyRefresh
+	if refresh <= 0 {
+		refresh = defaultPolicyRefresh
+	}
+	return &policyConfig{
+		reader:  options.PolicyReader,
+		name:    options.PolicyConfig,
+		refresh: refresh,
+	}
+}
+
+// refreshPolicies reads the policy config when it is due, it
+// returns an error while the policies were never read
+func (deployer *Deployer) refreshPolicies(now time.Time) error {
+	config := deployer.policies
+	if config == nil {
+		return nil
+	}
+	config.lock.Lock()
+	due := now.Sub(config.fetchedAt) >= config.refresh
+	config.lock.Unlock()
+	if due {
+		deployer.readPolicies(config, now)
+	}
+
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.policies == nil {
+		return fmt.Errorf("The policy config %s was not read yet", config.name)
+	}
+	return nil
+}
+
+func (deployer *Deployer) readPolicies(config *policyConfig, now time.Time) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	swarmConfig, err := config.reader.ReadConfig(ctx, config.name)
+	var policies *Policies
+	if err == nil {
+		policies, err = ParsePolicies(swarmConfig.Data)
+	}
+
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.fetchedAt = now
+	if err != nil {
+		countMetric("policy_config_errors")
+		deployer.debug("could not read the policy config %s: %v", config.name, err)
+		return
+	}
+	version := fmt.Sprintf("%s@%d", swarmConfig.ID, swarmConfig.Version)
+	if version == config.version {
+		return
+	}
+	deployer.debug("policy config %s is now %s with policies of %d services", config.name, swarmConfig.Name, len(policies.Services))
+	countMetric("policy_config_reloads")
+	config.policies = policies
+	config.version = version
+	config.trains = trainsByName(policies.ReleaseTrains)
+}
+
+// policyVersion returns the version of the policies in use, empty without them
+func (deployer *Deployer) policyVersion() string {
+	config := deployer.policies
+	if config == nil {
+		return ""
+	}
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	return config.version
+}
+
+// applyPolicies returns the services with the labels of their
+// policies, the services themselves are not changed
+func (deployer *Deployer) applyPolicies(services []swarm.Service) []swarm.Service {
+	config := deployer.policies
+	if config == nil {
+		return services
+	}
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	if config.policies == nil || len(config.policies.Services) == 0 {
+		return services
+	}
+	applied := make([]swarm.Service, len(services))
+	for i, service := range services {
+		applied[i] = service
+		policy, ok := config.policies.Services[service.Spec.Name]
+		if !ok {
+			continue
+		}
+		labels := make(map[string]string, len(service.Spec.Labels)+len(policy))
+		for key, value := range service.Spec.Labels {
+			labels[key] = value
+		}
+		for key, value := range policy {
+			labels[key] = value
+		}
+		applied[i].Spec.Labels = labels
+	}
+	return applied
+}
+
+// train returns the release train of the name, from the
+// policies or else from the options
+func (deployer *Deployer) train(name string) (Train, bool) {
+	if config := deployer.policies; config != nil {
+		config.lock.Lock()
+		train, ok := config.trains[name]
+		config.lock.Unlock()
+		if ok {
+			return train, true
+		}
+	}
+	train, ok := deployer.trains[name]
+	return train, ok
+}
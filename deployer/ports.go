@@ -0,0 +1,98 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// PublishedPort is a port a version of a service needs published,
+// e.g. a new grpc port. Published zero lets the swarm pick one
+type PublishedPort struct {
+	Name      string `json:"name,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Target    uint32 `json:"target"`
+	Published uint32 `json:"published,omitempty"`
+}
+
+// Validate returns why the port cannot be published
+func (port PublishedPort) Validate() error {
+	if port.Target == 0 {
+		return fmt.Errorf("Published port %q has no target", port.Name)
+	}
+	switch port.protocol() {
+	case swarm.PortConfigProtocolTCP, swarm.PortConfigProtocolUDP:
+		return nil
+	}
+	return fmt.Errorf("Published port %d has an unknown protocol %q", port.Target, port.Protocol)
+}
+
+func (port PublishedPort) protocol() swarm.PortConfigProtocol {
+	if port.Protocol == "" {
+		return swarm.PortConfigProtocolTCP
+	}
+	return swarm.PortConfigProtocol(strings.ToLower(port.Protocol))
+}
+
+// publishPorts returns the service with the ports of metadata
+// published. A port already published for the same target and
+// protocol is updated, the ports metadata does not declare are
+// left as they are. Nothing is written to docker, the ports go
+// out with the deploy
+func publishPorts(service swarm.Service, metadata *RequestMetadata) (swarm.Service, error) {
+	if metadata == nil || len(metadata.Ports) == 0 {
+		return service, nil
+	}
+	declared := make([]swarm.PortConfig, 0, len(metadata.Ports))
+	for _, port := range metadata.Ports {
+		if err := port.Validate(); err != nil {
+			return service, err
+		}
+		declared = append(declared, swarm.PortConfig{
+			Name:          port.Name,
+			Protocol:      port.protocol(),
+			TargetPort:    port.Target,
+			PublishedPort: port.Published,
+		})
+	}
+
+	endpointSpec := swarm.EndpointSpec{}
+	if service.Spec.EndpointSpec != nil {
+		endpointSpec = *service.Spec.EndpointSpec
+	}
+	endpointSpec.Ports = mergePorts(endpointSpec.Ports, declared)
+	service.Spec.EndpointSpec = &endpointSpec
+	return service, nil
+}
+
+// mergePorts returns existing with the ports of declared added,
+// or replacing the one for the same target and protocol
+func mergePorts(existing, declared []swarm.PortConfig) []swarm.PortConfig {
+	ports := append([]swarm.PortConfig(nil), existing...)
+	for _, port := range declared {
+		found := false
+		for i, current := range ports {
+			if current.TargetPort != port.TargetPort || portProtocol(current) != port.Protocol {
+				continue
+			}
+			if port.PublishedPort == 0 {
+				port.PublishedPort = current.PublishedPort
+			}
+			ports[i] = port
+			found = true
+		}
+		if !found {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// portProtocol is the protocol of a published port, tcp when unset
+func portProtocol(port swarm.PortConfig) swarm.PortConfigProtocol {
+	if port.Protocol == "" {
+		return swarm.PortConfigProtocolTCP
+	}
+	return port.Protocol
+}
@@ -0,0 +1,116 @@
+package deployer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// RolloutProgress is how far a rollout has come,
+// derived from the states of the service's tasks
+type RolloutProgress struct {
+	ServiceID string    `json:"serviceId"`
+	Service   string    `json:"service"`
+	Image     string    `json:"image"`
+	State     string    `json:"state"`
+	Desired   int       `json:"desired"`
+	Updated   int       `json:"updated"`
+	Failed    int       `json:"failed"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// getRolloutProgress counts the running tasks on the new image
+// and the tasks of the new image that failed
+func (deployer *Deployer) getRolloutProgress(service swarm.Service, dockerURL string) (RolloutProgress, error) {
+	progress := RolloutProgress{
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     dockerURL,
+		State:     string(service.UpdateStatus.State),
+		UpdatedAt: deployer.clock.Now(),
+	}
+
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	filter := filters.NewArgs()
+	filter.Add("service", service.ID)
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return progress, deployer.dockerError(ctx, "TaskList", err)
+	}
+
+	desired := 0
+	for _, task := range tasks {
+		if task.DesiredState == swarm.TaskStateRunning {
+			desired++
+		}
+		if task.Spec.ContainerSpec.Image != dockerURL {
+			continue
+		}
+		switch task.Status.State {
+		case swarm.TaskStateRunning:
+			progress.Updated++
+		case swarm.TaskStateFailed, swarm.TaskStateRejected:
+			progress.Failed++
+		}
+	}
+	if service.Spec.Mode.Replicated != nil && service.Spec.Mode.Replicated.Replicas != nil {
+		desired = int(*service.Spec.Mode.Replicated.Replicas)
+	}
+	progress.Desired = desired
+	return progress, nil
+}
+
+// setProgress stores and publishes the progress of a rollout
+func (deployer *Deployer) setProgress(progress RolloutProgress) {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	if previous, ok := deployer.progress[progress.ServiceID]; ok {
+		progress.StartedAt = previous.StartedAt
+	}
+	deployer.progress[progress.ServiceID] = progress
+	for subscriber := range deployer.subscribers {
+		select {
+		case subscriber <- progress:
+		default:
+			// a slow subscriber misses updates rather than stalling the rollout
+		}
+	}
+}
+
+// Rollouts returns the progress of the rollouts
+// being monitored, sorted by service name
+func (deployer *Deployer) Rollouts() []RolloutProgress {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	rollouts := make([]RolloutProgress, 0, len(deployer.progress))
+	for _, progress := range deployer.progress {
+		rollouts = append(rollouts, progress)
+	}
+	sort.Sort(byService(rollouts))
+	return rollouts
+}
+
+// SubscribeRollouts streams every progress update until
+// the returned unsubscribe func is called
+func (deployer *Deployer) SubscribeRollouts() (<-chan RolloutProgress, func()) {
+	updates := make(chan RolloutProgress, 16)
+	deployer.rolloutsLock.Lock()
+	deployer.subscribers[updates] = true
+	deployer.rolloutsLock.Unlock()
+	return updates, func() {
+		deployer.rolloutsLock.Lock()
+		delete(deployer.subscribers, updates)
+		deployer.rolloutsLock.Unlock()
+	}
+}
+
+type byService []RolloutProgress
+
+func (rollouts byService) Len() int           { return len(rollouts) }
+func (rollouts byService) Swap(i, j int)      { rollouts[i], rollouts[j] = rollouts[j], rollouts[i] }
+func (rollouts byService) Less(i, j int) bool { return rollouts[i].Service < rollouts[j].Service }
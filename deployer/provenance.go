@@ -0,0 +1,72 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// revisionLabel is the image label holding the commit it was built from
+const revisionLabel = "org.opencontainers.image.revision"
+
+// Provenance is the ci build beekeeper recorded for a deployment
+type Provenance struct {
+	CommitSHA  string `json:"commit_sha"`
+	PipelineID string `json:"pipeline_id"`
+	BuildURL   string `json:"build_url,omitempty"`
+}
+
+// provenanceError means a deployment has no, or mismatching, provenance
+type provenanceError struct {
+	message string
+}
+
+func (err *provenanceError) Error() string {
+	return err.message
+}
+
+// verifyProvenance checks the provenance of a deployment when it
+// is required, and that the image was built from its commit when
+// image revisions are verified. Verified revisions are remembered
+// so the registry is asked once per image
+func (deployer *Deployer) verifyProvenance(dockerURL string, provenance *Provenance) error {
+	if !deployer.requireProvenance && !deployer.verifyImageRevision {
+		return nil
+	}
+	if provenance == nil {
+		return &provenanceError{fmt.Sprintf("Deployment %v has no provenance", dockerURL)}
+	}
+	var missing []string
+	if strings.TrimSpace(provenance.CommitSHA) == "" {
+		missing = append(missing, "commit_sha")
+	}
+	if strings.TrimSpace(provenance.PipelineID) == "" {
+		missing = append(missing, "pipeline_id")
+	}
+	if len(missing) > 0 {
+		return &provenanceError{fmt.Sprintf("Deployment %v has no %v in its provenance", dockerURL, strings.Join(missing, ", "))}
+	}
+	if !deployer.verifyImageRevision {
+		return nil
+	}
+
+	deployer.revisionsLock.Lock()
+	revision, ok := deployer.revisions[dockerURL]
+	deployer.revisionsLock.Unlock()
+	if !ok {
+		labels, err := deployer.imageLabels(dockerURL)
+		if err != nil {
+			return fmt.Errorf("Could not read the labels of %v: %v", dockerURL, err)
+		}
+		revision = labels[revisionLabel]
+		deployer.revisionsLock.Lock()
+		deployer.revisions[dockerURL] = revision
+		deployer.revisionsLock.Unlock()
+	}
+	if revision == "" {
+		return &provenanceError{fmt.Sprintf("Image %v has no %v label", dockerURL, revisionLabel)}
+	}
+	if !strings.EqualFold(revision, provenance.CommitSHA) {
+		return &provenanceError{fmt.Sprintf("Image %v was built from %v, not %v", dockerURL, revision, provenance.CommitSHA)}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package deployer
+
+import (
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedDocker spaces out the calls to docker, so the rollout
+// monitors, cycles and swarms of an updater cannot overwhelm the
+// raft store of a manager. Each swarm has its own limiter, the
+// long-lived events stream is not limited. A call made to wait is
+// counted in docker_throttled by operation, a wait past the
+// deadline of the call fails like the call would
+type rateLimitedDocker struct {
+	DockerClient
+	limiter *rate.Limiter
+}
+
+// rateLimitDocker wraps dockerClient in the rate limit of the
+// options, without a limit it is returned as is
+func rateLimitDocker(dockerClient DockerClient, options *Options) DockerClient {
+	if options.DockerRateLimit <= 0 {
+		return dockerClient
+	}
+	burst := options.DockerRateBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimitedDocker{dockerClient, rate.NewLimiter(rate.Limit(options.DockerRateLimit), burst)}
+}
+
+// wait blocks until the limiter allows a call
+func (docker *rateLimitedDocker) wait(ctx context.Context, operation string) error {
+	reservation := docker.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	countLabeledMetric("docker_throttled", operation)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+func (docker *rateLimitedDocker) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	if err := docker.wait(ctx, "NodeList"); err != nil {
+		return nil, err
+	}
+	return docker.DockerClient.NodeList(ctx, options)
+}
+
+func (docker *rateLimitedDocker) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error {
+	if err := docker.wait(ctx, "NodeUpdate"); err != nil {
+		return err
+	}
+	return docker.DockerClient.NodeUpdate(ctx, nodeID, version, node)
+}
+
+func (docker *rateLimitedDocker) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	if err := docker.wait(ctx, "ServiceCreate"); err != nil {
+		return types.ServiceCreateResponse{}, err
+	}
+	return docker.DockerClient.ServiceCreate(ctx, service, options)
+}
+
+func (docker *rateLimitedDocker) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	if err := docker.wait(ctx, "ServiceInspect"); err != nil {
+		return swarm.Service{}, nil, err
+	}
+	return docker.DockerClient.ServiceInspectWithRaw(ctx, serviceID)
+}
+
+func (docker *rateLimitedDocker) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	if err := docker.wait(ctx, "ServiceList"); err != nil {
+		return nil, err
+	}
+	return docker.DockerClient.ServiceList(ctx, options)
+}
+
+func (docker *rateLimitedDocker) ServiceRemove(ctx context.Context, serviceID string) error {
+	if err := docker.wait(ctx, "ServiceRemove"); err != nil {
+		return err
+	}
+	return docker.DockerClient.ServiceRemove(ctx, serviceID)
+}
+
+func (docker *rateLimitedDocker) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error {
+	if err := docker.wait(ctx, "ServiceUpdate"); err != nil {
+		return err
+	}
+	return docker.DockerClient.ServiceUpdate(ctx, serviceID, version, service, options)
+}
+
+func (docker *rateLimitedDocker) SwarmInspect(ctx context.Context) (swarm.Swarm, error) {
+	if err := docker.wait(ctx, "SwarmInspect"); err != nil {
+		return swarm.Swarm{}, err
+	}
+	return docker.DockerClient.SwarmInspect(ctx)
+}
+
+func (docker *rateLimitedDocker) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	if err := docker.wait(ctx, "TaskList"); err != nil {
+		return nil, err
+	}
+	return docker.DockerClient.TaskList(ctx, options)
+}
@@ -0,0 +1,318 @@
+package deployer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// Reason is why the deployer did, or did not, update a service
+type Reason string
+
+const (
+	// ReasonDeployed means a new image was deployed
+	ReasonDeployed Reason = "deployed"
+	// ReasonSelectorMismatch means the service does not match the selectors
+	ReasonSelectorMismatch Reason = "selector-mismatch"
+	// ReasonNotOptedIn means the update label value is not accepted
+	ReasonNotOptedIn Reason = "not-opted-in"
+	// ReasonOtherShard means another updater sharing the swarm
+	// updates the service
+	ReasonOtherShard Reason = "other-shard"
+	// ReasonPinned means the service is pinned by its update label
+	ReasonPinned Reason = "pinned"
+	// ReasonReportOnly means a new image was found but only reported
+	ReasonReportOnly Reason = "report-only"
+	// ReasonNoImage means the service has no image
+	ReasonNoImage Reason = "no-image"
+	// ReasonScaledToZero means the service has no replicas, it was
+	// skipped, or only its image was set with BumpScaledToZero
+	ReasonScaledToZero Reason = "scaled-to-zero"
+	// ReasonUpdateInProgress means swarm is still rolling out the last update
+	ReasonUpdateInProgress Reason = "update-in-progress"
+	// ReasonHeldDown means the latest image was rolled back
+	// and is held down, a newer build is required
+	ReasonHeldDown Reason = "held-down"
+	// ReasonUpdateStuck means the last update has been rolling
+	// out for longer than the stuck threshold
+	ReasonUpdateStuck Reason = "update-stuck"
+	// ReasonUnparsableImage means no beekeeper owner/repo could be derived
+	ReasonUnparsableImage Reason = "unparsable-image"
+	// ReasonInvalidBeekeeper means the service names an unconfigured
+	// beekeeper instance or has an invalid octoblu.beekeeper.uri label
+	ReasonInvalidBeekeeper Reason = "invalid-beekeeper"
+	// ReasonBeekeeperError means the beekeeper lookup failed
+	ReasonBeekeeperError Reason = "beekeeper-error"
+	// ReasonNoDeployment means beekeeper does not know the project,
+	// it is looked up again after a backoff
+	ReasonNoDeployment Reason = "no-deployment"
+	// ReasonInvalidDeployment means beekeeper returned an empty or invalid docker url
+	ReasonInvalidDeployment Reason = "invalid-deployment"
+	// ReasonRegistryNotAllowed means beekeeper returned an image from a registry not allowed
+	ReasonRegistryNotAllowed Reason = "registry-not-allowed"
+	// ReasonProvenanceRejected means the deployment has no ci
+	// provenance, or the image was not built from its commit
+	ReasonProvenanceRejected Reason = "provenance-rejected"
+	// ReasonRegistryError means the image could not be read from its registry
+	ReasonRegistryError Reason = "registry-error"
+	// ReasonUpToDate means the service already runs the latest image
+	ReasonUpToDate Reason = "up-to-date"
+	// ReasonPinnedInBeekeeper means the service runs the version
+	// a release manager pinned in beekeeper
+	ReasonPinnedInBeekeeper Reason = "pinned-in-beekeeper"
+	// ReasonFlapping means the latest deployment keeps changing
+	// back and forth, updates are held until it settles
+	ReasonFlapping Reason = "flapping"
+	// ReasonVulnerable means the scan report of the latest image has
+	// vulnerabilities of the scan severity or higher
+	ReasonVulnerable Reason = "vulnerable"
+	// ReasonScanError means the scan report of the latest image
+	// could not be read, or it was not scanned
+	ReasonScanError Reason = "scan-error"
+	// ReasonTooSoon means the service was updated less than
+	// the min update interval ago
+	ReasonTooSoon Reason = "too-soon"
+	// ReasonInvalidUpdatedAt means the lastUpdatedAt of the
+	// service is unparsable and such services are held
+	ReasonInvalidUpdatedAt Reason = "invalid-last-updated-at"
+	// ReasonRetiring means beekeeper retired the project, the
+	// service is taken down once the grace period passed
+	ReasonRetiring Reason = "retiring"
+	// ReasonRetired means the service of a retired project was taken down
+	ReasonRetired Reason = "retired"
+	// ReasonLastUpdateFailed means the latest image already failed to roll out
+	ReasonLastUpdateFailed Reason = "last-update-failed"
+	// ReasonPaused means updates are paused cluster-wide
+	ReasonPaused Reason = "paused"
+	// ReasonOutsideWindow means it is outside the deploy windows or in a blackout
+	ReasonOutsideWindow Reason = "outside-window"
+	// ReasonWaitingForTrain means the service rides a release
+	// train, it deploys at the next departure
+	ReasonWaitingForTrain Reason = "waiting-for-train"
+	// ReasonUnknownTrain means the releaseTrain label of the
+	// service names a train that is not defined
+	ReasonUnknownTrain Reason = "unknown-train"
+	// ReasonDeferred means the deployment has a deploy_after in the future
+	ReasonDeferred Reason = "deferred"
+	// ReasonObserving means the first cycle after a start
+	// only observes, the update happens the next cycle
+	ReasonObserving Reason = "observing"
+	// ReasonBatchWaiting means a service sharing the image with a
+	// lower batch order has not finished rolling it out yet
+	ReasonBatchWaiting Reason = "batch-waiting"
+	// ReasonDegraded means too few replicas of the service are
+	// running to safely update it
+	ReasonDegraded Reason = "degraded"
+	// ReasonNoCapacity means the free capacity of the cluster does not
+	// fit the tasks the rollout of the service starts at once
+	ReasonNoCapacity Reason = "insufficient-capacity"
+	// ReasonBudgetExhausted means the hourly update budget is spent
+	ReasonBudgetExhausted Reason = "budget-exhausted"
+	// ReasonInvalidWeights means the weights labels cannot be parsed
+	ReasonInvalidWeights Reason = "invalid-weights"
+	// ReasonInvalidPorts means the deployment declares
+	// ports that cannot be published
+	ReasonInvalidPorts Reason = "invalid-ports"
+	// ReasonWeighted means a weighted deploy is in progress, the
+	// new image runs in the canary service next to the current one
+	ReasonWeighted Reason = "weighted"
+	// ReasonHookFailed means the pre-deploy hook of the service
+	// failed, the deploy is tried again on the next cycle
+	ReasonHookFailed Reason = "hook-failed"
+	// ReasonMigrationFailed means the migration of the deployment
+	// failed, the image is not deployed
+	ReasonMigrationFailed Reason = "migration-failed"
+	// ReasonDeployError means the docker service update failed
+	ReasonDeployError Reason = "deploy-error"
+	// ReasonPanic means processing the service panicked
+	ReasonPanic Reason = "panic"
+)
+
+// ReasonsVersion is the version of the reasons and outcomes sent
+// to beekeeper and used as metric labels. Existing values are never
+// renamed or given another outcome without bumping it, new ones
+// may be added
+const ReasonsVersion = 1
+
+// Outcome is the kind of a Reason, for consumers that
+// only need to know what happens next to a service
+type Outcome string
+
+// The outcomes of the reasons
+const (
+	// OutcomeDeployed means a new image is rolling out
+	OutcomeDeployed Outcome = "deployed"
+	// OutcomeCurrent means the service runs the latest image
+	OutcomeCurrent Outcome = "current"
+	// OutcomePending means the deploy goes ahead by itself later
+	OutcomePending Outcome = "pending"
+	// OutcomeBlocked means the deploy needs a human or a new build
+	OutcomeBlocked Outcome = "blocked"
+	// OutcomeSkipped means the service is not updated by the deployer
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeFailed means the deployer failed, it is tried again
+	OutcomeFailed Outcome = "failed"
+)
+
+// reasonOutcomes is every Reason the deployer decides with its outcome
+var reasonOutcomes = map[Reason]Outcome{
+	ReasonDeployed:           OutcomeDeployed,
+	ReasonUpToDate:           OutcomeCurrent,
+	ReasonPinnedInBeekeeper:  OutcomeCurrent,
+	ReasonUpdateInProgress:   OutcomePending,
+	ReasonDeferred:           OutcomePending,
+	ReasonOutsideWindow:      OutcomePending,
+	ReasonWaitingForTrain:    OutcomePending,
+	ReasonBudgetExhausted:    OutcomePending,
+	ReasonPaused:             OutcomePending,
+	ReasonWeighted:           OutcomePending,
+	ReasonDegraded:           OutcomePending,
+	ReasonNoCapacity:         OutcomePending,
+	ReasonObserving:          OutcomePending,
+	ReasonBatchWaiting:       OutcomePending,
+	ReasonFlapping:           OutcomePending,
+	ReasonRetiring:           OutcomePending,
+	ReasonTooSoon:            OutcomePending,
+	ReasonRetired:            OutcomeDeployed,
+	ReasonHeldDown:           OutcomeBlocked,
+	ReasonInvalidUpdatedAt:   OutcomeBlocked,
+	ReasonUnknownTrain:       OutcomeBlocked,
+	ReasonVulnerable:         OutcomeBlocked,
+	ReasonScanError:          OutcomeFailed,
+	ReasonUpdateStuck:        OutcomeBlocked,
+	ReasonLastUpdateFailed:   OutcomeBlocked,
+	ReasonRegistryNotAllowed: OutcomeBlocked,
+	ReasonProvenanceRejected: OutcomeBlocked,
+	ReasonInvalidDeployment:  OutcomeBlocked,
+	ReasonInvalidWeights:     OutcomeBlocked,
+	ReasonInvalidPorts:       OutcomeBlocked,
+	ReasonSelectorMismatch:   OutcomeSkipped,
+	ReasonNotOptedIn:         OutcomeSkipped,
+	ReasonPinned:             OutcomeSkipped,
+	ReasonOtherShard:         OutcomeSkipped,
+	ReasonReportOnly:         OutcomeSkipped,
+	ReasonNoImage:            OutcomeSkipped,
+	ReasonScaledToZero:       OutcomeSkipped,
+	ReasonUnparsableImage:    OutcomeSkipped,
+	ReasonNoDeployment:       OutcomeSkipped,
+	ReasonInvalidBeekeeper:   OutcomeFailed,
+	ReasonBeekeeperError:     OutcomeFailed,
+	ReasonRegistryError:      OutcomeFailed,
+	ReasonHookFailed:         OutcomeFailed,
+	ReasonMigrationFailed:    OutcomeFailed,
+	ReasonDeployError:        OutcomeFailed,
+	ReasonPanic:              OutcomeFailed,
+}
+
+// Reasons returns every Reason of ReasonsVersion, sorted
+func Reasons() []Reason {
+	reasons := make([]Reason, 0, len(reasonOutcomes))
+	for reason := range reasonOutcomes {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+	return reasons
+}
+
+// Outcome returns the kind of the reason, empty for an unknown one
+func (reason Reason) Outcome() Outcome {
+	return reasonOutcomes[reason]
+}
+
+// ServiceState is the last decision made for a service
+type ServiceState struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Image       string    `json:"image"`
+	LatestImage string    `json:"latestImage,omitempty"`
+	Reason      Reason    `json:"reason"`
+	Error       string    `json:"error,omitempty"`
+	ErrorClass  string    `json:"errorClass,omitempty"`
+	CheckedAt   time.Time `json:"checkedAt"`
+
+	// EligibleAt is the earliest time a deploy held back may go ahead
+	EligibleAt *time.Time `json:"eligibleAt,omitempty"`
+
+	// UpdatingSince is when the update swarm is rolling out started
+	UpdatingSince *time.Time `json:"updatingSince,omitempty"`
+
+	// LastUpdatedAt is when the updater last deployed to the service,
+	// LastUpdatedAtError why its lastUpdatedAt could not be parsed
+	LastUpdatedAt      *time.Time `json:"lastUpdatedAt,omitempty"`
+	LastUpdatedAtError string     `json:"lastUpdatedAtError,omitempty"`
+
+	// version, updateState, policy and deployment are what the
+	// decision was based on, to tell whether it still holds
+	version     uint64
+	updateState swarm.UpdateState
+	policy      string
+	deployment  deploymentKey
+}
+
+func (deployer *Deployer) recordState(state ServiceState) {
+	if state.Reason == ReasonDeployed {
+		countMetric("deploys")
+		countLabeledMetric("cluster_deploys", deployer.clusterLabel())
+		countLabeledMetric("service_deploys", state.Name)
+	} else {
+		deployer.countClusterMetric("skip_reasons", string(state.Reason))
+	}
+	deployer.countClusterMetric("decision_outcomes", string(state.Reason.Outcome()))
+	deployer.exportDecision(state)
+
+	deployer.storeState(state)
+}
+
+// previousReason returns the decision of the last cycle for the service
+func (deployer *Deployer) previousReason(serviceID string) Reason {
+	deployer.statesLock.Lock()
+	defer deployer.statesLock.Unlock()
+	return deployer.states[serviceID].Reason
+}
+
+func (deployer *Deployer) storeState(state ServiceState) {
+	deployer.statesLock.Lock()
+	deployer.states[state.ID] = state
+	deployer.statesLock.Unlock()
+	deployer.updatePending(state)
+}
+
+// forgetStates drops services that were not seen in the last cycle
+func (deployer *Deployer) forgetStates(seen map[string]bool) {
+	deployer.statesLock.Lock()
+	defer deployer.statesLock.Unlock()
+	for id := range deployer.states {
+		if !seen[id] {
+			delete(deployer.states, id)
+		}
+	}
+
+	deployer.pendingLock.Lock()
+	defer deployer.pendingLock.Unlock()
+	for id := range deployer.pending {
+		if !seen[id] {
+			delete(deployer.pending, id)
+		}
+	}
+}
+
+// Services returns the last decision for every
+// tracked service, sorted by name
+func (deployer *Deployer) Services() []ServiceState {
+	deployer.statesLock.Lock()
+	defer deployer.statesLock.Unlock()
+
+	states := make([]ServiceState, 0, len(deployer.states))
+	for _, state := range deployer.states {
+		states = append(states, state)
+	}
+	sort.Sort(byName(states))
+	return states
+}
+
+type byName []ServiceState
+
+func (states byName) Len() int           { return len(states) }
+func (states byName) Swap(i, j int)      { states[i], states[j] = states[j], states[i] }
+func (states byName) Less(i, j int) bool { return states[i].Name < states[j].Name }
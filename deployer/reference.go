@@ -0,0 +1,190 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// imageMapping rewrites image names starting with prefix
+type imageMapping struct {
+	prefix      string
+	replacement string
+}
+
+func parseImageMappings(mappings []string) []imageMapping {
+	var parsed []imageMapping
+	for _, mapping := range mappings {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			debug("ignoring invalid image mapping %q", mapping)
+			continue
+		}
+		parsed = append(parsed, imageMapping{prefix: parts[0], replacement: parts[1]})
+	}
+	return parsed
+}
+
+// mapImageName applies the first mapping matching name
+func (deployer *Deployer) mapImageName(name string) string {
+	for _, mapping := range deployer.imageMappings {
+		if strings.HasPrefix(name, mapping.prefix) {
+			return mapping.replacement + strings.TrimPrefix(name, mapping.prefix)
+		}
+	}
+	return name
+}
+
+// parseRegistryMirrors parses "docker.io/*=mirror.internal:5000/*"
+// rules, the trailing "*" is optional and the source is a fully
+// qualified image name, e.g. docker.io/library/redis
+func parseRegistryMirrors(mirrors []string) []imageMapping {
+	var parsed []imageMapping
+	for _, mirror := range mirrors {
+		parts := strings.SplitN(mirror, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			debug("ignoring invalid registry mirror %q", mirror)
+			continue
+		}
+		parsed = append(parsed, imageMapping{
+			prefix:      strings.TrimSuffix(strings.TrimSpace(parts[0]), "*"),
+			replacement: strings.TrimSuffix(strings.TrimSpace(parts[1]), "*"),
+		})
+	}
+	return parsed
+}
+
+// mirrorDockerURL rewrites a docker url from beekeeper to be pulled
+// from a mirror by the first matching rule, the url is matched with
+// its registry, docker.io for docker hub, and library/ for official
+// images
+func (deployer *Deployer) mirrorDockerURL(dockerURL string) string {
+	if len(deployer.registryMirrors) == 0 {
+		return dockerURL
+	}
+	qualified := qualifyDockerURL(dockerURL)
+	for _, mirror := range deployer.registryMirrors {
+		if strings.HasPrefix(qualified, mirror.prefix) {
+			mirrored := mirror.replacement + strings.TrimPrefix(qualified, mirror.prefix)
+			deployer.debug("pulling %s from mirror %s", dockerURL, mirrored)
+			return mirrored
+		}
+	}
+	return dockerURL
+}
+
+// qualifyDockerURL adds the registry docker would pull from
+func qualifyDockerURL(dockerURL string) string {
+	registry, path := splitRegistry(dockerURL)
+	if registry != "" {
+		return dockerURL
+	}
+	if !strings.Contains(strings.SplitN(path, ":", 2)[0], "/") {
+		path = "library/" + path
+	}
+	return "docker.io/" + path
+}
+
+// parseDockerURL maps an image reference to its beekeeper
+// owner and repo: the registry host is dropped, the first path
+// component is the owner and the last is the repo
+func (deployer *Deployer) parseDockerURL(dockerURL string) (string, string, string) {
+	named, err := reference.ParseNamed(getRealDockerURL(dockerURL))
+	if err != nil {
+		deployer.debug("could not parse image reference %s: %v", dockerURL, err)
+		return "", "", ""
+	}
+
+	var tag string
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+
+	_, path := splitRegistry(deployer.mapImageName(named.Name()))
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return "", "", ""
+	}
+	return parts[0], parts[len(parts)-1], tag
+}
+
+// getBeekeeperProject returns the owner/repo to look the service
+// up by, the octoblu.beekeeper.owner and octoblu.beekeeper.repo
+// labels take precedence over the image name
+func (deployer *Deployer) getBeekeeperProject(service swarm.Service) (string, string) {
+	owner, repo, _ := deployer.parseDockerURL(getCurrentDockerURL(service))
+	if label := service.Spec.Labels["octoblu.beekeeper.owner"]; label != "" {
+		owner = label
+	}
+	if label := service.Spec.Labels["octoblu.beekeeper.repo"]; label != "" {
+		repo = label
+	}
+	return owner, repo
+}
+
+// splitRegistry splits the registry host off an image name,
+// the first component is a registry if it looks like a
+// hostname, the same rule the docker cli uses
+func splitRegistry(name string) (string, string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return "", name
+	}
+	if parts[0] == "localhost" || strings.ContainsAny(parts[0], ".:") {
+		return parts[0], parts[1]
+	}
+	return "", name
+}
+
+// validateDeployment checks the docker url beekeeper returned
+// before it is deployed, counting each kind of rejection
+func (deployer *Deployer) validateDeployment(owner, repo, dockerURL string) error {
+	if strings.TrimSpace(dockerURL) == "" {
+		countLabeledMetric("invalid_deployments", "empty")
+		return fmt.Errorf("Beekeeper returned no docker_url for %v/%v", owner, repo)
+	}
+	ref, err := reference.Parse(dockerURL)
+	if err != nil {
+		countLabeledMetric("invalid_deployments", "unparsable")
+		return fmt.Errorf("Beekeeper returned an invalid docker_url %q for %v/%v: %v", dockerURL, owner, repo, err)
+	}
+	if named, ok := ref.(reference.Named); ok && len(deployer.allowedRegistries) > 0 {
+		registry, _ := splitRegistry(named.Name())
+		if registry == "" {
+			registry = "docker.io"
+		}
+		if !containsString(deployer.allowedRegistries, registry) {
+			countLabeledMetric("invalid_deployments", "registry-not-allowed")
+			return &registryError{registry: registry, dockerURL: dockerURL}
+		}
+	}
+	_, tagged := ref.(reference.Tagged)
+	_, digested := ref.(reference.Digested)
+	if !tagged && !digested {
+		countLabeledMetric("invalid_deployments", "untagged")
+		return fmt.Errorf("Beekeeper returned docker_url %q for %v/%v without a tag or digest", dockerURL, owner, repo)
+	}
+	return nil
+}
+
+// registryError means beekeeper returned an image
+// from a registry outside --allowed-registries
+type registryError struct {
+	registry  string
+	dockerURL string
+}
+
+func (err *registryError) Error() string {
+	return fmt.Sprintf("Registry %v of %v is not allowed", err.registry, err.dockerURL)
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
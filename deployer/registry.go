@@ -0,0 +1,256 @@
+package deployer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/engine-api/types"
+)
+
+const (
+	manifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociIndexMediaType     = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	manifestListMediaType,
+	ociIndexMediaType,
+}
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// registryManifest is a manifest, or a list of them
+// for the platforms of a multi-arch image
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// imageLabels reads the labels of an image from its registry,
+// without pulling it. A multi-arch image is read for linux/amd64
+func (deployer *Deployer) imageLabels(dockerURL string) (map[string]string, error) {
+	named, err := reference.ParseNamed(dockerURL)
+	if err != nil {
+		return nil, err
+	}
+	registry, path := splitRegistry(named.Name())
+	if registry == "" || registry == "docker.io" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(path, "/") {
+			path = "library/" + path
+		}
+	}
+	ref := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref = digested.Digest().String()
+	}
+
+	base := registryScheme(registry) + "://" + registry + "/v2/" + path
+	var manifest registryManifest
+	if err := deployer.registryGet(base+"/manifests/"+ref, strings.Join(manifestMediaTypes, ", "), &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.MediaType == manifestListMediaType || manifest.MediaType == ociIndexMediaType || len(manifest.Manifests) > 0 {
+		if len(manifest.Manifests) == 0 {
+			return nil, fmt.Errorf("Image %v has an empty manifest list", dockerURL)
+		}
+		digest := manifest.Manifests[0].Digest
+		for _, platform := range manifest.Manifests {
+			if platform.Platform.OS == "linux" && platform.Platform.Architecture == "amd64" {
+				digest = platform.Digest
+				break
+			}
+		}
+		manifest = registryManifest{}
+		if err := deployer.registryGet(base+"/manifests/"+digest, strings.Join(manifestMediaTypes, ", "), &manifest); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("Image %v has no config, only v2 and oci manifests are supported", dockerURL)
+	}
+
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err := deployer.registryGet(base+"/blobs/"+manifest.Config.Digest, "", &config); err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+// registryScheme is http for a registry on the local host,
+// like the docker daemon treats it as insecure
+func registryScheme(registry string) string {
+	host := strings.Split(registry, ":")[0]
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http"
+	}
+	return "https"
+}
+
+// registryGet decodes the json at uri, answering a bearer or
+// basic challenge of the registry with the registry credentials
+func (deployer *Deployer) registryGet(uri, accept string, value interface{}) error {
+	res, err := deployer.registryRequest(uri, accept, "")
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		authorization, err := deployer.registryAuthorization(challenge)
+		if err != nil {
+			return err
+		}
+		if res, err = deployer.registryRequest(uri, accept, authorization); err != nil {
+			return err
+		}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		err := fmt.Errorf("Invalid registry response status code %v for %v", res.StatusCode, uri)
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return classify(ErrRegistryAuth, err)
+		}
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(value)
+}
+
+func (deployer *Deployer) registryRequest(uri, accept, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if deployer.userAgent != "" {
+		req.Header.Set("User-Agent", deployer.userAgent)
+	}
+	return registryClient.Do(req)
+}
+
+// registryAuthorization answers a WWW-Authenticate challenge,
+// fetching a token from the realm of a bearer challenge
+func (deployer *Deployer) registryAuthorization(challenge string) (string, error) {
+	username, password := deployer.registryCredentials()
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if username == "" {
+			return "", classify(ErrRegistryAuth, fmt.Errorf("Registry requires credentials"))
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		return "Basic " + credentials, nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("Unsupported registry challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Invalid registry challenge %q", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	res, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		err := fmt.Errorf("Invalid registry token response status code %v", res.StatusCode)
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return "", classify(ErrRegistryAuth, err)
+		}
+		return "", err
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."`
+// into the lower cased scheme and its parameters
+func parseChallenge(challenge string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	params := make(map[string]string)
+	if len(parts) == 2 {
+		for _, match := range challengeParam.FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+	}
+	return strings.ToLower(parts[0]), params
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryCredentials decodes the credentials of SetRegistryAuth
+func (deployer *Deployer) registryCredentials() (string, string) {
+	encoded := deployer.encodedRegistryAuth()
+	if encoded == "" {
+		return "", ""
+	}
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ""
+	}
+	var auth types.AuthConfig
+	if err := json.Unmarshal(decoded, &auth); err != nil {
+		return "", ""
+	}
+	return auth.Username, auth.Password
+}
@@ -0,0 +1,61 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// resumedAtLabel is changed to resume a paused rollout
+const resumedAtLabel = "octoblu.beekeeper.resumedAt"
+
+// Resume rolls a paused update of the service forward. Docker
+// resumes a paused update only when the spec changes, so the spec is
+// written back with a new resumedAt label, and the rollout is
+// monitored again. It returns the image being rolled out
+func (deployer *Deployer) Resume(serviceName string) (string, error) {
+	requestID := newRequestID()
+	ctx, cancel := deployer.dockerContext()
+	service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceName)
+	err = deployer.dockerError(ctx, "ServiceInspect", err)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	if service.UpdateStatus.State != swarm.UpdateStatePaused {
+		return "", fmt.Errorf("Rollout of %v is not paused", service.Spec.Name)
+	}
+
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	message := service.UpdateStatus.Message
+	if service.Spec.Labels == nil {
+		service.Spec.Labels = make(map[string]string)
+	}
+	service.Spec.Labels[resumedAtLabel] = deployer.clock.Now().Format(time.RFC3339)
+	debug("[%s] resuming the rollout of %s to %s, paused: %s", requestID, service.ID, image, message)
+
+	ctx, cancel = deployer.dockerContext()
+	defer cancel()
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, options); err != nil {
+		return "", deployer.dockerError(ctx, "ServiceUpdate", err)
+	}
+	countMetric("resumes")
+	deployer.audit(AuditRecord{
+		RequestID: requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "resumed",
+		Image:     image,
+		Message:   message,
+	})
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	// the image it replaces is not in the spec anymore,
+	// so nothing is cleaned up after this rollout
+	go deployer.monitorRollout(requestID, service.ID, image, image, deployer.getDeployTimeout(service))
+	return getRealDockerURL(image), nil
+}
@@ -0,0 +1,182 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const (
+	// RetireActionScale scales a retired service to zero,
+	// it keeps its spec, so it can be brought back by hand
+	RetireActionScale = "scale-to-zero"
+
+	// RetireActionRemove removes a retired service
+	RetireActionRemove = "remove"
+)
+
+// Retirement is how beekeeper decommissions a project, unlike a 404,
+// which may be a typo, it tells the updater to take the service down
+type Retirement struct {
+	// RetiredAt is when the project was retired, the service
+	// is taken down once the retire grace period passed
+	RetiredAt time.Time `json:"retired_at"`
+
+	// Action is RetireActionScale, the default, or RetireActionRemove
+	Action string `json:"action,omitempty"`
+
+	// Message tells the owners why, e.g. what replaces the service
+	Message string `json:"message,omitempty"`
+}
+
+// Validate returns an error if the retirement cannot be acted on
+func (retirement *Retirement) Validate() error {
+	if retirement.RetiredAt.IsZero() {
+		return fmt.Errorf("retired without retired_at")
+	}
+	switch retirement.Action {
+	case "", RetireActionScale, RetireActionRemove:
+		return nil
+	}
+	return fmt.Errorf("unknown retire action %q", retirement.Action)
+}
+
+func (retirement *Retirement) action() string {
+	if retirement.Action == "" {
+		return RetireActionScale
+	}
+	return retirement.Action
+}
+
+// retireService takes down a service whose project beekeeper retired,
+// after alerting its owners and waiting for the grace period
+func (deployer *Deployer) retireService(service swarm.Service, owner, repo string, retirement *Retirement) (Reason, error) {
+	if err := retirement.Validate(); err != nil {
+		return ReasonInvalidDeployment, err
+	}
+	action := retirement.action()
+	if action == RetireActionScale && isScaledToZero(service) {
+		return ReasonRetired, nil
+	}
+	retireAt := retirement.RetiredAt.Add(deployer.retireGrace)
+	if deployer.clock.Now().Before(retireAt) {
+		deployer.debug("beekeeper retired %s/%s, %s %s at %s", owner, repo, action, service.ID, retireAt.Format(time.RFC3339))
+		if deployer.previousReason(service.ID) != ReasonRetiring {
+			deployer.alertRetirement(service, "service-retiring", fmt.Sprintf("%s/%s was retired in beekeeper, the service is taken down (%s) at %s", owner, repo, action, retireAt.Format(time.RFC3339)), retirement)
+		}
+		deployer.holdUntil(retireAt)
+		return ReasonRetiring, nil
+	}
+	if deployer.getUpdateMode(service) == updateModeReport {
+		deployer.debug("report only, would %s %s", action, service.ID)
+		return ReasonReportOnly, nil
+	}
+	if deployer.isPaused() {
+		deployer.debug("updates are paused, not retiring %s", service.ID)
+		return ReasonPaused, nil
+	}
+	if deployer.observing {
+		deployer.debug("observing the first cycle, not retiring %s", service.ID)
+		return ReasonObserving, nil
+	}
+	if deployer.dryRun {
+		deployer.debug("dry run, not retiring %s", service.ID)
+		return ReasonRetired, nil
+	}
+
+	var err error
+	if action == RetireActionRemove {
+		err = deployer.removeService(service)
+	} else {
+		err = deployer.scaleToZero(service)
+	}
+	if err != nil {
+		return ReasonDeployError, err
+	}
+	countLabeledMetric("services_retired", action)
+	deployer.audit(AuditRecord{
+		RequestID: deployer.requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "retired",
+		Image:     getCurrentDockerURL(service),
+		Message:   action,
+	})
+	deployer.alertRetirement(service, "service-retired", fmt.Sprintf("%s/%s was retired in beekeeper, the service was taken down (%s)", owner, repo, action), retirement)
+	deployer.postRolloutStatus(service, RolloutStatus{
+		State:     "retired",
+		Message:   action,
+		RequestID: deployer.requestID,
+	})
+	return ReasonRetired, nil
+}
+
+func (deployer *Deployer) alertRetirement(service swarm.Service, kind, message string, retirement *Retirement) {
+	if retirement.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, retirement.Message)
+	}
+	deployer.sendAlert(Alert{
+		Kind:      kind,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     getCurrentDockerURL(service),
+		Message:   message,
+		Owner:     deployer.serviceOwner(service),
+	})
+}
+
+// scaleToZero keeps the service but stops its tasks, a global
+// service cannot be scaled so it is an error. Only the replicas
+// of the spec docker has now are changed
+func (deployer *Deployer) scaleToZero(service swarm.Service) error {
+	if service.Spec.Mode.Replicated == nil {
+		return fmt.Errorf("%s is not replicated, it cannot be scaled to zero", service.Spec.Name)
+	}
+	var err error
+	for attempt := 1; attempt <= maxWriteAttempts; attempt++ {
+		if err = deployer.writeReplicas(service.ID, 0); !isOutOfSequence(err) {
+			break
+		}
+		deployer.debug("%s changed while scaling it, scaling again", service.ID)
+	}
+	if isOutOfSequence(err) {
+		return classify(ErrUpdateConflict, err)
+	}
+	if err != nil {
+		return err
+	}
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	return nil
+}
+
+func (deployer *Deployer) writeReplicas(serviceID string, replicas uint64) error {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	current, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		return deployer.dockerError(ctx, "ServiceInspect", err)
+	}
+	if current.Spec.Mode.Replicated == nil {
+		return fmt.Errorf("%s is not replicated anymore, it cannot be scaled to zero", current.Spec.Name)
+	}
+	current.Spec.Mode.Replicated.Replicas = &replicas
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	err = deployer.dockerClient.ServiceUpdate(ctx, serviceID, current.Version, current.Spec, options)
+	return deployer.dockerError(ctx, "ServiceUpdate", err)
+}
+
+func (deployer *Deployer) removeService(service swarm.Service) error {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	if err := deployer.dockerClient.ServiceRemove(ctx, service.ID); err != nil {
+		return deployer.dockerError(ctx, "ServiceRemove", err)
+	}
+	if deployer.cache != nil {
+		deployer.cache.remove(service.ID)
+	}
+	return nil
+}
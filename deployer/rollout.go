@@ -0,0 +1,158 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+const rolloutPollInterval = 5 * time.Second
+
+// getDeployTimeout returns the octoblu.beekeeper.deployTimeout label,
+// falling back to the global deploy timeout
+func (deployer *Deployer) getDeployTimeout(service swarm.Service) time.Duration {
+	label := service.Spec.Labels["octoblu.beekeeper.deployTimeout"]
+	if label == "" {
+		return deployer.deployTimeout
+	}
+	timeout, err := time.ParseDuration(label)
+	if err != nil || timeout <= 0 {
+		deployer.debug("invalid deployTimeout label %q on %s, using %v", label, service.ID, deployer.deployTimeout)
+		return deployer.deployTimeout
+	}
+	return timeout
+}
+
+// monitorRollout waits for the update of the service to converge,
+// reporting it as failed if it pauses or does not finish in time.
+// Once converged previousImage is cleaned up, when enabled. It runs
+// in the background, requestID is the one of the cycle that deployed
+func (deployer *Deployer) monitorRollout(requestID, serviceID, dockerURL, previousImage string, timeout time.Duration) {
+	if !deployer.startMonitoring(serviceID) {
+		return
+	}
+	defer deployer.stopMonitoring(serviceID)
+
+	defer func() {
+		if r := recover(); r != nil {
+			debug("[%s] recovered panic monitoring rollout of %s - %v\n%s", requestID, serviceID, r, debugStack())
+			countLabeledMetric("recovered_panics", serviceID)
+		}
+	}()
+	deadline := deployer.clock.Now().Add(timeout)
+	var last swarm.Service
+	var lastProgress RolloutProgress
+	for {
+		deployer.clock.Sleep(rolloutPollInterval)
+
+		ctx, cancel := deployer.dockerContext()
+		service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+		err = deployer.dockerError(ctx, "ServiceInspect", err)
+		cancel()
+		if err == nil && service.Spec.TaskTemplate.ContainerSpec.Image == dockerURL {
+			lastProgress = deployer.reportProgress(requestID, service, dockerURL, lastProgress)
+		}
+		if err != nil {
+			debug("[%s] rollout of %s: inspect failed %v", requestID, serviceID, err)
+		} else if service.Spec.TaskTemplate.ContainerSpec.Image != dockerURL {
+			debug("[%s] rollout of %s superseded by %s", requestID, serviceID, service.Spec.TaskTemplate.ContainerSpec.Image)
+			return
+		} else if service.UpdateStatus.State == swarm.UpdateStateCompleted {
+			debug("[%s] rollout of %s converged on %s", requestID, serviceID, dockerURL)
+			countMetric("rollouts_converged")
+			deployer.reportRollout(requestID, service, "converged", "")
+			deployer.runHook(requestID, postDeployLabel, service, dockerURL, previousImage)
+			if previousImage != dockerURL {
+				go deployer.cleanupImage(requestID, previousImage)
+			}
+			return
+		} else if service.UpdateStatus.State == swarm.UpdateStatePaused {
+			debug("[%s] rollout of %s paused: %s", requestID, serviceID, service.UpdateStatus.Message)
+			countMetric("rollouts_failed")
+			deployer.reportRollout(requestID, service, "failed", service.UpdateStatus.Message)
+			return
+		}
+		if err == nil {
+			last = service
+		}
+
+		if deployer.clock.Now().After(deadline) {
+			debug("[%s] rollout of %s did not converge within %v", requestID, serviceID, timeout)
+			countMetric("rollouts_timed_out")
+			if last.ID != "" {
+				deployer.reportRollout(requestID, last, "timed-out", "did not converge within "+timeout.String())
+			}
+			return
+		}
+	}
+}
+
+// reportRollout audits the end of a rollout and posts it to
+// beekeeper. A rollout that did not converge is annotated with the
+// errors of its failed tasks, e.g. "No such image", and alerted on
+func (deployer *Deployer) reportRollout(requestID string, service swarm.Service, event, message string) {
+	var failures []TaskFailure
+	if event != "converged" {
+		countLabeledMetric("service_failures", service.Spec.Name)
+		var err error
+		failures, err = deployer.getTaskFailures(service.ID, service.Spec.TaskTemplate.ContainerSpec.Image)
+		if err != nil {
+			debug("[%s] could not get the failed tasks of %s: %v", requestID, service.ID, err)
+		}
+		deployer.attachFailureLogs(requestID, service.ID, failures)
+		if summary := summarizeFailures(failures); summary != "" {
+			message = fmt.Sprintf("%s: %s", message, summary)
+		}
+		deployer.sendAlert(Alert{
+			RequestID: requestID,
+			Kind:      "rollout-" + event,
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Image:     service.Spec.TaskTemplate.ContainerSpec.Image,
+			Message:   message,
+			Owner:     deployer.serviceOwner(service),
+			Logs:      failureLogs(failures),
+		})
+	}
+	deployer.auditRollout(requestID, service, event, message, failures)
+	deployer.postRolloutStatus(service, RolloutStatus{
+		State:     event,
+		Message:   message,
+		Failures:  failures,
+		RequestID: requestID,
+	})
+}
+
+// reportProgress publishes the progress of the rollout,
+// logging it whenever the task counts change
+func (deployer *Deployer) reportProgress(requestID string, service swarm.Service, dockerURL string, previous RolloutProgress) RolloutProgress {
+	progress, err := deployer.getRolloutProgress(service, dockerURL)
+	if err != nil {
+		debug("[%s] rollout of %s: could not get progress %v", requestID, service.ID, err)
+		return previous
+	}
+	deployer.setProgress(progress)
+	if progress.Updated != previous.Updated || progress.Failed != previous.Failed || progress.Desired != previous.Desired {
+		debug("[%s] rollout of %s: %d/%d tasks updated, %d failed", requestID, service.ID, progress.Updated, progress.Desired, progress.Failed)
+	}
+	return progress
+}
+
+func (deployer *Deployer) startMonitoring(serviceID string) bool {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	if deployer.rollouts[serviceID] {
+		return false
+	}
+	deployer.rollouts[serviceID] = true
+	deployer.progress[serviceID] = RolloutProgress{ServiceID: serviceID, StartedAt: deployer.clock.Now()}
+	return true
+}
+
+func (deployer *Deployer) stopMonitoring(serviceID string) {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	delete(deployer.rollouts, serviceID)
+	delete(deployer.progress, serviceID)
+}
@@ -0,0 +1,2840 @@
+package deployer_test
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"github.com/octoblu/beekeeper-updater-swarm/deployertest"
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Run", func() {
+	var docker *deployertest.FakeDocker
+	var beekeeper *deployertest.Beekeeper
+	var options *deployer.Options
+	var sut *deployer.Deployer
+
+	run := func() error {
+		sut = deployer.New(docker, options)
+		return sut.Run()
+	}
+
+	stateOf := func(name string) deployer.ServiceState {
+		for _, state := range sut.Services() {
+			if state.Name == name {
+				return state
+			}
+		}
+		Fail("no state for " + name)
+		return deployer.ServiceState{}
+	}
+
+	imageOf := func(name string) string {
+		service, ok := docker.Service(name)
+		Expect(ok).To(BeTrue())
+		return service.Spec.TaskTemplate.ContainerSpec.Image
+	}
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+		beekeeper = deployertest.NewBeekeeper()
+		options = &deployer.Options{
+			BeekeeperURI:  beekeeper.URL,
+			DockerTimeout: time.Second,
+		}
+	})
+
+	AfterEach(func() {
+		beekeeper.Close()
+	})
+
+	Describe("when beekeeper has a new image", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 2, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should deploy it", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+		})
+
+		It("should record the deploy in the labels", func() {
+			service, _ := docker.Service("app")
+			Expect(service.Spec.Labels["octoblu.beekeeper.lastDockerURL"]).To(Equal("octoblu/app:v2"))
+			Expect(service.Spec.UpdateConfig.FailureAction).To(Equal("pause"))
+		})
+
+		It("should not stamp deployment labels beekeeper has no value for", func() {
+			service, _ := docker.Service("app")
+			Expect(service.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.commitSHA"))
+		})
+
+		Describe("and the deployment has provenance", func() {
+			BeforeEach(func() {
+				beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+					Status: http.StatusOK,
+					Body: map[string]interface{}{
+						"id":         "d-42",
+						"docker_url": "octoblu/app:v3",
+						"provenance": map[string]string{
+							"commit_sha": "abc123",
+							"build_url":  "https://ci.example.com/builds/7",
+						},
+					},
+				})
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should stamp it on the service", func() {
+				service, _ := docker.Service("app")
+				Expect(service.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.deploymentId", "d-42"))
+				Expect(service.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.commitSHA", "abc123"))
+				Expect(service.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.buildURL", "https://ci.example.com/builds/7"))
+			})
+		})
+
+		Describe("and the deployment declares ports", func() {
+			var ports []map[string]interface{}
+
+			BeforeEach(func() {
+				ports = []map[string]interface{}{
+					{"target": 80, "published": 8080},
+					{"name": "grpc", "target": 50051, "published": 50051},
+				}
+			})
+
+			JustBeforeEach(func() {
+				beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+					Status: http.StatusOK,
+					Body:   map[string]interface{}{"docker_url": "octoblu/app:v3", "ports": ports},
+				})
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			})
+
+			It("should publish them with the update", func() {
+				Expect(run()).To(Succeed())
+				service, _ := docker.Service("app")
+				Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v3"))
+				Expect(service.Spec.EndpointSpec.Ports).To(ConsistOf(
+					swarm.PortConfig{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 80, PublishedPort: 8080},
+					swarm.PortConfig{Name: "grpc", Protocol: swarm.PortConfigProtocolTCP, TargetPort: 50051, PublishedPort: 50051},
+				))
+			})
+
+			Describe("and one cannot be published", func() {
+				BeforeEach(func() {
+					ports = append(ports, map[string]interface{}{"target": 53, "protocol": "sctp"})
+				})
+
+				It("should not deploy", func() {
+					Expect(run()).To(Succeed())
+					Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+					Expect(stateOf("app").Reason).To(Equal(deployer.ReasonInvalidPorts))
+					Expect(stateOf("app").Error).To(ContainSubstring(`unknown protocol "sctp"`))
+				})
+			})
+		})
+
+		It("should send the request id to beekeeper", func() {
+			Expect(beekeeper.LastHeader("octoblu", "app").Get("X-Request-Id")).To(Equal(sut.RequestID()))
+		})
+
+		Describe("and the deployer has a cluster name", func() {
+			BeforeEach(func() {
+				options.Cluster = "east"
+				options.Environment = "production"
+				beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should send it to beekeeper", func() {
+				header := beekeeper.LastHeader("octoblu", "app")
+				Expect(header.Get("X-Beekeeper-Cluster")).To(Equal("east"))
+				Expect(header.Get("X-Beekeeper-Environment")).To(Equal("production"))
+			})
+		})
+
+		Describe("and the rollout is still running on the next cycle", func() {
+			BeforeEach(func() {
+				beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should wait for it", func() {
+				Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpdateInProgress))
+			})
+		})
+
+		Describe("and the rollout paused", func() {
+			BeforeEach(func() {
+				docker.SetUpdateState("app", swarm.UpdateStatePaused, "task failed")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should not deploy the same image again", func() {
+				Expect(docker.Calls("ServiceUpdate")).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("when a service overrides the beekeeper uri", func() {
+		var other *deployertest.Beekeeper
+
+		BeforeEach(func() {
+			other = deployertest.NewBeekeeper()
+			other.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			options.BeekeeperUsername = "updater"
+			options.BeekeeperPassword = "secret"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 2, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"octoblu.beekeeper.uri":    other.URL,
+			}))
+		})
+
+		AfterEach(func() {
+			other.Close()
+		})
+
+		It("should look the deployment up there without the credentials", func() {
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			Expect(other.Requests("octoblu", "app")).To(Equal(1))
+			Expect(other.LastHeader("octoblu", "app").Get("Authorization")).To(BeEmpty())
+		})
+
+		Describe("and its host is allowed", func() {
+			BeforeEach(func() {
+				options.BeekeeperURIHosts = []string{strings.TrimPrefix(other.URL, "http://")}
+			})
+
+			It("should send the credentials", func() {
+				Expect(run()).To(Succeed())
+				username, password, ok := (&http.Request{Header: other.LastHeader("octoblu", "app")}).BasicAuth()
+				Expect(ok).To(BeTrue())
+				Expect(username).To(Equal("updater"))
+				Expect(password).To(Equal("secret"))
+			})
+		})
+
+		Describe("and the beekeeper is https", func() {
+			BeforeEach(func() {
+				options.BeekeeperURI = "https://beekeeper.example.com"
+			})
+
+			It("should refuse the http uri", func() {
+				Expect(run()).To(Succeed())
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonInvalidBeekeeper))
+				Expect(other.Requests("octoblu", "app")).To(Equal(0))
+			})
+		})
+	})
+
+	Describe("when the service is up to date", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should leave it alone", func() {
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+	})
+
+	Describe("when the service has no update label", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, nil))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should not look it up", func() {
+			Expect(beekeeper.Requests("octoblu", "app")).To(Equal(0))
+			Expect(sut.Services()).To(BeEmpty())
+		})
+
+		Describe("but it is given by Services", func() {
+			BeforeEach(func() {
+				options.Services = []string{"app"}
+				Expect(run()).To(Succeed())
+			})
+
+			It("should deploy it", func() {
+				Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			})
+		})
+	})
+
+	Describe("when the update label", func() {
+		var value string
+
+		JustBeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": value,
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		Describe("is report", func() {
+			BeforeEach(func() {
+				value = "report"
+			})
+
+			It("should only report the new image", func() {
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonReportOnly))
+				Expect(stateOf("app").LatestImage).To(Equal("octoblu/app:v2"))
+			})
+		})
+
+		Describe("is pinned", func() {
+			BeforeEach(func() {
+				value = "pinned"
+			})
+
+			It("should not ask beekeeper", func() {
+				Expect(beekeeper.Requests("octoblu", "app")).To(Equal(0))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonPinned))
+			})
+		})
+
+		Describe("is not accepted", func() {
+			BeforeEach(func() {
+				value = "maybe"
+			})
+
+			It("should not ask beekeeper", func() {
+				Expect(beekeeper.Requests("octoblu", "app")).To(Equal(0))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonNotOptedIn))
+			})
+		})
+	})
+
+	Describe("ClusterState", func() {
+		BeforeEach(func() {
+			options.Cluster = "east"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 3, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should list the tracked services with their decision", func() {
+			state, err := sut.ClusterState()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(state.Cluster).To(Equal("east"))
+			Expect(state.Services).To(HaveLen(1))
+			status := state.Services[0]
+			Expect(status.Name).To(Equal("app"))
+			Expect(status.Owner + "/" + status.Repo).To(Equal("octoblu/app"))
+			Expect(status.Image).To(Equal("octoblu/app:v2"))
+			Expect(*status.Replicas).To(Equal(uint64(3)))
+			Expect(status.Outcome).To(Equal(deployer.OutcomeDeployed))
+		})
+
+		It("should fail while docker cannot list the services", func() {
+			docker.SetError("ServiceList", errors.New("connection refused"))
+			_, err := sut.ClusterState()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("when updaters share the swarm in shards", func() {
+		names := []string{"app", "api", "web", "worker", "cron", "proxy"}
+
+		BeforeEach(func() {
+			for _, name := range names {
+				docker.AddService(deployertest.ServiceSpec(name, "octoblu/"+name+":v1", 1, map[string]string{
+					"octoblu.beekeeper.update": "true",
+				}))
+				beekeeper.SetDeployment("octoblu", name, "octoblu/"+name+":v2")
+			}
+		})
+
+		It("should update every service exactly once between them", func() {
+			reasons := map[string][]deployer.Reason{}
+			for index := 0; index < 2; index++ {
+				sut = deployer.New(docker, options)
+				sut.SetShard(index, 2)
+				Expect(sut.Run()).To(Succeed())
+				for _, name := range names {
+					reasons[name] = append(reasons[name], stateOf(name).Reason)
+				}
+			}
+			for _, name := range names {
+				Expect(reasons[name]).To(ContainElement(deployer.ReasonOtherShard), name)
+				Expect(reasons[name]).To(ContainElement(deployer.ReasonDeployed), name)
+				Expect(beekeeper.Requests("octoblu", name)).To(Equal(1), name)
+				Expect(imageOf(name)).To(Equal("octoblu/" + name + ":v2"))
+			}
+		})
+	})
+
+	Describe("when the service is scaled to zero", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 0, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		It("should skip it", func() {
+			Expect(run()).To(Succeed())
+			Expect(beekeeper.Requests("octoblu", "app")).To(Equal(0))
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonScaledToZero))
+		})
+
+		It("should only set the image when bumping", func() {
+			options.BumpScaledToZero = true
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			service, _ := docker.Service("app")
+			Expect(service.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.lastDockerURL"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonScaledToZero))
+		})
+	})
+
+	Describe("when the docker url has placeholders", func() {
+		BeforeEach(func() {
+			options.Environment = "staging"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"region":                   "eu",
+			}))
+		})
+
+		It("should expand them", func() {
+			beekeeper.SetDeployment("octoblu", "app", "mirror-{{.Labels.region}}.example.com/{{.Environment}}/app:v2")
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("mirror-eu.example.com/staging/app:v2"))
+		})
+
+		It("should refuse an unknown placeholder", func() {
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:{{.Labels.tag}}")
+			Expect(run()).To(Succeed())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonInvalidDeployment))
+		})
+	})
+
+	Describe("when images are pulled from a mirror", func() {
+		BeforeEach(func() {
+			options.RegistryMirrors = []string{"docker.io/*=mirror.internal:5000/*"}
+			docker.AddService(deployertest.ServiceSpec("app", "mirror.internal:5000/octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should deploy the mirrored image", func() {
+			Expect(imageOf("app")).To(Equal("mirror.internal:5000/octoblu/app:v2"))
+		})
+
+		It("should be up to date on the next cycle", func() {
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+	})
+
+	Describe("when beekeeper returns an image by digest", func() {
+		const digest = "sha256:5d41402abc4b2a76b9719d911017c592ae7e5d41402abc4b2a76b9719d911017"
+
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app@"+digest)
+			Expect(run()).To(Succeed())
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+		})
+
+		It("should deploy it once", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app@" + digest))
+			Expect(sut.Run()).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(1))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+
+		It("should match the tagged image swarm pinned to the digest", func() {
+			service, _ := docker.Service("app")
+			service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/app:v2@" + digest
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(sut.Run()).To(Succeed())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(2))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+
+		It("should deploy another digest", func() {
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app@sha256:"+strings.Repeat("a", 64))
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app@sha256:" + strings.Repeat("a", 64)))
+		})
+	})
+
+	for _, project := range []struct {
+		image, mapping, owner, repo string
+	}{
+		{image: "octoblu/app:v1", owner: "octoblu", repo: "app"},
+		{image: "registry.example.com:5000/team/app:v1", owner: "team", repo: "app"},
+		{image: "localhost/team/app:v1", owner: "team", repo: "app"},
+		{image: "registry.example.com/team/group/app:v1", owner: "team", repo: "app"},
+		{image: "octoblu/app@sha256:5d41402abc4b2a76b9719d911017c592ae7e5d41402abc4b2a76b9719d911017", owner: "octoblu", repo: "app"},
+		{image: "octoblu/app:v1@sha256:5d41402abc4b2a76b9719d911017c592ae7e5d41402abc4b2a76b9719d911017", owner: "octoblu", repo: "app"},
+		{image: "legacy/app:v1", mapping: "legacy/=octoblu/", owner: "octoblu", repo: "app"},
+		{image: "registry.example.com/legacy/app:v1", mapping: "registry.example.com/legacy/=octoblu/", owner: "octoblu", repo: "app"},
+	} {
+		project := project
+
+		Describe(fmt.Sprintf("when the service runs %s", project.image), func() {
+			BeforeEach(func() {
+				if project.mapping != "" {
+					options.ImageMappings = []string{project.mapping}
+				}
+				docker.AddService(deployertest.ServiceSpec("app", project.image, 1, map[string]string{
+					"octoblu.beekeeper.update": "true",
+				}))
+				Expect(run()).To(Succeed())
+			})
+
+			It(fmt.Sprintf("should look up %s/%s", project.owner, project.repo), func() {
+				Expect(beekeeper.Requests(project.owner, project.repo)).To(Equal(1))
+			})
+		})
+	}
+
+	Describe("when the image of the service has no owner", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("redis", "redis:3", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			Expect(run()).To(Succeed())
+		})
+
+		It("should not look it up", func() {
+			Expect(stateOf("redis").Reason).To(Equal(deployer.ReasonUnparsableImage))
+		})
+	})
+
+	Describe("when only the mirror of a registry is allowed", func() {
+		BeforeEach(func() {
+			options.RegistryMirrors = []string{"docker.io/*=mirror.internal:5000/*"}
+			options.AllowedRegistries = []string{"mirror.internal:5000"}
+			docker.AddService(deployertest.ServiceSpec("app", "mirror.internal:5000/octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should refuse the images of the registry", func() {
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(imageOf("app")).To(Equal("mirror.internal:5000/octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonRegistryNotAllowed))
+			Expect(stateOf("app").Error).To(ContainSubstring("docker.io"))
+		})
+	})
+
+	Describe("when beekeeper fails", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{Status: http.StatusInternalServerError})
+			Expect(run()).To(Succeed())
+		})
+
+		It("should record the error and not deploy", func() {
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+			Expect(stateOf("app").Error).To(ContainSubstring("500"))
+			Expect(stateOf("app").ErrorClass).To(Equal("beekeeper-unavailable"))
+		})
+	})
+
+	Describe("ErrorClass", func() {
+		It("should tell wrapped errors apart by class", func() {
+			Expect(deployer.ErrorClass(fmt.Errorf("looking up: %w", deployer.ErrUpdateConflict))).To(Equal("update-conflict"))
+			Expect(deployer.ErrorClass(&deployer.TimeoutError{Operation: "ServiceUpdate"})).To(Equal("docker-timeout"))
+			Expect(deployer.ErrorClass(errors.New("boom"))).To(Equal("other"))
+			Expect(deployer.ErrorClass(nil)).To(BeEmpty())
+		})
+	})
+
+	Describe("when beekeeper does not know the project", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			Expect(run()).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+		})
+
+		It("should report it without an error", func() {
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonNoDeployment))
+			Expect(stateOf("app").Error).To(BeEmpty())
+		})
+
+		It("should back off looking it up", func() {
+			Expect(beekeeper.Requests("octoblu", "app")).To(Equal(1))
+		})
+	})
+
+	Describe("when beekeeper returns an image from a registry not allowed", func() {
+		BeforeEach(func() {
+			options.AllowedRegistries = []string{"registry.octoblu.com"}
+			docker.AddService(deployertest.ServiceSpec("app", "registry.octoblu.com/octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "evil.example.com/octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should refuse it", func() {
+			Expect(imageOf("app")).To(Equal("registry.octoblu.com/octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonRegistryNotAllowed))
+		})
+	})
+
+	Describe("when provenance is required", func() {
+		var registry *httptest.Server
+		var revision string
+
+		BeforeEach(func() {
+			revision = "abc123"
+			registry = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				switch request.URL.Path {
+				case "/v2/octoblu/app/manifests/v2":
+					json.NewEncoder(response).Encode(map[string]interface{}{
+						"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+						"config":    map[string]string{"digest": "sha256:config"},
+					})
+				case "/v2/octoblu/app/blobs/sha256:config":
+					json.NewEncoder(response).Encode(map[string]interface{}{
+						"config": map[string]interface{}{
+							"Labels": map[string]string{"org.opencontainers.image.revision": revision},
+						},
+					})
+				default:
+					http.NotFound(response, request)
+				}
+			}))
+			image := strings.TrimPrefix(registry.URL, "http://") + "/octoblu/app"
+			docker.AddService(deployertest.ServiceSpec("app", image+":v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+				Status: http.StatusOK,
+				Body: map[string]interface{}{
+					"docker_url": image + ":v2",
+					"provenance": map[string]string{"commit_sha": "abc123", "pipeline_id": "42"},
+				},
+			})
+			options.VerifyImageRevision = true
+		})
+
+		AfterEach(func() {
+			registry.Close()
+		})
+
+		It("should deploy an image built from the commit", func() {
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+		})
+
+		It("should refuse an image built from another commit", func() {
+			revision = "def456"
+			Expect(run()).To(Succeed())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonProvenanceRejected))
+		})
+
+		It("should refuse a deployment without provenance", func() {
+			beekeeper.SetDeployment("octoblu", "app", strings.TrimPrefix(registry.URL, "http://")+"/octoblu/app:v2")
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonProvenanceRejected))
+		})
+	})
+
+	Describe("when images are scanned", func() {
+		var scans *httptest.Server
+		var severity string
+
+		BeforeEach(func() {
+			severity = "HIGH"
+			scans = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				if request.URL.Query().Get("image") != "octoblu/app:v2" {
+					http.NotFound(response, request)
+					return
+				}
+				json.NewEncoder(response).Encode(map[string]interface{}{
+					"Results": []interface{}{map[string]interface{}{
+						"Vulnerabilities": []interface{}{
+							map[string]string{"VulnerabilityID": "CVE-2026-1", "Severity": severity},
+							map[string]string{"VulnerabilityID": "CVE-2026-2", "Severity": "LOW"},
+						},
+					}},
+				})
+			}))
+			scanURL, err := deployer.ParseScanURL(scans.URL + "/report?image={{.Image | urlquery}}")
+			Expect(err).NotTo(HaveOccurred())
+			options.ScanURL = scanURL
+			options.ScanSeverity = "high"
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		AfterEach(func() {
+			scans.Close()
+		})
+
+		addService := func(labels map[string]string) {
+			labels["octoblu.beekeeper.update"] = "true"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, labels))
+		}
+
+		It("should refuse an image with vulnerabilities of the severity", func() {
+			addService(map[string]string{})
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonVulnerable))
+			Expect(stateOf("app").Error).To(ContainSubstring("CVE-2026-1"))
+			Expect(stateOf("app").Error).NotTo(ContainSubstring("CVE-2026-2"))
+		})
+
+		It("should deploy an image with lesser vulnerabilities", func() {
+			severity = "MEDIUM"
+			addService(map[string]string{})
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should follow the severity label of the service", func() {
+			addService(map[string]string{"octoblu.beekeeper.scanSeverity": "critical"})
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should refuse an image that was not scanned unless the gate is off", func() {
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+			addService(map[string]string{})
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonScanError))
+			service, _ := docker.Service("app")
+			service.Spec.Labels["octoblu.beekeeper.scanSeverity"] = "off"
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v3"))
+		})
+	})
+
+	Describe("when the deployment has a deploy_after in the future", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+				Status: http.StatusOK,
+				Body: map[string]interface{}{
+					"docker_url":   "octoblu/app:v2",
+					"deploy_after": time.Now().Add(time.Hour),
+				},
+			})
+			Expect(run()).To(Succeed())
+		})
+
+		It("should hold it", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeferred))
+		})
+
+		It("should queue it until then", func() {
+			pending := sut.Pending()
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].LatestImage).To(Equal("octoblu/app:v2"))
+			Expect(pending[0].Reason).To(Equal(deployer.ReasonDeferred))
+			Expect(*pending[0].EligibleAt).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+		})
+	})
+
+	Describe("when the swarm has the pause label", func() {
+		BeforeEach(func() {
+			docker.SetSwarmLabels(map[string]string{"octoblu.beekeeper.paused": "incident"})
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should report but not deploy", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonPaused))
+			Expect(sut.PauseState().Reason).To(Equal("incident"))
+		})
+	})
+
+	Describe("when it is in a blackout", func() {
+		BeforeEach(func() {
+			options.Blackouts = []deployer.Window{{
+				Name:  "incident",
+				Start: time.Now().Add(-time.Hour),
+				End:   time.Now().Add(time.Hour),
+			}}
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		It("should not deploy", func() {
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonOutsideWindow))
+		})
+
+		It("should deploy when windows are ignored", func() {
+			options.IgnoreWindows = true
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should queue it until the blackout ends", func() {
+			Expect(run()).To(Succeed())
+			Expect(sut.Pending()).To(HaveLen(1))
+			Expect(*sut.Pending()[0].EligibleAt).To(BeTemporally("~", options.Blackouts[0].End, time.Second))
+		})
+	})
+
+	Describe("when it is in a freeze of the freeze calendar", func() {
+		var calendar *httptest.Server
+		var calendarStatus int
+
+		BeforeEach(func() {
+			calendarStatus = http.StatusOK
+			start := time.Now().Add(-time.Hour).UTC().Format("20060102T150405Z")
+			end := time.Now().Add(time.Hour).UTC().Format("20060102T150405Z")
+			calendar = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				response.WriteHeader(calendarStatus)
+				fmt.Fprintf(response, "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Release\r\n  freeze\r\nDTSTART:%s\r\nDTEND:%s\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", start, end)
+			}))
+			options.FreezeCalendarURL = calendar.URL
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		AfterEach(func() {
+			calendar.Close()
+		})
+
+		It("should not deploy", func() {
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonOutsideWindow))
+			Expect(sut.Pending()).To(HaveLen(1))
+			Expect(*sut.Pending()[0].EligibleAt).To(BeTemporally("~", time.Now().Add(time.Hour), 2*time.Second))
+		})
+
+		It("should not deploy while the calendar was never fetched", func() {
+			calendarStatus = http.StatusInternalServerError
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonOutsideWindow))
+		})
+
+		It("should deploy when windows are ignored", func() {
+			options.IgnoreWindows = true
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+	})
+
+	Describe("ParseFreezes", func() {
+		It("should expand weekly freezes within the horizon", func() {
+			ics := "BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:Weekend\nDTSTART;TZID=UTC:20260102T180000\nDTEND;TZID=UTC:20260105T060000\nRRULE:FREQ=WEEKLY;BYDAY=FR;COUNT=10\nEND:VEVENT\nBEGIN:VEVENT\nSUMMARY:Cancelled\nSTATUS:CANCELLED\nDTSTART;VALUE=DATE:20260110\nEND:VEVENT\nEND:VCALENDAR\n"
+			from := time.Date(2026, 1, 13, 0, 0, 0, 0, time.UTC)
+			freezes, err := deployer.ParseFreezes(strings.NewReader(ics), from, from.AddDate(0, 0, 14))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(freezes).To(HaveLen(2))
+			Expect(freezes[0].Start).To(Equal(time.Date(2026, 1, 16, 18, 0, 0, 0, time.UTC)))
+			Expect(freezes[1].End).To(Equal(time.Date(2026, 1, 26, 6, 0, 0, 0, time.UTC)))
+		})
+	})
+
+	Describe("ParseFaults", func() {
+		It("should parse the faults", func() {
+			faults, err := deployer.ParseFaults("beekeeper-errors=0.1, docker-update-delay=5s,paused-rollouts=1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*faults).To(Equal(deployer.Faults{BeekeeperErrors: 0.1, DockerUpdateDelay: 5 * time.Second, PausedRollouts: 1}))
+		})
+
+		It("should refuse unknown faults and shares past 1", func() {
+			_, err := deployer.ParseFaults("docker-errors=0.1")
+			Expect(err).To(HaveOccurred())
+			_, err = deployer.ParseFaults("beekeeper-errors=10")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParsePolicies", func() {
+		It("should accept the labels of services and release trains", func() {
+			policies, err := deployer.ParsePolicies([]byte(`{
+				"services": {"app": {"octoblu.beekeeper.batchOrder": "1"}},
+				"releaseTrains": [{"name": "web", "departures": ["10:00"]}]
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(policies.Services["app"]).To(HaveKeyWithValue("octoblu.beekeeper.batchOrder", "1"))
+		})
+
+		It("should reject labels that are not the updater's", func() {
+			_, err := deployer.ParsePolicies([]byte(`{"services": {"app": {"com.example.team": "web"}}}`))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject the labels the updater keeps", func() {
+			_, err := deployer.ParsePolicies([]byte(`{"services": {"app": {"octoblu.beekeeper.lastDockerURL": "octoblu/app:v0"}}}`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("when the service has a pre-deploy hook", func() {
+		var hook *httptest.Server
+		var hookStatus int
+		var event deployer.HookEvent
+
+		BeforeEach(func() {
+			hookStatus = http.StatusNoContent
+			hook = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				json.NewDecoder(request.Body).Decode(&event)
+				response.WriteHeader(hookStatus)
+			}))
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update":    "true",
+				"octoblu.beekeeper.preDeploy": hook.URL,
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		AfterEach(func() {
+			hook.Close()
+		})
+
+		It("should call it before deploying", func() {
+			Expect(run()).To(Succeed())
+			Expect(event.Phase).To(Equal("preDeploy"))
+			Expect(event.Image).To(Equal("octoblu/app:v2"))
+			Expect(event.PreviousImage).To(Equal("octoblu/app:v1"))
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should not deploy when it fails", func() {
+			hookStatus = http.StatusInternalServerError
+			Expect(run()).To(Succeed())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonHookFailed))
+		})
+	})
+
+	Describe("when the migration of the deployment fails", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+				Status: http.StatusOK,
+				Body: map[string]interface{}{
+					"docker_url": "octoblu/app:v2",
+					"migration":  map[string]interface{}{"command": "./migrate"},
+				},
+			})
+			docker.SetError("ServiceCreate", errors.New("no suitable node"))
+			Expect(run()).To(Succeed())
+		})
+
+		It("should not deploy", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonMigrationFailed))
+		})
+
+		It("should not try the image again", func() {
+			docker.SetError("ServiceCreate", nil)
+			Expect(run()).To(Succeed())
+			Expect(docker.Calls("ServiceCreate")).To(Equal(1))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonLastUpdateFailed))
+		})
+	})
+
+	Describe("when a service with an owner fails to migrate", func() {
+		var incidents chan map[string]interface{}
+		var pagerDuty *httptest.Server
+
+		BeforeEach(func() {
+			incidents = make(chan map[string]interface{}, 1)
+			pagerDuty = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				var event map[string]interface{}
+				json.NewDecoder(request.Body).Decode(&event)
+				incidents <- event
+				response.WriteHeader(http.StatusAccepted)
+			}))
+			options.PagerDutyURL = pagerDuty.URL
+			options.PagerDutyRoutingKeys = []string{"payments=payments-key", "*=central-key"}
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"octoblu.beekeeper.team":   "payments",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+				Status: http.StatusOK,
+				Body: map[string]interface{}{
+					"docker_url": "octoblu/app:v2",
+					"migration":  map[string]interface{}{"command": "./migrate"},
+				},
+			})
+			docker.SetError("ServiceCreate", errors.New("no suitable node"))
+			Expect(run()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			pagerDuty.Close()
+		})
+
+		It("should page the owning team", func() {
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonMigrationFailed))
+			var event map[string]interface{}
+			Eventually(incidents).Should(Receive(&event))
+			Expect(event["routing_key"]).To(Equal("payments-key"))
+			Expect(event["event_action"]).To(Equal("trigger"))
+			payload := event["payload"].(map[string]interface{})
+			Expect(payload["class"]).To(Equal("migration-failed"))
+			Expect(payload["group"]).To(Equal("payments"))
+			Expect(payload["custom_details"]).To(HaveKeyWithValue("owner", "payments"))
+		})
+	})
+
+	Describe("when the alert endpoints are reloaded", func() {
+		var paths chan string
+		var webhook *httptest.Server
+
+		BeforeEach(func() {
+			paths = make(chan string, 2)
+			webhook = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				paths <- request.URL.Path
+				response.WriteHeader(http.StatusNoContent)
+			}))
+			options.AlertWebhook = webhook.URL + "/leaked"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			Expect(run()).To(Succeed())
+			Eventually(paths).Should(Receive(Equal("/leaked")))
+		})
+
+		AfterEach(func() {
+			webhook.Close()
+		})
+
+		It("should send the next alerts to the new ones", func() {
+			sut.SetNotifications(webhook.URL+"/rotated", nil)
+			docker.AddService(deployertest.ServiceSpec("other", "octoblu/other:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			Expect(sut.Run()).To(Succeed())
+			Eventually(paths).Should(Receive(Equal("/rotated")))
+		})
+	})
+
+	Describe("when the latest deployment flaps between images", func() {
+		BeforeEach(func() {
+			options.FlapWindow = time.Hour
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+			for _, image := range []string{"octoblu/app:v3", "octoblu/app:v2"} {
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				beekeeper.SetDeployment("octoblu", "app", image)
+				Expect(sut.Run()).To(Succeed())
+				Expect(imageOf("app")).To(Equal(image))
+			}
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+			Expect(sut.Run()).To(Succeed())
+		})
+
+		It("should hold the service until it stops", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonFlapping))
+			Expect(sut.Pending()).To(HaveLen(1))
+			Expect(*sut.Pending()[0].EligibleAt).To(BeTemporally(">", time.Now().Add(59*time.Minute)))
+		})
+
+		It("should not hold releases that only move forward", func() {
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v3"))
+			for _, image := range []string{"octoblu/app:v4", "octoblu/app:v5", "octoblu/app:v6"} {
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				beekeeper.SetDeployment("octoblu", "app", image)
+				Expect(sut.Run()).To(Succeed())
+				Expect(imageOf("app")).To(Equal(image))
+			}
+		})
+	})
+
+	Describe("when beekeeper has a status path", func() {
+		decisions := func() []deployer.RolloutStatus {
+			var statuses []deployer.RolloutStatus
+			for _, body := range beekeeper.Posted("/status") {
+				var status deployer.RolloutStatus
+				Expect(json.Unmarshal(body, &status)).To(Succeed())
+				if status.State == "decision" {
+					statuses = append(statuses, status)
+				}
+			}
+			return statuses
+		}
+
+		BeforeEach(func() {
+			options.StatusPath = "/status"
+			options.Blackouts = []deployer.Window{{
+				Name:  "incident",
+				Start: time.Now().Add(-time.Hour),
+				End:   time.Now().Add(time.Hour),
+			}}
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should post the reason and outcome of the decision", func() {
+			Eventually(decisions).Should(HaveLen(1))
+			status := decisions()[0]
+			Expect(status.Reason).To(Equal(deployer.ReasonOutsideWindow))
+			Expect(status.Outcome).To(Equal(deployer.OutcomePending))
+			Expect(status.ReasonsVersion).To(Equal(deployer.ReasonsVersion))
+			Expect(status.LatestImage).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should not post it again while it does not change", func() {
+			Eventually(decisions).Should(HaveLen(1))
+			Expect(sut.Run()).To(Succeed())
+			Consistently(decisions, 100*time.Millisecond).Should(HaveLen(1))
+		})
+	})
+
+	Describe("with a test clock", func() {
+		var clock *deployertest.Clock
+
+		BeforeEach(func() {
+			clock = deployertest.NewClock(time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+			options.Clock = clock
+			options.StatusPath = "/status"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		Describe("when a resync lists a service older than its last event", func() {
+			BeforeEach(func() {
+				options.WatchEvents = true
+				options.ResyncInterval = time.Minute
+				Expect(run()).To(Succeed())
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				docker.FreezeServiceList()
+
+				service, _ := docker.Service("app")
+				service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/app:v3"
+				Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				inspected := docker.Calls("ServiceInspect")
+				Eventually(func() int {
+					return docker.PublishServiceEvent("update", "app")
+				}).Should(Equal(1))
+				Eventually(func() int {
+					return docker.Calls("ServiceInspect")
+				}).Should(BeNumerically(">", inspected))
+
+				beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+				clock.Advance(2 * time.Minute)
+			})
+
+			It("should keep the version of the event", func() {
+				listed := docker.Calls("ServiceList")
+				Expect(sut.Run()).To(Succeed())
+				Expect(docker.Calls("ServiceList")).To(BeNumerically(">", listed))
+				Expect(docker.Calls("ServiceUpdate")).To(Equal(2))
+				Expect(docker.Calls("ServiceUpdate")).To(Equal(2))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+			})
+		})
+
+		Describe("when policies are kept in a swarm config", func() {
+			BeforeEach(func() {
+				options.PolicyConfig = "beekeeper-policies"
+				options.PolicyReader = docker
+				docker.SetConfig("beekeeper-policies", []byte(`{
+					"services": {"app": {"octoblu.beekeeper.releaseTrain": "web"}},
+					"releaseTrains": [{"name": "web", "departures": ["16:00"]}]
+				}`))
+			})
+
+			It("should apply the policy of the service", func() {
+				Expect(run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonWaitingForTrain))
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			})
+
+			It("should reload a new version of the policies", func() {
+				Expect(run()).To(Succeed())
+				docker.SetConfig("beekeeper-policies", []byte(`{"services": {}}`))
+				clock.Advance(time.Minute)
+				Expect(sut.Run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+			})
+
+			It("should not write the policy labels to the service", func() {
+				clock.Advance(4 * time.Hour)
+				Expect(run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+				service, _ := docker.Service("app")
+				Expect(service.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.releaseTrain"))
+			})
+
+			It("should keep the last policies while the config cannot be read", func() {
+				Expect(run()).To(Succeed())
+				docker.SetError("ReadConfig", errors.New("connection refused"))
+				clock.Advance(time.Minute)
+				Expect(sut.Run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonWaitingForTrain))
+			})
+
+			It("should not run a cycle before the policies were read", func() {
+				options.PolicyConfig = "other-policies"
+				Expect(run()).NotTo(Succeed())
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			})
+		})
+
+		Describe("when services ride a release train", func() {
+			BeforeEach(func() {
+				options.Trains = []deployer.Train{{Name: "web", Departures: []string{"10:00", "16:00"}}}
+				for _, name := range []string{"api", "www"} {
+					docker.AddService(deployertest.ServiceSpec(name, "octoblu/"+name+":v1", 1, map[string]string{
+						"octoblu.beekeeper.update":       "true",
+						"octoblu.beekeeper.releaseTrain": "web",
+					}))
+					beekeeper.SetDeployment("octoblu", name, "octoblu/"+name+":v2")
+				}
+			})
+
+			It("should hold the updates until the next departure", func() {
+				Expect(run()).To(Succeed())
+				Expect(stateOf("www").Reason).To(Equal(deployer.ReasonWaitingForTrain))
+				Expect(stateOf("api").Reason).To(Equal(deployer.ReasonWaitingForTrain))
+				Expect(imageOf("www")).To(Equal("octoblu/www:v1"))
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+				Expect(sut.Pending()).To(HaveLen(2))
+				Expect(*sut.Pending()[0].EligibleAt).To(Equal(time.Date(2026, 3, 2, 16, 0, 0, 0, time.UTC)))
+			})
+
+			It("should deploy every member together at the departure", func() {
+				Expect(run()).To(Succeed())
+				clock.Advance(4*time.Hour + 5*time.Minute)
+				Expect(sut.Run()).To(Succeed())
+				Expect(stateOf("www").Reason).To(Equal(deployer.ReasonDeployed))
+				Expect(stateOf("api").Reason).To(Equal(deployer.ReasonDeployed))
+			})
+
+			It("should not deploy once boarding is over", func() {
+				clock.Advance(4*time.Hour + 15*time.Minute)
+				Expect(run()).To(Succeed())
+				Expect(stateOf("www").Reason).To(Equal(deployer.ReasonWaitingForTrain))
+				Expect(*sut.Pending()[0].EligibleAt).To(Equal(time.Date(2026, 3, 3, 10, 0, 0, 0, time.UTC)))
+			})
+
+			It("should block the members of an unknown train", func() {
+				options.Trains = nil
+				Expect(run()).To(Succeed())
+				Expect(stateOf("www").Reason).To(Equal(deployer.ReasonUnknownTrain))
+				Expect(imageOf("www")).To(Equal("octoblu/www:v1"))
+			})
+		})
+
+		It("should deploy once the blackout ended on it", func() {
+			options.Blackouts = []deployer.Window{{
+				Name:  "incident",
+				Start: clock.Now().Add(-time.Hour),
+				End:   clock.Now().Add(time.Hour),
+			}}
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonOutsideWindow))
+			clock.Advance(time.Hour)
+			Expect(sut.Run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+			service, _ := docker.Service("app")
+			Expect(service.Spec.Labels["octoblu.beekeeper.lastUpdatedAt"]).To(Equal("2026-03-02T13:00:00Z"))
+		})
+
+		It("should time the rollout out when it moved past the deploy timeout", func() {
+			Expect(run()).To(Succeed())
+			Eventually(clock.Sleepers).Should(Equal(1))
+			clock.Advance(6 * time.Minute)
+			Eventually(func() string {
+				for _, body := range beekeeper.Posted("/status") {
+					var status deployer.RolloutStatus
+					json.Unmarshal(body, &status)
+					if status.State != "decision" {
+						return status.State
+					}
+				}
+				return ""
+			}).Should(Equal("timed-out"))
+		})
+
+		Describe("when replaced images are cleaned up", func() {
+			cleanups := func() []swarm.Service {
+				filter := filters.NewArgs()
+				filter.Add("label", "octoblu.beekeeper.cleanup")
+				services, _ := docker.ServiceList(context.Background(), types.ServiceListOptions{Filter: filter})
+				return services
+			}
+
+			BeforeEach(func() {
+				options.CleanupRunnerImage = "docker:cli"
+				Expect(run()).To(Succeed())
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				Eventually(clock.Sleepers).Should(Equal(1))
+				clock.Advance(5 * time.Second)
+				Eventually(cleanups).Should(HaveLen(1))
+			})
+
+			It("should remove the previous image on every node", func() {
+				cleanup := cleanups()[0]
+				Expect(cleanup.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.cleanup", "octoblu/app:v1"))
+				Expect(cleanup.Spec.Mode.Global).NotTo(BeNil())
+				Expect(cleanup.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("docker:cli"))
+				Expect(cleanup.Spec.TaskTemplate.ContainerSpec.Args).To(Equal([]string{"docker", "image", "rm", "octoblu/app:v1"}))
+			})
+
+			It("should remove the cleanup service once its tasks are done", func() {
+				docker.AddTask(swarm.Task{
+					ID:        "cleanup",
+					ServiceID: cleanups()[0].ID,
+					Status:    swarm.TaskStatus{State: swarm.TaskStateComplete},
+				})
+				Eventually(clock.Sleepers).Should(Equal(1))
+				clock.Advance(5 * time.Second)
+				Eventually(cleanups).Should(BeEmpty())
+				Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			})
+		})
+
+		Describe("when the rollout fails", func() {
+			failed := func() *deployer.RolloutStatus {
+				for _, body := range beekeeper.Posted("/status") {
+					var status deployer.RolloutStatus
+					json.Unmarshal(body, &status)
+					if status.State == "failed" {
+						return &status
+					}
+				}
+				return nil
+			}
+
+			BeforeEach(func() {
+				options.LogReader = docker
+			})
+
+			JustBeforeEach(func() {
+				Expect(run()).To(Succeed())
+				service, _ := docker.Service("app")
+				docker.AddTask(swarm.Task{
+					ID:           "crashed",
+					ServiceID:    service.ID,
+					DesiredState: swarm.TaskStateShutdown,
+					Spec:         swarm.TaskSpec{ContainerSpec: swarm.ContainerSpec{Image: "octoblu/app:v2"}},
+					Status:       swarm.TaskStatus{State: swarm.TaskStateFailed, Err: "task: non-zero exit (1)"},
+				})
+				docker.AddLogs("crashed", "starting", "connecting to redis", "panic: redis unavailable")
+				docker.SetUpdateState("app", swarm.UpdateStatePaused, "task failed")
+				Eventually(clock.Sleepers).Should(Equal(1))
+				clock.Advance(5 * time.Second)
+				Eventually(failed).ShouldNot(BeNil())
+			})
+
+			Describe("with failure logs", func() {
+				BeforeEach(func() {
+					options.FailureLogLines = 2
+				})
+
+				It("should attach the last lines of the failed tasks", func() {
+					Expect(failed().Failures).To(HaveLen(1))
+					Expect(failed().Failures[0].Logs).To(Equal([]string{"connecting to redis", "panic: redis unavailable"}))
+				})
+			})
+
+			Describe("without failure logs", func() {
+				It("should not read them", func() {
+					Expect(failed().Failures[0].Logs).To(BeEmpty())
+					Expect(docker.Calls("ServiceLogs")).To(Equal(0))
+				})
+			})
+
+			Describe("when tasks failed on a node", func() {
+				BeforeEach(func() {
+					service, _ := docker.Service("app")
+					node := swarm.Node{ID: "node1"}
+					node.Description.Hostname = "worker-1"
+					docker.AddNode(node)
+					oom := swarm.Task{
+						ID:        "oom",
+						ServiceID: service.ID,
+						NodeID:    "node1",
+						Spec:      swarm.TaskSpec{ContainerSpec: swarm.ContainerSpec{Image: "octoblu/app:v2"}},
+						Status:    swarm.TaskStatus{State: swarm.TaskStateFailed, Message: "OOMKilled", Timestamp: clock.Now().Add(time.Second)},
+					}
+					oom.Status.ContainerStatus.ExitCode = 137
+					docker.AddTask(oom)
+					docker.AddTask(swarm.Task{
+						ID:        "previous",
+						ServiceID: service.ID,
+						Spec:      swarm.TaskSpec{ContainerSpec: swarm.ContainerSpec{Image: "octoblu/app:v1"}},
+						Status:    swarm.TaskStatus{State: swarm.TaskStateFailed, Err: "No such image"},
+					})
+				})
+
+				It("should post the failures of the new image, the most recent first", func() {
+					failures := failed().Failures
+					Expect(failures).To(HaveLen(2))
+					Expect(failures[0]).To(Equal(deployer.TaskFailure{
+						TaskID:   "oom",
+						NodeID:   "node1",
+						Node:     "worker-1",
+						State:    "failed",
+						Message:  "OOMKilled",
+						ExitCode: 137,
+					}))
+					Expect(failures[1].TaskID).To(Equal("crashed"))
+					Expect(failures[1].Message).To(Equal("task: non-zero exit (1)"))
+				})
+			})
+		})
+
+		Describe("when beekeeper retired the project", func() {
+			var action string
+
+			JustBeforeEach(func() {
+				options.RetireGrace = 2 * time.Hour
+				beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+					Status: http.StatusOK,
+					Body: map[string]interface{}{
+						"retired": map[string]interface{}{
+							"retired_at": clock.Now().Add(-time.Hour),
+							"action":     action,
+						},
+					},
+				})
+				Expect(run()).To(Succeed())
+			})
+
+			Describe("to scale it to zero", func() {
+				BeforeEach(func() {
+					action = ""
+				})
+
+				It("should scale it to zero once the grace period passed", func() {
+					Expect(stateOf("app").Reason).To(Equal(deployer.ReasonRetiring))
+					Expect(*stateOf("app").EligibleAt).To(Equal(clock.Now().Add(time.Hour)))
+					Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+
+					clock.Advance(time.Hour)
+					Expect(sut.Run()).To(Succeed())
+					Expect(stateOf("app").Reason).To(Equal(deployer.ReasonRetired))
+					service, _ := docker.Service("app")
+					Expect(*service.Spec.Mode.Replicated.Replicas).To(BeZero())
+					Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+				})
+			})
+
+			Describe("to remove it", func() {
+				BeforeEach(func() {
+					action = deployer.RetireActionRemove
+				})
+
+				It("should remove it once the grace period passed", func() {
+					clock.Advance(time.Hour)
+					Expect(sut.Run()).To(Succeed())
+					_, ok := docker.Service("app")
+					Expect(ok).To(BeFalse())
+				})
+			})
+		})
+
+		Describe("with a min update interval", func() {
+			var lastUpdatedAt string
+
+			JustBeforeEach(func() {
+				options.MinUpdateInterval = time.Hour
+				docker.AddService(deployertest.ServiceSpec("api", "octoblu/api:v1", 1, map[string]string{
+					"octoblu.beekeeper.update":        "true",
+					"octoblu.beekeeper.lastUpdatedAt": lastUpdatedAt,
+				}))
+				beekeeper.SetDeployment("octoblu", "api", "octoblu/api:v2")
+			})
+
+			Describe("when the service was updated recently", func() {
+				BeforeEach(func() {
+					lastUpdatedAt = clock.Now().Add(-20 * time.Minute).Format(time.RFC3339)
+				})
+
+				It("should wait for the interval to pass", func() {
+					Expect(run()).To(Succeed())
+					Expect(stateOf("api").Reason).To(Equal(deployer.ReasonTooSoon))
+					Expect(*stateOf("api").EligibleAt).To(Equal(clock.Now().Add(40 * time.Minute)))
+					Expect(stateOf("api").LastUpdatedAt).NotTo(BeNil())
+					clock.Advance(40 * time.Minute)
+					Expect(sut.Run()).To(Succeed())
+					Expect(stateOf("api").Reason).To(Equal(deployer.ReasonDeployed))
+				})
+			})
+
+			Describe("when its lastUpdatedAt is unparsable", func() {
+				BeforeEach(func() {
+					lastUpdatedAt = "yesterday"
+				})
+
+				It("should treat it as never updated", func() {
+					Expect(run()).To(Succeed())
+					Expect(stateOf("api").Reason).To(Equal(deployer.ReasonDeployed))
+					Expect(stateOf("api").LastUpdatedAtError).To(ContainSubstring("yesterday"))
+				})
+
+				It("should hold it when told to", func() {
+					options.UnparsableUpdatedAt = deployer.UnparsableHold
+					Expect(run()).To(Succeed())
+					Expect(stateOf("api").Reason).To(Equal(deployer.ReasonInvalidUpdatedAt))
+					Expect(imageOf("api")).To(Equal("octoblu/api:v1"))
+				})
+			})
+		})
+
+		Describe("with injected faults", func() {
+			It("should fail beekeeper lookups without calling beekeeper", func() {
+				options.Faults = &deployer.Faults{BeekeeperErrors: 1}
+				Expect(run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+				Expect(stateOf("app").Error).To(ContainSubstring("injected fault"))
+				Expect(beekeeper.Requests("octoblu", "app")).To(Equal(0))
+			})
+
+			It("should report rollouts paused", func() {
+				options.Faults = &deployer.Faults{PausedRollouts: 1}
+				Expect(run()).To(Succeed())
+				Eventually(clock.Sleepers).Should(Equal(1))
+				clock.Advance(5 * time.Second)
+				Eventually(func() string {
+					for _, body := range beekeeper.Posted("/status") {
+						var status deployer.RolloutStatus
+						json.Unmarshal(body, &status)
+						if status.State != "decision" {
+							return status.State + ": " + status.Message
+						}
+					}
+					return ""
+				}).Should(HavePrefix("failed: update paused by an injected fault"))
+			})
+		})
+	})
+
+	Describe("Reasons", func() {
+		It("should list the reasons with their outcome", func() {
+			Expect(deployer.Reasons()).To(ContainElement(deployer.ReasonFlapping))
+			Expect(deployer.ReasonOutsideWindow.Outcome()).To(Equal(deployer.OutcomePending))
+			Expect(deployer.ReasonHeldDown.Outcome()).To(Equal(deployer.OutcomeBlocked))
+			Expect(deployer.Reason("unknown").Outcome()).To(BeEmpty())
+		})
+	})
+
+	Describe("when the update budget is spent", func() {
+		BeforeEach(func() {
+			options.UpdatesPerHour = 1
+			for _, name := range []string{"app", "other"} {
+				docker.AddService(deployertest.ServiceSpec(name, "octoblu/"+name+":v1", 1, map[string]string{
+					"octoblu.beekeeper.update": "true",
+				}))
+				beekeeper.SetDeployment("octoblu", name, "octoblu/"+name+":v2")
+			}
+			Expect(run()).To(Succeed())
+		})
+
+		It("should deploy only one service", func() {
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(1))
+			Expect(stateOf("other").Reason).To(Equal(deployer.ReasonBudgetExhausted))
+		})
+
+		It("should queue the other until the budget refills", func() {
+			pending := sut.Pending()
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].Service).To(Equal("other"))
+			Expect(*pending[0].EligibleAt).To(BeTemporally(">", time.Now()))
+		})
+	})
+
+	Describe("when the service is deployed weighted", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 10, map[string]string{
+				"octoblu.beekeeper.update":  "true",
+				"octoblu.beekeeper.weights": "20,100",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should run the new image in a canary", func() {
+			canary, ok := docker.Service("app-canary")
+			Expect(ok).To(BeTrue())
+			Expect(canary.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v2"))
+			Expect(*canary.Spec.Mode.Replicated.Replicas).To(Equal(uint64(2)))
+			Expect(canary.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.update"))
+		})
+
+		It("should move the replicas from the service", func() {
+			service, _ := docker.Service("app")
+			Expect(*service.Spec.Mode.Replicated.Replicas).To(Equal(uint64(8)))
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonWeighted))
+		})
+	})
+
+	Describe("when a weighted deploy steps through to the last weight", func() {
+		var clock *deployertest.Clock
+
+		BeforeEach(func() {
+			clock = deployertest.NewClock(time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+			options.Clock = clock
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 10, map[string]string{
+				"octoblu.beekeeper.update":         "true",
+				"octoblu.beekeeper.weights":        "20,100",
+				"octoblu.beekeeper.weightInterval": "1m",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonWeighted))
+			clock.Advance(2 * time.Minute)
+			Expect(sut.Run()).To(Succeed())
+		})
+
+		It("should deploy the image with all of the replicas", func() {
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			service, _ := docker.Service("app")
+			Expect(*service.Spec.Mode.Replicated.Replicas).To(Equal(uint64(10)))
+		})
+
+		It("should remove the canary", func() {
+			_, ok := docker.Service("app-canary")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	for _, replicas := range []uint64{0, 1} {
+		replicas := replicas
+
+		Describe(fmt.Sprintf("when a service with %d replicas is deployed weighted", replicas), func() {
+			BeforeEach(func() {
+				docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", replicas, map[string]string{
+					"octoblu.beekeeper.update":  "true",
+					"octoblu.beekeeper.weights": "10,50",
+				}))
+				beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should refuse to split its replicas", func() {
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonInvalidWeights))
+				Expect(docker.Calls("ServiceCreate")).To(Equal(0))
+				service, _ := docker.Service("app")
+				Expect(*service.Spec.Mode.Replicated.Replicas).To(Equal(replicas))
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			})
+		})
+	}
+
+	Describe("when deployments are cached", func() {
+		BeforeEach(func() {
+			options.BeekeeperCacheTTL = time.Hour
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+			Expect(run()).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+		})
+
+		It("should ask beekeeper once", func() {
+			Expect(beekeeper.Requests("octoblu", "app")).To(Equal(1))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+	})
+
+	Describe("when too few replicas of the service are running", func() {
+		BeforeEach(func() {
+			options.MinHealthy = 0.5
+			service := docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 4, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			for i, state := range []swarm.TaskState{swarm.TaskStateRunning, swarm.TaskStateFailed, swarm.TaskStatePending, swarm.TaskStatePending} {
+				docker.AddTask(swarm.Task{
+					ID:           fmt.Sprintf("task-%d", i),
+					ServiceID:    service.ID,
+					DesiredState: swarm.TaskStateRunning,
+					Status:       swarm.TaskStatus{State: state},
+				})
+			}
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should hold the update back", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDegraded))
+			Expect(sut.Pending()).To(HaveLen(1))
+		})
+	})
+
+	Describe("when the cluster has little free capacity", func() {
+		var labels map[string]string
+
+		addNode := func(id string, nanoCPUs int64) {
+			docker.AddNode(swarm.Node{
+				ID:          id,
+				Spec:        swarm.NodeSpec{Availability: swarm.NodeAvailabilityActive},
+				Description: swarm.NodeDescription{Resources: swarm.Resources{NanoCPUs: nanoCPUs, MemoryBytes: 4 << 30}},
+			})
+		}
+
+		BeforeEach(func() {
+			labels = map[string]string{"octoblu.beekeeper.update": "true"}
+			addNode("node-0", 2e9)
+			docker.AddTask(swarm.Task{
+				ID:           "db-task",
+				NodeID:       "node-0",
+				DesiredState: swarm.TaskStateRunning,
+				Spec:         swarm.TaskSpec{Resources: &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: 15e8}}},
+			})
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		addApp := func(replicas uint64) {
+			spec := deployertest.ServiceSpec("app", "octoblu/app:v1", replicas, labels)
+			spec.TaskTemplate.Resources = &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: 1e9}}
+			docker.AddService(spec)
+		}
+
+		It("should defer a start-first rollout that does not fit", func() {
+			labels["octoblu.beekeeper.updateOrder"] = "start-first"
+			addApp(1)
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonNoCapacity))
+			Expect(sut.Pending()).To(HaveLen(1))
+		})
+
+		It("should deploy once a node adds room", func() {
+			labels["octoblu.beekeeper.updateOrder"] = "start-first"
+			addApp(1)
+			Expect(run()).To(Succeed())
+			addNode("node-1", 2e9)
+			Expect(sut.Run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+		})
+
+		It("should defer a rollout with a large parallelism", func() {
+			options.CapacityParallelism = 2
+			addApp(10)
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonNoCapacity))
+		})
+
+		It("should not check a stop-first rollout with a small parallelism", func() {
+			addApp(1)
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+			Expect(docker.Calls("NodeList")).To(Equal(0))
+		})
+	})
+
+	Describe("when a global service is rolled out in waves", func() {
+		var clock *deployertest.Clock
+
+		BeforeEach(func() {
+			clock = deployertest.NewClock(time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+			options.Clock = clock
+			options.WaveNodeLabel = "rack"
+			for i, rack := range []string{"a", "a", "b", "b"} {
+				docker.AddNode(swarm.Node{
+					ID:          fmt.Sprintf("node-%d", i),
+					Spec:        swarm.NodeSpec{Annotations: swarm.Annotations{Labels: map[string]string{"rack": rack}}, Availability: swarm.NodeAvailabilityActive},
+					Description: swarm.NodeDescription{Hostname: fmt.Sprintf("host-%d", i)},
+				})
+			}
+			spec := deployertest.ServiceSpec("agent", "octoblu/agent:v1", 0, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			})
+			spec.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+			docker.AddService(spec)
+			beekeeper.SetDeployment("octoblu", "agent", "octoblu/agent:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should update one node of every rack first", func() {
+			service, _ := docker.Service("agent")
+			Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/agent:v2"))
+			Expect(service.Spec.UpdateConfig.Parallelism).To(Equal(uint64(2)))
+		})
+
+		It("should cordon the nodes of the later wave", func() {
+			for id, availability := range map[string]swarm.NodeAvailability{
+				"node-0": swarm.NodeAvailabilityActive,
+				"node-1": swarm.NodeAvailabilityPause,
+				"node-2": swarm.NodeAvailabilityActive,
+				"node-3": swarm.NodeAvailabilityPause,
+			} {
+				node, _ := docker.Node(id)
+				Expect(node.Spec.Availability).To(Equal(availability), id)
+			}
+			node, _ := docker.Node("node-1")
+			Expect(node.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.cordonedBy", "agent"))
+		})
+
+		Describe("and the service is updated by hand before the first wave finished", func() {
+			BeforeEach(func() {
+				service, _ := docker.Service("agent")
+				service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/agent:v1"
+				Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+				Eventually(clock.Sleepers).Should(Equal(1))
+				clock.Advance(5 * time.Second)
+			})
+
+			It("should uncordon the nodes of the later wave", func() {
+				for _, id := range []string{"node-1", "node-3"} {
+					id := id
+					Eventually(func() swarm.NodeAvailability {
+						node, _ := docker.Node(id)
+						return node.Spec.Availability
+					}).Should(Equal(swarm.NodeAvailabilityActive), id)
+					node, _ := docker.Node(id)
+					Expect(node.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.cordonedBy"))
+				}
+			})
+		})
+	})
+
+	Describe("when events are exported to kafka", func() {
+		var records chan map[string]interface{}
+		var restProxy *httptest.Server
+
+		BeforeEach(func() {
+			records = make(chan map[string]interface{}, 10)
+			restProxy = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				Expect(request.URL.Path).To(Equal("/topics/deploys"))
+				var body struct {
+					Records []map[string]interface{} `json:"records"`
+				}
+				json.NewDecoder(request.Body).Decode(&body)
+				for _, record := range body.Records {
+					records <- record["value"].(map[string]interface{})
+				}
+			}))
+			options.KafkaRESTURL = restProxy.URL
+			options.KafkaTopic = "deploys"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			restProxy.Close()
+		})
+
+		It("should publish the deploy", func() {
+			var event map[string]interface{}
+			Eventually(records, 3*time.Second).Should(Receive(&event))
+			Expect(event).To(HaveKeyWithValue("type", "audit"))
+			Expect(event).To(HaveKeyWithValue("event", "deployed"))
+			Expect(event).To(HaveKeyWithValue("image", "octoblu/app:v2"))
+		})
+	})
+
+	Describe("when counters are kept in a state file", func() {
+		var dir string
+
+		readCounters := func() map[string]interface{} {
+			data, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+			var state map[string]map[string]interface{}
+			Expect(json.Unmarshal(data, &state)).To(Succeed())
+			return state["counters"]
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "beekeeper-state")
+			Expect(err).NotTo(HaveOccurred())
+			options.StateFile = filepath.Join(dir, "state.json")
+			docker.AddService(deployertest.ServiceSpec("counted", "octoblu/counted:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "counted", "octoblu/counted:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should save the deploys of the service", func() {
+			labeled := readCounters()["labeled"].(map[string]interface{})
+			Expect(labeled["service_deploys"]).To(HaveKeyWithValue("counted", BeNumerically(">=", 1)))
+		})
+
+		It("should add the saved counters to the next process", func() {
+			metric := func() int64 {
+				deploys, _ := expvar.Get("beekeeper").(*expvar.Map).Get("service_deploys").(*expvar.Map).Get("counted").(*expvar.Int)
+				return deploys.Value()
+			}
+			before := metric()
+			deployer.New(docker, options)
+			Expect(metric()).To(Equal(2 * before))
+		})
+
+		It("should report drift from the last answer of beekeeper after a restart while it is unavailable", func() {
+			service, _ := docker.Service("counted")
+			service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/counted:v1"
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			docker.SetUpdateState("counted", swarm.UpdateStateCompleted, "")
+			beekeeper.SetResponse("octoblu", "counted", deployertest.Response{Status: http.StatusServiceUnavailable})
+			Expect(run()).To(Succeed())
+			Expect(stateOf("counted").Reason).To(Equal(deployer.ReasonBeekeeperError))
+			Expect(stateOf("counted").Image).To(Equal("octoblu/counted:v1"))
+			Expect(stateOf("counted").LatestImage).To(Equal("octoblu/counted:v2"))
+			Expect(imageOf("counted")).To(Equal("octoblu/counted:v1"))
+		})
+
+		It("should restore the last answer of beekeeper while it is unavailable when told to", func() {
+			options.DeployLastKnownGood = true
+			service, _ := docker.Service("counted")
+			service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/counted:v1"
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			docker.SetUpdateState("counted", swarm.UpdateStateCompleted, "")
+			beekeeper.SetResponse("octoblu", "counted", deployertest.Response{Status: http.StatusServiceUnavailable})
+			Expect(run()).To(Succeed())
+			Expect(stateOf("counted").Reason).To(Equal(deployer.ReasonDeployed))
+			Expect(imageOf("counted")).To(Equal("octoblu/counted:v2"))
+		})
+
+		Describe("and bookkeeping labels are off", func() {
+			BeforeEach(func() {
+				options.NoBookkeepingLabels = true
+				docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+					"octoblu.beekeeper.update": "true",
+				}))
+				beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+				Expect(run()).To(Succeed())
+			})
+
+			It("should deploy without writing the labels", func() {
+				Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+				service, _ := docker.Service("app")
+				Expect(service.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.lastDockerURL"))
+				Expect(service.Spec.Labels).NotTo(HaveKey("octoblu.beekeeper.lastUpdatedAt"))
+			})
+
+			It("should remember the deploy across restarts", func() {
+				options.RollbackHoldDown = time.Hour
+				service, _ := docker.Service("app")
+				service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/app:v1"
+				Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+				docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+				Expect(run()).To(Succeed())
+				Expect(stateOf("app").Reason).To(Equal(deployer.ReasonHeldDown))
+				Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			})
+		})
+	})
+
+	Describe("when the deployed image was rolled back by hand", func() {
+		BeforeEach(func() {
+			options.RollbackHoldDown = time.Hour
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+
+			service, _ := docker.Service("app")
+			service.Spec.TaskTemplate.ContainerSpec.Image = "octoblu/app:v1"
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(sut.Run()).To(Succeed())
+		})
+
+		It("should not deploy it again", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonHeldDown))
+		})
+
+		It("should deploy a newer build", func() {
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v3")
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v3"))
+		})
+	})
+
+	Describe("when an update is stuck", func() {
+		BeforeEach(func() {
+			options.StuckAfter = time.Nanosecond
+			options.StuckAction = deployer.StuckActionRollback
+			service := docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v2", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			docker.SetUpdateState("app", swarm.UpdateStateUpdating, "")
+			docker.AddTask(swarm.Task{
+				ID:           "old-task",
+				ServiceID:    service.ID,
+				DesiredState: swarm.TaskStateRunning,
+				Spec:         swarm.TaskSpec{ContainerSpec: swarm.ContainerSpec{Image: "octoblu/app:v1"}},
+				Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+			})
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should roll it back to the image still running", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpdateStuck))
+			Expect(stateOf("app").UpdatingSince).NotTo(BeNil())
+		})
+
+		It("should not deploy the stuck image again", func() {
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonLastUpdateFailed))
+		})
+	})
+
+	Describe("when a stuck update is explained", func() {
+		var alerts chan string
+		var webhook *httptest.Server
+		var explanation *deployer.Explanation
+
+		BeforeEach(func() {
+			alerts = make(chan string, 1)
+			webhook = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				alerts <- request.URL.Path
+				response.WriteHeader(http.StatusNoContent)
+			}))
+			options.AlertWebhook = webhook.URL
+			options.StuckAfter = time.Nanosecond
+			options.StuckAction = deployer.StuckActionRollback
+			service := docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v2", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			docker.SetUpdateState("app", swarm.UpdateStateUpdating, "")
+			docker.AddTask(swarm.Task{
+				ID:           "old-task",
+				ServiceID:    service.ID,
+				DesiredState: swarm.TaskStateRunning,
+				Spec:         swarm.TaskSpec{ContainerSpec: swarm.ContainerSpec{Image: "octoblu/app:v1"}},
+				Status:       swarm.TaskStatus{State: swarm.TaskStateRunning},
+			})
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			sut = deployer.New(docker, options)
+			var err error
+			explanation, err = sut.Explain("app")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			webhook.Close()
+		})
+
+		It("should explain it without rolling it back", func() {
+			Expect(explanation.Reason).To(Equal(deployer.ReasonUpdateStuck))
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should not alert", func() {
+			Consistently(alerts, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Describe("when the first cycle only observes", func() {
+		BeforeEach(func() {
+			options.ObserveFirstCycle = true
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should not deploy in the first cycle", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonObserving))
+		})
+
+		It("should deploy in the next cycle", func() {
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+	})
+
+	Describe("when a release manager pinned an older version", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v2", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetResponse("octoblu", "app", deployertest.Response{
+				Status: http.StatusOK,
+				Body:   map[string]interface{}{"docker_url": "octoblu/app:v1", "pinned": true},
+			})
+			Expect(run()).To(Succeed())
+		})
+
+		It("should roll back to it", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployed))
+		})
+
+		It("should hold the service on it", func() {
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonPinnedInBeekeeper))
+		})
+	})
+
+	Describe("when another swarm runs the same service", func() {
+		var other *deployertest.FakeDocker
+
+		BeforeEach(func() {
+			options.BeekeeperCacheTTL = time.Hour
+			spec := deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			})
+			other = deployertest.NewFakeDocker()
+			docker.AddService(spec)
+			other.AddService(spec)
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+			Expect(sut.ForCluster("west", other).Run()).To(Succeed())
+		})
+
+		It("should deploy to both with one beekeeper lookup", func() {
+			service, _ := other.Service("app")
+			Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v2"))
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			Expect(beekeeper.Requests("octoblu", "app")).To(Equal(1))
+		})
+
+		It("should report the services of each swarm", func() {
+			clusters := sut.Clusters()
+			Expect(clusters).To(HaveLen(2))
+			Expect(clusters[0].Cluster).To(Equal("default"))
+			Expect(clusters[1].Cluster).To(Equal("west"))
+			Expect(clusters[1].Services).To(HaveLen(1))
+			Expect(clusters[1].Services[0].Reason).To(Equal(deployer.ReasonDeployed))
+		})
+
+		It("should count the decisions of each swarm", func() {
+			perCluster, _ := expvar.Get("beekeeper").(*expvar.Map).Get("clusters").(*expvar.Map)
+			Expect(perCluster).NotTo(BeNil())
+			west, _ := perCluster.Get("west").(*expvar.Map)
+			Expect(west).NotTo(BeNil())
+			outcomes, _ := west.Get("decision_outcomes").(*expvar.Map)
+			Expect(outcomes).NotTo(BeNil())
+			Expect(outcomes.Get(string(deployer.ReasonDeployed.Outcome()))).NotTo(BeNil())
+		})
+	})
+
+	Describe("when beekeeper requires mutual tls", func() {
+		var dir string
+		var certs *deployertest.Certificates
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "beekeeper-tls")
+			Expect(err).NotTo(HaveOccurred())
+			certs, err = deployertest.NewCertificates(dir)
+			Expect(err).NotTo(HaveOccurred())
+			beekeeper.Close()
+			beekeeper = deployertest.NewTLSBeekeeper(certs)
+			options.BeekeeperURI = beekeeper.URL
+			options.BeekeeperCACert = certs.CA
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should deploy with the client certificate", func() {
+			options.BeekeeperClientCert = certs.ClientCert
+			options.BeekeeperClientKey = certs.ClientKey
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should pick up a rotated client certificate", func() {
+			options.BeekeeperClientCert = filepath.Join(dir, "rotated.pem")
+			options.BeekeeperClientKey = filepath.Join(dir, "rotated-key.pem")
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+
+			Expect(os.Rename(certs.ClientCert, options.BeekeeperClientCert)).To(Succeed())
+			Expect(os.Rename(certs.ClientKey, options.BeekeeperClientKey)).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should not reach beekeeper without it", func() {
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+			Expect(beekeeper.Requests("octoblu", "app")).To(BeZero())
+		})
+	})
+
+	Describe("when beekeeper is authorized with oauth tokens", func() {
+		authorization := func() string {
+			return beekeeper.LastHeader("octoblu", "app").Get("Authorization")
+		}
+
+		BeforeEach(func() {
+			options.OAuthTokenURL = beekeeper.TokenURL
+			options.OAuthClientID = "updater"
+			options.OAuthClientSecret = "secret"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+		})
+
+		It("should reuse a token until it is about to expire", func() {
+			beekeeper.SetTokenExpiry(3600)
+			Expect(run()).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+			Expect(beekeeper.Tokens()).To(Equal(1))
+			Expect(authorization()).To(Equal("Bearer token-1"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+
+		It("should refresh a token about to expire", func() {
+			beekeeper.SetTokenExpiry(10)
+			Expect(run()).To(Succeed())
+			Expect(sut.Run()).To(Succeed())
+			Expect(beekeeper.Tokens()).To(Equal(2))
+			Expect(authorization()).To(Equal("Bearer token-2"))
+		})
+
+		It("should fetch a new token once beekeeper rejects it", func() {
+			Expect(run()).To(Succeed())
+			beekeeper.RevokeTokens()
+			Expect(sut.Run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+
+			Expect(sut.Run()).To(Succeed())
+			Expect(beekeeper.Tokens()).To(Equal(2))
+			Expect(authorization()).To(Equal("Bearer token-2"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+
+		It("should not look up without a token", func() {
+			options.OAuthTokenURL = beekeeper.URL + "/oauth/missing"
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonBeekeeperError))
+			Expect(beekeeper.Requests("octoblu", "app")).To(BeZero())
+		})
+	})
+
+	Describe("when the beekeeper credentials are rotated", func() {
+		credentials := func(owner, repo string) (string, string) {
+			request := &http.Request{Header: beekeeper.LastHeader(owner, repo)}
+			username, password, _ := request.BasicAuth()
+			return username, password
+		}
+
+		BeforeEach(func() {
+			options.BeekeeperUsername = "updater"
+			options.BeekeeperPassword = "hunter2"
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should send the new ones from the next lookup on, in every swarm", func() {
+			username, password := credentials("octoblu", "app")
+			Expect(username).To(Equal("updater"))
+			Expect(password).To(Equal("hunter2"))
+
+			other := deployertest.NewFakeDocker()
+			other.AddService(deployertest.ServiceSpec("worker", "octoblu/worker:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			sibling := sut.ForCluster("west", other)
+			sut.SetBeekeeperCredentials("updater", "correct-horse")
+			Expect(sut.Run()).To(Succeed())
+			Expect(sibling.Run()).To(Succeed())
+
+			_, password = credentials("octoblu", "app")
+			Expect(password).To(Equal("correct-horse"))
+			_, password = credentials("octoblu", "worker")
+			Expect(password).To(Equal("correct-horse"))
+		})
+	})
+
+	Describe("when several selectors are given", func() {
+		BeforeEach(func() {
+			options.Selectors = []string{"team=platform", "tier"}
+			for _, name := range []string{"api", "worker", "www"} {
+				beekeeper.SetDeployment("octoblu", name, "octoblu/"+name+":v2")
+			}
+			docker.AddService(deployertest.ServiceSpec("api", "octoblu/api:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"team":                     "platform",
+				"tier":                     "backend",
+			}))
+			docker.AddService(deployertest.ServiceSpec("worker", "octoblu/worker:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"team":                     "platform",
+			}))
+			docker.AddService(deployertest.ServiceSpec("www", "octoblu/www:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+				"team":                     "web",
+				"tier":                     "frontend",
+			}))
+			Expect(run()).To(Succeed())
+		})
+
+		It("should only update the services matching all of them", func() {
+			Expect(imageOf("api")).To(Equal("octoblu/api:v2"))
+			Expect(imageOf("worker")).To(Equal("octoblu/worker:v1"))
+			Expect(imageOf("www")).To(Equal("octoblu/www:v1"))
+			Expect(beekeeper.Requests("octoblu", "worker")).To(Equal(0))
+			Expect(beekeeper.Requests("octoblu", "www")).To(Equal(0))
+		})
+	})
+
+	Describe("when cycles are differential", func() {
+		unchanged := func() int64 {
+			counter, _ := expvar.Get("beekeeper").(*expvar.Map).Get("services_unchanged").(*expvar.Int)
+			if counter == nil {
+				return 0
+			}
+			return counter.Value()
+		}
+
+		BeforeEach(func() {
+			options.Differential = true
+			options.BeekeeperCacheTTL = time.Hour
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should reuse the decision of an unchanged service", func() {
+			before := unchanged()
+			Expect(sut.Run()).To(Succeed())
+			Expect(unchanged()).To(Equal(before + 1))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonUpToDate))
+		})
+
+		It("should evaluate a service again once its spec changes", func() {
+			service, _ := docker.Service("app")
+			service.Spec.Labels["octoblu.beekeeper.update"] = "pinned"
+			Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			before := unchanged()
+			Expect(sut.Run()).To(Succeed())
+			Expect(unchanged()).To(Equal(before))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonPinned))
+		})
+	})
+
+	Describe("when the user agent names the cluster", func() {
+		var other *deployertest.FakeDocker
+
+		BeforeEach(func() {
+			options.UserAgent = "beekeeper-updater-swarm/1.2.3"
+			options.Cluster = "east"
+			spec := deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			})
+			other = deployertest.NewFakeDocker()
+			docker.AddService(spec)
+			other.AddService(deployertest.ServiceSpec("worker", "octoblu/worker:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+		})
+
+		It("should send the cluster of each swarm", func() {
+			Expect(run()).To(Succeed())
+			Expect(sut.ForCluster("west", other).Run()).To(Succeed())
+			Expect(beekeeper.LastHeader("octoblu", "app").Get("User-Agent")).To(Equal("beekeeper-updater-swarm/1.2.3 (east)"))
+			Expect(beekeeper.LastHeader("octoblu", "worker").Get("User-Agent")).To(Equal("beekeeper-updater-swarm/1.2.3 (west)"))
+		})
+
+		It("should send the suffix instead of the cluster", func() {
+			options.UserAgentSuffix = "staging"
+			Expect(run()).To(Succeed())
+			Expect(beekeeper.LastHeader("octoblu", "app").Get("User-Agent")).To(Equal("beekeeper-updater-swarm/1.2.3 (staging)"))
+		})
+	})
+
+	Describe("when an operator changes the service while the cycle runs", func() {
+		var change func(*swarm.ServiceSpec)
+
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+		})
+
+		runRacing := func() error {
+			sut = deployer.New(racingDocker{docker, func() {
+				service, _ := docker.Service("app")
+				change(&service.Spec)
+				Expect(docker.ServiceUpdate(context.Background(), service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})).To(Succeed())
+			}}, options)
+			return sut.Run()
+		}
+
+		It("should keep the change", func() {
+			change = func(spec *swarm.ServiceSpec) {
+				spec.TaskTemplate.ContainerSpec.Env = []string{"WORKERS=4"}
+				spec.Labels["team"] = "core"
+			}
+			Expect(runRacing()).To(Succeed())
+			service, _ := docker.Service("app")
+			Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v2"))
+			Expect(service.Spec.TaskTemplate.ContainerSpec.Env).To(Equal([]string{"WORKERS=4"}))
+			Expect(service.Spec.Labels).To(HaveKeyWithValue("team", "core"))
+			Expect(service.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.lastDockerURL", "octoblu/app:v2"))
+		})
+
+		It("should not deploy over an image the operator set", func() {
+			change = func(spec *swarm.ServiceSpec) {
+				spec.TaskTemplate.ContainerSpec.Image = "octoblu/app:hotfix"
+			}
+			Expect(runRacing()).To(Succeed())
+			Expect(imageOf("app")).To(Equal("octoblu/app:hotfix"))
+			Expect(stateOf("app").Reason).To(Equal(deployer.ReasonDeployError))
+		})
+	})
+
+	Describe("when docker api calls are rate limited", func() {
+		BeforeEach(func() {
+			options.DockerRateLimit = 20
+			for _, name := range []string{"app", "other", "third"} {
+				docker.AddService(deployertest.ServiceSpec(name, "octoblu/"+name+":v1", 1, map[string]string{
+					"octoblu.beekeeper.update": "true",
+				}))
+				beekeeper.SetDeployment("octoblu", name, "octoblu/"+name+":v2")
+			}
+		})
+
+		throttled := func() int64 {
+			labeled, _ := expvar.Get("beekeeper").(*expvar.Map).Get("docker_throttled").(*expvar.Map)
+			if labeled == nil {
+				return 0
+			}
+			calls, _ := labeled.Get("ServiceUpdate").(*expvar.Int)
+			if calls == nil {
+				return 0
+			}
+			return calls.Value()
+		}
+
+		It("should space the calls out and count the waits", func() {
+			before := throttled()
+			startedAt := time.Now()
+			Expect(run()).To(Succeed())
+			Expect(time.Since(startedAt)).To(BeNumerically(">=", 100*time.Millisecond))
+			Expect(imageOf("third")).To(Equal("octoblu/third:v2"))
+			Expect(throttled()).To(BeNumerically(">", before))
+		})
+
+		It("should fail a call that cannot wait for its turn", func() {
+			options.DockerRateLimit = 0.01
+			options.DockerTimeout = 50 * time.Millisecond
+			Expect(deployer.IsTimeout(run())).To(BeTrue())
+		})
+	})
+
+	Describe("when listing services fails", func() {
+		BeforeEach(func() {
+			docker.SetError("ServiceList", errors.New("docker is down"))
+		})
+
+		It("should return the error", func() {
+			Expect(run()).To(MatchError("docker is down"))
+		})
+	})
+
+	Describe("when services sharing an image have a batch order", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 2, map[string]string{
+				"octoblu.beekeeper.update": "true",
+			}))
+			docker.AddService(deployertest.ServiceSpec("app-worker", "octoblu/app:v1", 2, map[string]string{
+				"octoblu.beekeeper.update":     "true",
+				"octoblu.beekeeper.batchOrder": "1",
+			}))
+			beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v2")
+			Expect(run()).To(Succeed())
+		})
+
+		It("should roll out the lower order first", func() {
+			Expect(imageOf("app")).To(Equal("octoblu/app:v2"))
+			Expect(imageOf("app-worker")).To(Equal("octoblu/app:v1"))
+			Expect(stateOf("app-worker").Reason).To(Equal(deployer.ReasonBatchWaiting))
+		})
+
+		It("should wait for the rollout to finish", func() {
+			Expect(run()).To(Succeed())
+			Expect(stateOf("app-worker").Reason).To(Equal(deployer.ReasonBatchWaiting))
+
+			docker.SetUpdateState("app", swarm.UpdateStateCompleted, "")
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app-worker")).To(Equal("octoblu/app:v2"))
+		})
+
+		It("should hold the batch back when the rollout paused", func() {
+			docker.SetUpdateState("app", swarm.UpdateStatePaused, "task failed")
+			Expect(run()).To(Succeed())
+			Expect(imageOf("app-worker")).To(Equal("octoblu/app:v1"))
+		})
+	})
+})
+
+var _ = Describe("Resume", func() {
+	var docker *deployertest.FakeDocker
+	var sut *deployer.Deployer
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+		docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v2", 1, nil))
+		sut = deployer.New(docker, &deployer.Options{DockerTimeout: time.Second})
+	})
+
+	It("should roll a paused update forward", func() {
+		docker.SetUpdateState("app", swarm.UpdateStatePaused, "task failed")
+		image, err := sut.Resume("app")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(image).To(Equal("octoblu/app:v2"))
+
+		service, _ := docker.Service("app")
+		Expect(service.UpdateStatus.State).To(Equal(swarm.UpdateStateUpdating))
+		Expect(service.Spec.Labels).To(HaveKey("octoblu.beekeeper.resumedAt"))
+	})
+
+	It("should refuse a rollout that is not paused", func() {
+		_, err := sut.Resume("app")
+		Expect(err).To(HaveOccurred())
+		Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+	})
+})
+
+var _ = Describe("SubscribeDeployments", func() {
+	var beekeeper *deployertest.Beekeeper
+	var events <-chan deployer.DeploymentEvent
+
+	BeforeEach(func() {
+		beekeeper = deployertest.NewBeekeeper()
+		sut := deployer.New(deployertest.NewFakeDocker(), &deployer.Options{
+			BeekeeperURI:       beekeeper.URL,
+			BeekeeperEventsURL: beekeeper.EventsURL,
+		})
+		events = sut.SubscribeDeployments()
+		Eventually(beekeeper.Listeners).Should(Equal(1))
+	})
+
+	AfterEach(func() {
+		beekeeper.Close()
+	})
+
+	It("should receive published builds", func() {
+		beekeeper.Publish(map[string]string{"owner": "octoblu", "repo": "app", "docker_url": "octoblu/app:v2"})
+		Eventually(events).Should(Receive(Equal(deployer.DeploymentEvent{
+			Owner:     "octoblu",
+			Repo:      "app",
+			DockerURL: "octoblu/app:v2",
+		})))
+	})
+})
+
+var _ = Describe("Verify", func() {
+	var docker *deployertest.FakeDocker
+	var beekeeper *deployertest.Beekeeper
+	var sut *deployer.Deployer
+
+	checkOf := func(err error) deployer.VerifyCheck {
+		verifyErr, ok := err.(*deployer.VerifyError)
+		Expect(ok).To(BeTrue(), "expected a VerifyError, got %v", err)
+		return verifyErr.Check
+	}
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+		beekeeper = deployertest.NewBeekeeper()
+		sut = deployer.New(docker, &deployer.Options{BeekeeperURI: beekeeper.URL, DockerTimeout: time.Second})
+	})
+
+	AfterEach(func() {
+		beekeeper.Close()
+	})
+
+	It("should pass without changing anything", func() {
+		Expect(sut.Verify()).To(Succeed())
+		Expect(docker.Calls("ServiceUpdate")).To(Equal(1))
+	})
+
+	It("should tell a read-only docker endpoint", func() {
+		docker.SetError("ServiceUpdate", errors.New("Error response from daemon: forbidden"))
+		Expect(checkOf(sut.Verify())).To(Equal(deployer.CheckDockerReadOnly))
+	})
+
+	It("should tell a docker endpoint that is not a manager", func() {
+		docker.SetError("SwarmInspect", errors.New("Error response from daemon: This node is not a swarm manager."))
+		Expect(checkOf(sut.Verify())).To(Equal(deployer.CheckNotSwarmManager))
+	})
+
+	It("should tell rejected beekeeper credentials", func() {
+		beekeeper.SetResponse("octoblu", "beekeeper-updater-swarm", deployertest.Response{Status: http.StatusUnauthorized})
+		Expect(checkOf(sut.Verify())).To(Equal(deployer.CheckBeekeeperCredentials))
+	})
+
+	It("should tell a cycle that could not reach docker", func() {
+		docker.SetError("ServiceList", errors.New("Cannot connect to the Docker daemon"))
+		err := sut.Run()
+		Expect(deployer.IsDockerUnreachable(err)).To(BeTrue())
+
+		docker.SetError("ServiceList", errors.New("Error response from daemon: rpc error"))
+		err = sut.Run()
+		Expect(err).To(HaveOccurred())
+		Expect(deployer.IsDockerUnreachable(err)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Simulate", func() {
+	dump := `[{
+		"ID": "abc123",
+		"Version": {"Index": 7},
+		"Spec": {
+			"Name": "app",
+			"Labels": {"octoblu.beekeeper.update": "true"},
+			"TaskTemplate": {"ContainerSpec": {"Image": "octoblu/app:v1"}},
+			"Mode": {"Replicated": {"Replicas": 2}}
+		}
+	}, {
+		"ID": "def456",
+		"Spec": {
+			"Name": "other",
+			"TaskTemplate": {"ContainerSpec": {"Image": "octoblu/other:v1"}}
+		}
+	}]`
+
+	It("should tell what a cycle would deploy", func() {
+		dockerClient, err := deployer.ReadServicesDump(strings.NewReader(dump))
+		Expect(err).NotTo(HaveOccurred())
+		sut := deployer.New(dockerClient, &deployer.Options{DockerTimeout: time.Second})
+		states, err := sut.Simulate(deployer.BeekeeperSnapshot{
+			"octoblu/app": {DockerURL: "octoblu/app:v2"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(states).To(HaveLen(1))
+		Expect(states[0].Name).To(Equal("app"))
+		Expect(states[0].LatestImage).To(Equal("octoblu/app:v2"))
+		Expect(states[0].Reason).To(Equal(deployer.ReasonDeployed))
+	})
+
+	It("should not write to the swarm", func() {
+		docker := deployertest.NewFakeDocker()
+		docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+			"octoblu.beekeeper.update": "true",
+		}))
+		sut := deployer.New(docker, &deployer.Options{DockerTimeout: time.Second, BumpScaledToZero: true})
+		_, err := sut.Simulate(deployer.BeekeeperSnapshot{
+			"octoblu/app": {DockerURL: "octoblu/app:v2"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+	})
+})
+
+var _ = Describe("DesiredState", func() {
+	var state deployer.DesiredState
+
+	BeforeEach(func() {
+		docker := deployertest.NewFakeDocker()
+		docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v2", 2, map[string]string{
+			"octoblu.beekeeper.update": "true",
+		}))
+		docker.AddService(deployertest.ServiceSpec("other", "octoblu/other:v1", 1, nil))
+		sut := deployer.New(docker, &deployer.Options{DockerTimeout: time.Second})
+		var err error
+		state, err = sut.ExportDesiredState()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should export only the tracked services", func() {
+		Expect(state.Services).To(HaveLen(1))
+		Expect(state.Services[0].Name).To(Equal("app"))
+		Expect(state.Services[0].Image).To(Equal("octoblu/app:v2"))
+	})
+
+	It("should create the missing services on a rebuilt swarm", func() {
+		docker := deployertest.NewFakeDocker()
+		sut := deployer.New(docker, &deployer.Options{DockerTimeout: time.Second})
+		changes, err := sut.ApplyDesiredState(state, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(HaveLen(1))
+		Expect(changes[0].Action).To(Equal(deployer.DesiredCreate))
+		service, ok := docker.Service("app")
+		Expect(ok).To(BeTrue())
+		Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v2"))
+		Expect(service.Spec.Labels).To(HaveKeyWithValue("octoblu.beekeeper.update", "true"))
+	})
+
+	It("should deploy the image to a service running another one", func() {
+		docker := deployertest.NewFakeDocker()
+		docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 2, nil))
+		sut := deployer.New(docker, &deployer.Options{DockerTimeout: time.Second})
+		changes, err := sut.ApplyDesiredState(state, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes[0].Action).To(Equal(deployer.DesiredUpdate))
+		Expect(changes[0].PreviousImage).To(Equal("octoblu/app:v1"))
+		Expect(docker.Calls("ServiceUpdate")).To(Equal(0))
+
+		_, err = sut.ApplyDesiredState(state, false)
+		Expect(err).NotTo(HaveOccurred())
+		service, _ := docker.Service("app")
+		Expect(service.Spec.TaskTemplate.ContainerSpec.Image).To(Equal("octoblu/app:v2"))
+	})
+})
+
+var _ = Describe("PollInterval", func() {
+	var docker *deployertest.FakeDocker
+	var beekeeper *deployertest.Beekeeper
+	var sut *deployer.Deployer
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+		docker.AddService(deployertest.ServiceSpec("app", "octoblu/app:v1", 1, map[string]string{
+			"octoblu.beekeeper.update": "true",
+		}))
+		beekeeper = deployertest.NewBeekeeper()
+		sut = deployer.New(docker, &deployer.Options{
+			BeekeeperURI:         beekeeper.URL,
+			DockerTimeout:        time.Second,
+			BeekeeperErrorBudget: 0.5,
+		})
+	})
+
+	AfterEach(func() {
+		beekeeper.Close()
+	})
+
+	runCycles := func(count int) {
+		for i := 0; i < count; i++ {
+			Expect(sut.Run()).To(Succeed())
+		}
+	}
+
+	It("should be base without a latency budget", func() {
+		sut = deployer.New(docker, &deployer.Options{BeekeeperURI: beekeeper.URL})
+		Expect(sut.MaxPollInterval(time.Minute)).To(Equal(time.Minute))
+	})
+
+	It("should not change while beekeeper is within budget", func() {
+		beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+		runCycles(25)
+		Expect(sut.PollInterval(time.Minute)).To(Equal(time.Minute))
+	})
+
+	It("should lengthen while beekeeper fails, and recover", func() {
+		beekeeper.SetResponse("octoblu", "app", deployertest.Response{Status: http.StatusInternalServerError})
+		runCycles(19)
+		Expect(sut.PollInterval(time.Minute)).To(Equal(time.Minute))
+		runCycles(1)
+		Expect(sut.PollInterval(time.Minute)).To(Equal(2 * time.Minute))
+		runCycles(5)
+		Expect(sut.PollInterval(time.Minute)).To(Equal(8 * time.Minute))
+		Expect(sut.MaxPollInterval(time.Minute)).To(Equal(sut.PollInterval(time.Minute)))
+
+		beekeeper.SetDeployment("octoblu", "app", "octoblu/app:v1")
+		runCycles(30)
+		Expect(sut.PollInterval(time.Minute)).To(Equal(time.Minute))
+	})
+})
+
+// racingDocker changes a service right after listing it,
+// like an operator between the list and the update of a cycle
+type racingDocker struct {
+	*deployertest.FakeDocker
+	race func()
+}
+
+func (docker racingDocker) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	services, err := docker.FakeDocker.ServiceList(ctx, options)
+	docker.race()
+	return services, err
+}
@@ -0,0 +1,34 @@
+package deployer
+
+import (
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// isScaledToZero returns true for a replicated service without
+// replicas. A weighted service is not, while its canary runs the
+// service itself may have none
+func isScaledToZero(service swarm.Service) bool {
+	if service.Spec.Labels["octoblu.beekeeper.weights"] != "" {
+		return false
+	}
+	replicated := service.Spec.Mode.Replicated
+	return replicated != nil && replicated.Replicas != nil && *replicated.Replicas == 0
+}
+
+// bumpImage sets the image of a service scaled to zero, so it
+// starts on it when scaled up. Nothing rolls out, so unlike deploy
+// it writes no labels, runs no hooks and is not audited
+func (deployer *Deployer) bumpImage(service swarm.Service, dockerURL string) error {
+	listedImage := service.Spec.TaskTemplate.ContainerSpec.Image
+	service.Spec.TaskTemplate.ContainerSpec.Image = dockerURL
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.writeService(service, listedImage, options); err != nil {
+		return err
+	}
+	countMetric("image_bumps")
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	return nil
+}
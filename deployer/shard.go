@@ -0,0 +1,49 @@
+package deployer
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// shard is the part of the services this updater updates when
+// several share a swarm, those whose id hashes to index mod count
+type shard struct {
+	index int
+	count int
+	lock  sync.Mutex
+}
+
+// SetShard makes the deployer update only the services whose id
+// hashes to index mod count, e.g. as the index of this updater among
+// the members sharing the swarm. A count of 1 or less updates them all
+func (deployer *Deployer) SetShard(index, count int) {
+	deployer.shard.lock.Lock()
+	defer deployer.shard.lock.Unlock()
+	if deployer.shard.index != index || deployer.shard.count != count {
+		debug("updating shard %d of %d", index, count)
+	}
+	deployer.shard.index = index
+	deployer.shard.count = count
+	metrics.Set("shard_index", expvarInt(int64(index)))
+	metrics.Set("shard_count", expvarInt(int64(count)))
+}
+
+// inShard returns true if the service belongs to the shard of the deployer
+func (deployer *Deployer) inShard(service swarm.Service) bool {
+	deployer.shard.lock.Lock()
+	index, count := deployer.shard.index, deployer.shard.count
+	deployer.shard.lock.Unlock()
+	if count <= 1 {
+		return true
+	}
+	return shardOf(service.ID, count) == index
+}
+
+// shardOf hashes the service id, which unlike its name never changes
+func shardOf(serviceID string, count int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(serviceID))
+	return int(hash.Sum32() % uint32(count))
+}
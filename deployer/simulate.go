@@ -0,0 +1,162 @@
+package deployer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+// errReadOnly is returned by the writes of a read-only docker client
+var errReadOnly = errors.New("Docker is read-only in a simulation")
+
+// BeekeeperSnapshot is the latest deployment of each
+// beekeeper project, keyed by "owner/repo"
+type BeekeeperSnapshot map[string]*RequestMetadata
+
+// Simulate runs a cycle without changing anything and returns what
+// it decided for each service, ReasonDeployed meaning it would
+// deploy LatestImage. With a snapshot beekeeper is not asked,
+// a project missing from it is unknown to beekeeper
+func (deployer *Deployer) Simulate(snapshot BeekeeperSnapshot) ([]ServiceState, error) {
+	deployer.dockerClient = ReadOnly(deployer.dockerClient)
+	deployer.cache = nil
+	deployer.snapshot = snapshot
+	deployer.dryRun = true
+	deployer.requestID = newRequestID()
+	deployer.checkSwarmPause()
+	if err := deployer.refreshPolicies(deployer.clock.Now()); err != nil {
+		return nil, err
+	}
+	services, err := deployer.listServices()
+	if err != nil {
+		return nil, err
+	}
+	deployer.batches = deployer.groupByImage(services)
+	for _, service := range services {
+		deployer.processService(service)
+	}
+	return deployer.Services(), nil
+}
+
+// snapshotDeployment returns the deployment of owner/repo in the snapshot
+func (deployer *Deployer) snapshotDeployment(owner, repo string) (*RequestMetadata, error) {
+	metadata, ok := deployer.snapshot[owner+"/"+repo]
+	if !ok || metadata == nil {
+		return nil, errProjectNotFound
+	}
+	return metadata, nil
+}
+
+// readOnlyDocker refuses every write to docker
+type readOnlyDocker struct {
+	DockerClient
+}
+
+// ReadOnly wraps dockerClient so every write fails
+func ReadOnly(dockerClient DockerClient) DockerClient {
+	if _, ok := dockerClient.(readOnlyDocker); ok {
+		return dockerClient
+	}
+	return readOnlyDocker{dockerClient}
+}
+
+func (docker readOnlyDocker) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error {
+	return errReadOnly
+}
+
+func (docker readOnlyDocker) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	return types.ServiceCreateResponse{}, errReadOnly
+}
+
+func (docker readOnlyDocker) ServiceRemove(ctx context.Context, serviceID string) error {
+	return errReadOnly
+}
+
+func (docker readOnlyDocker) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error {
+	return errReadOnly
+}
+
+// servicesDump is a swarm of the services of a docker
+// service inspect dump, without tasks or nodes
+type servicesDump struct {
+	services []swarm.Service
+}
+
+// ReadServicesDump reads the json of docker service inspect
+// as a read-only docker client
+func ReadServicesDump(reader io.Reader) (DockerClient, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var services []swarm.Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("Could not parse the services dump: %v", err)
+	}
+	return &servicesDump{services}, nil
+}
+
+func (dump *servicesDump) Events(ctx context.Context, options types.EventsOptions) (io.ReadCloser, error) {
+	return nil, errors.New("A services dump has no events")
+}
+
+func (dump *servicesDump) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	return nil, nil
+}
+
+func (dump *servicesDump) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, node swarm.NodeSpec) error {
+	return errReadOnly
+}
+
+func (dump *servicesDump) ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	return types.ServiceCreateResponse{}, errReadOnly
+}
+
+func (dump *servicesDump) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	for _, service := range dump.services {
+		if service.ID == serviceID || service.Spec.Name == serviceID {
+			return service, nil, nil
+		}
+	}
+	return swarm.Service{}, nil, fmt.Errorf("Error: No such service: %s", serviceID)
+}
+
+// ServiceList applies the id, name and label filters like docker
+func (dump *servicesDump) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	var services []swarm.Service
+	for _, service := range dump.services {
+		if options.Filter.Include("id") && !options.Filter.Match("id", service.ID) {
+			continue
+		}
+		if options.Filter.Include("name") && !options.Filter.Match("name", service.Spec.Name) {
+			continue
+		}
+		if !options.Filter.MatchKVList("label", service.Spec.Labels) {
+			continue
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (dump *servicesDump) ServiceRemove(ctx context.Context, serviceID string) error {
+	return errReadOnly
+}
+
+func (dump *servicesDump) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error {
+	return errReadOnly
+}
+
+func (dump *servicesDump) SwarmInspect(ctx context.Context) (swarm.Swarm, error) {
+	return swarm.Swarm{}, nil
+}
+
+func (dump *servicesDump) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	return nil, nil
+}
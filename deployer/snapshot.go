@@ -0,0 +1,137 @@
+package deployer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// DesiredState is the tracked services and their target images,
+// enough to recreate them on a rebuilt swarm
+type DesiredState struct {
+	ExportedAt time.Time        `json:"exportedAt"`
+	Services   []DesiredService `json:"services"`
+}
+
+// DesiredService is one tracked service of a DesiredState,
+// Spec is applied with Image as its image
+type DesiredService struct {
+	Name  string            `json:"name"`
+	Image string            `json:"image"`
+	Spec  swarm.ServiceSpec `json:"spec"`
+}
+
+// DesiredChange is what applying a DesiredState did,
+// or would do, to one service
+type DesiredChange struct {
+	Service       string `json:"service"`
+	Action        string `json:"action"`
+	Image         string `json:"image"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// The actions of a DesiredChange
+const (
+	DesiredCreate    = "create"
+	DesiredUpdate    = "update"
+	DesiredUnchanged = "unchanged"
+)
+
+// ExportDesiredState returns the services with the
+// octoblu.beekeeper.update label, or given by --services,
+// sorted by name, with the image each runs
+func (deployer *Deployer) ExportDesiredState() (DesiredState, error) {
+	state := DesiredState{ExportedAt: deployer.clock.Now().UTC(), Services: []DesiredService{}}
+	services, err := deployer.listAllServices()
+	if err != nil {
+		return state, err
+	}
+	for _, service := range services {
+		if _, tracked := deployer.updateLabel(service); !tracked {
+			continue
+		}
+		state.Services = append(state.Services, DesiredService{
+			Name:  service.Spec.Name,
+			Image: getCurrentDockerURL(service),
+			Spec:  service.Spec,
+		})
+	}
+	sort.Slice(state.Services, func(i, j int) bool {
+		return state.Services[i].Name < state.Services[j].Name
+	})
+	return state, nil
+}
+
+// ApplyDesiredState creates the services of state missing from the
+// swarm and deploys the target image to those running another one,
+// the specs of existing services are otherwise left alone.
+// It goes on past a failed service and returns the first error
+func (deployer *Deployer) ApplyDesiredState(state DesiredState, dryRun bool) ([]DesiredChange, error) {
+	deployer.requestID = newRequestID()
+	var changes []DesiredChange
+	var firstErr error
+	for _, desired := range state.Services {
+		change, err := deployer.applyDesiredService(desired, dryRun)
+		if err != nil {
+			change.Error = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, firstErr
+}
+
+func (deployer *Deployer) applyDesiredService(desired DesiredService, dryRun bool) (DesiredChange, error) {
+	change := DesiredChange{Service: desired.Name, Image: desired.Image}
+	ctx, cancel := deployer.dockerContext()
+	service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, desired.Name)
+	err = deployer.dockerError(ctx, "ServiceInspect", err)
+	cancel()
+	if isNotFound(err) {
+		change.Action = DesiredCreate
+		if dryRun {
+			return change, nil
+		}
+		return change, deployer.createDesiredService(desired)
+	}
+	if err != nil {
+		return change, err
+	}
+
+	change.PreviousImage = getCurrentDockerURL(service)
+	if change.PreviousImage == desired.Image {
+		change.Action = DesiredUnchanged
+		return change, nil
+	}
+	change.Action = DesiredUpdate
+	if dryRun {
+		return change, nil
+	}
+	return change, deployer.deploy(service, desired.Image)
+}
+
+func (deployer *Deployer) createDesiredService(desired DesiredService) error {
+	spec := desired.Spec
+	spec.Name = desired.Name
+	spec.TaskTemplate.ContainerSpec.Image = desired.Image
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	options := types.ServiceCreateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	response, err := deployer.dockerClient.ServiceCreate(ctx, spec, options)
+	if err = deployer.dockerError(ctx, "ServiceCreate", err); err != nil {
+		return err
+	}
+	deployer.audit(AuditRecord{
+		RequestID: deployer.requestID,
+		ServiceID: response.ID,
+		Service:   desired.Name,
+		Event:     "restored",
+		Image:     desired.Image,
+	})
+	return nil
+}
@@ -0,0 +1,79 @@
+package deployer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateStore keeps what the updater must remember across restarts
+// in a json file, written atomically by replacing it
+type stateStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// persistedState is the content of the state file
+type persistedState struct {
+	Counters    *persistedCounters         `json:"counters,omitempty"`
+	Deploys     map[string]deployRecord    `json:"deploys,omitempty"`
+	Deployments map[string]knownDeployment `json:"deployments,omitempty"`
+}
+
+func newStateStore(path string) *stateStore {
+	if path == "" {
+		return nil
+	}
+	return &stateStore{path: path}
+}
+
+// load reads the state file, a missing file is an empty state
+func (store *stateStore) load() (persistedState, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.read()
+}
+
+func (store *stateStore) read() (persistedState, error) {
+	var state persistedState
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// update changes the state with change and writes it back
+func (store *stateStore) update(change func(*persistedState)) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	state, err := store.read()
+	if err != nil {
+		return err
+	}
+	change(&state)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), ".state")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), store.path)
+}
@@ -0,0 +1,142 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// stuckImageLabel is the image a stuck update was rolled back from,
+// it is not deployed again until beekeeper has another
+const stuckImageLabel = "octoblu.beekeeper.stuckDockerURL"
+
+// StuckActionRollback rolls a stuck update back to the
+// image of the tasks it did not replace yet
+const StuckActionRollback = "rollback"
+
+// updatingSince returns when the update of the service started,
+// swarm may not say so the first cycle it was seen updating is used
+func (deployer *Deployer) updatingSince(service swarm.Service) time.Time {
+	if !service.UpdateStatus.StartedAt.IsZero() {
+		return service.UpdateStatus.StartedAt
+	}
+	deployer.updatingLock.Lock()
+	defer deployer.updatingLock.Unlock()
+	since, ok := deployer.updating[service.ID]
+	if !ok {
+		since = deployer.clock.Now()
+		deployer.updating[service.ID] = since
+	}
+	return since
+}
+
+// forgetUpdating drops the start of an update once the service
+// is not updating anymore
+func (deployer *Deployer) forgetUpdating(serviceID string) {
+	deployer.updatingLock.Lock()
+	defer deployer.updatingLock.Unlock()
+	delete(deployer.updating, serviceID)
+	delete(deployer.stuckAlerted, serviceID)
+}
+
+// checkStuck returns true if the service has been updating for longer
+// than the stuck threshold, e.g. because its tasks cannot be scheduled.
+// The first time it is alerted on and, with the rollback stuck action,
+// rolled back to the image its running tasks still have
+func (deployer *Deployer) checkStuck(service swarm.Service) bool {
+	if deployer.stuckAfter <= 0 {
+		return false
+	}
+	since := deployer.updatingSince(service)
+	if deployer.since(since) < deployer.stuckAfter {
+		return false
+	}
+	if deployer.dryRun {
+		deployer.debug("dry run, not acting on the stuck update of %s", service.ID)
+		return true
+	}
+
+	deployer.updatingLock.Lock()
+	alerted := deployer.stuckAlerted[service.ID]
+	deployer.stuckAlerted[service.ID] = true
+	deployer.updatingLock.Unlock()
+	if alerted {
+		return true
+	}
+
+	image := getCurrentDockerURL(service)
+	message := fmt.Sprintf("Updating since %s, longer than %v", since.Format(time.RFC3339), deployer.stuckAfter)
+	countLabeledMetric("stuck_updates", service.Spec.Name)
+	if deployer.stuckAction == StuckActionRollback {
+		if previous, err := deployer.rollbackStuck(service); err != nil {
+			message = fmt.Sprintf("%s, could not roll back: %v", message, err)
+		} else if previous != "" {
+			message = fmt.Sprintf("%s, rolled back to %s", message, previous)
+		}
+	}
+	deployer.debug("update of %s is stuck: %s", service.ID, message)
+	deployer.audit(AuditRecord{
+		RequestID: deployer.requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "update-stuck",
+		Image:     image,
+		Message:   message,
+	})
+	deployer.sendAlert(Alert{
+		Kind:      "update-stuck",
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     image,
+		Message:   message,
+		Owner:     deployer.serviceOwner(service),
+	})
+	return true
+}
+
+// rollbackStuck updates the service back to the image of the tasks
+// the stuck update did not replace yet, returning that image, or
+// an empty string when every task was replaced
+func (deployer *Deployer) rollbackStuck(service swarm.Service) (string, error) {
+	image := getCurrentDockerURL(service)
+	previous, err := deployer.runningImage(service.ID, service.Spec.TaskTemplate.ContainerSpec.Image)
+	if err != nil || previous == "" {
+		return "", err
+	}
+	listedImage := service.Spec.TaskTemplate.ContainerSpec.Image
+	service.Spec.TaskTemplate.ContainerSpec.Image = previous
+	if service.Spec.Labels == nil {
+		service.Spec.Labels = make(map[string]string)
+	}
+	service.Spec.Labels[stuckImageLabel] = image
+
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.writeService(service, listedImage, options); err != nil {
+		return "", err
+	}
+	countMetric("stuck_rollbacks")
+	return previous, nil
+}
+
+// runningImage returns the image of a running task of
+// the service that does not run image
+func (deployer *Deployer) runningImage(serviceID, image string) (string, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	filter := filters.NewArgs()
+	filter.Add("service", serviceID)
+	filter.Add("desired-state", string(swarm.TaskStateRunning))
+	tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+	if err != nil {
+		return "", deployer.dockerError(ctx, "TaskList", err)
+	}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning && task.Spec.ContainerSpec.Image != image {
+			return task.Spec.ContainerSpec.Image, nil
+		}
+	}
+	return "", nil
+}
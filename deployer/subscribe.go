@@ -0,0 +1,84 @@
+package deployer
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const subscribeRetryInterval = 10 * time.Second
+
+// DeploymentEvent is a message of the beekeeper
+// websocket, sent when a build is published
+type DeploymentEvent struct {
+	Owner     string `json:"owner"`
+	Repo      string `json:"repo"`
+	DockerURL string `json:"docker_url"`
+}
+
+// SubscribeDeployments connects to the beekeeper events websocket
+// and sends every deployment event on the returned channel, so a
+// cycle can start right away instead of waiting for the next poll.
+// A dropped socket is reconnected, polling carries on meanwhile.
+// The channel is nil without BeekeeperEventsURL
+func (deployer *Deployer) SubscribeDeployments() <-chan DeploymentEvent {
+	if deployer.beekeeperEventsURL == "" {
+		return nil
+	}
+	events := make(chan DeploymentEvent, 1)
+	go func() {
+		for {
+			err := deployer.streamDeployments(events)
+			debug("beekeeper event stream ended, reconnecting: %v", redactError(err))
+			countMetric("beekeeper_event_stream_reconnects")
+			time.Sleep(subscribeRetryInterval)
+		}
+	}()
+	return events
+}
+
+func (deployer *Deployer) streamDeployments(events chan<- DeploymentEvent) error {
+	config, err := websocket.NewConfig(deployer.beekeeperEventsURL, deployer.beekeeperURI)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", deployer.beekeeperEventsURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := deployer.authorizeBeekeeperRequest(deployer.defaultBeekeeper(), req); err != nil {
+		return err
+	}
+	config.Header = req.Header
+	if deployer.userAgent != "" {
+		config.Header.Set("User-Agent", deployer.userAgent)
+	}
+	if transport, ok := deployer.httpClient.Transport.(*http.Transport); ok {
+		config.TlsConfig = transport.TLSClientConfig
+	}
+
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	debug("subscribed to beekeeper events at %s", RedactURI(deployer.beekeeperEventsURL))
+
+	for {
+		var event DeploymentEvent
+		if err := websocket.JSON.Receive(conn, &event); err != nil {
+			return err
+		}
+		debug("beekeeper published %s/%s %s", event.Owner, event.Repo, event.DockerURL)
+		countMetric("beekeeper_events")
+		if deployer.deployments != nil {
+			deployer.deployments.forget(event.Owner, event.Repo)
+		}
+		select {
+		case events <- event:
+		default:
+			// a cycle is already due, it will pick this one up too
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package deployer
+
+import (
+	"golang.org/x/net/context"
+)
+
+// LogLine is a line a task of a service logged
+type LogLine struct {
+	TaskID string
+	Line   string
+}
+
+// LogReader reads the logs of services, which the docker
+// api the DockerClient speaks predates
+type LogReader interface {
+	// ServiceLogs returns the last tail lines of every task of
+	// the service, the tasks that exited included
+	ServiceLogs(ctx context.Context, serviceID string, tail int) ([]LogLine, error)
+}
+
+// attachFailureLogs adds the last lines the failed tasks logged to
+// their failures, when failure logs are enabled. Failures of tasks
+// that logged nothing, or whose logs cannot be read, are kept as is
+func (deployer *Deployer) attachFailureLogs(requestID, serviceID string, failures []TaskFailure) {
+	if deployer.logReader == nil || deployer.failureLogLines <= 0 || len(failures) == 0 {
+		return
+	}
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	lines, err := deployer.logReader.ServiceLogs(ctx, serviceID, deployer.failureLogLines)
+	if err != nil {
+		countMetric("failure_log_errors")
+		debug("[%s] could not read the logs of %s: %v", requestID, serviceID, deployer.dockerError(ctx, "ServiceLogs", err))
+		return
+	}
+	byTask := make(map[string][]string)
+	for _, line := range lines {
+		byTask[line.TaskID] = append(byTask[line.TaskID], line.Line)
+	}
+	for i, failure := range failures {
+		logs := byTask[failure.TaskID]
+		if len(logs) > deployer.failureLogLines {
+			logs = logs[len(logs)-deployer.failureLogLines:]
+		}
+		failures[i].Logs = logs
+	}
+}
+
+// failureLogs returns the logs of the most recent failure that has any
+func failureLogs(failures []TaskFailure) []string {
+	for _, failure := range failures {
+		if len(failure.Logs) > 0 {
+			return failure.Logs
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package deployer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// releaseTrainLabel names the release train of the service. Updates
+// of the members of a train wait for its next departure and deploy
+// together then, instead of whenever beekeeper has a new image
+const releaseTrainLabel = "octoblu.beekeeper.releaseTrain"
+
+// defaultBoarding is how long after a departure the members of a
+// train still deploy, so every cycle of that time reaches them
+const defaultBoarding = 15 * time.Minute
+
+// Train is a release train. Its members deploy at the Departures,
+// "HH:MM" in Timezone, on Days, every day when there are none
+type Train struct {
+	Name       string   `json:"name"`
+	Departures []string `json:"departures"`
+	Days       []string `json:"days"`
+	Timezone   string   `json:"timezone"`
+	// Boarding is how long after a departure members still
+	// deploy, e.g. "30m", 15 minutes by default
+	Boarding string `json:"boarding"`
+}
+
+// Validate returns why the train cannot be used
+func (train Train) Validate() error {
+	if train.Name == "" {
+		return fmt.Errorf("A release train has no name")
+	}
+	if len(train.Departures) == 0 {
+		return fmt.Errorf("Release train %q has no departures", train.Name)
+	}
+	if _, err := train.boarding(); err != nil {
+		return fmt.Errorf("Release train %q boarding: %v", train.Name, err)
+	}
+	for _, departure := range train.Departures {
+		if _, err := parseClock(departure); err != nil {
+			return fmt.Errorf("Release train %q departure: %v", train.Name, err)
+		}
+	}
+	windows, _ := train.windows()
+	for _, window := range windows {
+		if err := window.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (train Train) boarding() (time.Duration, error) {
+	if train.Boarding == "" {
+		return defaultBoarding, nil
+	}
+	boarding, err := time.ParseDuration(train.Boarding)
+	if err != nil {
+		return 0, err
+	}
+	if boarding < time.Minute || boarding >= 24*time.Hour {
+		return 0, fmt.Errorf("expected between 1m and 24h, got %v", boarding)
+	}
+	return boarding, nil
+}
+
+// windows are the times members of the train deploy, one
+// per departure lasting the boarding time
+func (train Train) windows() ([]Window, error) {
+	boarding, err := train.boarding()
+	if err != nil {
+		return nil, err
+	}
+	windows := make([]Window, 0, len(train.Departures))
+	for _, departure := range train.Departures {
+		from, err := parseClock(departure)
+		if err != nil {
+			return nil, err
+		}
+		to := (from + boarding.Truncate(time.Minute)) % (24 * time.Hour)
+		windows = append(windows, Window{
+			Name:     fmt.Sprintf("%s %s", train.Name, departure),
+			Days:     train.Days,
+			From:     departure,
+			To:       fmt.Sprintf("%02d:%02d", int(to/time.Hour), int(to%time.Hour/time.Minute)),
+			Timezone: train.Timezone,
+		})
+	}
+	return windows, nil
+}
+
+// departing returns true if the train departed at most the
+// boarding time before now, the train must be valid
+func (train Train) departing(now time.Time) bool {
+	windows, _ := train.windows()
+	for _, window := range windows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextDeparture returns the first departure of the train after
+// now, the train must be valid
+func (train Train) nextDeparture(now time.Time) time.Time {
+	windows, _ := train.windows()
+	var next time.Time
+	for _, window := range windows {
+		// transitions alternate between the window opening and closing
+		for i, candidate := range window.transitions(now, 7) {
+			if i%2 != 0 || !candidate.After(now) || !window.onDay(candidate.Weekday()) {
+				continue
+			}
+			if next.IsZero() || candidate.Before(next) {
+				next = candidate
+			}
+		}
+	}
+	return next
+}
+
+// ValidateTrains returns why the trains cannot be used together
+func ValidateTrains(trains []Train) error {
+	names := make(map[string]bool)
+	for _, train := range trains {
+		if err := train.Validate(); err != nil {
+			return err
+		}
+		if names[train.Name] {
+			return fmt.Errorf("Release train %q is defined twice", train.Name)
+		}
+		names[train.Name] = true
+	}
+	return nil
+}
+
+func trainsByName(trains []Train) map[string]Train {
+	byName := make(map[string]Train)
+	for _, train := range trains {
+		byName[train.Name] = train
+	}
+	return byName
+}
+
+// waitForTrain returns ReasonWaitingForTrain and holds the deploy
+// until the next departure when the service rides a train that is
+// not departing now, or ReasonUnknownTrain when its train is not
+// defined. It returns an empty reason when the deploy may go ahead
+func (deployer *Deployer) waitForTrain(service swarm.Service, dockerURL string) Reason {
+	name, ok := service.Spec.Labels[releaseTrainLabel]
+	if !ok || name == "" {
+		return ""
+	}
+	train, ok := deployer.train(name)
+	if !ok {
+		deployer.debug("%s rides the unknown release train %q, not deploying %s", service.ID, name, dockerURL)
+		return ReasonUnknownTrain
+	}
+	now := deployer.clock.Now()
+	if train.departing(now) {
+		return ""
+	}
+	next := train.nextDeparture(now)
+	deployer.debug("%s waits for release train %q at %s to deploy %s", service.ID, name, next.Format(time.RFC3339), dockerURL)
+	deployer.holdUntil(next)
+	return ReasonWaitingForTrain
+}
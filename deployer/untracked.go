@@ -0,0 +1,74 @@
+package deployer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// errProjectNotFound is returned when beekeeper answers
+// 404, it does not know the project
+var errProjectNotFound = errors.New("Beekeeper does not know the project")
+
+const maxUntrackedBackoff = 6 * time.Hour
+
+// untrackedProject is a project beekeeper answered 404 for,
+// it is looked up again with an exponential backoff
+type untrackedProject struct {
+	since    time.Time
+	retryAt  time.Time
+	failures uint
+}
+
+// untrackedUntil returns when the project may be looked up
+// again, ok is false when it is not backing off
+func (deployer *Deployer) untrackedUntil(key deploymentKey) (time.Time, bool) {
+	deployer.untrackedLock.Lock()
+	defer deployer.untrackedLock.Unlock()
+	project, ok := deployer.untracked[key]
+	if !ok || deployer.clock.Now().After(project.retryAt) {
+		return time.Time{}, false
+	}
+	return project.retryAt, true
+}
+
+// markUntracked backs off lookups of the project, the first
+// 404 is alerted on, the ones after only counted
+func (deployer *Deployer) markUntracked(key deploymentKey, service swarm.Service) time.Time {
+	deployer.untrackedLock.Lock()
+	project, known := deployer.untracked[key]
+	if !known {
+		project = &untrackedProject{since: deployer.clock.Now()}
+		deployer.untracked[key] = project
+	}
+	backoff := deployer.untrackedBackoff << project.failures
+	if backoff > maxUntrackedBackoff || backoff <= 0 {
+		backoff = maxUntrackedBackoff
+	}
+	project.failures++
+	project.retryAt = deployer.clock.Now().Add(backoff)
+	retryAt := project.retryAt
+	deployer.untrackedLock.Unlock()
+
+	countLabeledMetric("untracked_projects", key.owner+"/"+key.repo)
+	if !known {
+		deployer.sendAlert(Alert{
+			Kind:      "untracked-project",
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Image:     getCurrentDockerURL(service),
+			Message:   fmt.Sprintf("Beekeeper %v does not know %v/%v", RedactURI(key.beekeeper), key.owner, key.repo),
+			Owner:     deployer.serviceOwner(service),
+		})
+	}
+	return retryAt
+}
+
+// markTracked forgets the backoff once beekeeper knows the project
+func (deployer *Deployer) markTracked(key deploymentKey) {
+	deployer.untrackedLock.Lock()
+	defer deployer.untrackedLock.Unlock()
+	delete(deployer.untracked, key)
+}
@@ -0,0 +1,50 @@
+package deployer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// dockerURLData is what a docker url from beekeeper can use, so one
+// deployment serves several swarms, e.g.
+// "registry.{{.Environment}}.example.com/octoblu/app:v2"
+type dockerURLData struct {
+	Environment string
+	ClusterName string
+	Owner       string
+	Repo        string
+	Service     string
+	Labels      map[string]string
+}
+
+// expandDockerURL expands the placeholders in a docker url from
+// beekeeper for the service, a url without any is returned as is
+func (deployer *Deployer) expandDockerURL(dockerURL string, service swarm.Service, owner, repo string) (string, error) {
+	if !strings.Contains(dockerURL, "{{") {
+		return dockerURL, nil
+	}
+	tmpl, err := template.New("docker-url").Option("missingkey=error").Parse(dockerURL)
+	if err != nil {
+		countLabeledMetric("invalid_deployments", "template")
+		return "", fmt.Errorf("Beekeeper returned an invalid docker_url template %q for %v/%v: %v", dockerURL, owner, repo, err)
+	}
+	var expanded bytes.Buffer
+	err = tmpl.Execute(&expanded, dockerURLData{
+		Environment: deployer.environment,
+		ClusterName: deployer.cluster,
+		Owner:       owner,
+		Repo:        repo,
+		Service:     service.Spec.Name,
+		Labels:      service.Spec.Labels,
+	})
+	if err != nil {
+		countLabeledMetric("invalid_deployments", "template")
+		return "", fmt.Errorf("Could not expand docker_url %q for %v/%v: %v", dockerURL, owner, repo, err)
+	}
+	deployer.debug("expanded docker url %s to %s", dockerURL, expanded.String())
+	return expanded.String(), nil
+}
@@ -0,0 +1,101 @@
+package deployer
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// VerifyCheck names a misconfiguration found by Verify
+type VerifyCheck string
+
+const (
+	// CheckDockerUnreachable means docker did not answer
+	CheckDockerUnreachable VerifyCheck = "docker-unreachable"
+	// CheckNotSwarmManager means docker answered but is not a swarm manager
+	CheckNotSwarmManager VerifyCheck = "not-swarm-manager"
+	// CheckDockerReadOnly means docker refused a service update,
+	// e.g. behind a read-only socket proxy
+	CheckDockerReadOnly VerifyCheck = "docker-read-only"
+	// CheckBeekeeperUnreachable means beekeeper did not answer
+	CheckBeekeeperUnreachable VerifyCheck = "beekeeper-unreachable"
+	// CheckBeekeeperCredentials means beekeeper refused the credentials
+	CheckBeekeeperCredentials VerifyCheck = "beekeeper-credentials"
+)
+
+// probeService is updated to find out whether the docker endpoint
+// allows updates. It does not exist, so nothing changes either way
+const probeService = "beekeeper-updater-swarm-permission-probe"
+
+// probeOwner and probeRepo are looked up to check
+// the beekeeper credentials, beekeeper may not know them
+const (
+	probeOwner = "octoblu"
+	probeRepo  = "beekeeper-updater-swarm"
+)
+
+// VerifyError is returned by Verify for a misconfiguration
+type VerifyError struct {
+	Check VerifyCheck
+	Err   error
+}
+
+func (err *VerifyError) Error() string {
+	return string(err.Check) + ": " + redactError(err.Err).Error()
+}
+
+// Verify checks the docker endpoint is a swarm manager that allows
+// service updates and that beekeeper accepts the credentials,
+// without changing anything. The first failed check is returned
+func (deployer *Deployer) Verify() error {
+	deployer.requestID = newRequestID()
+	ctx, cancel := deployer.dockerContext()
+	_, err := deployer.dockerClient.SwarmInspect(ctx)
+	err = deployer.dockerError(ctx, "SwarmInspect", err)
+	cancel()
+	if err != nil {
+		if isDaemonResponse(err) {
+			return &VerifyError{CheckNotSwarmManager, err}
+		}
+		return &VerifyError{CheckDockerUnreachable, err}
+	}
+
+	ctx, cancel = deployer.dockerContext()
+	err = deployer.dockerClient.ServiceUpdate(ctx, probeService, swarm.Version{}, swarm.ServiceSpec{}, types.ServiceUpdateOptions{})
+	err = deployer.dockerError(ctx, "ServiceUpdate", err)
+	cancel()
+	if err != nil && !isNotFound(err) && !strings.Contains(strings.ToLower(err.Error()), "not found") {
+		if isDaemonResponse(err) {
+			return &VerifyError{CheckDockerReadOnly, err}
+		}
+		return &VerifyError{CheckDockerUnreachable, err}
+	}
+
+	_, err = deployer.getLatestDeployment(deployer.defaultBeekeeper(), probeOwner, probeRepo)
+	if err == nil || err == errProjectNotFound {
+		return nil
+	}
+	if statusErr, ok := err.(*beekeeperStatusError); ok {
+		if statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden {
+			return &VerifyError{CheckBeekeeperCredentials, err}
+		}
+	}
+	return &VerifyError{CheckBeekeeperUnreachable, err}
+}
+
+// IsDockerUnreachable returns true if err is a docker request
+// that failed before reaching the daemon, other than a timeout
+func IsDockerUnreachable(err error) bool {
+	return err != nil && !IsTimeout(err) && !isDaemonResponse(err)
+}
+
+// isDaemonResponse returns true if docker answered with err, rather
+// than the request not reaching it
+func isDaemonResponse(err error) bool {
+	if isNotFound(err) {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "Error response from daemon")
+}
@@ -0,0 +1,198 @@
+package deployer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// scanSeverityLabel overrides the scan severity for a service,
+// "off" deploys it whatever its scan report says
+const scanSeverityLabel = "octoblu.beekeeper.scanSeverity"
+
+// scanCacheTTL is how long a scan report is used, new
+// vulnerabilities are found in images that did not change
+const scanCacheTTL = 10 * time.Minute
+
+// severityRanks orders the severities of trivy reports
+var severityRanks = map[string]int{
+	"UNKNOWN":  1,
+	"LOW":      2,
+	"MEDIUM":   3,
+	"HIGH":     4,
+	"CRITICAL": 5,
+}
+
+var scanClient = &http.Client{Timeout: 30 * time.Second}
+
+// scanURLData is what a scan url template can use
+type scanURLData struct {
+	Image string
+	Owner string
+	Repo  string
+}
+
+// ParseScanURL parses the url of the scan report of an image, a
+// trivy json report, e.g. "https://scans.example.com/report?image={{.Image | urlquery}}"
+func ParseScanURL(uri string) (*template.Template, error) {
+	return template.New("scan-url").Option("missingkey=error").Parse(uri)
+}
+
+// ValidSeverity returns true for a trivy severity, e.g. HIGH
+func ValidSeverity(severity string) bool {
+	_, ok := severityRanks[strings.ToUpper(severity)]
+	return ok
+}
+
+// scanReport is the part of a trivy json report the gate reads
+type scanReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			Severity        string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// atLeast returns the ids of the vulnerabilities of severity or higher
+func (report *scanReport) atLeast(severity string) []string {
+	threshold := severityRanks[strings.ToUpper(severity)]
+	seen := make(map[string]bool)
+	var ids []string
+	for _, result := range report.Results {
+		for _, vulnerability := range result.Vulnerabilities {
+			if severityRanks[strings.ToUpper(vulnerability.Severity)] >= threshold && !seen[vulnerability.VulnerabilityID] {
+				seen[vulnerability.VulnerabilityID] = true
+				ids = append(ids, vulnerability.VulnerabilityID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// scanReports remembers the reports of images for scanCacheTTL
+type scanReports struct {
+	byImage map[string]cachedScanReport
+	lock    sync.Mutex
+}
+
+type cachedScanReport struct {
+	report    *scanReport
+	fetchedAt time.Time
+}
+
+// scanSeverity returns the severity from which the vulnerabilities
+// of the images of the service block their deploy, empty when the
+// service is not gated
+func (deployer *Deployer) scanSeverity(service swarm.Service) string {
+	label := service.Spec.Labels[scanSeverityLabel]
+	switch {
+	case label == "":
+		return deployer.scanSeverityDefault
+	case strings.EqualFold(label, "off"):
+		return ""
+	case ValidSeverity(label):
+		return strings.ToUpper(label)
+	}
+	deployer.debug("invalid %s label %q on %s, using %s", scanSeverityLabel, label, service.ID, deployer.scanSeverityDefault)
+	return deployer.scanSeverityDefault
+}
+
+// checkVulnerabilities blocks the deploy of an image whose scan report
+// has vulnerabilities of the scan severity or higher, alerting once.
+// An image without a report is not deployed either
+func (deployer *Deployer) checkVulnerabilities(service swarm.Service, dockerURL, owner, repo string) (Reason, error) {
+	if deployer.scanURL == nil {
+		return "", nil
+	}
+	severity := deployer.scanSeverity(service)
+	if severity == "" {
+		deployer.debug("the scan gate is off for %s", service.ID)
+		return "", nil
+	}
+	report, err := deployer.getScanReport(dockerURL, owner, repo)
+	if err != nil {
+		countLabeledMetric("scan_errors", owner+"/"+repo)
+		return ReasonScanError, fmt.Errorf("Could not get the scan report of %v: %v", dockerURL, err)
+	}
+	ids := report.atLeast(severity)
+	if len(ids) == 0 {
+		return "", nil
+	}
+	shown := ids
+	if len(shown) > 5 {
+		shown = append(shown[:5:5], "...")
+	}
+	message := fmt.Sprintf("%v has %d vulnerabilities of severity %s or higher: %s", dockerURL, len(ids), severity, strings.Join(shown, ", "))
+	countMetric("vulnerability_rejections")
+	if deployer.previousReason(service.ID) != ReasonVulnerable {
+		deployer.sendAlert(Alert{
+			Kind:      "vulnerable-image",
+			ServiceID: service.ID,
+			Service:   service.Spec.Name,
+			Image:     dockerURL,
+			Message:   message,
+			Owner:     deployer.serviceOwner(service),
+		})
+	}
+	return ReasonVulnerable, fmt.Errorf("%s", message)
+}
+
+func (deployer *Deployer) getScanReport(dockerURL, owner, repo string) (*scanReport, error) {
+	deployer.scanReports.lock.Lock()
+	cached, ok := deployer.scanReports.byImage[dockerURL]
+	deployer.scanReports.lock.Unlock()
+	if ok && deployer.since(cached.fetchedAt) < scanCacheTTL {
+		return cached.report, nil
+	}
+
+	var uri bytes.Buffer
+	if err := deployer.scanURL.Execute(&uri, scanURLData{Image: dockerURL, Owner: owner, Repo: repo}); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if deployer.userAgent != "" {
+		req.Header.Set("User-Agent", deployer.userAgent)
+	}
+	res, err := scanClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("%v was not scanned", dockerURL)
+	}
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("Invalid scan response status code %v", res.StatusCode)
+	}
+	report := &scanReport{}
+	if err := json.NewDecoder(res.Body).Decode(report); err != nil {
+		return nil, err
+	}
+
+	deployer.scanReports.lock.Lock()
+	for image, cached := range deployer.scanReports.byImage {
+		if deployer.since(cached.fetchedAt) >= scanCacheTTL {
+			delete(deployer.scanReports.byImage, image)
+		}
+	}
+	deployer.scanReports.byImage[dockerURL] = cachedScanReport{report, deployer.clock.Now()}
+	deployer.scanReports.lock.Unlock()
+	return report, nil
+}
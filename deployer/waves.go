@@ -0,0 +1,317 @@
+package deployer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// cordonedLabel marks a node paused by a wave rollout,
+// its value is the name of the service rolling out
+const cordonedLabel = "octoblu.beekeeper.cordonedBy"
+
+// planWaves splits the active nodes into the waves a global service
+// is rolled out in. Each wave takes a node of every rack, by the
+// wave node label, before a second node of any, so a rack never
+// loses all its nodes at once. Nodes paused by an earlier wave
+// rollout are planned again, nodes paused or drained by hand are not
+func (deployer *Deployer) planWaves() ([][]swarm.Node, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	nodes, err := deployer.dockerClient.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, deployer.dockerError(ctx, "NodeList", err)
+	}
+
+	racks := make(map[string][]swarm.Node)
+	var names []string
+	for _, node := range nodes {
+		if node.Spec.Availability != swarm.NodeAvailabilityActive && node.Spec.Labels[cordonedLabel] == "" {
+			continue
+		}
+		rack := node.Spec.Labels[deployer.waveNodeLabel]
+		if _, ok := racks[rack]; !ok {
+			names = append(names, rack)
+		}
+		racks[rack] = append(racks[rack], node)
+	}
+	sort.Strings(names)
+
+	var ordered []swarm.Node
+	for i := 0; len(ordered) < len(nodes); i++ {
+		added := false
+		for _, name := range names {
+			if i < len(racks[name]) {
+				ordered = append(ordered, racks[name][i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	size := deployer.waveSize
+	if size <= 0 {
+		size = len(names)
+	}
+	var waves [][]swarm.Node
+	for len(ordered) > 0 {
+		if size > len(ordered) {
+			size = len(ordered)
+		}
+		waves = append(waves, ordered[:size])
+		ordered = ordered[size:]
+	}
+	return waves, nil
+}
+
+// setCordoned pauses the node for the rollout of service, or makes
+// it active again. Only a node paused by a wave rollout is made active
+func (deployer *Deployer) setCordoned(node swarm.Node, service string, cordoned bool) error {
+	spec := node.Spec
+	labels := make(map[string]string, len(spec.Labels)+1)
+	for key, value := range spec.Labels {
+		labels[key] = value
+	}
+	if cordoned {
+		spec.Availability = swarm.NodeAvailabilityPause
+		labels[cordonedLabel] = service
+	} else {
+		if labels[cordonedLabel] == "" {
+			return nil
+		}
+		spec.Availability = swarm.NodeAvailabilityActive
+		delete(labels, cordonedLabel)
+	}
+	spec.Labels = labels
+
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	if err := deployer.dockerClient.NodeUpdate(ctx, node.ID, node.Version, spec); err != nil {
+		return deployer.dockerError(ctx, "NodeUpdate", err)
+	}
+	return nil
+}
+
+// cordonWaves pauses the nodes of every wave but the first, so the
+// update of the service only replaces the tasks of the first wave.
+// Nodes already paused are uncordoned again if one cannot be
+func (deployer *Deployer) cordonWaves(service string, waves [][]swarm.Node) error {
+	var cordoned []swarm.Node
+	for _, wave := range waves[1:] {
+		for _, node := range wave {
+			if node.Spec.Availability == swarm.NodeAvailabilityPause {
+				continue
+			}
+			if err := deployer.setCordoned(node, service, true); err != nil {
+				deployer.uncordonNodes(cordoned)
+				return err
+			}
+			cordoned = append(cordoned, node)
+		}
+	}
+	return nil
+}
+
+// uncordonNodes makes nodes active again, reading each node
+// first since its version changed when it was cordoned
+func (deployer *Deployer) uncordonNodes(nodes []swarm.Node) error {
+	ctx, cancel := deployer.dockerContext()
+	current, err := deployer.dockerClient.NodeList(ctx, types.NodeListOptions{})
+	err = deployer.dockerError(ctx, "NodeList", err)
+	cancel()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]swarm.Node, len(current))
+	for _, node := range current {
+		byID[node.ID] = node
+	}
+	for _, node := range nodes {
+		if err := deployer.setCordoned(byID[node.ID], "", false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flattenWaves(waves [][]swarm.Node) []swarm.Node {
+	var nodes []swarm.Node
+	for _, wave := range waves {
+		nodes = append(nodes, wave...)
+	}
+	return nodes
+}
+
+// rollWaves uncordons the waves one after another once the tasks of
+// the previous wave run dockerURL, then monitors the rollout as a
+// whole. A wave that does not finish within the deploy timeout stops
+// the rollout with the remaining waves still cordoned, to be looked at.
+// A superseded rollout uncordons them, unless the rollout of the
+// newer image plans them in its own waves
+func (deployer *Deployer) rollWaves(requestID string, service swarm.Service, dockerURL, previousImage string, waves [][]swarm.Node, timeout time.Duration) {
+	defer deployer.stopWaves(service.ID, dockerURL)
+	defer func() {
+		if r := recover(); r != nil {
+			debug("[%s] recovered panic rolling waves of %s - %v\n%s", requestID, service.ID, r, debugStack())
+			countLabeledMetric("recovered_panics", service.ID)
+		}
+	}()
+	for i, wave := range waves {
+		if i > 0 {
+			debug("[%s] uncordoning wave %d of %d of %s", requestID, i+1, len(waves), service.Spec.Name)
+			if err := deployer.uncordonNodes(wave); err != nil {
+				deployer.waveFailed(requestID, service, dockerURL, waves[i:], err)
+				return
+			}
+		}
+		if err := deployer.waitForWave(service.ID, dockerURL, wave, timeout); err != nil {
+			if _, superseded := err.(*supersededError); superseded {
+				deployer.supersedeWaves(requestID, service, dockerURL, waves[i+1:], err)
+				return
+			}
+			deployer.waveFailed(requestID, service, dockerURL, waves[i+1:], err)
+			return
+		}
+		countMetric("waves_rolled")
+	}
+	deployer.monitorRollout(requestID, service.ID, dockerURL, previousImage, timeout)
+}
+
+// startWaves records that the service rolls dockerURL out in waves,
+// before the rollout starts in the background
+func (deployer *Deployer) startWaves(serviceID, dockerURL string) {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	deployer.waveRollouts[serviceID] = dockerURL
+}
+
+// stopWaves forgets the wave rollout of dockerURL, unless
+// a newer one of the service replaced it
+func (deployer *Deployer) stopWaves(serviceID, dockerURL string) {
+	deployer.rolloutsLock.Lock()
+	defer deployer.rolloutsLock.Unlock()
+	if deployer.waveRollouts[serviceID] == dockerURL {
+		delete(deployer.waveRollouts, serviceID)
+	}
+}
+
+// supersedeWaves uncordons the remaining waves of a rollout another
+// image replaced, they would stay paused for every service otherwise.
+// A wave rollout of the newer image planned them in its own waves and
+// uncordons them itself
+func (deployer *Deployer) supersedeWaves(requestID string, service swarm.Service, dockerURL string, remaining [][]swarm.Node, err error) {
+	deployer.rolloutsLock.Lock()
+	current := deployer.waveRollouts[service.ID]
+	deployer.rolloutsLock.Unlock()
+	if current != "" && current != dockerURL {
+		debug("[%s] wave rollout of %s superseded by the wave rollout of %s", requestID, service.ID, current)
+		return
+	}
+	debug("[%s] wave rollout of %s superseded, uncordoning the remaining waves: %v", requestID, service.ID, err)
+	countMetric("waves_superseded")
+	if uncordonErr := deployer.uncordonNodes(flattenWaves(remaining)); uncordonErr != nil {
+		deployer.waveFailed(requestID, service, dockerURL, remaining, fmt.Errorf("%v, could not uncordon the remaining waves: %v", err, uncordonErr))
+	}
+}
+
+// supersededError is returned by waitForWave once
+// another image was deployed to the service
+type supersededError struct {
+	image string
+}
+
+func (err *supersededError) Error() string {
+	return fmt.Sprintf("Superseded by %v", err.image)
+}
+
+// waitForWave waits until every task of the service meant to run
+// on the nodes of wave runs dockerURL
+func (deployer *Deployer) waitForWave(serviceID, dockerURL string, wave []swarm.Node, timeout time.Duration) error {
+	onWave := make(map[string]bool, len(wave))
+	for _, node := range wave {
+		onWave[node.ID] = true
+	}
+	deadline := deployer.clock.Now().Add(timeout)
+	for deployer.clock.Now().Before(deadline) {
+		deployer.clock.Sleep(rolloutPollInterval)
+
+		ctx, cancel := deployer.dockerContext()
+		service, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, serviceID)
+		err = deployer.dockerError(ctx, "ServiceInspect", err)
+		cancel()
+		if err != nil {
+			continue
+		}
+		if image := service.Spec.TaskTemplate.ContainerSpec.Image; image != dockerURL {
+			return &supersededError{image}
+		}
+		if service.UpdateStatus.State == swarm.UpdateStatePaused {
+			return fmt.Errorf("Update paused: %v", service.UpdateStatus.Message)
+		}
+
+		ctx, cancel = deployer.dockerContext()
+		filter := filters.NewArgs()
+		filter.Add("service", serviceID)
+		filter.Add("desired-state", string(swarm.TaskStateRunning))
+		tasks, err := deployer.dockerClient.TaskList(ctx, types.TaskListOptions{Filter: filter})
+		err = deployer.dockerError(ctx, "TaskList", err)
+		cancel()
+		if err == nil && waveDone(tasks, onWave, dockerURL) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Wave did not finish within %v", timeout)
+}
+
+func waveDone(tasks []swarm.Task, onWave map[string]bool, dockerURL string) bool {
+	for _, task := range tasks {
+		if !onWave[task.NodeID] || task.DesiredState != swarm.TaskStateRunning {
+			continue
+		}
+		if task.Spec.ContainerSpec.Image != dockerURL || task.Status.State != swarm.TaskStateRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// waveFailed alerts on a wave rollout that stopped, naming
+// the nodes left cordoned
+func (deployer *Deployer) waveFailed(requestID string, service swarm.Service, dockerURL string, remaining [][]swarm.Node, err error) {
+	var cordoned []string
+	for _, wave := range remaining {
+		for _, node := range wave {
+			cordoned = append(cordoned, node.Description.Hostname)
+		}
+	}
+	message := err.Error()
+	if len(cordoned) > 0 {
+		message = fmt.Sprintf("%s, nodes left cordoned: %s", message, strings.Join(cordoned, ", "))
+	}
+	debug("[%s] wave rollout of %s stopped: %s", requestID, service.ID, message)
+	countMetric("waves_failed")
+	deployer.audit(AuditRecord{
+		RequestID: requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "wave-failed",
+		Image:     dockerURL,
+		Message:   message,
+	})
+	deployer.sendAlert(Alert{
+		RequestID: requestID,
+		Kind:      "wave-failed",
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Image:     dockerURL,
+		Message:   message,
+		Owner:     deployer.serviceOwner(service),
+	})
+}
@@ -0,0 +1,329 @@
+package deployer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+)
+
+// A service labeled octoblu.beekeeper.weights, e.g. "10,50,100",
+// gets new images as a weighted deploy: the image first runs in a
+// companion <name>-canary service holding that share of the replicas,
+// stepping through the weights every octoblu.beekeeper.weightInterval
+// (default 30m). When the last step is reached the service itself
+// is updated and the canary removed. The canary joins the networks
+// of the service with its name as an alias, so swarm dns spreads
+// clients over both. It does not publish ports, those stay on the
+// service. The progress is kept in the labels of the canary
+const (
+	canarySuffix          = "-canary"
+	defaultWeightInterval = 30 * time.Minute
+	// minWeightedReplicas is the fewest replicas that can be split
+	// between the service and its canary
+	minWeightedReplicas = 2
+
+	canaryOfLabel          = "octoblu.beekeeper.canaryOf"
+	weightStepLabel        = "octoblu.beekeeper.weightStep"
+	weightStepAtLabel      = "octoblu.beekeeper.weightStepAt"
+	weightTotalLabel       = "octoblu.beekeeper.weightTotal"
+	weightFailedImageLabel = "octoblu.beekeeper.weightFailedImage"
+)
+
+// weightSchedule is the percentage of replicas running the
+// new image at each step, the last step is always 100
+type weightSchedule struct {
+	weights  []uint64
+	interval time.Duration
+}
+
+// getWeightSchedule parses the weights labels of the service,
+// it returns nil when the service is not deployed weighted
+func getWeightSchedule(service swarm.Service) (*weightSchedule, error) {
+	label := service.Spec.Labels["octoblu.beekeeper.weights"]
+	if label == "" {
+		return nil, nil
+	}
+	if service.Spec.Mode.Replicated == nil || service.Spec.Mode.Replicated.Replicas == nil {
+		return nil, fmt.Errorf("Weighted deploys need a replicated service, %v is global", service.Spec.Name)
+	}
+
+	schedule := &weightSchedule{interval: defaultWeightInterval}
+	var previous uint64
+	for _, part := range strings.Split(label, ",") {
+		weight, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+		if err != nil || weight <= previous || weight > 100 {
+			return nil, fmt.Errorf("Invalid weights label %q, expected increasing percentages", label)
+		}
+		schedule.weights = append(schedule.weights, weight)
+		previous = weight
+	}
+	if previous != 100 {
+		schedule.weights = append(schedule.weights, 100)
+	}
+
+	if interval := service.Spec.Labels["octoblu.beekeeper.weightInterval"]; interval != "" {
+		parsed, err := time.ParseDuration(interval)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("Invalid weightInterval label %q", interval)
+		}
+		schedule.interval = parsed
+	}
+	return schedule, nil
+}
+
+// deployWeighted starts or advances the weighted deploy of dockerURL
+func (deployer *Deployer) deployWeighted(service swarm.Service, dockerURL string, migration *Migration, schedule *weightSchedule) (Reason, error) {
+	if service.Spec.Labels[weightFailedImageLabel] == dockerURL {
+		deployer.debug("weighted deploy of %s to %s failed before", dockerURL, service.ID)
+		return ReasonLastUpdateFailed, nil
+	}
+
+	canary, found, err := deployer.getCanary(service)
+	if err != nil {
+		return ReasonDeployError, err
+	}
+	if !found {
+		if replicas := *service.Spec.Mode.Replicated.Replicas; replicas < minWeightedReplicas {
+			return ReasonInvalidWeights, fmt.Errorf("Weighted deploys need at least %d replicas, %v has %d", minWeightedReplicas, service.Spec.Name, replicas)
+		}
+		reservation, ok := deployer.reserveUpdate()
+		if !ok {
+			deployer.debug("update budget exhausted, not starting weighted deploy of %s to %s", dockerURL, service.ID)
+			return ReasonBudgetExhausted, nil
+		}
+		if reason, err := deployer.beforeDeploy(service, dockerURL, migration); err != nil {
+			if reservation != nil {
+				reservation.Cancel()
+			}
+			return reason, err
+		}
+		if err := deployer.createCanary(service, dockerURL, schedule.weights[0]); err != nil {
+			if reservation != nil {
+				reservation.Cancel()
+			}
+			return ReasonDeployError, err
+		}
+		deployer.holdUntil(deployer.clock.Now().Add(schedule.interval))
+		return ReasonWeighted, nil
+	}
+
+	total, err := strconv.ParseUint(canary.Spec.Labels[weightTotalLabel], 10, 64)
+	if err != nil {
+		return ReasonDeployError, fmt.Errorf("Canary %v has an invalid %v label", canary.Spec.Name, weightTotalLabel)
+	}
+	if canary.UpdateStatus.State == swarm.UpdateStatePaused {
+		return ReasonDeployError, deployer.abortWeighted(service, canary, total)
+	}
+	if isUpdateInProcess(canary) {
+		deployer.debug("canary %s is still updating", canary.ID)
+		return ReasonWeighted, nil
+	}
+
+	step, _ := strconv.Atoi(canary.Spec.Labels[weightStepLabel])
+	if getCurrentDockerURL(canary) != dockerURL {
+		deployer.debug("new image %s during the weighted deploy of %s, starting over", dockerURL, service.ID)
+		step = 0
+	} else {
+		stepAt, _ := time.Parse(time.RFC3339, canary.Spec.Labels[weightStepAtLabel])
+		if deployer.since(stepAt) < schedule.interval {
+			deployer.holdUntil(stepAt.Add(schedule.interval))
+			deployer.debug("holding %s at %v%% of %v replicas", service.ID, schedule.weights[step], total)
+			return ReasonWeighted, nil
+		}
+		step++
+	}
+
+	if step >= len(schedule.weights)-1 {
+		return deployer.finishWeighted(service, canary, dockerURL, total)
+	}
+	if err := deployer.setWeight(service, canary, dockerURL, total, step, schedule.weights[step]); err != nil {
+		return ReasonDeployError, err
+	}
+	deployer.holdUntil(deployer.clock.Now().Add(schedule.interval))
+	return ReasonWeighted, nil
+}
+
+func (deployer *Deployer) getCanary(service swarm.Service) (swarm.Service, bool, error) {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	canary, _, err := deployer.dockerClient.ServiceInspectWithRaw(ctx, service.Spec.Name+canarySuffix)
+	if isNotFound(err) {
+		return canary, false, nil
+	}
+	if err != nil {
+		return canary, false, deployer.dockerError(ctx, "ServiceInspect", err)
+	}
+	if canary.Spec.Labels[canaryOfLabel] != service.ID {
+		return canary, false, fmt.Errorf("Service %v exists but is not the canary of %v", canary.Spec.Name, service.Spec.Name)
+	}
+	return canary, true, nil
+}
+
+// createCanary starts the canary with the first weight
+// of the replicas taken from the service
+func (deployer *Deployer) createCanary(service swarm.Service, dockerURL string, weight uint64) error {
+	total := *service.Spec.Mode.Replicated.Replicas
+	canaryReplicas := weightedReplicas(total, weight)
+	if canaryReplicas >= total {
+		return fmt.Errorf("Cannot split %v replicas of %v for a canary", total, service.Spec.Name)
+	}
+
+	spec := service.Spec
+	spec.Name = service.Spec.Name + canarySuffix
+	spec.TaskTemplate.ContainerSpec.Image = dockerURL
+	spec.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &canaryReplicas}}
+	spec.Labels = make(map[string]string)
+	for key, value := range service.Spec.Labels {
+		if !strings.HasPrefix(key, "octoblu.beekeeper.") {
+			spec.Labels[key] = value
+		}
+	}
+	spec.Labels[canaryOfLabel] = service.ID
+	spec.Labels[weightStepLabel] = "0"
+	spec.Labels[weightStepAtLabel] = deployer.clock.Now().Format(time.RFC3339)
+	spec.Labels[weightTotalLabel] = strconv.FormatUint(total, 10)
+	spec.Networks = make([]swarm.NetworkAttachmentConfig, len(service.Spec.Networks))
+	for i, network := range service.Spec.Networks {
+		spec.Networks[i] = swarm.NetworkAttachmentConfig{
+			Target:  network.Target,
+			Aliases: append(append([]string{}, network.Aliases...), service.Spec.Name),
+		}
+	}
+	if service.Spec.EndpointSpec != nil {
+		spec.EndpointSpec = &swarm.EndpointSpec{Mode: service.Spec.EndpointSpec.Mode}
+	}
+
+	deployer.debug("starting weighted deploy of %s to %s with %v%% of %v replicas", dockerURL, service.ID, weight, total)
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	options := types.ServiceCreateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if _, err := deployer.dockerClient.ServiceCreate(ctx, spec, options); err != nil {
+		return deployer.dockerError(ctx, "ServiceCreate", err)
+	}
+	if err := deployer.scaleService(service, total-canaryReplicas); err != nil {
+		return err
+	}
+	deployer.auditWeight(service, dockerURL, weight)
+	return nil
+}
+
+// setWeight moves replicas from the service to the canary,
+// the canary is scaled up first so capacity never drops
+func (deployer *Deployer) setWeight(service, canary swarm.Service, dockerURL string, total uint64, step int, weight uint64) error {
+	canaryReplicas := weightedReplicas(total, weight)
+	if canaryReplicas >= total {
+		return fmt.Errorf("Cannot split %v replicas of %v for a canary", total, service.Spec.Name)
+	}
+	deployer.debug("weighting %s at %v%% of %v replicas", service.ID, weight, total)
+
+	canary.Spec.TaskTemplate.ContainerSpec.Image = dockerURL
+	canary.Spec.Mode.Replicated.Replicas = &canaryReplicas
+	canary.Spec.Labels[weightStepLabel] = strconv.Itoa(step)
+	canary.Spec.Labels[weightStepAtLabel] = deployer.clock.Now().Format(time.RFC3339)
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.dockerClient.ServiceUpdate(ctx, canary.ID, canary.Version, canary.Spec, options); err != nil {
+		return deployer.dockerError(ctx, "ServiceUpdate", err)
+	}
+	if err := deployer.scaleService(service, total-canaryReplicas); err != nil {
+		return err
+	}
+	deployer.auditWeight(service, dockerURL, weight)
+	return nil
+}
+
+// finishWeighted gives the service all of its replicas back, deploys
+// the image to it and removes the canary. The replicas are written
+// before the deploy, which keeps the replicas docker has
+func (deployer *Deployer) finishWeighted(service, canary swarm.Service, dockerURL string, total uint64) (Reason, error) {
+	if err := deployer.scaleService(service, total); err != nil {
+		return ReasonDeployError, err
+	}
+	if err := deployer.deploy(service, dockerURL); err != nil {
+		return ReasonDeployError, err
+	}
+	if err := deployer.removeCanary(canary); err != nil {
+		return ReasonDeployError, err
+	}
+	return ReasonDeployed, nil
+}
+
+// abortWeighted gives the service its replicas back when the
+// canary rollout failed, the image is not tried again
+func (deployer *Deployer) abortWeighted(service, canary swarm.Service, total uint64) error {
+	dockerURL := getCurrentDockerURL(canary)
+	message := fmt.Sprintf("Rollout of canary %v paused: %v", canary.Spec.Name, canary.UpdateStatus.Message)
+	deployer.debug("aborting weighted deploy of %s to %s: %s", dockerURL, service.ID, message)
+
+	service.Spec.Labels[weightFailedImageLabel] = dockerURL
+	if err := deployer.scaleService(service, total); err != nil {
+		return err
+	}
+	if err := deployer.removeCanary(canary); err != nil {
+		return err
+	}
+	deployer.audit(AuditRecord{
+		RequestID: deployer.requestID,
+		ServiceID: service.ID,
+		Service:   service.Spec.Name,
+		Event:     "failed",
+		Image:     dockerURL,
+		Message:   message,
+	})
+	return fmt.Errorf("%v", message)
+}
+
+// scaleService writes the replicas, and any label changes, of the service
+func (deployer *Deployer) scaleService(service swarm.Service, replicas uint64) error {
+	service.Spec.Mode.Replicated.Replicas = &replicas
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	options := types.ServiceUpdateOptions{EncodedRegistryAuth: deployer.encodedRegistryAuth()}
+	if err := deployer.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, options); err != nil {
+		return deployer.dockerError(ctx, "ServiceUpdate", err)
+	}
+	if deployer.cache != nil {
+		deployer.refreshCachedService(service.ID)
+	}
+	return nil
+}
+
+func (deployer *Deployer) removeCanary(canary swarm.Service) error {
+	ctx, cancel := deployer.dockerContext()
+	defer cancel()
+	if err := deployer.dockerClient.ServiceRemove(ctx, canary.ID); err != nil {
+		return deployer.dockerError(ctx, "ServiceRemove", err)
+	}
+	return nil
+}
+
+func (deployer *Deployer) auditWeight(service swarm.Service, dockerURL string, weight uint64) {
+	countMetric("weight_steps")
+	deployer.audit(AuditRecord{
+		RequestID:     deployer.requestID,
+		ServiceID:     service.ID,
+		Service:       service.Spec.Name,
+		Event:         "weighted",
+		Image:         dockerURL,
+		PreviousImage: getCurrentDockerURL(service),
+		Message:       fmt.Sprintf("%v%% of replicas on the new image", weight),
+	})
+}
+
+// weightedReplicas is the share of total given to the canary,
+// at least one so the new image runs, and at most total-1
+func weightedReplicas(total, weight uint64) uint64 {
+	replicas := (total*weight + 99) / 100
+	if replicas < 1 {
+		replicas = 1
+	}
+	if replicas >= total && total > 1 {
+		replicas = total - 1
+	}
+	return replicas
+}
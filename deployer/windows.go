@@ -0,0 +1,180 @@
+package deployer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Window is a period deploys are allowed in, or forbidden in when
+// it is a blackout. It is either fixed, from Start to End, or
+// recurring on Days from From to To, "HH:MM" in Timezone. To before
+// From spans midnight. No Days means every day
+type Window struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Days     []string  `json:"days"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Timezone string    `json:"timezone"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Validate returns why the window cannot be used
+func (window Window) Validate() error {
+	if !window.Start.IsZero() || !window.End.IsZero() {
+		if window.From != "" || window.To != "" || len(window.Days) > 0 {
+			return fmt.Errorf("Window %q is both fixed and recurring", window.Name)
+		}
+		if !window.End.After(window.Start) {
+			return fmt.Errorf("Window %q ends before it starts", window.Name)
+		}
+		return nil
+	}
+	if _, err := parseClock(window.From); err != nil {
+		return fmt.Errorf("Window %q from: %v", window.Name, err)
+	}
+	if _, err := parseClock(window.To); err != nil {
+		return fmt.Errorf("Window %q to: %v", window.Name, err)
+	}
+	if _, err := time.LoadLocation(window.Timezone); err != nil {
+		return fmt.Errorf("Window %q timezone: %v", window.Name, err)
+	}
+	for _, day := range window.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("Window %q has an unknown day %q", window.Name, day)
+		}
+	}
+	return nil
+}
+
+// Contains returns true if now is within the window,
+// the window must be valid
+func (window Window) Contains(now time.Time) bool {
+	if !window.Start.IsZero() {
+		return !now.Before(window.Start) && now.Before(window.End)
+	}
+	location, _ := time.LoadLocation(window.Timezone)
+	now = now.In(location)
+	from, _ := parseClock(window.From)
+	to, _ := parseClock(window.To)
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+
+	day := now.Weekday()
+	if from <= to {
+		return clock >= from && clock < to && window.onDay(day)
+	}
+	// spanning midnight, the early hours belong to the day before
+	if clock >= from {
+		return window.onDay(day)
+	}
+	return clock < to && window.onDay((day+6)%7)
+}
+
+func (window Window) onDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, name := range window.Days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// transitions are the times in the days after now the window
+// opens or closes, the window must be valid
+func (window Window) transitions(now time.Time, days int) []time.Time {
+	if !window.Start.IsZero() {
+		return []time.Time{window.Start, window.End}
+	}
+	location, _ := time.LoadLocation(window.Timezone)
+	from, _ := parseClock(window.From)
+	to, _ := parseClock(window.To)
+	now = now.In(location)
+
+	var times []time.Time
+	for day := 0; day <= days; day++ {
+		for _, clock := range []time.Duration{from, to} {
+			times = append(times, time.Date(now.Year(), now.Month(), now.Day()+day, int(clock/time.Hour), int(clock%time.Hour/time.Minute), 0, 0, location))
+		}
+	}
+	return times
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// windowClosed returns why deploys are not allowed at now: a
+// blackout or calendar freeze it is in, or that it is outside
+// every deploy window
+func (deployer *Deployer) windowClosed(now time.Time) string {
+	if deployer.ignoreWindows {
+		return ""
+	}
+	for _, blackout := range deployer.blackouts {
+		if blackout.Contains(now) {
+			return fmt.Sprintf("in blackout %q", blackout.Name)
+		}
+	}
+	if deployer.freezeCalendar != nil {
+		freezes, loaded := deployer.freezeCalendar.current()
+		if !loaded {
+			return "the freeze calendar was not fetched yet"
+		}
+		for _, freeze := range freezes {
+			if freeze.Contains(now) {
+				return fmt.Sprintf("in freeze %q", freeze.Name)
+			}
+		}
+	}
+	if len(deployer.deployWindows) == 0 {
+		return ""
+	}
+	for _, window := range deployer.deployWindows {
+		if window.Contains(now) {
+			return ""
+		}
+	}
+	return "outside the deploy windows"
+}
+
+// windowOpens returns the first time after now deploys are
+// allowed again, zero when that is more than a week away
+func (deployer *Deployer) windowOpens(now time.Time) time.Time {
+	var candidates []time.Time
+	windowSets := [][]Window{deployer.deployWindows, deployer.blackouts}
+	if deployer.freezeCalendar != nil {
+		freezes, _ := deployer.freezeCalendar.current()
+		windowSets = append(windowSets, freezes)
+	}
+	for _, windows := range windowSets {
+		for _, window := range windows {
+			candidates = append(candidates, window.transitions(now, 7)...)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, candidate := range candidates {
+		if candidate.After(now) && deployer.windowClosed(candidate) == "" {
+			return candidate
+		}
+	}
+	return time.Time{}
+}
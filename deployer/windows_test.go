@@ -0,0 +1,98 @@
+package deployer_test
+
+import (
+	"time"
+
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Window", func() {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		Expect(err).NotTo(HaveOccurred())
+		return parsed
+	}
+
+	Describe("when it is fixed", func() {
+		window := deployer.Window{
+			Name:  "black friday",
+			Start: time.Date(2026, 11, 23, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2026, 11, 30, 0, 0, 0, 0, time.UTC),
+		}
+
+		It("should be valid", func() {
+			Expect(window.Validate()).To(Succeed())
+		})
+
+		It("should contain the times from start until end", func() {
+			Expect(window.Contains(at("2026-11-23T00:00:00Z"))).To(BeTrue())
+			Expect(window.Contains(at("2026-11-29T23:59:00Z"))).To(BeTrue())
+			Expect(window.Contains(at("2026-11-30T00:00:00Z"))).To(BeFalse())
+		})
+	})
+
+	Describe("when it recurs on weekdays", func() {
+		window := deployer.Window{
+			Days:     []string{"Mon", "Tue", "Wed", "Thu", "Fri"},
+			From:     "09:00",
+			To:       "17:00",
+			Timezone: "America/Phoenix",
+		}
+
+		It("should be valid", func() {
+			Expect(window.Validate()).To(Succeed())
+		})
+
+		It("should contain office hours in its timezone", func() {
+			// a friday, 16:30 in phoenix
+			Expect(window.Contains(at("2026-10-16T23:30:00Z"))).To(BeTrue())
+			Expect(window.Contains(at("2026-10-17T00:30:00Z"))).To(BeFalse())
+		})
+
+		It("should not contain the weekend", func() {
+			Expect(window.Contains(at("2026-10-17T18:00:00Z"))).To(BeFalse())
+		})
+	})
+
+	Describe("when it spans midnight", func() {
+		window := deployer.Window{Days: []string{"Fri"}, From: "22:00", To: "02:00"}
+
+		It("should contain the early hours of the next day", func() {
+			Expect(window.Contains(at("2026-10-16T23:00:00Z"))).To(BeTrue())
+			Expect(window.Contains(at("2026-10-17T01:00:00Z"))).To(BeTrue())
+			Expect(window.Contains(at("2026-10-18T01:00:00Z"))).To(BeFalse())
+		})
+	})
+
+	Describe("when it is invalid", func() {
+		It("should say so", func() {
+			Expect(deployer.Window{From: "9am", To: "17:00"}.Validate()).NotTo(Succeed())
+			Expect(deployer.Window{From: "09:00", To: "17:00", Days: []string{"Someday"}}.Validate()).NotTo(Succeed())
+			Expect(deployer.Window{From: "09:00", To: "17:00", Timezone: "Nowhere/Town"}.Validate()).NotTo(Succeed())
+		})
+	})
+})
+
+var _ = Describe("ValidateTrains", func() {
+	It("should accept valid trains", func() {
+		Expect(deployer.ValidateTrains([]deployer.Train{
+			{Name: "web", Departures: []string{"10:00", "16:00"}, Timezone: "America/Phoenix"},
+			{Name: "night", Departures: []string{"23:50"}, Days: []string{"Fri"}, Boarding: "30m"},
+		})).To(Succeed())
+	})
+
+	It("should reject invalid trains", func() {
+		Expect(deployer.ValidateTrains([]deployer.Train{{Name: "web"}})).NotTo(Succeed())
+		Expect(deployer.ValidateTrains([]deployer.Train{{Name: "web", Departures: []string{"10am"}}})).NotTo(Succeed())
+		Expect(deployer.ValidateTrains([]deployer.Train{{Name: "web", Departures: []string{"10:00"}, Boarding: "1s"}})).NotTo(Succeed())
+		Expect(deployer.ValidateTrains([]deployer.Train{{Name: "web", Departures: []string{"10:00"}, Days: []string{"Someday"}}})).NotTo(Succeed())
+	})
+
+	It("should reject a train defined twice", func() {
+		train := deployer.Train{Name: "web", Departures: []string{"10:00"}}
+		Expect(deployer.ValidateTrains([]deployer.Train{train, train})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,254 @@
+package deployertest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Response is a scripted answer of the Beekeeper stub,
+// Body is sent as json unless it is nil
+type Response struct {
+	Status int
+	Body   interface{}
+}
+
+// Beekeeper is a beekeeper server answering latest deployment
+// lookups at the default /deployments/<owner>/<repo>/latest path
+// with scripted responses, unknown projects get a 404. Deployment
+// events are published to websocket clients of /events. Bearer
+// tokens are issued by /oauth/token, a lookup with a revoked one
+// gets a 401
+type Beekeeper struct {
+	// URL is the base uri to give the deployer
+	URL string
+
+	// EventsURL is the websocket Publish sends events on
+	EventsURL string
+
+	// TokenURL issues tokens with the client credentials grant
+	TokenURL string
+
+	server    *httptest.Server
+	lock      sync.Mutex
+	responses map[string]Response
+	requests  map[string]int
+	headers   map[string]http.Header
+	posts     map[string][]json.RawMessage
+	listeners map[*websocket.Conn]chan struct{}
+	tokens    int
+	revoked   int
+	expiresIn int
+}
+
+// NewBeekeeper starts a stub, it must be closed
+func NewBeekeeper() *Beekeeper {
+	return newBeekeeper(func(server *httptest.Server) {
+		server.Start()
+	})
+}
+
+// NewTLSBeekeeper starts a stub serving the server certificate of
+// certs, it rejects clients without a certificate signed by its ca
+func NewTLSBeekeeper(certs *Certificates) *Beekeeper {
+	return newBeekeeper(func(server *httptest.Server) {
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{certs.server},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    certs.roots,
+		}
+		server.StartTLS()
+	})
+}
+
+func newBeekeeper(start func(*httptest.Server)) *Beekeeper {
+	beekeeper := &Beekeeper{
+		responses: make(map[string]Response),
+		requests:  make(map[string]int),
+		headers:   make(map[string]http.Header),
+		posts:     make(map[string][]json.RawMessage),
+		listeners: make(map[*websocket.Conn]chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/events", websocket.Handler(beekeeper.serveEvents))
+	mux.HandleFunc("/oauth/token", beekeeper.serveToken)
+	mux.HandleFunc("/", beekeeper.serveHTTP)
+	beekeeper.server = httptest.NewUnstartedServer(mux)
+	start(beekeeper.server)
+	beekeeper.URL = beekeeper.server.URL
+	beekeeper.EventsURL = "ws" + strings.TrimPrefix(beekeeper.server.URL, "http") + "/events"
+	beekeeper.TokenURL = beekeeper.server.URL + "/oauth/token"
+	return beekeeper
+}
+
+// Close stops the stub
+func (beekeeper *Beekeeper) Close() {
+	beekeeper.lock.Lock()
+	for conn, done := range beekeeper.listeners {
+		close(done)
+		delete(beekeeper.listeners, conn)
+	}
+	beekeeper.lock.Unlock()
+	beekeeper.server.Close()
+}
+
+// Listeners returns how many clients are subscribed to the events
+func (beekeeper *Beekeeper) Listeners() int {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	return len(beekeeper.listeners)
+}
+
+// Publish sends event as json to every subscribed client
+func (beekeeper *Beekeeper) Publish(event interface{}) {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	for conn := range beekeeper.listeners {
+		websocket.JSON.Send(conn, event)
+	}
+}
+
+func (beekeeper *Beekeeper) serveEvents(conn *websocket.Conn) {
+	done := make(chan struct{})
+	beekeeper.lock.Lock()
+	beekeeper.listeners[conn] = done
+	beekeeper.lock.Unlock()
+	<-done
+}
+
+// SetTokenExpiry sets the expires_in of the tokens issued from
+// now on, in seconds. Zero issues tokens that do not expire
+func (beekeeper *Beekeeper) SetTokenExpiry(seconds int) {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	beekeeper.expiresIn = seconds
+}
+
+// Tokens returns how many tokens were issued
+func (beekeeper *Beekeeper) Tokens() int {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	return beekeeper.tokens
+}
+
+// RevokeTokens rejects every token issued so far
+func (beekeeper *Beekeeper) RevokeTokens() {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	beekeeper.revoked = beekeeper.tokens
+}
+
+func (beekeeper *Beekeeper) serveToken(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" || request.FormValue("grant_type") != "client_credentials" {
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, _, ok := request.BasicAuth(); !ok {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	beekeeper.lock.Lock()
+	beekeeper.tokens++
+	token := map[string]interface{}{
+		"access_token": fmt.Sprintf("token-%d", beekeeper.tokens),
+		"token_type":   "bearer",
+		"expires_in":   beekeeper.expiresIn,
+	}
+	beekeeper.lock.Unlock()
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(token)
+}
+
+// isRevoked returns true if the request has a revoked bearer token
+func (beekeeper *Beekeeper) isRevoked(request *http.Request) bool {
+	var issued int
+	if _, err := fmt.Sscanf(request.Header.Get("Authorization"), "Bearer token-%d", &issued); err != nil {
+		return false
+	}
+	return issued <= beekeeper.revoked
+}
+
+// SetDeployment answers lookups of owner/repo with dockerURL
+func (beekeeper *Beekeeper) SetDeployment(owner, repo, dockerURL string) {
+	beekeeper.SetResponse(owner, repo, Response{
+		Status: http.StatusOK,
+		Body:   map[string]interface{}{"docker_url": dockerURL},
+	})
+}
+
+// SetResponse answers lookups of owner/repo with response
+func (beekeeper *Beekeeper) SetResponse(owner, repo string, response Response) {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	beekeeper.responses[owner+"/"+repo] = response
+}
+
+// Requests returns how often owner/repo was looked up
+func (beekeeper *Beekeeper) Requests(owner, repo string) int {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	return beekeeper.requests[owner+"/"+repo]
+}
+
+// LastHeader returns the headers of the last lookup of owner/repo
+func (beekeeper *Beekeeper) LastHeader(owner, repo string) http.Header {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	return beekeeper.headers[owner+"/"+repo]
+}
+
+// Posted returns the json bodies posted to path, e.g. rollout statuses
+func (beekeeper *Beekeeper) Posted(path string) []json.RawMessage {
+	beekeeper.lock.Lock()
+	defer beekeeper.lock.Unlock()
+	return append([]json.RawMessage(nil), beekeeper.posts[path]...)
+}
+
+func (beekeeper *Beekeeper) serveHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method == "POST" {
+		body, _ := ioutil.ReadAll(request.Body)
+		beekeeper.lock.Lock()
+		beekeeper.posts[request.URL.Path] = append(beekeeper.posts[request.URL.Path], body)
+		beekeeper.lock.Unlock()
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "deployments" || parts[3] != "latest" {
+		http.NotFound(response, request)
+		return
+	}
+	project := parts[1] + "/" + parts[2]
+
+	beekeeper.lock.Lock()
+	beekeeper.requests[project]++
+	beekeeper.headers[project] = request.Header
+	scripted, ok := beekeeper.responses[project]
+	revoked := beekeeper.isRevoked(request)
+	beekeeper.lock.Unlock()
+
+	if revoked {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	if scripted.Body == nil {
+		response.WriteHeader(scripted.Status)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(scripted.Status)
+	json.NewEncoder(response).Encode(scripted.Body)
+}
@@ -0,0 +1,80 @@
+package deployertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a deployer.Clock that only moves when told to. Sleeps
+// return once Advance or Set moved the clock past their end, so a
+// rollout being polled waits until the test moves time
+type Clock struct {
+	lock     sync.Mutex
+	now      time.Time
+	sleepers []sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+// NewClock returns a clock stopped at now
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the time the clock is at
+func (clock *Clock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+// Sleep blocks until the clock moved duration past now
+func (clock *Clock) Sleep(duration time.Duration) {
+	clock.lock.Lock()
+	if duration <= 0 {
+		clock.lock.Unlock()
+		return
+	}
+	wake := make(chan struct{})
+	clock.sleepers = append(clock.sleepers, sleeper{clock.now.Add(duration), wake})
+	clock.lock.Unlock()
+	<-wake
+}
+
+// Sleepers returns how many sleeps are waiting on the clock
+func (clock *Clock) Sleepers() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.sleepers)
+}
+
+// Advance moves the clock forward by duration
+func (clock *Clock) Advance(duration time.Duration) {
+	clock.Set(clock.Now().Add(duration))
+}
+
+// Set moves the clock to now, waking the sleeps that ended,
+// the earliest first
+func (clock *Clock) Set(now time.Time) {
+	clock.lock.Lock()
+	clock.now = now
+	var woken, waiting []sleeper
+	for _, sleeper := range clock.sleepers {
+		if sleeper.until.After(now) {
+			waiting = append(waiting, sleeper)
+		} else {
+			woken = append(woken, sleeper)
+		}
+	}
+	clock.sleepers = waiting
+	clock.lock.Unlock()
+
+	sort.Slice(woken, func(i, j int) bool { return woken[i].until.Before(woken[j].until) })
+	for _, sleeper := range woken {
+		close(sleeper.wake)
+	}
+}
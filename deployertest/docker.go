@@ -0,0 +1,504 @@
+// Package deployertest has fakes of docker and beekeeper
+// for testing the deployer without a swarm
+package deployertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"golang.org/x/net/context"
+)
+
+// FakeDocker is an in-memory swarm implementing deployer.DockerClient.
+// Updates change the spec right away, a rollout they start leaves
+// the service updating until SetUpdateState is called
+type FakeDocker struct {
+	lock     sync.Mutex
+	nextID   int
+	services map[string]swarm.Service
+	tasks    []swarm.Task
+	nodes    []swarm.Node
+	swarm    swarm.Swarm
+	configs  map[string]deployer.SwarmConfig
+	logs     map[string][]string
+	errors   map[string]error
+	calls    map[string]int
+	streams  []*io.PipeWriter
+	frozen   []swarm.Service
+}
+
+// NewFakeDocker constructs an empty swarm
+func NewFakeDocker() *FakeDocker {
+	return &FakeDocker{
+		services: make(map[string]swarm.Service),
+		configs:  make(map[string]deployer.SwarmConfig),
+		logs:     make(map[string][]string),
+		errors:   make(map[string]error),
+		calls:    make(map[string]int),
+	}
+}
+
+// ServiceSpec is a replicated service spec, labels may be nil
+func ServiceSpec(name, image string, replicas uint64, labels map[string]string) swarm.ServiceSpec {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	spec := swarm.ServiceSpec{
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	}
+	spec.Name = name
+	spec.Labels = labels
+	spec.TaskTemplate.ContainerSpec.Image = image
+	return spec
+}
+
+// AddService creates a service without going through
+// ServiceCreate, so it is not counted as a call
+func (fake *FakeDocker) AddService(spec swarm.ServiceSpec) swarm.Service {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.createService(spec)
+}
+
+// Service returns the current state of a service by id or name
+func (fake *FakeDocker) Service(nameOrID string) (swarm.Service, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	service, ok := fake.findService(nameOrID)
+	return copyService(service), ok
+}
+
+// SetUpdateState sets the update status of a service, e.g. to
+// complete or pause the rollout the deployer started
+func (fake *FakeDocker) SetUpdateState(nameOrID string, state swarm.UpdateState, message string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	service, ok := fake.findService(nameOrID)
+	if !ok {
+		panic("no such service " + nameOrID)
+	}
+	service.UpdateStatus.State = state
+	service.UpdateStatus.Message = message
+	if state == swarm.UpdateStateCompleted || state == swarm.UpdateStatePaused {
+		service.UpdateStatus.CompletedAt = time.Now()
+	}
+	fake.services[service.ID] = service
+}
+
+// AddTask adds a task, the test keeps it consistent with the services
+func (fake *FakeDocker) AddTask(task swarm.Task) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.tasks = append(fake.tasks, task)
+}
+
+// AddNode adds a node to the swarm
+func (fake *FakeDocker) AddNode(node swarm.Node) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.nodes = append(fake.nodes, node)
+}
+
+// SetConfig creates the swarm config name with data, replacing
+// the one of that name with a new version
+func (fake *FakeDocker) SetConfig(name string, data []byte) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.nextID++
+	fake.configs[name] = deployer.SwarmConfig{
+		ID:      fmt.Sprintf("config%d", fake.nextID),
+		Name:    name,
+		Version: uint64(fake.nextID),
+		Data:    append([]byte{}, data...),
+	}
+}
+
+// ReadConfig implements deployer.ConfigReader, it
+// returns the config of the name, not its versions
+func (fake *FakeDocker) ReadConfig(ctx context.Context, name string) (deployer.SwarmConfig, error) {
+	if err := fake.call("ReadConfig"); err != nil {
+		return deployer.SwarmConfig{}, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	config, ok := fake.configs[name]
+	if !ok {
+		return deployer.SwarmConfig{}, fmt.Errorf("config %s not found", name)
+	}
+	return config, nil
+}
+
+// AddLogs appends lines to the logs of a task
+func (fake *FakeDocker) AddLogs(taskID string, lines ...string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.logs[taskID] = append(fake.logs[taskID], lines...)
+}
+
+// ServiceLogs implements deployer.LogReader, it returns the
+// last tail lines of each task of the service
+func (fake *FakeDocker) ServiceLogs(ctx context.Context, serviceID string, tail int) ([]deployer.LogLine, error) {
+	if err := fake.call("ServiceLogs"); err != nil {
+		return nil, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	var lines []deployer.LogLine
+	for _, task := range fake.tasks {
+		if task.ServiceID != serviceID {
+			continue
+		}
+		logs := fake.logs[task.ID]
+		if len(logs) > tail {
+			logs = logs[len(logs)-tail:]
+		}
+		for _, line := range logs {
+			lines = append(lines, deployer.LogLine{TaskID: task.ID, Line: line})
+		}
+	}
+	return lines, nil
+}
+
+// SetSwarmLabels replaces the labels of the swarm spec
+func (fake *FakeDocker) SetSwarmLabels(labels map[string]string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.swarm.Spec.Labels = labels
+}
+
+// SetError makes every call of operation, e.g. "ServiceUpdate",
+// fail with err until it is set back to nil
+func (fake *FakeDocker) SetError(operation string, err error) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if err == nil {
+		delete(fake.errors, operation)
+		return
+	}
+	fake.errors[operation] = err
+}
+
+// Calls returns how often operation was called
+func (fake *FakeDocker) Calls(operation string) int {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.calls[operation]
+}
+
+// Events returns a stream that stays open until the context is
+// done, fake changes are not published, see PublishServiceEvent
+func (fake *FakeDocker) Events(ctx context.Context, options types.EventsOptions) (io.ReadCloser, error) {
+	if err := fake.call("Events"); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	fake.lock.Lock()
+	fake.streams = append(fake.streams, writer)
+	fake.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		writer.CloseWithError(ctx.Err())
+	}()
+	return reader, nil
+}
+
+// PublishServiceEvent sends a service event to the open event
+// streams, it returns how many streams it was sent to
+func (fake *FakeDocker) PublishServiceEvent(action, nameOrID string) int {
+	fake.lock.Lock()
+	service, _ := fake.findService(nameOrID)
+	streams := append([]*io.PipeWriter{}, fake.streams...)
+	fake.lock.Unlock()
+
+	event, _ := json.Marshal(map[string]interface{}{
+		"Type":   "service",
+		"Action": action,
+		"Actor":  map[string]string{"ID": service.ID},
+	})
+	sent := 0
+	for _, stream := range streams {
+		if _, err := stream.Write(event); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// FreezeServiceList makes ServiceList return the services as they
+// are now from then on, like a list taken before later updates
+func (fake *FakeDocker) FreezeServiceList() {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.frozen = make([]swarm.Service, 0, len(fake.services))
+	for _, service := range fake.services {
+		fake.frozen = append(fake.frozen, copyService(service))
+	}
+}
+
+// NodeList returns every node, filters are ignored
+func (fake *FakeDocker) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	if err := fake.call("NodeList"); err != nil {
+		return nil, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return append([]swarm.Node{}, fake.nodes...), nil
+}
+
+// NodeUpdate replaces the spec of a node
+func (fake *FakeDocker) NodeUpdate(ctx context.Context, nodeID string, version swarm.Version, spec swarm.NodeSpec) error {
+	if err := fake.call("NodeUpdate"); err != nil {
+		return err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for i, node := range fake.nodes {
+		if node.ID != nodeID {
+			continue
+		}
+		if node.Version.Index != version.Index {
+			return fmt.Errorf("Error response from daemon: update out of sequence")
+		}
+		fake.nodes[i].Spec = spec
+		fake.nodes[i].Version.Index++
+		return nil
+	}
+	return notFoundError{nodeID}
+}
+
+// Node returns the node with the id
+func (fake *FakeDocker) Node(id string) (swarm.Node, bool) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	for _, node := range fake.nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return swarm.Node{}, false
+}
+
+// ServiceCreate creates a service, the name must be unused
+func (fake *FakeDocker) ServiceCreate(ctx context.Context, spec swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	if err := fake.call("ServiceCreate"); err != nil {
+		return types.ServiceCreateResponse{}, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	if _, ok := fake.findService(spec.Name); ok {
+		return types.ServiceCreateResponse{}, fmt.Errorf("Error response from daemon: name %s is already in use", spec.Name)
+	}
+	service := fake.createService(spec)
+	return types.ServiceCreateResponse{ID: service.ID}, nil
+}
+
+// ServiceInspectWithRaw returns a service by id or name,
+// the raw body is always nil
+func (fake *FakeDocker) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	if err := fake.call("ServiceInspect"); err != nil {
+		return swarm.Service{}, nil, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	service, ok := fake.findService(serviceID)
+	if !ok {
+		return swarm.Service{}, nil, notFoundError{serviceID}
+	}
+	return copyService(service), nil, nil
+}
+
+// ServiceList returns the services sorted by name, the
+// id, name and label filters are applied like docker does
+func (fake *FakeDocker) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	if err := fake.call("ServiceList"); err != nil {
+		return nil, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	all := fake.services
+	if fake.frozen != nil {
+		all = make(map[string]swarm.Service, len(fake.frozen))
+		for _, service := range fake.frozen {
+			all[service.ID] = service
+		}
+	}
+	services := []swarm.Service{}
+	for _, service := range all {
+		if options.Filter.Include("id") && !options.Filter.Match("id", service.ID) {
+			continue
+		}
+		if options.Filter.Include("name") && !options.Filter.Match("name", service.Spec.Name) {
+			continue
+		}
+		if !options.Filter.MatchKVList("label", service.Spec.Labels) {
+			continue
+		}
+		services = append(services, copyService(service))
+	}
+	sort.Sort(byName(services))
+	return services, nil
+}
+
+// ServiceRemove removes a service by id or name
+func (fake *FakeDocker) ServiceRemove(ctx context.Context, serviceID string) error {
+	if err := fake.call("ServiceRemove"); err != nil {
+		return err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	service, ok := fake.findService(serviceID)
+	if !ok {
+		return notFoundError{serviceID}
+	}
+	delete(fake.services, service.ID)
+	return nil
+}
+
+// ServiceUpdate replaces the spec of a service, failing like docker
+// when version is not the current version of the service. A changed
+// image, or any update of a paused service, starts a rollout
+func (fake *FakeDocker) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec, options types.ServiceUpdateOptions) error {
+	if err := fake.call("ServiceUpdate"); err != nil {
+		return err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	service, ok := fake.findService(serviceID)
+	if !ok {
+		return notFoundError{serviceID}
+	}
+	if version.Index != service.Version.Index {
+		return fmt.Errorf("Error response from daemon: update out of sequence")
+	}
+
+	if spec.TaskTemplate.ContainerSpec.Image != service.Spec.TaskTemplate.ContainerSpec.Image || service.UpdateStatus.State == swarm.UpdateStatePaused {
+		service.UpdateStatus = swarm.UpdateStatus{
+			State:     swarm.UpdateStateUpdating,
+			StartedAt: time.Now(),
+		}
+	}
+	service.Spec = copySpec(spec)
+	service.Version.Index++
+	service.UpdatedAt = time.Now()
+	fake.services[service.ID] = service
+	return nil
+}
+
+// SwarmInspect returns the swarm, only its labels are set
+func (fake *FakeDocker) SwarmInspect(ctx context.Context) (swarm.Swarm, error) {
+	if err := fake.call("SwarmInspect"); err != nil {
+		return swarm.Swarm{}, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	return fake.swarm, nil
+}
+
+// TaskList returns the tasks, filtered by service, node and desired-state
+func (fake *FakeDocker) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	if err := fake.call("TaskList"); err != nil {
+		return nil, err
+	}
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	tasks := []swarm.Task{}
+	for _, task := range fake.tasks {
+		if options.Filter.Include("service") && !options.Filter.ExactMatch("service", task.ServiceID) {
+			continue
+		}
+		if options.Filter.Include("node") && !options.Filter.ExactMatch("node", task.NodeID) {
+			continue
+		}
+		if options.Filter.Include("desired-state") && !options.Filter.ExactMatch("desired-state", string(task.DesiredState)) {
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// call counts a call of operation and returns its scripted error
+func (fake *FakeDocker) call(operation string) error {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.calls[operation]++
+	return fake.errors[operation]
+}
+
+func (fake *FakeDocker) createService(spec swarm.ServiceSpec) swarm.Service {
+	fake.nextID++
+	service := swarm.Service{
+		ID:   fmt.Sprintf("service%d", fake.nextID),
+		Spec: copySpec(spec),
+	}
+	service.Version.Index = 1
+	service.CreatedAt = time.Now()
+	service.UpdatedAt = service.CreatedAt
+	fake.services[service.ID] = service
+	return copyService(service)
+}
+
+func (fake *FakeDocker) findService(nameOrID string) (swarm.Service, bool) {
+	if service, ok := fake.services[nameOrID]; ok {
+		return service, true
+	}
+	for _, service := range fake.services {
+		if service.Spec.Name == nameOrID {
+			return service, true
+		}
+	}
+	return swarm.Service{}, false
+}
+
+// copyService keeps callers from changing the stored
+// labels or replicas through the maps and pointers they share
+func copyService(service swarm.Service) swarm.Service {
+	service.Spec = copySpec(service.Spec)
+	return service
+}
+
+func copySpec(spec swarm.ServiceSpec) swarm.ServiceSpec {
+	labels := make(map[string]string, len(spec.Labels))
+	for key, value := range spec.Labels {
+		labels[key] = value
+	}
+	spec.Labels = labels
+	if spec.Mode.Replicated != nil && spec.Mode.Replicated.Replicas != nil {
+		replicas := *spec.Mode.Replicated.Replicas
+		spec.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	}
+	if spec.UpdateConfig != nil {
+		updateConfig := *spec.UpdateConfig
+		spec.UpdateConfig = &updateConfig
+	}
+	return spec
+}
+
+// notFoundError is returned for a missing service,
+// like the unexported error of engine-api it has NotFound
+type notFoundError struct {
+	id string
+}
+
+func (err notFoundError) Error() string {
+	return fmt.Sprintf("Error: No such service: %s", err.id)
+}
+
+func (err notFoundError) NotFound() bool {
+	return true
+}
+
+type byName []swarm.Service
+
+func (services byName) Len() int           { return len(services) }
+func (services byName) Swap(i, j int)      { services[i], services[j] = services[j], services[i] }
+func (services byName) Less(i, j int) bool { return services[i].Spec.Name < services[j].Spec.Name }
@@ -0,0 +1,112 @@
+package deployertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Certificates are a certificate authority with a server certificate
+// for 127.0.0.1 and a client certificate signed by it, the pem files
+// of the authority and the client are written to a directory
+type Certificates struct {
+	// CA is the pem file of the certificate authority
+	CA string
+
+	// ClientCert and ClientKey are the pem files of the client
+	ClientCert string
+	ClientKey  string
+
+	roots  *x509.CertPool
+	server tls.Certificate
+}
+
+// NewCertificates creates the certificates, writing them to dir
+func NewCertificates(dir string) (*Certificates, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := certificateTemplate(1, "beekeeper test ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := &Certificates{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+		roots:      x509.NewCertPool(),
+	}
+	certs.roots.AddCert(ca)
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return nil, err
+	}
+
+	serverTemplate := certificateTemplate(2, "127.0.0.1")
+	serverTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	serverDER, serverKey, err := signCertificate(serverTemplate, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	certs.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientTemplate := certificateTemplate(3, "beekeeper-updater-swarm")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	clientDER, clientKey, err := signCertificate(clientTemplate, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(certs.ClientCert, "CERTIFICATE", clientDER); err != nil {
+		return nil, err
+	}
+	if err := writePEM(certs.ClientKey, "EC PRIVATE KEY", clientKeyDER); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func certificateTemplate(serial int64, name string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+func signCertificate(template, ca *x509.Certificate, caKey *ecdsa.PrivateKey) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	return der, key, err
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
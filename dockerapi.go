@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/fatih/color"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"golang.org/x/net/context"
+)
+
+const (
+	// serviceLogsVersion is the first docker api version with service logs
+	serviceLogsVersion = "v1.29"
+	// swarmConfigsVersion is the first docker api version with configs
+	swarmConfigsVersion = "v1.30"
+	// serviceEventsVersion is the first docker api version with service events
+	serviceEventsVersion = "v1.30"
+)
+
+// dockerAPI reads swarm configs, service logs and service events
+// straight from the docker api, the engine-api client the updater
+// uses predates them
+type dockerAPI struct {
+	baseURL string
+	client  *http.Client
+}
+
+// swarmConfig is a config as the docker api lists it
+type swarmConfig struct {
+	ID      string
+	Version struct {
+		Index uint64
+	}
+	Spec struct {
+		Name string
+		Data []byte
+	}
+}
+
+func newDockerAPI(dockerURI, contextName string) (*dockerAPI, error) {
+	dockerURI, httpClient := getDockerEndpoint(dockerURI, contextName)
+	proto, addr, basePath, err := ParseHost(dockerURI)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	scheme := "http"
+	if transport, ok := httpClient.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+		scheme = "https"
+	}
+	switch proto {
+	case "unix":
+		socket := addr
+		httpClient = &http.Client{Transport: &http.Transport{
+			Dial: func(network, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		}}
+		// the address is never dialed, the socket is
+		addr = "docker"
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("cannot reach the docker api over %s", proto)
+	}
+	return &dockerAPI{
+		baseURL: fmt.Sprintf("%s://%s%s", scheme, addr, basePath),
+		client:  httpClient,
+	}, nil
+}
+
+// get returns the body of a GET of path on the docker api of
+// version, the caller must close it
+func (api *dockerAPI) get(ctx context.Context, version, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", api.baseURL+"/"+version+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s failed with status code %v: %s", path, res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return res.Body, nil
+}
+
+// Events streams the events matching the filters of options,
+// service events included
+func (api *dockerAPI) Events(ctx context.Context, options types.EventsOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	if options.Filters.Len() > 0 {
+		param, err := filters.ToParam(options.Filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", param)
+	}
+	return api.get(ctx, serviceEventsVersion, "/events?"+query.Encode())
+}
+
+// serviceEventsDocker is a docker client whose event stream
+// comes from a docker api version with service events
+type serviceEventsDocker struct {
+	deployer.DockerClient
+	api *dockerAPI
+}
+
+// withServiceEvents returns dockerClient with the events of the docker
+// api of dockerURI, the events of the v1.24 api of the engine-api
+// client do not include services so a cache of them is never updated
+func withServiceEvents(dockerClient deployer.DockerClient, dockerURI, contextName string) deployer.DockerClient {
+	api, err := newDockerAPI(dockerURI, contextName)
+	if err != nil {
+		color.Red("  Cannot stream service events: %v", err)
+		os.Exit(exitConfig)
+	}
+	return serviceEventsDocker{DockerClient: dockerClient, api: api}
+}
+
+func (docker serviceEventsDocker) Events(ctx context.Context, options types.EventsOptions) (io.ReadCloser, error) {
+	return docker.api.Events(ctx, options)
+}
+
+// ReadConfig returns the config named name, or the newest of
+// those named name-<version>, by the raft index of their creation
+func (api *dockerAPI) ReadConfig(ctx context.Context, name string) (deployer.SwarmConfig, error) {
+	body, err := api.get(ctx, swarmConfigsVersion, "/configs")
+	if err != nil {
+		return deployer.SwarmConfig{}, err
+	}
+	defer body.Close()
+	var listed []swarmConfig
+	if err := json.NewDecoder(body).Decode(&listed); err != nil {
+		return deployer.SwarmConfig{}, err
+	}
+
+	var newest *swarmConfig
+	for i, config := range listed {
+		if config.Spec.Name != name && !strings.HasPrefix(config.Spec.Name, name+"-") {
+			continue
+		}
+		if newest == nil || config.Version.Index > newest.Version.Index {
+			newest = &listed[i]
+		}
+	}
+	if newest == nil {
+		return deployer.SwarmConfig{}, fmt.Errorf("There is no swarm config named %s", name)
+	}
+	return deployer.SwarmConfig{
+		ID:      newest.ID,
+		Name:    newest.Spec.Name,
+		Version: newest.Version.Index,
+		Data:    newest.Spec.Data,
+	}, nil
+}
+
+// ServiceLogs returns the last tail lines of every task of the
+// service, with the task each line is of from the log details
+func (api *dockerAPI) ServiceLogs(ctx context.Context, serviceID string, tail int) ([]deployer.LogLine, error) {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	query.Set("details", "1")
+	query.Set("tail", strconv.Itoa(tail))
+	body, err := api.get(ctx, serviceLogsVersion, "/services/"+url.PathEscape(serviceID)+"/logs?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	raw, err := demuxLogs(bufio.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []deployer.LogLine
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		details, line := splitLogDetails(scanner.Text())
+		lines = append(lines, deployer.LogLine{TaskID: details["com.docker.swarm.task.id"], Line: line})
+	}
+	return lines, scanner.Err()
+}
+
+// demuxLogs returns the payload of a log stream, which docker
+// multiplexes with an 8 byte header per frame unless the service
+// has a tty, the header being the stream and the frame size
+func demuxLogs(reader *bufio.Reader) ([]byte, error) {
+	peek, err := reader.Peek(8)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(peek) < 8 || peek[0] > 2 || peek[1] != 0 || peek[2] != 0 || peek[3] != 0 {
+		return ioutil.ReadAll(reader)
+	}
+	var out bytes.Buffer
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return out.Bytes(), nil
+			}
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(&out, reader, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// splitLogDetails splits the details docker prepends to a log line,
+// "key=value,key=value message", from the message
+func splitLogDetails(text string) (map[string]string, string) {
+	details := make(map[string]string)
+	parts := strings.SplitN(text, " ", 2)
+	if len(parts) != 2 || !strings.Contains(parts[0], "=") {
+		return details, text
+	}
+	for _, pair := range strings.Split(parts[0], ",") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) == 2 {
+			details[keyValue[0]] = keyValue[1]
+		}
+	}
+	return details, parts[1]
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// dockerContext is an endpoint from the docker cli's
+// context store, as managed by `docker context`
+type dockerContext struct {
+	Name          string
+	Host          string
+	SkipTLSVerify bool
+	TLSDir        string
+}
+
+type dockerContextMeta struct {
+	Name      string
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+}
+
+// dockerConfigDir mirrors the docker cli, honoring DOCKER_CONFIG
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home := os.Getenv("HOME")
+	return filepath.Join(home, ".docker")
+}
+
+// loadDockerContext reads the named context, the store
+// keys each context directory by the sha256 of its name
+func loadDockerContext(name string) (*dockerContext, error) {
+	digest := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(digest[:])
+	contextsDir := filepath.Join(dockerConfigDir(), "contexts")
+
+	data, err := ioutil.ReadFile(filepath.Join(contextsDir, "meta", id, "meta.json"))
+	if err != nil {
+		return nil, fmt.Errorf("docker context %q not found: %v", name, err)
+	}
+	var meta dockerContextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("docker context %q is invalid: %v", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return nil, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+
+	return &dockerContext{
+		Name:          name,
+		Host:          endpoint.Host,
+		SkipTLSVerify: endpoint.SkipTLSVerify,
+		TLSDir:        filepath.Join(contextsDir, "tls", id, "docker"),
+	}, nil
+}
+
+// clientConfig returns the host and http client to hand to
+// the docker client, a nil client means the default transport
+func (dockerCtx *dockerContext) clientConfig() (string, *http.Client, error) {
+	u, err := url.Parse(dockerCtx.Host)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if u.Scheme == "ssh" {
+		transport := &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dialSSH(u)
+			},
+		}
+		// the address is never dialed, ssh tunnels to the remote socket
+		return "tcp://docker", &http.Client{Transport: transport}, nil
+	}
+
+	if !fileExists(filepath.Join(dockerCtx.TLSDir, "ca.pem")) && !fileExists(filepath.Join(dockerCtx.TLSDir, "cert.pem")) {
+		return dockerCtx.Host, nil, nil
+	}
+
+	options := tlsconfig.Options{
+		InsecureSkipVerify: dockerCtx.SkipTLSVerify,
+	}
+	if fileExists(filepath.Join(dockerCtx.TLSDir, "ca.pem")) {
+		options.CAFile = filepath.Join(dockerCtx.TLSDir, "ca.pem")
+	}
+	if fileExists(filepath.Join(dockerCtx.TLSDir, "cert.pem")) {
+		options.CertFile = filepath.Join(dockerCtx.TLSDir, "cert.pem")
+		options.KeyFile = filepath.Join(dockerCtx.TLSDir, "key.pem")
+	}
+	tlsConfig, err := tlsconfig.Client(options)
+	if err != nil {
+		return "", nil, err
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	return dockerCtx.Host, &http.Client{Transport: transport}, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// dialSSH connects to the remote docker daemon the same way
+// the docker cli does, by running `docker system dial-stdio` over ssh
+func dialSSH(u *url.URL) (net.Conn, error) {
+	args := []string{"-T"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, host: u.Host}, nil
+}
+
+// commandConn is a net.Conn over the stdio of a command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	host   string
+}
+
+func (conn *commandConn) Read(p []byte) (int, error)  { return conn.stdout.Read(p) }
+func (conn *commandConn) Write(p []byte) (int, error) { return conn.stdin.Write(p) }
+
+func (conn *commandConn) Close() error {
+	conn.stdin.Close()
+	conn.stdout.Close()
+	conn.cmd.Process.Kill()
+	return conn.cmd.Wait()
+}
+
+func (conn *commandConn) LocalAddr() net.Addr  { return commandAddr("ssh") }
+func (conn *commandConn) RemoteAddr() net.Addr { return commandAddr(conn.host) }
+
+func (conn *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr string
+
+func (addr commandAddr) Network() string { return "ssh" }
+func (addr commandAddr) String() string  { return string(addr) }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+)
+
+// endpointFlags are the auth flags of the http endpoint name,
+// each endpoint is secured independently of the others
+func endpointFlags(name string) []cli.Flag {
+	env := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   name + "-token",
+			EnvVar: env + "_TOKEN",
+			Usage:  "Bearer token required by the " + name + " endpoint",
+		},
+		cli.StringFlag{
+			Name:   name + "-tls-cert",
+			EnvVar: env + "_TLS_CERT",
+			Usage:  "Certificate to serve the " + name + " endpoint over https with",
+		},
+		cli.StringFlag{
+			Name:   name + "-tls-key",
+			EnvVar: env + "_TLS_KEY",
+			Usage:  "Key of --" + name + "-tls-cert",
+		},
+		cli.StringFlag{
+			Name:   name + "-client-ca",
+			EnvVar: env + "_CLIENT_CA",
+			Usage:  "Require client certificates signed by this ca on the " + name + " endpoint (mTLS)",
+		},
+	}
+}
+
+// getEndpoint reads the address and auth flags of the endpoint name
+func getEndpoint(context *cli.Context, name string) control.Endpoint {
+	return control.Endpoint{
+		Address:  context.String(name + "-address"),
+		Token:    context.String(name + "-token"),
+		TLSCert:  context.String(name + "-tls-cert"),
+		TLSKey:   context.String(name + "-tls-key"),
+		ClientCA: context.String(name + "-client-ca"),
+	}
+}
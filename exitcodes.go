@@ -0,0 +1,24 @@
+package main
+
+// The exit codes of the updater, documented in the README
+// so orchestration and alerting can tell the failures apart
+const (
+	// exitError is any other error, e.g. of a subcommand
+	exitError = 1
+	// exitConfig is an invalid flag, config file or credential source
+	exitConfig = 2
+	// exitDockerUnreachable means docker did not answer
+	exitDockerUnreachable = 10
+	// exitNotSwarmManager means docker is not a swarm manager
+	exitNotSwarmManager = 11
+	// exitDockerReadOnly means docker refused a service update
+	exitDockerReadOnly = 12
+	// exitBeekeeperUnreachable means beekeeper did not answer
+	exitBeekeeperUnreachable = 13
+	// exitBeekeeperAuth means beekeeper refused the credentials
+	exitBeekeeperAuth = 14
+	// exitFailureThreshold means --max-failed-cycles cycles failed in a row
+	exitFailureThreshold = 20
+	// exitSIGTERM is a clean shutdown on SIGTERM, 128 + 15 like a shell
+	exitSIGTERM = 143
+)
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// sendHeartbeats posts a heartbeat to beekeeper every interval,
+// so it can tell which clusters have a live updater
+func sendHeartbeats(theDeployer *deployer.Deployer, controlServer *control.Server, path string, interval time.Duration) {
+	for {
+		health := controlServer.Health()
+		err := theDeployer.SendHeartbeat(path, deployer.Heartbeat{
+			Version:         version(),
+			TrackedServices: len(theDeployer.Services()),
+			LastCycleAt:     health.LastCycleAt,
+			LastCycleError:  health.LastError,
+			Healthy:         health.Healthy,
+			Timestamp:       time.Now(),
+		})
+		if err != nil {
+			warn("Could not send heartbeat:", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,154 @@
+package leader
+
+import (
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	De "github.com/tj/go-debug"
+	"golang.org/x/net/context"
+)
+
+var debug = De.Debug("beekeeper-updater-swarm:leader")
+
+const (
+	holderLabel    = "octoblu.beekeeper.leader"
+	expiresAtLabel = "octoblu.beekeeper.leaderExpiresAt"
+	dockerTimeout  = 30 * time.Second
+
+	// leaseImage is never pulled, the lease service has no replicas
+	leaseImage = "busybox"
+)
+
+// DockerClient is the part of the docker api the lease
+// and the membership are kept with
+type DockerClient interface {
+	ServiceCreate(ctx context.Context, spec swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) error
+}
+
+// isNotFound returns true if err says the service does not
+// exist, engine-api and deployertest errors have NotFound
+func isNotFound(err error) bool {
+	notFound, ok := err.(interface {
+		NotFound() bool
+	})
+	return ok && notFound.NotFound()
+}
+
+// Lease elects a leader among updaters sharing a swarm. The holder
+// and expiry are kept in the labels of a dedicated service with no
+// replicas, service updates are versioned so only one updater
+// can take or renew the lease at a time
+type Lease struct {
+	dockerClient DockerClient
+	serviceName  string
+	identity     string
+	duration     time.Duration
+	held         bool
+}
+
+// New constructs a lease kept on serviceName, identity must be
+// unique to each updater and duration longer than a cycle
+func New(dockerClient DockerClient, serviceName, identity string, duration time.Duration) *Lease {
+	return &Lease{
+		dockerClient: dockerClient,
+		serviceName:  serviceName,
+		identity:     identity,
+		duration:     duration,
+	}
+}
+
+// Acquire takes the lease if it is free or expired and renews it
+// if this updater already holds it, returning whether it is held
+func (lease *Lease) Acquire() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	service, _, err := lease.dockerClient.ServiceInspectWithRaw(ctx, lease.serviceName)
+	if isNotFound(err) {
+		return lease.create(ctx)
+	}
+	if err != nil {
+		lease.held = false
+		return false, err
+	}
+
+	holder := service.Spec.Labels[holderLabel]
+	expiresAt, _ := time.Parse(time.RFC3339, service.Spec.Labels[expiresAtLabel])
+	if holder != "" && holder != lease.identity && time.Now().Before(expiresAt) {
+		if lease.held {
+			debug("lost lease to %s", holder)
+		}
+		lease.held = false
+		return false, nil
+	}
+
+	if service.Spec.Labels == nil {
+		service.Spec.Labels = make(map[string]string)
+	}
+	service.Spec.Labels[holderLabel] = lease.identity
+	service.Spec.Labels[expiresAtLabel] = time.Now().Add(lease.duration).Format(time.RFC3339)
+	err = lease.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		// a concurrent update bumped the version, the other updater won
+		lease.held = false
+		return false, err
+	}
+	if !lease.held {
+		debug("acquired lease as %s", lease.identity)
+	}
+	lease.held = true
+	return true, nil
+}
+
+// Release expires the lease right away if it is held,
+// so a standby updater can take over without waiting
+func (lease *Lease) Release() error {
+	if !lease.held {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	service, _, err := lease.dockerClient.ServiceInspectWithRaw(ctx, lease.serviceName)
+	if err != nil {
+		return err
+	}
+	if service.Spec.Labels[holderLabel] != lease.identity {
+		lease.held = false
+		return nil
+	}
+	delete(service.Spec.Labels, holderLabel)
+	delete(service.Spec.Labels, expiresAtLabel)
+	lease.held = false
+	return lease.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+}
+
+func (lease *Lease) create(ctx context.Context) (bool, error) {
+	var replicas uint64
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name: lease.serviceName,
+			Labels: map[string]string{
+				holderLabel:    lease.identity,
+				expiresAtLabel: time.Now().Add(lease.duration).Format(time.RFC3339),
+			},
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{Image: leaseImage},
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		},
+	}
+	// creating fails when another updater created it first
+	if _, err := lease.dockerClient.ServiceCreate(ctx, spec, types.ServiceCreateOptions{}); err != nil {
+		lease.held = false
+		return false, err
+	}
+	debug("created lease service %s as %s", lease.serviceName, lease.identity)
+	lease.held = true
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package leader_test
+
+import (
+	"time"
+
+	"github.com/octoblu/beekeeper-updater-swarm/deployertest"
+	"github.com/octoblu/beekeeper-updater-swarm/leader"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lease", func() {
+	var docker *deployertest.FakeDocker
+	var sut, other *leader.Lease
+
+	labels := func() map[string]string {
+		service, ok := docker.Service("beekeeper-leader")
+		Expect(ok).To(BeTrue())
+		return service.Spec.Labels
+	}
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+		sut = leader.New(docker, "beekeeper-leader", "updater-a", time.Minute)
+		other = leader.New(docker, "beekeeper-leader", "updater-b", time.Minute)
+	})
+
+	It("should create the lease service when there is none", func() {
+		Expect(sut.Acquire()).To(BeTrue())
+		Expect(labels()).To(HaveKeyWithValue("octoblu.beekeeper.leader", "updater-a"))
+		service, _ := docker.Service("beekeeper-leader")
+		Expect(*service.Spec.Mode.Replicated.Replicas).To(BeZero())
+	})
+
+	Describe("when another updater holds it", func() {
+		BeforeEach(func() {
+			Expect(other.Acquire()).To(BeTrue())
+		})
+
+		It("should not take it before it expires", func() {
+			Expect(sut.Acquire()).To(BeFalse())
+			Expect(labels()).To(HaveKeyWithValue("octoblu.beekeeper.leader", "updater-b"))
+		})
+
+		It("should renew it for the holder", func() {
+			Expect(other.Acquire()).To(BeTrue())
+			Expect(docker.Calls("ServiceUpdate")).To(Equal(1))
+			Expect(sut.Acquire()).To(BeFalse())
+		})
+
+		It("should take it once the holder released it", func() {
+			Expect(other.Release()).To(Succeed())
+			Expect(labels()).NotTo(HaveKey("octoblu.beekeeper.leader"))
+			Expect(sut.Acquire()).To(BeTrue())
+			Expect(labels()).To(HaveKeyWithValue("octoblu.beekeeper.leader", "updater-a"))
+		})
+	})
+
+	Describe("when the lease of another updater expired", func() {
+		BeforeEach(func() {
+			docker.AddService(deployertest.ServiceSpec("beekeeper-leader", "busybox", 0, map[string]string{
+				"octoblu.beekeeper.leader":          "updater-b",
+				"octoblu.beekeeper.leaderExpiresAt": time.Now().Add(-time.Second).Format(time.RFC3339),
+			}))
+		})
+
+		It("should take it over", func() {
+			Expect(sut.Acquire()).To(BeTrue())
+			Expect(labels()).To(HaveKeyWithValue("octoblu.beekeeper.leader", "updater-a"))
+			expiresAt, err := time.Parse(time.RFC3339, labels()["octoblu.beekeeper.leaderExpiresAt"])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expiresAt).To(BeTemporally("~", time.Now().Add(time.Minute), 2*time.Second))
+		})
+
+		It("should not release it on behalf of the new holder", func() {
+			Expect(sut.Acquire()).To(BeTrue())
+			Expect(other.Release()).To(Succeed())
+			Expect(labels()).To(HaveKeyWithValue("octoblu.beekeeper.leader", "updater-a"))
+		})
+	})
+})
@@ -0,0 +1,146 @@
+package leader
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+const (
+	// memberLabelPrefix is followed by the identity of a member,
+	// the value is when its membership expires
+	memberLabelPrefix = "octoblu.beekeeper.member."
+
+	// joinAttempts bounds the renewals lost to members
+	// renewing at the same time
+	joinAttempts = 3
+)
+
+// Members tracks the updaters sharing a swarm, so they can split its
+// services among themselves. Like the lease, membership is kept in
+// the labels of a dedicated service with no replicas, each updater
+// renews its own label and the labels of expired members are dropped
+type Members struct {
+	dockerClient DockerClient
+	serviceName  string
+	identity     string
+	duration     time.Duration
+}
+
+// NewMembers constructs a membership kept on serviceName, identity
+// must be unique to each updater and duration longer than a cycle
+func NewMembers(dockerClient DockerClient, serviceName, identity string, duration time.Duration) *Members {
+	return &Members{
+		dockerClient: dockerClient,
+		serviceName:  serviceName,
+		identity:     identity,
+		duration:     duration,
+	}
+}
+
+// Join renews the membership of this updater and returns the
+// identities of the members, sorted, so every member derives
+// the same shards from them
+func (members *Members) Join() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	var identities []string
+	var err error
+	for attempt := 0; attempt < joinAttempts; attempt++ {
+		if identities, err = members.renew(ctx); err == nil {
+			return identities, nil
+		}
+		debug("could not renew membership of %s: %v", members.identity, err)
+	}
+	return nil, err
+}
+
+func (members *Members) renew(ctx context.Context) ([]string, error) {
+	service, _, err := members.dockerClient.ServiceInspectWithRaw(ctx, members.serviceName)
+	if isNotFound(err) {
+		return members.create(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	labels := make(map[string]string, len(service.Spec.Labels)+1)
+	for key, value := range service.Spec.Labels {
+		if !strings.HasPrefix(key, memberLabelPrefix) {
+			labels[key] = value
+			continue
+		}
+		if expiresAt, err := time.Parse(time.RFC3339, value); err == nil && now.Before(expiresAt) {
+			labels[key] = value
+		} else {
+			debug("dropping expired member %s", strings.TrimPrefix(key, memberLabelPrefix))
+		}
+	}
+	labels[memberLabelPrefix+members.identity] = now.Add(members.duration).Format(time.RFC3339)
+	service.Spec.Labels = labels
+	// fails when a concurrent renewal bumped the version
+	err = members.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return memberIdentities(labels), nil
+}
+
+// Leave drops the membership of this updater right away,
+// so the others take over its services on their next cycle
+func (members *Members) Leave() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	service, _, err := members.dockerClient.ServiceInspectWithRaw(ctx, members.serviceName)
+	if err != nil {
+		return err
+	}
+	if _, ok := service.Spec.Labels[memberLabelPrefix+members.identity]; !ok {
+		return nil
+	}
+	delete(service.Spec.Labels, memberLabelPrefix+members.identity)
+	return members.dockerClient.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+}
+
+func (members *Members) create(ctx context.Context) ([]string, error) {
+	var replicas uint64
+	labels := map[string]string{
+		memberLabelPrefix + members.identity: time.Now().Add(members.duration).Format(time.RFC3339),
+	}
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   members.serviceName,
+			Labels: labels,
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{Image: leaseImage},
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		},
+	}
+	// creating fails when another updater created it first
+	if _, err := members.dockerClient.ServiceCreate(ctx, spec, types.ServiceCreateOptions{}); err != nil {
+		return nil, err
+	}
+	debug("created members service %s as %s", members.serviceName, members.identity)
+	return memberIdentities(labels), nil
+}
+
+func memberIdentities(labels map[string]string) []string {
+	var identities []string
+	for key := range labels {
+		if strings.HasPrefix(key, memberLabelPrefix) {
+			identities = append(identities, strings.TrimPrefix(key, memberLabelPrefix))
+		}
+	}
+	sort.Strings(identities)
+	return identities
+}
@@ -0,0 +1,39 @@
+package leader_test
+
+import (
+	"time"
+
+	"github.com/octoblu/beekeeper-updater-swarm/deployertest"
+	"github.com/octoblu/beekeeper-updater-swarm/leader"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Members", func() {
+	var docker *deployertest.FakeDocker
+
+	BeforeEach(func() {
+		docker = deployertest.NewFakeDocker()
+	})
+
+	It("should return every member, sorted", func() {
+		Expect(leader.NewMembers(docker, "beekeeper-members", "updater-b", time.Minute).Join()).To(Equal([]string{"updater-b"}))
+		Expect(leader.NewMembers(docker, "beekeeper-members", "updater-a", time.Minute).Join()).To(Equal([]string{"updater-a", "updater-b"}))
+	})
+
+	It("should drop expired members", func() {
+		docker.AddService(deployertest.ServiceSpec("beekeeper-members", "busybox", 0, map[string]string{
+			"octoblu.beekeeper.member.updater-b": time.Now().Add(-time.Second).Format(time.RFC3339),
+		}))
+		Expect(leader.NewMembers(docker, "beekeeper-members", "updater-a", time.Minute).Join()).To(Equal([]string{"updater-a"}))
+	})
+
+	It("should drop a member that left", func() {
+		members := leader.NewMembers(docker, "beekeeper-members", "updater-b", time.Minute)
+		_, err := members.Join()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(members.Leave()).To(Succeed())
+		Expect(leader.NewMembers(docker, "beekeeper-members", "updater-a", time.Minute).Join()).To(Equal([]string{"updater-a"}))
+	})
+})
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes an exclusive flock on path, waiting up to timeout,
+// so the daemon and a manual force-update never update at once
+func lockFile(path string, timeout time.Duration) (func(), error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("Could not lock %s: %v", path, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// lockError means a cycle was skipped because the lock
+// could not be taken, the next cycle tries again
+type lockError struct {
+	err error
+}
+
+func (err *lockError) Error() string {
+	return err.err.Error()
+}
@@ -1,90 +1,1154 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/codegangsta/cli"
 	"github.com/coreos/go-semver/semver"
 	"github.com/docker/engine-api/client"
 	"github.com/fatih/color"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
 	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"github.com/octoblu/beekeeper-updater-swarm/leader"
 	De "github.com/tj/go-debug"
 )
 
 var debug = De.Debug("beekeeper-updater-swarm:main")
 
+const (
+	// pollInterval is how long the daemon waits between cycles,
+	// longer while beekeeper is over its latency budget
+	pollInterval = 60 * time.Second
+	// missedCycles is how many poll intervals the daemon may go
+	// without a successful cycle before it is unhealthy, and a
+	// leader without renewing its lease
+	missedCycles = 3
+)
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "beekeeper-updater-swarm"
 	app.Version = version()
 	app.Action = run
+	app.Before = setupOutput
+	app.Commands = []cli.Command{
+		{
+			Name:   "healthcheck",
+			Usage:  "Exit 0 if the running daemon is healthy, 1 otherwise",
+			Action: healthcheck,
+		},
+		{
+			Name:   "list",
+			Usage:  "List the tracked services and why they were last updated or skipped",
+			Action: list,
+			Flags: []cli.Flag{
+				outputFlag,
+				cli.BoolFlag{
+					Name:  "pending",
+					Usage: "List only the deploys held back, with when they may go ahead",
+				},
+			},
+		},
+		{
+			Name:      "status",
+			Usage:     "Show the daemon status, or the status of one service",
+			ArgsUsage: "[service]",
+			Action:    status,
+			Flags:     []cli.Flag{outputFlag},
+		},
+		{
+			Name:      "explain",
+			Usage:     "Run the update decision for one service verbosely, without deploying",
+			ArgsUsage: "<service>",
+			Action:    explain,
+			Flags:     []cli.Flag{outputFlag},
+		},
+		{
+			Name:   "watch",
+			Usage:  "Show the tracked services and live rollout progress, refreshing in place",
+			Action: watch,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "interval",
+					Usage: "How often to refresh",
+					Value: 2 * time.Second,
+				},
+			},
+		},
+		{
+			Name:      "force-update",
+			Usage:     "Deploy an image, or the latest from beekeeper, to a service regardless of its labels",
+			ArgsUsage: "<service> [image]",
+			Action:    forceUpdate,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "lock-timeout",
+					Usage: "How long to wait for a running cycle of the daemon to finish",
+					Value: 5 * time.Minute,
+				},
+			},
+		},
+		{
+			Name:   "simulate",
+			Usage:  "Print what a cycle would do, with the services of a dump or the swarm, read-only, and the deployments of a beekeeper snapshot or beekeeper",
+			Action: simulate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "services",
+					Usage: "Json of docker service inspect to simulate with instead of the swarm",
+				},
+				cli.StringFlag{
+					Name:  "beekeeper",
+					Usage: "Json of the latest deployments by \"owner/repo\" to simulate with instead of beekeeper",
+				},
+				outputFlag,
+			},
+		},
+		{
+			Name:   "verify",
+			Usage:  "Check docker allows service updates and beekeeper accepts the credentials, exiting with a code for each misconfiguration",
+			Action: verify,
+		},
+		{
+			Name:      "resume",
+			Usage:     "Roll a paused update of a service forward, through the daemon",
+			ArgsUsage: "<service>",
+			Action:    resume,
+			Flags:     []cli.Flag{outputFlag},
+		},
+		{
+			Name:  "labels",
+			Usage: "Maintain the octoblu.beekeeper labels on services",
+			Subcommands: []cli.Command{
+				{
+					Name:   "gc",
+					Usage:  "Remove bookkeeping labels from services no longer opted in",
+					Action: labelsGC,
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "dry-run", Usage: "Only print what would change"},
+						outputFlag,
+					},
+				},
+				{
+					Name:   "migrate",
+					Usage:  "Rename labels from one prefix to another",
+					Action: labelsMigrate,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "from", Usage: "Label prefix to rename, e.g. beekeeper."},
+						cli.StringFlag{Name: "to", Usage: "New label prefix, e.g. octoblu.beekeeper."},
+						cli.BoolFlag{Name: "dry-run", Usage: "Only print what would change"},
+						outputFlag,
+					},
+				},
+			},
+		},
+		{
+			Name:  "snapshot",
+			Usage: "Save the tracked services and their images, and restore them to a rebuilt swarm",
+			Subcommands: []cli.Command{
+				{
+					Name:      "export",
+					Usage:     "Write the specs and images of the tracked services as json",
+					ArgsUsage: "[file]",
+					Action:    snapshotExport,
+				},
+				{
+					Name:      "apply",
+					Usage:     "Create the services of a snapshot missing from the swarm and deploy their images to the others",
+					ArgsUsage: "<file>",
+					Action:    snapshotApply,
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "dry-run", Usage: "Only print what would change"},
+						outputFlag,
+					},
+				},
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "Show the deploys and rollout outcomes in the audit log, with where the tasks landed",
+			ArgsUsage: "[service]",
+			Action:    history,
+			Flags:     []cli.Flag{outputFlag},
+		},
+		{
+			Name:      "pause",
+			Usage:     "Pause updates of every service until unpause, the daemon keeps checking and reporting",
+			ArgsUsage: "[reason]",
+			Action:    pause,
+			Flags:     []cli.Flag{outputFlag},
+		},
+		{
+			Name:   "unpause",
+			Usage:  "Lift a pause set by pause or SIGUSR1, the octoblu.beekeeper.paused swarm label must be removed instead",
+			Action: unpause,
+			Flags:  []cli.Flag{outputFlag},
+		},
+	}
 	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:   "quiet, q",
+			EnvVar: "QUIET",
+			Usage:  "Only print warnings and errors",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "Do not color output, also set by NO_COLOR",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			EnvVar: "CONFIG_FILE",
+			Usage:  "Json config file, e.g. with beekeeperInstances to route services to other beekeepers",
+		},
 		cli.StringFlag{
 			Name:   "docker-uri, d",
 			EnvVar: "DOCKER_HOST",
 			Usage:  "Docker server to deploy to",
 			Value:  "unix:///var/run/docker.sock",
 		},
+		cli.StringFlag{
+			Name:   "docker-context",
+			EnvVar: "DOCKER_CONTEXT",
+			Usage:  "Docker cli context to connect with, overrides --docker-uri",
+		},
 		cli.StringFlag{
 			Name:   "beekeeper-uri",
 			EnvVar: "BEEKEEPER_URI",
 			Usage:  "Beekeeper uri, it should include authentication.",
 		},
+		cli.StringFlag{
+			Name:   "deployment-path",
+			EnvVar: "DEPLOYMENT_PATH",
+			Usage:  "Go template of the latest deployment path, appended to the beekeeper uri. {{.Owner}} and {{.Repo}} are available",
+			Value:  "/deployments/{{.Owner}}/{{.Repo}}/latest",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-username",
+			EnvVar: "BEEKEEPER_USERNAME",
+			Usage:  "Beekeeper basic auth username, overrides any credentials in the uri. May be an aws-sm://, ssm:// or file:// reference",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-password",
+			EnvVar: "BEEKEEPER_PASSWORD",
+			Usage:  "Beekeeper basic auth password. May be an aws-sm://, ssm:// or file:// reference",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-events-url",
+			EnvVar: "BEEKEEPER_EVENTS_URL",
+			Usage:  "ws:// or wss:// url of the beekeeper deployment events, a cycle starts as soon as a build is published",
+		},
+		cli.StringFlag{
+			Name:   "registry-username",
+			EnvVar: "REGISTRY_USERNAME",
+			Usage:  "Registry username sent with service updates so nodes can pull private images. May be an aws-sm://, ssm:// or file:// reference",
+		},
+		cli.StringFlag{
+			Name:   "registry-password",
+			EnvVar: "REGISTRY_PASSWORD",
+			Usage:  "Registry password. May be an aws-sm://, ssm:// or file:// reference",
+		},
+		cli.StringFlag{
+			Name:   "registry-server",
+			EnvVar: "REGISTRY_SERVER",
+			Usage:  "Registry the credentials belong to, e.g. registry.example.com",
+		},
+		cli.IntFlag{
+			Name:   "beekeeper-max-conns",
+			EnvVar: "BEEKEEPER_MAX_CONNS",
+			Usage:  "Maximum number of pooled connections to beekeeper",
+			Value:  10,
+		},
+		cli.BoolFlag{
+			Name:   "beekeeper-http2",
+			EnvVar: "BEEKEEPER_HTTP2",
+			Usage:  "Use http2 when talking to beekeeper",
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			EnvVar: "VAULT_ADDR",
+			Usage:  "Vault server to read beekeeper and registry credentials from",
+		},
+		cli.StringFlag{
+			Name:   "vault-token",
+			EnvVar: "VAULT_TOKEN",
+			Usage:  "Vault token",
+		},
+		cli.StringFlag{
+			Name:   "vault-beekeeper-path",
+			EnvVar: "VAULT_BEEKEEPER_PATH",
+			Usage:  "Vault secret with the beekeeper username and password or token, e.g. secret/data/beekeeper",
+		},
+		cli.StringFlag{
+			Name:   "vault-registry-path",
+			EnvVar: "VAULT_REGISTRY_PATH",
+			Usage:  "Vault secret with the registry username, password and serveraddress",
+		},
+		cli.DurationFlag{
+			Name:   "vault-refresh-interval",
+			EnvVar: "VAULT_REFRESH_INTERVAL",
+			Usage:  "How often to reread vault secrets without a lease, leased secrets are reread before they expire",
+			Value:  time.Hour,
+		},
+		cli.StringFlag{
+			Name:   "oauth-token-url",
+			EnvVar: "OAUTH_TOKEN_URL",
+			Usage:  "Fetch a bearer token for beekeeper with the oauth2 client credentials grant from this url",
+		},
+		cli.StringFlag{
+			Name:   "oauth-client-id",
+			EnvVar: "OAUTH_CLIENT_ID",
+			Usage:  "OAuth2 client id",
+		},
+		cli.StringFlag{
+			Name:   "oauth-client-secret",
+			EnvVar: "OAUTH_CLIENT_SECRET",
+			Usage:  "OAuth2 client secret",
+		},
+		cli.StringFlag{
+			Name:   "oauth-scopes",
+			EnvVar: "OAUTH_SCOPES",
+			Usage:  "Comma separated oauth2 scopes to request",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-client-cert",
+			EnvVar: "BEEKEEPER_CLIENT_CERT",
+			Usage:  "PEM client certificate presented to beekeeper for mutual tls",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-client-key",
+			EnvVar: "BEEKEEPER_CLIENT_KEY",
+			Usage:  "PEM private key of the beekeeper client certificate",
+		},
+		cli.StringFlag{
+			Name:   "beekeeper-ca-cert",
+			EnvVar: "BEEKEEPER_CA_CERT",
+			Usage:  "PEM certificate authorities the certificate of beekeeper is verified with, instead of the system ones",
+		},
+		cli.StringFlag{
+			Name:   "cluster-name",
+			EnvVar: "CLUSTER_NAME",
+			Usage:  "Name of this swarm, attached to metrics, logs, alerts, hooks and beekeeper requests",
+		},
+		cli.StringFlag{
+			Name:   "environment",
+			EnvVar: "ENVIRONMENT",
+			Usage:  "Environment of this swarm, e.g. production, attached like the cluster name",
+		},
+		cli.DurationFlag{
+			Name:   "heartbeat-interval",
+			EnvVar: "HEARTBEAT_INTERVAL",
+			Usage:  "How often to post a heartbeat to beekeeper, 0 disables heartbeats",
+		},
+		cli.StringFlag{
+			Name:   "heartbeat-path",
+			EnvVar: "HEARTBEAT_PATH",
+			Usage:  "Path on the beekeeper uri heartbeats are posted to",
+			Value:  "/heartbeats",
+		},
+		cli.BoolFlag{
+			Name:   "bump-scaled-to-zero",
+			EnvVar: "BUMP_SCALED_TO_ZERO",
+			Usage:  "Set the latest image on services scaled to zero without rolling it out, instead of skipping them",
+		},
+		cli.StringFlag{
+			Name:   "status-path",
+			EnvVar: "STATUS_PATH",
+			Usage:  "Path on the beekeeper of a service the outcome of each rollout is posted to, with the errors of failed tasks, and each changed decision about its latest image",
+		},
+		cli.StringFlag{
+			Name:   "user-agent-suffix",
+			EnvVar: "USER_AGENT_SUFFIX",
+			Usage:  "Appended to the User-Agent sent to beekeeper instead of the cluster name",
+		},
+		cli.DurationFlag{
+			Name:   "docker-timeout",
+			EnvVar: "DOCKER_TIMEOUT",
+			Usage:  "Timeout for each docker api call",
+			Value:  30 * time.Second,
+		},
+		cli.Float64Flag{
+			Name:   "docker-rate-limit",
+			EnvVar: "DOCKER_RATE_LIMIT",
+			Usage:  "Docker api calls per second made to each swarm, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:   "docker-rate-burst",
+			EnvVar: "DOCKER_RATE_BURST",
+			Usage:  "Docker api calls made at once before --docker-rate-limit applies",
+			Value:  1,
+		},
+		cli.StringFlag{
+			Name:   "inject-faults",
+			EnvVar: "INJECT_FAULTS",
+			Usage:  "Faults to inject for testing alerting and recovery in staging, e.g. beekeeper-errors=0.1,docker-update-delay=5s,paused-rollouts=0.5",
+		},
+		cli.DurationFlag{
+			Name:   "deploy-timeout",
+			EnvVar: "DEPLOY_TIMEOUT",
+			Usage:  "How long a rollout may take to converge, overridden by the octoblu.beekeeper.deployTimeout label",
+			Value:  5 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:   "update-label-values",
+			EnvVar: "UPDATE_LABEL_VALUES",
+			Usage:  "Comma separated octoblu.beekeeper.update values that opt a service into deploys, \"report\" and \"pinned\" are always understood",
+			Value:  "true",
+		},
+		cli.StringFlag{
+			Name:   "services",
+			EnvVar: "SERVICES",
+			Usage:  "Comma separated service names or ids managed as if they had the octoblu.beekeeper.update label, added to services in the config file",
+		},
+		cli.StringSliceFlag{
+			Name:   "selector",
+			EnvVar: "SELECTORS",
+			Usage:  "Only manage services with this label, as label or label=value. May be repeated, services must match all selectors",
+		},
+		cli.StringFlag{
+			Name:   "allowed-registries",
+			EnvVar: "ALLOWED_REGISTRIES",
+			Usage:  "Comma separated registries images may be deployed from, docker.io for docker hub. Other images are refused and alerted on",
+		},
+		cli.BoolFlag{
+			Name:   "require-provenance",
+			EnvVar: "REQUIRE_PROVENANCE",
+			Usage:  "Refuse deployments without a commit_sha and pipeline_id in their provenance",
+		},
+		cli.BoolFlag{
+			Name:   "verify-image-revision",
+			EnvVar: "VERIFY_IMAGE_REVISION",
+			Usage:  "Refuse images whose org.opencontainers.image.revision label is not the commit_sha of the deployment, implies --require-provenance",
+		},
+		cli.StringFlag{
+			Name:   "scan-url",
+			EnvVar: "SCAN_URL",
+			Usage:  "Template of the url of the trivy json report of an image, e.g. https://scans.example.com/report?image={{.Image | urlquery}}, images without a report or with vulnerabilities of --scan-severity are not deployed",
+		},
+		cli.StringFlag{
+			Name:   "scan-severity",
+			EnvVar: "SCAN_SEVERITY",
+			Usage:  "Severity from which vulnerabilities block a deploy, UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL. The octoblu.beekeeper.scanSeverity label of a service overrides it, off skips the gate",
+			Value:  "CRITICAL",
+		},
+		cli.StringFlag{
+			Name:   "alert-webhook",
+			EnvVar: "ALERT_WEBHOOK",
+			Usage:  "Url alerts are posted to as json. May be an aws-sm://, ssm:// or file:// reference, reloaded on SIGHUP",
+		},
+		cli.Float64Flag{
+			Name:   "min-healthy",
+			EnvVar: "MIN_HEALTHY",
+			Usage:  "Fraction of the replicas of a service that must be running before it is updated, e.g. 0.5, 0 disables",
+		},
+		cli.IntFlag{
+			Name:   "capacity-check-parallelism",
+			EnvVar: "CAPACITY_CHECK_PARALLELISM",
+			Usage:  "Update parallelism from which rollouts are deferred when the free capacity of the cluster does not fit their tasks, start-first rollouts (octoblu.beekeeper.updateOrder=start-first) are always checked, 0 only checks those",
+			Value:  10,
+		},
+		cli.DurationFlag{
+			Name:   "stuck-after",
+			EnvVar: "STUCK_AFTER",
+			Usage:  "Alert on services updating for longer than this, e.g. because their tasks cannot be scheduled, 0 disables",
+		},
+		cli.DurationFlag{
+			Name:   "min-update-interval",
+			EnvVar: "MIN_UPDATE_INTERVAL",
+			Usage:  "How long after a deploy a service is not updated again, newer deployments wait for it, 0 disables",
+		},
+		cli.StringFlag{
+			Name:   "unparsable-last-updated-at",
+			EnvVar: "UNPARSABLE_LAST_UPDATED_AT",
+			Usage:  "What to do about a service whose lastUpdatedAt label is unparsable, e.g. hand-edited: ignore treats it as never updated, hold does not update it until the label is fixed",
+			Value:  deployer.UnparsableIgnore,
+		},
+		cli.DurationFlag{
+			Name:   "retire-grace",
+			EnvVar: "RETIRE_GRACE",
+			Usage:  "How long after beekeeper retired a project its services are scaled to zero or removed, their owners are alerted meanwhile",
+			Value:  24 * time.Hour,
+		},
+		cli.StringFlag{
+			Name:   "stuck-action",
+			EnvVar: "STUCK_ACTION",
+			Usage:  "What to do about a stuck update besides alerting, rollback or nothing",
+		},
+		cli.DurationFlag{
+			Name:   "rollback-hold-down",
+			EnvVar: "ROLLBACK_HOLD_DOWN",
+			Usage:  "How long an image that was rolled back is not deployed to the service again, 0 disables",
+			Value:  24 * time.Hour,
+		},
+		cli.DurationFlag{
+			Name:   "flap-window",
+			EnvVar: "FLAP_WINDOW",
+			Usage:  "Hold the updates of a project whose latest deployment changes back and forth --flap-changes times within this, e.g. two ci pipelines fighting, 0 disables",
+		},
+		cli.IntFlag{
+			Name:   "flap-changes",
+			EnvVar: "FLAP_CHANGES",
+			Usage:  "How many times the latest deployment may change within --flap-window before it counts as flapping",
+			Value:  3,
+		},
+		cli.StringFlag{
+			Name:   "kafka-rest-url",
+			EnvVar: "KAFKA_REST_URL",
+			Usage:  "Kafka rest proxy to publish every deploy, rollout outcome and skip to, e.g. http://kafka-rest:8082",
+		},
+		cli.StringFlag{
+			Name:   "kafka-topic",
+			EnvVar: "KAFKA_TOPIC",
+			Usage:  "Kafka topic the events are published to",
+			Value:  "beekeeper-deploys",
+		},
+		cli.StringFlag{
+			Name:   "state-file",
+			EnvVar: "STATE_FILE",
+			Usage:  "File the updater remembers state in across restarts, e.g. the cumulative deploy counters and the last answers of beekeeper",
+		},
+		cli.BoolFlag{
+			Name:   "deploy-last-known-good",
+			EnvVar: "DEPLOY_LAST_KNOWN_GOOD",
+			Usage:  "While beekeeper is unavailable, deploy its last answer kept in --state-file to services that drifted from it, e.g. reverted by hand",
+		},
+		cli.BoolFlag{
+			Name:   "no-bookkeeping-labels",
+			EnvVar: "NO_BOOKKEEPING_LABELS",
+			Usage:  "Keep the lastDockerURL, lastUpdatedAt and previousDockerURL of deploys in --state-file instead of service labels",
+		},
+		cli.BoolFlag{
+			Name:   "verify-on-start",
+			EnvVar: "VERIFY_ON_START",
+			Usage:  "Run the checks of verify before the first cycle, exiting with its exit code on a misconfiguration",
+		},
+		cli.DurationFlag{
+			Name:   "startup-delay",
+			EnvVar: "STARTUP_DELAY",
+			Usage:  "Wait this long after starting before the first cycle, while the swarm settles after a manager reboot",
+		},
+		cli.BoolFlag{
+			Name:   "observe-first-cycle",
+			EnvVar: "OBSERVE_FIRST_CYCLE",
+			Usage:  "Only record what the first cycle would deploy, updating from the second cycle on",
+		},
+		cli.StringFlag{
+			Name:   "wave-node-label",
+			EnvVar: "WAVE_NODE_LABEL",
+			Usage:  "Node label grouping nodes into racks, e.g. rack. Global services are rolled out in waves of nodes, pausing the nodes of later waves",
+		},
+		cli.IntFlag{
+			Name:   "wave-size",
+			EnvVar: "WAVE_SIZE",
+			Usage:  "Nodes in a wave of --wave-node-label, by default one node of every rack",
+		},
+		cli.StringFlag{
+			Name:   "owner-label",
+			EnvVar: "OWNER_LABEL",
+			Usage:  "Service label naming the team that owns it, sent with alerts and used to route them to pagerduty",
+			Value:  "octoblu.beekeeper.team",
+		},
+		cli.StringSliceFlag{
+			Name:   "pagerduty-routing-key",
+			EnvVar: "PAGERDUTY_ROUTING_KEYS",
+			Usage:  "Trigger pagerduty incidents for the alerts of an owner, as owner=routing key, * for services of other owners. The key may be an aws-sm://, ssm:// or file:// reference, reloaded on SIGHUP. May be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:   "beekeeper-uri-host",
+			EnvVar: "BEEKEEPER_URI_HOSTS",
+			Usage:  "Host, as host or host:port, an octoblu.beekeeper.uri label may send the beekeeper credentials to. Other hosts get none. May be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:   "image-mapping",
+			EnvVar: "IMAGE_MAPPINGS",
+			Usage:  "Rewrite image names before mapping them to a beekeeper owner/repo, as prefix=replacement. May be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:   "registry-mirror",
+			EnvVar: "REGISTRY_MIRRORS",
+			Usage:  "Deploy images from beekeeper from a mirror, as source=mirror, e.g. docker.io/*=mirror.internal:5000/*. May be repeated",
+		},
+		cli.DurationFlag{
+			Name:   "untracked-backoff",
+			EnvVar: "UNTRACKED_BACKOFF",
+			Usage:  "How long to skip projects beekeeper answers 404 for, doubling up to 6h while they stay unknown",
+			Value:  10 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "differential",
+			EnvVar: "DIFFERENTIAL",
+			Usage:  "Skip services whose spec and cached beekeeper answer did not change since the last cycle, needs --beekeeper-cache-ttl",
+		},
+		cli.BoolFlag{
+			Name:   "ignore-deploy-windows",
+			EnvVar: "IGNORE_DEPLOY_WINDOWS",
+			Usage:  "Deploy regardless of the deployWindows and blackouts in the config file",
+		},
+		cli.StringFlag{
+			Name:   "freeze-calendar-url",
+			EnvVar: "FREEZE_CALENDAR_URL",
+			Usage:  "iCal calendar, e.g. the secret address of a google calendar, whose events are deploy freezes",
+		},
+		cli.DurationFlag{
+			Name:   "freeze-calendar-refresh",
+			EnvVar: "FREEZE_CALENDAR_REFRESH",
+			Usage:  "How often to fetch the freeze calendar",
+			Value:  15 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:   "policy-config",
+			EnvVar: "POLICY_CONFIG",
+			Usage:  "Swarm config with the policies of tracked services, e.g. beekeeper-policies. The newest of beekeeper-policies and beekeeper-policies-<version> is used, no cycle runs until it was read",
+		},
+		cli.DurationFlag{
+			Name:   "policy-refresh",
+			EnvVar: "POLICY_REFRESH",
+			Usage:  "How often to read the --policy-config again",
+			Value:  time.Minute,
+		},
+		cli.DurationFlag{
+			Name:   "beekeeper-cache-ttl",
+			EnvVar: "BEEKEEPER_CACHE_TTL",
+			Usage:  "Reuse the latest deployment of a project for this long before asking beekeeper again, 0 disables the cache",
+		},
+		cli.BoolFlag{
+			Name:   "cleanup-images",
+			EnvVar: "CLEANUP_IMAGES",
+			Usage:  "Remove the replaced image from every node after a rollout converges",
+		},
+		cli.StringFlag{
+			Name:   "cleanup-runner-image",
+			EnvVar: "CLEANUP_RUNNER_IMAGE",
+			Usage:  "Image with the docker cli run on every node to remove replaced images",
+			Value:  "docker:cli",
+		},
+		cli.IntFlag{
+			Name:   "updates-per-hour",
+			EnvVar: "UPDATES_PER_HOUR",
+			Usage:  "At most this many service updates per hour across the swarm, 0 means no limit",
+		},
+		cli.BoolFlag{
+			Name:   "watch-events",
+			EnvVar: "WATCH_EVENTS",
+			Usage:  "Cache services and keep them current with docker events instead of listing them every cycle",
+		},
+		cli.DurationFlag{
+			Name:   "resync-interval",
+			EnvVar: "RESYNC_INTERVAL",
+			Usage:  "How often to fully resync the service cache when watching events",
+			Value:  10 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "leader-election",
+			EnvVar: "LEADER_ELECTION",
+			Usage:  "Only update services while holding a lease kept in swarm, so several updaters can run for high availability",
+		},
+		cli.StringFlag{
+			Name:   "leader-id",
+			EnvVar: "LEADER_ID",
+			Usage:  "Identity of this updater in the lease or membership, defaults to the hostname",
+		},
+		cli.StringFlag{
+			Name:   "leader-lease-service",
+			EnvVar: "LEADER_LEASE_SERVICE",
+			Usage:  "Service without replicas whose labels hold the lease, it is created when missing",
+			Value:  "beekeeper-updater-swarm-lease",
+		},
+		cli.DurationFlag{
+			Name:   "leader-lease",
+			EnvVar: "LEADER_LEASE",
+			Usage:  "How long the lease or a membership is held without renewal, at least 3 poll intervals, the longest the latency budget backs off to. The default is raised to that when shorter",
+			Value:  3 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:   "shard-membership",
+			EnvVar: "SHARD_MEMBERSHIP",
+			Usage:  "Split the services among the updaters renewing a membership kept in swarm, so several updaters can share a large swarm",
+		},
+		cli.StringFlag{
+			Name:   "shard-membership-service",
+			EnvVar: "SHARD_MEMBERSHIP_SERVICE",
+			Usage:  "Service without replicas whose labels hold the membership, it is created when missing",
+			Value:  "beekeeper-updater-swarm-members",
+		},
+		cli.StringFlag{
+			Name:   "control-socket",
+			EnvVar: "CONTROL_SOCKET",
+			Usage:  "Unix socket the daemon answers cli commands on",
+			Value:  "/var/run/beekeeper-updater-swarm.sock",
+		},
+		cli.StringFlag{
+			Name:   "lock-file",
+			EnvVar: "LOCK_FILE",
+			Usage:  "File locked while services are updated, so the daemon and force-update never run at once",
+			Value:  "/var/run/beekeeper-updater-swarm.lock",
+		},
+		cli.IntFlag{
+			Name:   "max-failed-cycles",
+			EnvVar: "MAX_FAILED_CYCLES",
+			Usage:  "Exit after this many cycles failed in a row, timeouts are retried without counting",
+			Value:  1,
+		},
+		cli.DurationFlag{
+			Name:   "beekeeper-p95-budget",
+			EnvVar: "BEEKEEPER_P95_BUDGET",
+			Usage:  "Poll less often while the p95 latency of beekeeper lookups over --beekeeper-budget-window exceeds this",
+		},
+		cli.Float64Flag{
+			Name:   "beekeeper-error-budget",
+			EnvVar: "BEEKEEPER_ERROR_BUDGET",
+			Usage:  "Poll less often while the rate of failed beekeeper lookups, from 0 to 1, exceeds this",
+		},
+		cli.DurationFlag{
+			Name:   "beekeeper-budget-window",
+			EnvVar: "BEEKEEPER_BUDGET_WINDOW",
+			Usage:  "How far back beekeeper lookups are judged against the budgets",
+			Value:  10 * time.Minute,
+		},
+		cli.StringFlag{
+			Name:   "status-file",
+			EnvVar: "STATUS_FILE",
+			Usage:  "Write a json summary of each cycle to this file",
+		},
+		cli.StringFlag{
+			Name:   "audit-log",
+			EnvVar: "AUDIT_LOG",
+			Usage:  "Append every deploy and rollout outcome to this file as json lines",
+		},
+		cli.IntFlag{
+			Name:   "failure-log-lines",
+			EnvVar: "FAILURE_LOG_LINES",
+			Usage:  "Attach the last lines the failed tasks of a rollout logged to the audit log, rollout status and alert, e.g. 50. Needs docker 17.05 or later, 0 disables",
+		},
+		cli.StringFlag{
+			Name:   "metrics-address",
+			EnvVar: "METRICS_ADDRESS",
+			Usage:  "Address to serve metrics on at /debug/vars, e.g. :9102",
+		},
+		cli.StringFlag{
+			Name:   "control-address",
+			EnvVar: "CONTROL_ADDRESS",
+			Usage:  "Address to serve the control api on besides --control-socket, e.g. :9103. Secure it with the --control-token or --control-client-ca flags",
+		},
+		cli.StringFlag{
+			Name:   "cluster-state-address",
+			EnvVar: "CLUSTER_STATE_ADDRESS",
+			Usage:  "Address to serve the live state of the tracked services on at /cluster, e.g. :9104, for beekeeper or a dashboard to pull. Secure it with the --cluster-state-token or --cluster-state-client-ca flags",
+		},
 		cli.StringFlag{
 			Name:   "tags",
 			EnvVar: "TAGS",
 			Usage:  "Beekeeper tags, used to filter builds",
 		},
 	}
+	app.Flags = append(app.Flags, endpointFlags("metrics")...)
+	app.Flags = append(app.Flags, endpointFlags("control")...)
+	app.Flags = append(app.Flags, endpointFlags("cluster-state")...)
 	app.Run(os.Args)
 }
 
 func run(context *cli.Context) {
-	dockerURI, beekeeperURI, tags := getOpts(context)
+	dockerURI, options := getOpts(context)
 
-	dockerClient := getDockerClient(dockerURI)
+	dockerClient := getDockerClient(dockerURI, context.String("docker-context"))
 	debug("running version %v", version())
-	debug("BEEKEEPER_URI: %s", beekeeperURI)
+	debug("BEEKEEPER_URI: %s", deployer.RedactURI(options.BeekeeperURI))
+	debug("BEEKEEPER_USERNAME: %s", options.BeekeeperUsername)
+	debug("OAUTH_TOKEN_URL: %s", options.OAuthTokenURL)
 	debug("DOCKER_HOST: %s", dockerURI)
-	debug("TAGS %s", tags)
-	theDeployer := deployer.New(dockerClient, beekeeperURI, tags)
-	sigTerm := make(chan os.Signal)
+	debug("TAGS %s", options.Tags)
+	debug("SELECTORS %v", options.Selectors)
+	debug("USER_AGENT %s", options.UserAgent)
+	var deployerClient deployer.DockerClient = dockerClient
+	if options.WatchEvents {
+		deployerClient = withServiceEvents(dockerClient, dockerURI, context.String("docker-context"))
+	}
+	theDeployer := deployer.New(deployerClient, options)
+	if err := loadCredentials(context, theDeployer); err != nil {
+		color.Red("  Could not resolve credentials: %v", err)
+		os.Exit(exitConfig)
+	}
+	if err := loadNotifications(context, theDeployer); err != nil {
+		color.Red("  Could not resolve alert endpoints: %v", err)
+		os.Exit(exitConfig)
+	}
+	go reloadCredentialsOnHangup(context, theDeployer)
+	if context.String("vault-addr") != "" {
+		refresh, err := loadVaultCredentials(context, theDeployer)
+		if err != nil {
+			color.Red("  Could not read vault credentials: %v", err)
+			os.Exit(exitConfig)
+		}
+		go watchVaultCredentials(context, theDeployer, refresh)
+	}
+	if context.Bool("verify-on-start") {
+		verifyOnStart(theDeployer)
+	}
+	if err := getEndpoint(context, "metrics").Serve("metrics", http.DefaultServeMux); err != nil {
+		color.Red("  Could not serve metrics: %v", err)
+		os.Exit(exitConfig)
+	}
+	maxPollInterval := theDeployer.MaxPollInterval(pollInterval)
+	controlServer := control.NewServer(context.String("control-socket"), missedCycles*maxPollInterval, context.Duration("startup-delay"))
+	controlServer.HandleJSON("/services", func() interface{} {
+		return theDeployer.Services()
+	})
+	controlServer.HandleJSON("/pending", func() interface{} {
+		return theDeployer.Pending()
+	})
+	controlServer.HandleJSON("/rollouts", func() interface{} {
+		return theDeployer.Rollouts()
+	})
+	controlServer.HandleJSON("/clusters", func() interface{} {
+		return theDeployer.Clusters()
+	})
+	controlServer.HandleStream("/events", func(done <-chan struct{}, send func(string, interface{}) error) {
+		updates, unsubscribe := theDeployer.SubscribeRollouts()
+		defer unsubscribe()
+		for {
+			select {
+			case <-done:
+				return
+			case progress := <-updates:
+				if err := send("rollout", progress); err != nil {
+					return
+				}
+			}
+		}
+	})
+	handlePause(controlServer, theDeployer)
+	handleResume(controlServer, theDeployer)
+	go pauseOnSignals(theDeployer)
+	if err := controlServer.Listen(); err != nil {
+		warn("Could not listen on control socket:", err.Error())
+	}
+	controlEndpoint := getEndpoint(context, "control")
+	if controlEndpoint.Address != "" && controlEndpoint.Token == "" && controlEndpoint.ClientCA == "" {
+		warn("The control api on", controlEndpoint.Address, "can pause and resume updates without auth")
+	}
+	if err := controlEndpoint.Serve("control api", controlServer.Handler()); err != nil {
+		color.Red("  Could not serve the control api: %v", err)
+		os.Exit(exitConfig)
+	}
+	stateEndpoint := getEndpoint(context, "cluster-state")
+	if stateEndpoint.Address != "" && stateEndpoint.Token == "" && stateEndpoint.ClientCA == "" {
+		warn("The cluster state on", stateEndpoint.Address, "is served without auth")
+	}
+	if err := stateEndpoint.Serve("cluster state", clusterStateHandler(theDeployer)); err != nil {
+		color.Red("  Could not serve the cluster state: %v", err)
+		os.Exit(exitConfig)
+	}
+	if interval := context.Duration("heartbeat-interval"); interval > 0 {
+		go sendHeartbeats(theDeployer, controlServer, context.String("heartbeat-path"), interval)
+	}
+	sigTerm := make(chan os.Signal, 1)
 	signal.Notify(sigTerm, syscall.SIGTERM)
 
 	sigTermReceived := false
 
 	go func() {
 		<-sigTerm
-		fmt.Println("SIGTERM received, waiting to exit")
+		info("SIGTERM received, waiting to exit")
+		sdNotify("STOPPING=1")
 		sigTermReceived = true
 	}()
 
+	leaseDuration := context.Duration("leader-lease")
+	if context.Bool("leader-election") || context.Bool("shard-membership") {
+		if minimum := missedCycles * maxPollInterval; leaseDuration < minimum {
+			if context.IsSet("leader-lease") || os.Getenv("LEADER_LEASE") != "" {
+				color.Red("  --leader-lease of %v expires between cycles up to %v apart, it must be at least %v", leaseDuration, maxPollInterval, minimum)
+				os.Exit(exitConfig)
+			}
+			leaseDuration = minimum
+		}
+		info("Leader lease", leaseDuration)
+	}
+	var lease *leader.Lease
+	if context.Bool("leader-election") {
+		lease = leader.New(dockerClient, context.String("leader-lease-service"), leaderID(context), leaseDuration)
+	}
+	var members *leader.Members
+	if context.Bool("shard-membership") {
+		if lease != nil {
+			color.Red("  --shard-membership and --leader-election are mutually exclusive")
+			os.Exit(exitConfig)
+		}
+		members = leader.NewMembers(dockerClient, context.String("shard-membership-service"), leaderID(context), leaseDuration)
+	}
+
+	leading := &leadership{}
+	if err := runClusters(context, theDeployer, leading); err != nil {
+		color.Red("  Could not load clusters: %v", err)
+		os.Exit(exitConfig)
+	}
+
+	deploymentEvents := theDeployer.SubscribeDeployments()
+	startAt := time.Now().Add(context.Duration("startup-delay"))
+	ready := false
+	statusFile := context.String("status-file")
+	lockPath := context.String("lock-file")
+	maxFailedCycles := context.Int("max-failed-cycles")
+	failedCycles := 0
+
 	for {
 		if sigTermReceived {
-			fmt.Println("I'll be back.")
-			os.Exit(0)
+			if lease != nil {
+				if err := lease.Release(); err != nil {
+					warn("Could not release leader lease:", err.Error())
+				}
+			}
+			if members != nil {
+				if err := members.Leave(); err != nil {
+					warn("Could not leave the membership:", err.Error())
+				}
+			}
+			info("I'll be back.")
+			os.Exit(exitSIGTERM)
+		}
+
+		if wait := startAt.Sub(time.Now()); wait > 0 {
+			debug("waiting %v before the first cycle", wait)
+			if !ready {
+				sdNotify("READY=1")
+				ready = true
+			}
+			sdNotify("WATCHDOG=1")
+			if wait > 60*time.Second {
+				wait = 60 * time.Second
+			}
+			time.Sleep(wait)
+			continue
+		}
+
+		leading.set(lease == nil || holdsLease(lease))
+		if !leading.get() {
+			debug("standing by, another updater holds the leader lease")
+			controlServer.RecordCycle(nil)
+			if !ready {
+				sdNotify("READY=1")
+				ready = true
+			}
+			sdNotify("WATCHDOG=1")
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		if members != nil && !joinShard(members, theDeployer, leaderID(context)) {
+			debug("standing by, could not renew the membership")
+			controlServer.RecordCycle(nil)
+			sdNotify("WATCHDOG=1")
+			time.Sleep(pollInterval)
+			continue
 		}
 
 		debug("theDeployer.Run()")
-		err := theDeployer.Run()
-		if err != nil {
-			log.Panic("Run error", err)
+		startedAt := time.Now()
+		err := runLocked(theDeployer, lockPath)
+		controlServer.RecordCycle(err)
+		if statusFile != "" {
+			statusErr := writeStatusFile(statusFile, cycleStatus{
+				Timestamp:  time.Now(),
+				RequestID:  theDeployer.RequestID(),
+				Outcome:    cycleOutcome(err, deployer.IsTimeout(err)),
+				Error:      errorString(err),
+				ErrorClass: deployer.ErrorClass(err),
+				Duration:   time.Since(startedAt).String(),
+				Version:    version(),
+			})
+			if statusErr != nil {
+				warn("Could not write status file:", statusErr.Error())
+			}
+		}
+		if _, locked := err.(*lockError); locked {
+			warn("Skipping cycle:", err.Error())
+		} else if deployer.IsTimeout(err) {
+			warn("Run timed out, retrying next cycle:", err.Error())
+		} else if err != nil {
+			failedCycles++
+			color.Red("  Run error [%s]: %v", theDeployer.RequestID(), err)
+			if failedCycles >= maxFailedCycles {
+				os.Exit(failedCyclesExitCode(err))
+			}
+		} else {
+			failedCycles = 0
+			if !ready {
+				sdNotify("READY=1")
+				ready = true
+			}
+		}
+		// WatchdogSec on the unit must be longer than the cycle interval
+		sdNotify("WATCHDOG=1")
+		select {
+		case event := <-deploymentEvents:
+			debug("starting a cycle early for %s/%s", event.Owner, event.Repo)
+		case <-time.After(theDeployer.PollInterval(pollInterval)):
+		}
+	}
+}
+
+// runLocked runs a cycle holding the lock file,
+// waiting for a manual force-update to finish first
+func runLocked(theDeployer *deployer.Deployer, lockPath string) error {
+	unlock, err := lockFile(lockPath, 5*time.Minute)
+	if err != nil {
+		return &lockError{err}
+	}
+	defer unlock()
+	return theDeployer.Run()
+}
+
+// failedCyclesExitCode returns the exit code once --max-failed-cycles
+// cycles failed in a row, telling an unreachable docker apart
+func failedCyclesExitCode(err error) int {
+	if deployer.IsDockerUnreachable(err) {
+		return exitDockerUnreachable
+	}
+	return exitFailureThreshold
+}
+
+// holdsLease acquires or renews the lease, an updater
+// that cannot reach docker does not assume it leads
+func holdsLease(lease *leader.Lease) bool {
+	held, err := lease.Acquire()
+	if err != nil {
+		warn("Could not acquire leader lease:", err.Error())
+	}
+	return held
+}
+
+// joinShard renews the membership and updates the shard of the
+// deployer, an updater that cannot renew it stands by since the
+// others may have taken over its services
+func joinShard(members *leader.Members, theDeployer *deployer.Deployer, identity string) bool {
+	identities, err := members.Join()
+	if err != nil {
+		warn("Could not renew the membership:", err.Error())
+		return false
+	}
+	for index, member := range identities {
+		if member == identity {
+			theDeployer.SetShard(index, len(identities))
+			return true
 		}
-		time.Sleep(60 * time.Second)
 	}
+	return false
 }
 
-func getOpts(context *cli.Context) (string, string, string) {
+func leaderID(context *cli.Context) string {
+	if id := context.String("leader-id"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Sprintf("pid-%d", os.Getpid())
+	}
+	return hostname
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func getOpts(context *cli.Context) (string, *deployer.Options) {
 	dockerURI := context.String("docker-uri")
 	beekeeperURI := context.String("beekeeper-uri")
+	beekeeperUsername := context.String("beekeeper-username")
+	beekeeperPassword := context.String("beekeeper-password")
 	tags := context.String("tags")
+	clientCert := context.String("beekeeper-client-cert")
+	clientKey := context.String("beekeeper-client-key")
+
+	if (clientCert == "") != (clientKey == "") {
+		color.Red("  --beekeeper-client-cert and --beekeeper-client-key must be used together")
+		os.Exit(exitConfig)
+	}
+	if context.String("oauth-token-url") != "" && context.String("oauth-client-id") == "" {
+		color.Red("  --oauth-token-url requires --oauth-client-id")
+		os.Exit(exitConfig)
+	}
+	if clientCert != "" {
+		if _, err := tls.LoadX509KeyPair(clientCert, clientKey); err != nil {
+			color.Red("  Could not load beekeeper client certificate: %v", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if caCert := context.String("beekeeper-ca-cert"); caCert != "" {
+		if _, err := deployer.LoadCertPool(caCert); err != nil {
+			color.Red("  %v", err)
+			os.Exit(exitConfig)
+		}
+	}
+
+	eventsURL := context.String("beekeeper-events-url")
+	if eventsURL != "" && !strings.HasPrefix(eventsURL, "ws://") && !strings.HasPrefix(eventsURL, "wss://") {
+		color.Red("  --beekeeper-events-url must be a ws:// or wss:// url")
+		os.Exit(exitConfig)
+	}
+
+	if context.Bool("no-bookkeeping-labels") && context.String("state-file") == "" {
+		color.Red("  --no-bookkeeping-labels requires --state-file")
+		os.Exit(exitConfig)
+	}
+	if context.Bool("deploy-last-known-good") && context.String("state-file") == "" {
+		color.Red("  --deploy-last-known-good requires --state-file")
+		os.Exit(exitConfig)
+	}
+
+	if action := context.String("stuck-action"); action != "" && action != deployer.StuckActionRollback {
+		color.Red("  --stuck-action must be %s or empty", deployer.StuckActionRollback)
+		os.Exit(exitConfig)
+	}
+
+	if value := context.String("unparsable-last-updated-at"); value != deployer.UnparsableIgnore && value != deployer.UnparsableHold {
+		color.Red("  --unparsable-last-updated-at must be %s or %s", deployer.UnparsableIgnore, deployer.UnparsableHold)
+		os.Exit(exitConfig)
+	}
+
+	deploymentPath, err := deployer.ParseDeploymentPath(context.String("deployment-path"))
+	if err != nil {
+		color.Red("  Invalid --deployment-path: %v", err)
+		os.Exit(exitConfig)
+	}
+
+	var scanURL *template.Template
+	if value := context.String("scan-url"); value != "" {
+		if scanURL, err = deployer.ParseScanURL(value); err != nil {
+			color.Red("  Invalid --scan-url: %v", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if !deployer.ValidSeverity(context.String("scan-severity")) {
+		color.Red("  --scan-severity must be UNKNOWN, LOW, MEDIUM, HIGH or CRITICAL")
+		os.Exit(exitConfig)
+	}
+
+	var faults *deployer.Faults
+	if value := context.String("inject-faults"); value != "" {
+		faults, err = deployer.ParseFaults(value)
+		if err != nil {
+			color.Red("  Invalid --inject-faults: %v", err)
+			os.Exit(exitConfig)
+		}
+		warn("Injecting faults, this is not for production:", value)
+	}
+
+	config, err := loadConfig(context.String("config"))
+	if err != nil {
+		color.Red("  Could not load config: %v", err)
+		os.Exit(exitConfig)
+	}
 
 	if dockerURI == "" || beekeeperURI == "" {
 		cli.ShowAppHelp(context)
@@ -95,22 +1159,141 @@ func getOpts(context *cli.Context) (string, string, string) {
 		if beekeeperURI == "" {
 			color.Red("  Missing required flag --beekeeper-uri or BEEKEEPER_URI")
 		}
-		os.Exit(1)
+		os.Exit(exitConfig)
 	}
 
-	return dockerURI, beekeeperURI, tags
+	var cleanupRunnerImage string
+	if context.Bool("cleanup-images") {
+		cleanupRunnerImage = context.String("cleanup-runner-image")
+	}
+
+	var policyReader deployer.ConfigReader
+	var logReader deployer.LogReader
+	if context.String("policy-config") != "" || context.Int("failure-log-lines") > 0 {
+		api, err := newDockerAPI(dockerURI, context.String("docker-context"))
+		if err != nil {
+			color.Red("  Cannot read swarm configs or service logs: %v", err)
+			os.Exit(exitConfig)
+		}
+		policyReader, logReader = api, api
+	}
+
+	return dockerURI, &deployer.Options{
+		BeekeeperURI:           beekeeperURI,
+		BeekeeperUsername:      beekeeperUsername,
+		BeekeeperPassword:      beekeeperPassword,
+		BeekeeperEventsURL:     eventsURL,
+		Tags:                   tags,
+		BeekeeperInstances:     config.BeekeeperInstances,
+		DeploymentPath:         deploymentPath,
+		BeekeeperMaxConns:      context.Int("beekeeper-max-conns"),
+		OAuthTokenURL:          context.String("oauth-token-url"),
+		OAuthClientID:          context.String("oauth-client-id"),
+		OAuthClientSecret:      context.String("oauth-client-secret"),
+		OAuthScopes:            splitList(context.String("oauth-scopes")),
+		BeekeeperClientCert:    clientCert,
+		BeekeeperCACert:        context.String("beekeeper-ca-cert"),
+		BeekeeperClientKey:     clientKey,
+		BeekeeperHTTP2:         context.Bool("beekeeper-http2"),
+		UserAgent:              userAgent(),
+		UserAgentSuffix:        context.String("user-agent-suffix"),
+		Cluster:                context.String("cluster-name"),
+		Environment:            context.String("environment"),
+		DockerTimeout:          context.Duration("docker-timeout"),
+		DockerRateLimit:        context.Float64("docker-rate-limit"),
+		Faults:                 faults,
+		DockerRateBurst:        context.Int("docker-rate-burst"),
+		DeployTimeout:          context.Duration("deploy-timeout"),
+		UpdateLabelValues:      splitList(context.String("update-label-values")),
+		Services:               append(splitList(context.String("services")), config.Services...),
+		Selectors:              context.StringSlice("selector"),
+		AllowedRegistries:      splitList(context.String("allowed-registries")),
+		RequireProvenance:      context.Bool("require-provenance"),
+		ScanURL:                scanURL,
+		ScanSeverity:           context.String("scan-severity"),
+		VerifyImageRevision:    context.Bool("verify-image-revision"),
+		AlertWebhook:           context.String("alert-webhook"),
+		BeekeeperLatencyBudget: context.Duration("beekeeper-p95-budget"),
+		BeekeeperErrorBudget:   context.Float64("beekeeper-error-budget"),
+		BeekeeperBudgetWindow:  context.Duration("beekeeper-budget-window"),
+		RollbackHoldDown:       context.Duration("rollback-hold-down"),
+		FlapWindow:             context.Duration("flap-window"),
+		FlapChanges:            context.Int("flap-changes"),
+		KafkaRESTURL:           context.String("kafka-rest-url"),
+		KafkaTopic:             context.String("kafka-topic"),
+		StuckAfter:             context.Duration("stuck-after"),
+		StuckAction:            context.String("stuck-action"),
+		RetireGrace:            context.Duration("retire-grace"),
+		MinUpdateInterval:      context.Duration("min-update-interval"),
+		UnparsableUpdatedAt:    context.String("unparsable-last-updated-at"),
+		StateFile:              context.String("state-file"),
+		NoBookkeepingLabels:    context.Bool("no-bookkeeping-labels"),
+		DeployLastKnownGood:    context.Bool("deploy-last-known-good"),
+		ObserveFirstCycle:      context.Bool("observe-first-cycle"),
+		WaveNodeLabel:          context.String("wave-node-label"),
+		WaveSize:               context.Int("wave-size"),
+		MinHealthy:             context.Float64("min-healthy"),
+		CapacityParallelism:    context.Int("capacity-check-parallelism"),
+		OwnerLabel:             context.String("owner-label"),
+		PagerDutyRoutingKeys:   append(context.StringSlice("pagerduty-routing-key"), config.pagerDutyRoutingKeys()...),
+		StatusPath:             context.String("status-path"),
+		BumpScaledToZero:       context.Bool("bump-scaled-to-zero"),
+		AuditLog:               context.String("audit-log"),
+		FailureLogLines:        context.Int("failure-log-lines"),
+		LogReader:              logReader,
+		CleanupRunnerImage:     cleanupRunnerImage,
+		ImageMappings:          context.StringSlice("image-mapping"),
+		BeekeeperURIHosts:      context.StringSlice("beekeeper-uri-host"),
+		RegistryMirrors:        append(context.StringSlice("registry-mirror"), config.RegistryMirrors...),
+		UpdatesPerHour:         context.Int("updates-per-hour"),
+		DeployWindows:          config.DeployWindows,
+		Blackouts:              config.Blackouts,
+		Trains:                 config.ReleaseTrains,
+		IgnoreWindows:          context.Bool("ignore-deploy-windows"),
+		FreezeCalendarURL:      context.String("freeze-calendar-url"),
+		FreezeCalendarRefresh:  context.Duration("freeze-calendar-refresh"),
+		PolicyConfig:           context.String("policy-config"),
+		PolicyReader:           policyReader,
+		PolicyRefresh:          context.Duration("policy-refresh"),
+		WatchEvents:            context.Bool("watch-events"),
+		ResyncInterval:         context.Duration("resync-interval"),
+		BeekeeperCacheTTL:      context.Duration("beekeeper-cache-ttl"),
+		Differential:           context.Bool("differential"),
+		UntrackedBackoff:       context.Duration("untracked-backoff"),
+	}
 }
 
-func getDockerClient(dockerURI string) client.APIClient {
+func getDockerClient(dockerURI, contextName string) client.APIClient {
 	defaultHeaders := map[string]string{"User-Agent": "beekeeper-updater-swarm"}
-
-	dockerClient, err := client.NewClient(dockerURI, "v1.24", nil, defaultHeaders)
+	dockerURI, httpClient := getDockerEndpoint(dockerURI, contextName)
+	dockerClient, err := client.NewClient(dockerURI, "v1.24", httpClient, defaultHeaders)
 	if err != nil {
-		panic(err)
+		color.Red("  Invalid docker uri %s: %v", dockerURI, err)
+		os.Exit(exitConfig)
 	}
 	return dockerClient
 }
 
+// getDockerEndpoint returns the docker uri and http client of the
+// docker context, or dockerURI and a nil client without one
+func getDockerEndpoint(dockerURI, contextName string) (string, *http.Client) {
+	var httpClient *http.Client
+	if contextName != "" {
+		dockerCtx, err := loadDockerContext(contextName)
+		if err != nil {
+			color.Red("  Could not load docker context %s: %v", contextName, err)
+			os.Exit(exitConfig)
+		}
+		dockerURI, httpClient, err = dockerCtx.clientConfig()
+		if err != nil {
+			color.Red("  Could not load docker context %s: %v", contextName, err)
+			os.Exit(exitConfig)
+		}
+		debug("DOCKER_CONTEXT: %s (%s)", contextName, dockerCtx.Host)
+	}
+	return dockerURI, httpClient
+}
+
 // ParseHost verifies that the given host strings is valid.
 func ParseHost(host string) (string, string, string, error) {
 	protoAddrParts := strings.SplitN(host, "://", 2)
@@ -131,11 +1314,26 @@ func ParseHost(host string) (string, string, string, error) {
 	return proto, addr, basePath, nil
 }
 
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func userAgent() string {
+	return fmt.Sprintf("beekeeper-updater-swarm/%s", version())
+}
+
 func version() string {
 	version, err := semver.NewVersion(VERSION)
 	if err != nil {
-		errorMessage := fmt.Sprintf("Error with version number: %v", VERSION)
-		log.Panicln(errorMessage, err.Error())
+		color.Red("  Invalid version number %v: %v", VERSION, err)
+		os.Exit(exitConfig)
 	}
 	return version.String()
 }
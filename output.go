@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	De "github.com/tj/go-debug"
+)
+
+// quiet suppresses informational output, warnings are still written
+var quiet bool
+
+// logPrefix starts every line of the daemon's output with the
+// cluster and environment, when they are given
+var logPrefix string
+
+// setupOutput applies --quiet, --no-color and the log prefix
+// before any command runs
+func setupOutput(context *cli.Context) error {
+	quiet = context.GlobalBool("quiet")
+	logPrefix = identityPrefix(context.GlobalString("cluster-name"), context.GlobalString("environment"))
+
+	var writer io.Writer = os.Stderr
+	if context.GlobalBool("no-color") || os.Getenv("NO_COLOR") != "" {
+		color.NoColor = true
+		// go-debug always colors its output
+		writer = &ansiStripper{writer: writer}
+	}
+	if logPrefix != "" {
+		writer = &prefixer{prefix: []byte(logPrefix), writer: writer}
+	}
+	if writer != os.Stderr {
+		De.SetWriter(writer)
+	}
+	return nil
+}
+
+// identityPrefix is "[cluster/environment] ", either may be missing
+func identityPrefix(cluster, environment string) string {
+	switch {
+	case cluster != "" && environment != "":
+		return fmt.Sprintf("[%s/%s] ", cluster, environment)
+	case cluster != "" || environment != "":
+		return fmt.Sprintf("[%s%s] ", cluster, environment)
+	}
+	return ""
+}
+
+// info prints progress of the daemon unless --quiet is set
+func info(args ...interface{}) {
+	if quiet {
+		return
+	}
+	fmt.Print(logPrefix)
+	fmt.Println(args...)
+}
+
+// warn prints a problem the daemon recovers from to stderr
+func warn(args ...interface{}) {
+	fmt.Fprint(os.Stderr, logPrefix)
+	fmt.Fprintln(os.Stderr, args...)
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// ansiStripper removes terminal color codes from what it writes
+type ansiStripper struct {
+	writer io.Writer
+}
+
+func (stripper *ansiStripper) Write(data []byte) (int, error) {
+	if _, err := stripper.writer.Write(ansiEscape.ReplaceAll(data, nil)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// prefixer starts what it writes with prefix, go-debug
+// writes each line with a single call
+type prefixer struct {
+	prefix []byte
+	writer io.Writer
+}
+
+func (prefixer *prefixer) Write(data []byte) (int, error) {
+	if _, err := prefixer.writer.Write(append(append([]byte{}, prefixer.prefix...), data...)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
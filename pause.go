@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// pauseRequest is the body of /pause
+type pauseRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handlePause serves /paused, /pause and /unpause on the control socket
+func handlePause(controlServer *control.Server, theDeployer *deployer.Deployer) {
+	controlServer.HandleJSON("/paused", func() interface{} {
+		return theDeployer.PauseState()
+	})
+	controlServer.HandleAction("/pause", func(decode func(interface{}) error) (interface{}, error) {
+		var request pauseRequest
+		if err := decode(&request); err != nil {
+			return nil, err
+		}
+		info("Updates paused:", request.Reason)
+		return theDeployer.Pause("api", request.Reason), nil
+	})
+	controlServer.HandleAction("/unpause", func(decode func(interface{}) error) (interface{}, error) {
+		info("Updates unpaused")
+		return theDeployer.Unpause(), nil
+	})
+}
+
+// pauseOnSignals pauses updates on SIGUSR1 and unpauses them on SIGUSR2
+func pauseOnSignals(theDeployer *deployer.Deployer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig == syscall.SIGUSR1 {
+			info("SIGUSR1 received, pausing updates")
+			theDeployer.Pause("signal", "SIGUSR1")
+			continue
+		}
+		info("SIGUSR2 received, unpausing updates")
+		theDeployer.Unpause()
+	}
+}
+
+func pause(context *cli.Context) error {
+	request := pauseRequest{Reason: strings.Join(context.Args(), " ")}
+	return changePause(context, "/pause", request)
+}
+
+func unpause(context *cli.Context) error {
+	return changePause(context, "/unpause", nil)
+}
+
+func changePause(context *cli.Context, path string, request interface{}) error {
+	var state deployer.PauseState
+	status, err := control.Post(context.GlobalString("control-socket"), path, request, &state)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if status != http.StatusOK {
+		return cli.NewExitError(fmt.Sprintf("daemon responded with %v", status), exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(state)
+	}
+	printPauseState(state)
+	return nil
+}
+
+func printPauseState(state deployer.PauseState) {
+	if !state.Paused {
+		fmt.Println("updates are not paused")
+		return
+	}
+	fmt.Printf("updates paused by %s since %s", state.Source, state.Since.Format(time.RFC3339))
+	if state.Reason != "" {
+		fmt.Printf(": %s", state.Reason)
+	}
+	fmt.Println("")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// resumeRequest is the body of /resume
+type resumeRequest struct {
+	Service string `json:"service"`
+}
+
+// resumeResponse is the answer of /resume, Error is
+// set when the daemon could not resume the rollout
+type resumeResponse struct {
+	Service string `json:"service"`
+	Image   string `json:"image"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleResume serves /resume on the control socket
+func handleResume(controlServer *control.Server, theDeployer *deployer.Deployer) {
+	controlServer.HandleAction("/resume", func(decode func(interface{}) error) (interface{}, error) {
+		var request resumeRequest
+		if err := decode(&request); err != nil {
+			return nil, err
+		}
+		if request.Service == "" {
+			return nil, fmt.Errorf("Missing service")
+		}
+		image, err := theDeployer.Resume(request.Service)
+		if err != nil {
+			return nil, err
+		}
+		info("Resumed the rollout of", request.Service, "to", image)
+		return resumeResponse{Service: request.Service, Image: image}, nil
+	})
+}
+
+func resume(context *cli.Context) error {
+	serviceName := context.Args().First()
+	if serviceName == "" {
+		return cli.NewExitError("Missing service name", exitError)
+	}
+	var response resumeResponse
+	if _, err := control.Post(context.GlobalString("control-socket"), "/resume", resumeRequest{Service: serviceName}, &response); err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if response.Error != "" {
+		return cli.NewExitError(response.Error, exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(response)
+	}
+	fmt.Printf("resuming %s to %s\n", response.Service, response.Image)
+	return nil
+}
@@ -0,0 +1,226 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials sign requests to the aws apis
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+var awsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// getAWSCredentials looks for credentials in the environment, then
+// the ecs task role, then the ec2 instance profile
+func getAWSCredentials() (*awsCredentials, error) {
+	if accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID"); accessKeyID != "" {
+		return &awsCredentials{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		return fetchAWSCredentials("http://169.254.170.2"+relativeURI, nil)
+	}
+	return getInstanceProfileCredentials()
+}
+
+func getInstanceProfileCredentials() (*awsCredentials, error) {
+	const metadataURI = "http://169.254.169.254/latest"
+	req, err := http.NewRequest("PUT", metadataURI+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := awsGetString(req)
+	if err != nil {
+		return nil, fmt.Errorf("No aws credentials in the environment or instance metadata: %v", err)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+
+	req, err = http.NewRequest("GET", metadataURI+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	role, err := awsGetString(req)
+	if err != nil {
+		return nil, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	return fetchAWSCredentials(metadataURI+"/meta-data/iam/security-credentials/"+role, headers)
+}
+
+func fetchAWSCredentials(uri string, headers map[string]string) (*awsCredentials, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	body, err := awsGetString(req)
+	if err != nil {
+		return nil, err
+	}
+	var credentials awsCredentials
+	if err := json.Unmarshal([]byte(body), &credentials); err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+func awsGetString(req *http.Request) (string, error) {
+	res, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s failed with status code %v", req.Method, req.URL, res.StatusCode)
+	}
+	return string(body), nil
+}
+
+// awsRegion returns the region of an arn,
+// falling back to AWS_REGION and AWS_DEFAULT_REGION
+func awsRegion(arn string) (string, error) {
+	if parts := strings.Split(arn, ":"); len(parts) > 3 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3], nil
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region, nil
+	}
+	if region := os.Getenv("AWS_DEFAULT_REGION"); region != "" {
+		return region, nil
+	}
+	return "", fmt.Errorf("No aws region, set AWS_REGION or use an arn")
+}
+
+// awsEndpoint is the uri of the api of service, AWS_ENDPOINT_URL
+// replaces it like it does for the aws cli, e.g. for localstack
+func awsEndpoint(service, region string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		return strings.TrimRight(endpoint, "/") + "/"
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+}
+
+// awsCall posts a json rpc request to an aws api,
+// e.g. target "AmazonSSM.GetParameter" of service "ssm"
+func awsCall(service, region, target string, input, output interface{}) error {
+	credentials, err := getAWSCredentials()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", awsEndpoint(service, region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, service, region, credentials, time.Now().UTC())
+
+	res, err := awsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s failed with status code %v: %s", target, res.StatusCode, message)
+	}
+	return json.NewDecoder(res.Body).Decode(output)
+}
+
+// signAWSRequest adds a signature version 4 authorization header
+func signAWSRequest(req *http.Request, body []byte, service, region string, credentials *awsCredentials, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
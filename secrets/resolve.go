@@ -0,0 +1,102 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	secretsManagerScheme = "aws-sm://"
+	parameterStoreScheme = "ssm://"
+	fileScheme           = "file://"
+)
+
+// IsReference is true when value names a secret
+// instead of holding it
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, secretsManagerScheme) || strings.HasPrefix(value, parameterStoreScheme) || strings.HasPrefix(value, fileScheme)
+}
+
+// Resolve returns the secret a reference names, any other value
+// is returned unchanged. References are either
+//
+//	aws-sm://<secret name or arn>[#<json key>]
+//	ssm://<parameter name>
+//	file://<path>, e.g. file:///run/secrets/alert_webhook for a docker secret
+func Resolve(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, fileScheme):
+		return getFileValue(strings.TrimPrefix(value, fileScheme))
+	case strings.HasPrefix(value, secretsManagerScheme):
+		return getSecretsManagerValue(strings.TrimPrefix(value, secretsManagerScheme))
+	case strings.HasPrefix(value, parameterStoreScheme):
+		return getParameterValue(strings.TrimPrefix(value, parameterStoreScheme))
+	}
+	return value, nil
+}
+
+// getFileValue reads the secret in path, without
+// the trailing newline editors and echo leave
+func getFileValue(path string) (string, error) {
+	debug("read secret file %s", path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read secret file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func getSecretsManagerValue(reference string) (string, error) {
+	secretID := reference
+	var key string
+	if index := strings.LastIndex(reference, "#"); index != -1 {
+		secretID, key = reference[:index], reference[index+1:]
+	}
+	region, err := awsRegion(secretID)
+	if err != nil {
+		return "", err
+	}
+	debug("secrets manager get %s", secretID)
+
+	var output struct {
+		SecretString string `json:"SecretString"`
+	}
+	input := map[string]string{"SecretId": secretID}
+	if err := awsCall("secretsmanager", region, "secretsmanager.GetSecretValue", input, &output); err != nil {
+		return "", fmt.Errorf("Could not get secret %s: %v", secretID, err)
+	}
+	if key == "" {
+		return output.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(output.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("Secret %s is not a json object: %v", secretID, err)
+	}
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no key %s", secretID, key)
+	}
+	return fmt.Sprint(field), nil
+}
+
+func getParameterValue(name string) (string, error) {
+	region, err := awsRegion(name)
+	if err != nil {
+		return "", err
+	}
+	debug("ssm get parameter %s", name)
+
+	var output struct {
+		Parameter struct {
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	input := map[string]interface{}{"Name": name, "WithDecryption": true}
+	if err := awsCall("ssm", region, "AmazonSSM.GetParameter", input, &output); err != nil {
+		return "", fmt.Errorf("Could not get parameter %s: %v", name, err)
+	}
+	return output.Parameter.Value, nil
+}
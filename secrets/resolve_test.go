@@ -0,0 +1,150 @@
+package secrets_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/octoblu/beekeeper-updater-swarm/secrets"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resolve", func() {
+	It("should return a plain value unchanged", func() {
+		Expect(secrets.IsReference("hunter2")).To(BeFalse())
+		Expect(secrets.Resolve("hunter2")).To(Equal("hunter2"))
+	})
+
+	Describe("when the value names a file", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "beekeeper-secrets")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "password"), []byte("hunter2\n"), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should read it without the trailing newline", func() {
+			reference := "file://" + filepath.Join(dir, "password")
+			Expect(secrets.IsReference(reference)).To(BeTrue())
+			Expect(secrets.Resolve(reference)).To(Equal("hunter2"))
+		})
+
+		It("should fail when it is missing", func() {
+			_, err := secrets.Resolve("file://" + filepath.Join(dir, "missing"))
+			Expect(err).To(MatchError(ContainSubstring("Could not read secret file")))
+		})
+	})
+
+	Describe("when the value names an aws secret", func() {
+		var server *httptest.Server
+		var lock sync.Mutex
+		var values map[string]string
+		var requests []*http.Request
+		var restore map[string]*string
+
+		BeforeEach(func() {
+			values = make(map[string]string)
+			requests = nil
+			server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+				var input map[string]interface{}
+				json.NewDecoder(request.Body).Decode(&input)
+				lock.Lock()
+				requests = append(requests, request)
+				var name string
+				switch request.Header.Get("X-Amz-Target") {
+				case "secretsmanager.GetSecretValue":
+					name, _ = input["SecretId"].(string)
+				case "AmazonSSM.GetParameter":
+					name, _ = input["Name"].(string)
+				}
+				value, ok := values[name]
+				lock.Unlock()
+				if !ok {
+					response.WriteHeader(http.StatusBadRequest)
+					response.Write([]byte(`{"__type":"ResourceNotFoundException"}`))
+					return
+				}
+				if strings.HasPrefix(request.Header.Get("X-Amz-Target"), "AmazonSSM.") {
+					json.NewEncoder(response).Encode(map[string]interface{}{"Parameter": map[string]string{"Value": value}})
+					return
+				}
+				json.NewEncoder(response).Encode(map[string]string{"SecretString": value})
+			}))
+			restore = make(map[string]*string)
+			for name, value := range map[string]string{
+				"AWS_ENDPOINT_URL":      server.URL,
+				"AWS_REGION":            "us-west-2",
+				"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+				"AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_SESSION_TOKEN":     "session",
+			} {
+				if previous, ok := os.LookupEnv(name); ok {
+					restore[name] = &previous
+				} else {
+					restore[name] = nil
+				}
+				os.Setenv(name, value)
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+			for name, previous := range restore {
+				if previous == nil {
+					os.Unsetenv(name)
+				} else {
+					os.Setenv(name, *previous)
+				}
+			}
+		})
+
+		It("should get a parameter with signed requests", func() {
+			values["/beekeeper/password"] = "hunter2"
+			Expect(secrets.Resolve("ssm:///beekeeper/password")).To(Equal("hunter2"))
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].Header.Get("Authorization")).To(HavePrefix("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+			Expect(requests[0].Header.Get("Authorization")).To(ContainSubstring("/us-west-2/ssm/aws4_request"))
+			Expect(requests[0].Header.Get("X-Amz-Security-Token")).To(Equal("session"))
+		})
+
+		It("should get a key of a json secret", func() {
+			values["beekeeper"] = `{"username": "updater", "password": "hunter2"}`
+			Expect(secrets.Resolve("aws-sm://beekeeper#password")).To(Equal("hunter2"))
+			_, err := secrets.Resolve("aws-sm://beekeeper#token")
+			Expect(err).To(MatchError("Secret beekeeper has no key token"))
+		})
+
+		It("should use the region of an arn", func() {
+			arn := "arn:aws:secretsmanager:eu-west-1:123456789012:secret:beekeeper"
+			values[arn] = "hunter2"
+			Expect(secrets.Resolve("aws-sm://" + arn)).To(Equal("hunter2"))
+			Expect(requests[0].Header.Get("Authorization")).To(ContainSubstring("/eu-west-1/secretsmanager/aws4_request"))
+		})
+
+		It("should return the rotated value when resolved again", func() {
+			values["beekeeper"] = "hunter2"
+			Expect(secrets.Resolve("aws-sm://beekeeper")).To(Equal("hunter2"))
+			values["beekeeper"] = "correct-horse"
+			Expect(secrets.Resolve("aws-sm://beekeeper")).To(Equal("correct-horse"))
+		})
+
+		It("should fail when the secret does not exist", func() {
+			_, err := secrets.Resolve("aws-sm://missing")
+			Expect(err).To(MatchError(ContainSubstring("Could not get secret missing")))
+			Expect(err).To(MatchError(ContainSubstring("ResourceNotFoundException")))
+		})
+	})
+})
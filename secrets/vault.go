@@ -0,0 +1,92 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	De "github.com/tj/go-debug"
+)
+
+var debug = De.Debug("beekeeper-updater-swarm:secrets")
+
+// Vault reads secrets from the http api of a HashiCorp Vault server
+type Vault struct {
+	address    string
+	token      string
+	httpClient *http.Client
+}
+
+// Secret is the data of a vault secret and how long it may be cached
+type Secret struct {
+	Data          map[string]string
+	LeaseDuration time.Duration
+}
+
+type vaultResponse struct {
+	LeaseDuration int64                  `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+// NewVault constructs a vault client for address, e.g.
+// https://vault.example.com:8200, authenticating with token
+func NewVault(address, token string) *Vault {
+	return &Vault{
+		address:    strings.TrimRight(address, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Read fetches the secret at path, e.g. "secret/data/beekeeper".
+// The nested data of kv version 2 secrets is unwrapped
+func (vault *Vault) Read(path string) (*Secret, error) {
+	uri := fmt.Sprintf("%s/v1/%s", vault.address, strings.TrimLeft(path, "/"))
+	debug("vault read %s", uri)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vault.token)
+
+	res, err := vault.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body vaultResponse
+	if res.StatusCode != http.StatusOK {
+		json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&body)
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("Vault read %s failed with status code %v %v", path, res.StatusCode, strings.Join(body.Errors, ", "))
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Could not decode vault secret %s: %v", path, err)
+	}
+
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isKV2 := data["metadata"]; isKV2 {
+			data = nested
+		}
+	}
+
+	secret := &Secret{
+		Data:          make(map[string]string, len(data)),
+		LeaseDuration: time.Duration(body.LeaseDuration) * time.Second,
+	}
+	for key, value := range data {
+		if str, ok := value.(string); ok {
+			secret.Data[key] = str
+		} else {
+			secret.Data[key] = fmt.Sprint(value)
+		}
+	}
+	return secret, nil
+}
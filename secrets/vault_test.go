@@ -0,0 +1,105 @@
+package secrets_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/octoblu/beekeeper-updater-swarm/secrets"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Vault", func() {
+	var server *httptest.Server
+	var lock sync.Mutex
+	var responses map[string]interface{}
+	var tokens []string
+	var sut *secrets.Vault
+
+	respond := func(path string, body interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		responses[path] = body
+	}
+
+	BeforeEach(func() {
+		responses = make(map[string]interface{})
+		tokens = nil
+		server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			lock.Lock()
+			tokens = append(tokens, request.Header.Get("X-Vault-Token"))
+			body, ok := responses[request.URL.Path]
+			lock.Unlock()
+			if !ok {
+				response.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(response).Encode(map[string]interface{}{"errors": []string{"no secret"}})
+				return
+			}
+			json.NewEncoder(response).Encode(body)
+		}))
+		sut = secrets.NewVault(server.URL+"/", "s.root")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("when the secret is a kv version 2 secret", func() {
+		BeforeEach(func() {
+			respond("/v1/secret/data/beekeeper", map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"username": "updater", "password": "hunter2"},
+					"metadata": map[string]interface{}{"version": 3},
+				},
+			})
+		})
+
+		It("should unwrap its data", func() {
+			secret, err := sut.Read("/secret/data/beekeeper")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Data).To(Equal(map[string]string{"username": "updater", "password": "hunter2"}))
+			Expect(tokens).To(Equal([]string{"s.root"}))
+		})
+
+		It("should read the rotated secret on the next read", func() {
+			_, err := sut.Read("secret/data/beekeeper")
+			Expect(err).NotTo(HaveOccurred())
+			respond("/v1/secret/data/beekeeper", map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"username": "updater", "password": "correct-horse"},
+					"metadata": map[string]interface{}{"version": 4},
+				},
+			})
+			secret, err := sut.Read("secret/data/beekeeper")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.Data["password"]).To(Equal("correct-horse"))
+		})
+	})
+
+	Describe("when the secret is leased", func() {
+		BeforeEach(func() {
+			respond("/v1/database/creds/registry", map[string]interface{}{
+				"lease_duration": 3600,
+				"data":           map[string]interface{}{"username": "pull", "password": "secret", "port": 5000},
+			})
+		})
+
+		It("should return the lease and stringify the values", func() {
+			secret, err := sut.Read("database/creds/registry")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(secret.LeaseDuration).To(Equal(time.Hour))
+			Expect(secret.Data).To(Equal(map[string]string{"username": "pull", "password": "secret", "port": "5000"}))
+		})
+	})
+
+	Describe("when the secret does not exist", func() {
+		It("should return the errors of vault", func() {
+			_, err := sut.Read("secret/data/missing")
+			Expect(err).To(MatchError(ContainSubstring("status code 404 no secret")))
+		})
+	})
+})
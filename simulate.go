@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// simulate prints what a cycle would do with the services of a dump,
+// or of the swarm read-only, and the deployments of a beekeeper
+// snapshot, or of beekeeper. Nothing is deployed, alerted or exported
+func simulate(context *cli.Context) error {
+	dockerURI, options := getOpts(context.Parent())
+	options.AuditLog = ""
+	options.AlertWebhook = ""
+	options.PagerDutyRoutingKeys = nil
+	options.KafkaRESTURL = ""
+	options.StatusPath = ""
+	options.StateFile = ""
+	options.WatchEvents = false
+
+	var dockerClient deployer.DockerClient
+	if path := context.String("services"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+		defer file.Close()
+		if dockerClient, err = deployer.ReadServicesDump(file); err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+	} else {
+		dockerClient = getDockerClient(dockerURI, context.GlobalString("docker-context"))
+	}
+
+	var snapshot deployer.BeekeeperSnapshot
+	if path := context.String("beekeeper"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return cli.NewExitError(fmt.Sprintf("Could not parse %s: %v", path, err), exitError)
+		}
+	}
+
+	theDeployer := deployer.New(dockerClient, options)
+	if snapshot == nil {
+		if err := loadCredentials(context.Parent(), theDeployer); err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+	}
+	states, err := theDeployer.Simulate(snapshot)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if jsonOutput(context) {
+		return printJSON(states)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tIMAGE\tLATEST\tDECISION\tERROR")
+	for _, state := range states {
+		decision := string(state.Reason)
+		if state.Reason == deployer.ReasonDeployed {
+			decision = "would deploy"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", state.Name, state.Image, state.LatestImage, decision, state.Error)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// snapshotExport writes the tracked services and their images
+// to the file given, or to stdout
+func snapshotExport(context *cli.Context) error {
+	theDeployer, err := newCommandDeployer(context.Parent())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	state, err := theDeployer.ExportDesiredState()
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+
+	path := context.Args().First()
+	if path == "" || path == "-" {
+		return printJSON(state)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	fmt.Printf("exported %d services to %s\n", len(state.Services), path)
+	return nil
+}
+
+// snapshotApply recreates the services of an exported snapshot
+// missing from the swarm and deploys their images to the others
+func snapshotApply(context *cli.Context) error {
+	path := context.Args().First()
+	if path == "" {
+		return cli.NewExitError("Missing snapshot file", exitError)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	var state deployer.DesiredState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Could not parse %s: %v", path, err), exitError)
+	}
+
+	theDeployer, err := newCommandDeployer(context.Parent())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	dryRun := context.Bool("dry-run")
+	if !dryRun {
+		unlock, err := lockFile(context.GlobalString("lock-file"), 5*time.Minute)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+		defer unlock()
+	}
+
+	changes, err := theDeployer.ApplyDesiredState(state, dryRun)
+	if jsonOutput(context) {
+		if changes == nil {
+			changes = []deployer.DesiredChange{}
+		}
+		printJSON(changes)
+	} else {
+		for _, change := range changes {
+			switch {
+			case change.Error != "":
+				fmt.Fprintf(os.Stderr, "%s: could not %s to %s: %s\n", change.Service, change.Action, change.Image, change.Error)
+			case change.Action == deployer.DesiredCreate:
+				fmt.Printf("%s: create with %s\n", change.Service, change.Image)
+			case change.Action == deployer.DesiredUpdate:
+				fmt.Printf("%s: update %s to %s\n", change.Service, change.PreviousImage, change.Image)
+			}
+		}
+		if dryRun {
+			fmt.Printf("%d of %d services would change\n", countChanged(changes), len(changes))
+		} else {
+			fmt.Printf("%d of %d services changed\n", countChanged(changes), len(changes))
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	return nil
+}
+
+func countChanged(changes []deployer.DesiredChange) int {
+	count := 0
+	for _, change := range changes {
+		if change.Action != deployer.DesiredUnchanged && change.Error == "" {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cycleStatus is written to the status file after every cycle
+type cycleStatus struct {
+	Timestamp  time.Time `json:"timestamp"`
+	RequestID  string    `json:"requestId"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+	Duration   string    `json:"duration"`
+	Version    string    `json:"version"`
+}
+
+// writeStatusFile atomically replaces the status file,
+// so readers never see a partial write
+func writeStatusFile(path string, status cycleStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".status")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func cycleOutcome(err error, timedOut bool) string {
+	if timedOut {
+		return "timeout"
+	}
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends state to systemd when running as a
+// Type=notify unit, it is a no-op everywhere else
+func sdNotify(state string) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return
+	}
+	if socketPath[0] == '@' {
+		// abstract namespace socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		debug("sd_notify %s failed: %v", state, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		debug("sd_notify %s failed: %v", state, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/engine-api/types"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+	"github.com/octoblu/beekeeper-updater-swarm/secrets"
+)
+
+// vaultRetryInterval is how soon a failed refresh is retried,
+// the previous credentials stay in use meanwhile
+const vaultRetryInterval = time.Minute
+
+// loadVaultCredentials reads the beekeeper and registry secrets
+// from vault into theDeployer, returning when to read them again
+func loadVaultCredentials(context *cli.Context, theDeployer *deployer.Deployer) (time.Duration, error) {
+	vault := secrets.NewVault(context.String("vault-addr"), context.String("vault-token"))
+	refresh := context.Duration("vault-refresh-interval")
+
+	if path := context.String("vault-beekeeper-path"); path != "" {
+		secret, err := vault.Read(path)
+		if err != nil {
+			return 0, err
+		}
+		username := secret.Data["username"]
+		if username == "" {
+			username = context.String("beekeeper-username")
+		}
+		password := secret.Data["password"]
+		if password == "" {
+			password = secret.Data["token"]
+		}
+		if password == "" {
+			return 0, fmt.Errorf("Vault secret %s has no password or token", path)
+		}
+		theDeployer.SetBeekeeperCredentials(username, password)
+		refresh = leaseRefresh(refresh, secret.LeaseDuration)
+	}
+
+	if path := context.String("vault-registry-path"); path != "" {
+		secret, err := vault.Read(path)
+		if err != nil {
+			return 0, err
+		}
+		err = theDeployer.SetRegistryAuth(types.AuthConfig{
+			Username:      secret.Data["username"],
+			Password:      secret.Data["password"],
+			ServerAddress: secret.Data["serveraddress"],
+		})
+		if err != nil {
+			return 0, err
+		}
+		refresh = leaseRefresh(refresh, secret.LeaseDuration)
+	}
+	return refresh, nil
+}
+
+// watchVaultCredentials rereads the secrets before their leases expire
+func watchVaultCredentials(context *cli.Context, theDeployer *deployer.Deployer, refresh time.Duration) {
+	for {
+		time.Sleep(refresh)
+		next, err := loadVaultCredentials(context, theDeployer)
+		if err != nil {
+			warn("Could not refresh vault credentials:", err.Error())
+			refresh = vaultRetryInterval
+			continue
+		}
+		debug("refreshed vault credentials, next refresh in %v", next)
+		refresh = next
+	}
+}
+
+// leaseRefresh shortens refresh to two thirds of a lease,
+// leaving time to retry before it expires
+func leaseRefresh(refresh, lease time.Duration) time.Duration {
+	if lease <= 0 {
+		return refresh
+	}
+	if early := lease * 2 / 3; early < refresh {
+		return early
+	}
+	return refresh
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+// verifyExitCodes are the exit codes of each misconfiguration
+// found by verify, so a deploy pipeline can tell them apart
+var verifyExitCodes = map[deployer.VerifyCheck]int{
+	deployer.CheckDockerUnreachable:    exitDockerUnreachable,
+	deployer.CheckNotSwarmManager:      exitNotSwarmManager,
+	deployer.CheckDockerReadOnly:       exitDockerReadOnly,
+	deployer.CheckBeekeeperUnreachable: exitBeekeeperUnreachable,
+	deployer.CheckBeekeeperCredentials: exitBeekeeperAuth,
+}
+
+// verifyExitCode returns the exit code of an error from Verify
+func verifyExitCode(err error) int {
+	if verifyErr, ok := err.(*deployer.VerifyError); ok {
+		if code, ok := verifyExitCodes[verifyErr.Check]; ok {
+			return code
+		}
+	}
+	return exitError
+}
+
+func verify(context *cli.Context) error {
+	theDeployer, err := newCommandDeployer(context)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	if err := theDeployer.Verify(); err != nil {
+		return cli.NewExitError(err.Error(), verifyExitCode(err))
+	}
+	fmt.Println("docker allows service updates and beekeeper accepts the credentials")
+	return nil
+}
+
+// verifyOnStart exits the daemon with the exit code of
+// a misconfiguration before the first cycle
+func verifyOnStart(theDeployer *deployer.Deployer) {
+	if err := theDeployer.Verify(); err != nil {
+		color.Red("  Verify failed: %v", err)
+		os.Exit(verifyExitCode(err))
+	}
+	info("Verified docker and beekeeper")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+	"github.com/octoblu/beekeeper-updater-swarm/control"
+	"github.com/octoblu/beekeeper-updater-swarm/deployer"
+)
+
+const (
+	clearScreen = "\033[H\033[2J"
+	hideCursor  = "\033[?25l"
+	showCursor  = "\033[?25h"
+)
+
+// watch redraws the daemon's services and rollouts in place
+// until interrupted
+func watch(context *cli.Context) error {
+	interval := context.Duration("interval")
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	fmt.Print(hideCursor)
+	defer fmt.Print(showCursor)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		screen := renderWatch(context.GlobalString("control-socket"))
+		fmt.Print(clearScreen + screen)
+		select {
+		case <-interrupt:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func renderWatch(socketPath string) string {
+	var screen bytes.Buffer
+	now := time.Now()
+
+	var health control.Health
+	if _, err := control.Get(socketPath, "/health", &health); err != nil {
+		fmt.Fprintf(&screen, "%s  %s\n\n", now.Format(time.RFC3339), color.RedString("daemon unreachable: %v", err))
+		return screen.String()
+	}
+	var states []deployer.ServiceState
+	control.Get(socketPath, "/services", &states)
+	var rollouts []deployer.RolloutProgress
+	control.Get(socketPath, "/rollouts", &rollouts)
+
+	healthy := color.GreenString("healthy")
+	if !health.Healthy {
+		healthy = color.RedString("unhealthy: %s", health.Reason)
+	}
+	fmt.Fprintf(&screen, "beekeeper-updater-swarm  %s  last cycle %s  %s\n", healthy, since(now, health.LastCycleAt), now.Format("15:04:05"))
+	if health.LastError != "" {
+		fmt.Fprintln(&screen, color.RedString("last error: %s", health.LastError))
+	}
+
+	fmt.Fprintf(&screen, "\nROLLOUTS (%d)\n", len(rollouts))
+	for _, rollout := range rollouts {
+		fmt.Fprintf(&screen, "  %-30s %s %d/%d", rollout.Service, progressBar(rollout.Updated, rollout.Desired, 20), rollout.Updated, rollout.Desired)
+		if rollout.Failed > 0 {
+			fmt.Fprint(&screen, color.RedString(" %d failed", rollout.Failed))
+		}
+		fmt.Fprintf(&screen, "  %s  %s\n", since(now, rollout.StartedAt), rollout.Image)
+	}
+
+	pending := 0
+	for _, state := range states {
+		if isPending(state) {
+			pending++
+		}
+	}
+	fmt.Fprintf(&screen, "\nSERVICES (%d, %d pending)\n", len(states), pending)
+	writer := tabwriter.NewWriter(&screen, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "  NAME\tIMAGE\tLATEST\tREASON\tCHECKED")
+	for _, state := range states {
+		reason := string(state.Reason)
+		if isPending(state) {
+			reason = color.YellowString(reason)
+		} else if state.Error != "" {
+			reason = color.RedString(reason)
+		}
+		fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\t%s\n", state.Name, state.Image, state.LatestImage, reason, since(now, state.CheckedAt))
+	}
+	writer.Flush()
+	return screen.String()
+}
+
+// isPending is true when a newer image is known but not deployed yet
+func isPending(state deployer.ServiceState) bool {
+	return state.LatestImage != "" && state.LatestImage != state.Image && state.Reason != deployer.ReasonDeployed
+}
+
+func progressBar(done, total, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = done * width / total
+	}
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+func since(now, then time.Time) string {
+	if then.IsZero() {
+		return "never"
+	}
+	return now.Sub(then).Truncate(time.Second).String() + " ago"
+}